@@ -13,6 +13,7 @@ import (
 	"lsm/utils"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 )
 
@@ -31,19 +32,55 @@ type ManifestFile struct {
 	lock                      sync.Mutex
 	deletionsRewriteThreshold int
 	manifest                  *Manifest
+	syncPolicy                ManifestSyncPolicy
+	written                   uint64     // 已经写入文件的change set数量
+	durable                   uint64     // 其中已经sync到磁盘的数量
+	syncLock                  sync.Mutex // 串行执行不持有lock的sync，一次sync覆盖之前的所有写入
+	backupInterval            int        // 每写入多少个change set备份一次，0表示不备份
+	sinceBackup               int        // 上次备份之后写入的change set数量
 }
 
+// ManifestSyncPolicy 决定manifest写入后何时sync到磁盘
+// 包含删除操作的change set总是立即sync，因为删除记录落盘后被删除的sst才能从磁盘上移除，
+// 否则崩溃后manifest会引用已经不存在的sst
+// 其余策略下崩溃可能丢失最近注册的sst，这些sst会作为孤儿表保留在工作目录中，可以通过FindOrphans找到
+type ManifestSyncPolicy int
+
+const (
+	// ManifestSyncAlways 每次写入后都sync，默认策略
+	ManifestSyncAlways ManifestSyncPolicy = iota
+	// ManifestSyncBatched 每积累ManifestSyncBatchSize个change set才sync一次
+	ManifestSyncBatched
+	// ManifestSyncOnClose 只在关闭时sync
+	ManifestSyncOnClose
+)
+
+// ManifestSyncBatchSize ManifestSyncBatched策略下每次sync前最多积累的change set数量
+const ManifestSyncBatchSize = 16
+
 type Manifest struct {
 	Levels    []levelManifest          // 每一层有哪些table
 	Tables    map[uint64]TableManifest // 用于快速查询每个table在哪一层
 	Creations int
 	Deletions int
+	// MaxVersion 各个change set记录的版本号检查点中的最大值，打开时用来初始化版本号
+	// 检查点只增不减，之后分配的版本号都记录在wal中
+	MaxVersion uint64
+	// FlushedWal 已经刷盘的内存表中最大的wal id，id不大于它的wal中的数据都已经在sst中，0表示没有记录
+	FlushedWal uint64
+	// Meta 用户元数据，与sst无关，覆写时一并写入
+	Meta map[string][]byte
 }
 
 // TableManifest 包含sst的基本信息
 type TableManifest struct {
 	Level    uint8
 	Checksum []byte // 方便今后扩展
+	// MinExpiresAt与MaxExpiresAt sst中设置了过期时间的entry最早与最晚的过期时间，没有时为0
+	MinExpiresAt uint64
+	MaxExpiresAt uint64
+	// CreatedAt sst的创建时间，unix秒，旧的manifest没有记录时为0
+	CreatedAt uint64
 }
 type levelManifest struct {
 	Tables map[uint64]struct{} // table id -> table
@@ -53,14 +90,27 @@ type levelManifest struct {
 type TableMeta struct {
 	ID       uint64
 	Checksum []byte
+	// MaxVersion 注册这个sst时已经分配出去的最大版本号，作为检查点与sst一起写入manifest，0表示不记录
+	MaxVersion uint64
+	// MinExpiresAt、MaxExpiresAt与CreatedAt 同TableManifest
+	MinExpiresAt uint64
+	MaxExpiresAt uint64
+	CreatedAt    uint64
 }
 
 // OpenManifestFile 打开/创建 manifest文件
 func OpenManifestFile(fileOpt *osFile.FileOption) (*ManifestFile, error) {
 	path := filepath.Join(fileOpt.WorkDir, utils.ManifestFilename)
+	if fileOpt.Logger == nil {
+		fileOpt.Logger = utils.DefaultLogger
+	}
 	manifestFile := &ManifestFile{lock: sync.Mutex{}, opt: fileOpt}
 
-	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	var file *os.File
+	err := fileOpt.Retry.Do(func() (err error) {
+		file, err = os.OpenFile(path, os.O_RDWR, 0)
+		return err
+	})
 	if err != nil {
 		// 打开失败 尝试创建一个新的 manifest newFile
 		if !os.IsNotExist(err) {
@@ -68,7 +118,7 @@ func OpenManifestFile(fileOpt *osFile.FileOption) (*ManifestFile, error) {
 			return nil, err
 		}
 		newManifest := createNewManifest()
-		newFile, netCreations, err := createFileAndRewrite(fileOpt.WorkDir, newManifest)
+		newFile, netCreations, err := createFileAndRewrite(fileOpt.WorkDir, newManifest, !fileOpt.DisableSyncDir, fileOpt.Retry)
 		if err != nil {
 			return nil, err
 		}
@@ -80,10 +130,10 @@ func OpenManifestFile(fileOpt *osFile.FileOption) (*ManifestFile, error) {
 	}
 
 	// 打开成功，则对manifest文件进行重放
-	manifest, truncOffset, err := ReplayManifestFile(file)
+	manifest, truncOffset, err := replayManifestFile(file, fileOpt)
 	if err != nil {
 		_ = file.Close()
-		return manifestFile, err
+		return recoverFromBackup(manifestFile, err)
 	}
 	// 将manifest的磁盘文件进行截断，使文件大小等于`truncOffset`
 	if err := file.Truncate(truncOffset); err != nil {
@@ -101,17 +151,91 @@ func OpenManifestFile(fileOpt *osFile.FileOption) (*ManifestFile, error) {
 	return manifestFile, nil
 }
 
+// recoverFromBackup manifest无法回放时改用备份，并用备份的状态覆写manifest，原来的文件改名为ManifestCorruptFilename保留
+// 没有可用的备份时返回回放manifest的错误replayErr
+func recoverFromBackup(mf *ManifestFile, replayErr error) (*ManifestFile, error) {
+	dir := mf.opt.WorkDir
+	f, err := os.Open(filepath.Join(dir, utils.ManifestBackupFilename))
+	if err != nil {
+		return mf, replayErr
+	}
+	backup, _, err := replayManifestFile(f, mf.opt)
+	_ = f.Close()
+	if err != nil {
+		return mf, replayErr
+	}
+	mf.opt.Logger.Warnf("replay %s: %v, recovering from %s; tables registered after the backup are kept as orphans",
+		utils.ManifestFilename, replayErr, utils.ManifestBackupFilename)
+	if err := mf.opt.Retry.Do(func() error {
+		return os.Rename(filepath.Join(dir, utils.ManifestFilename), filepath.Join(dir, utils.ManifestCorruptFilename))
+	}); err != nil {
+		return mf, err
+	}
+	file, netCreations, err := createFileAndRewrite(dir, backup, !mf.opt.DisableSyncDir, mf.opt.Retry)
+	if err != nil {
+		return mf, err
+	}
+	backup.Creations = netCreations
+	backup.Deletions = 0
+	mf.file = file
+	mf.manifest = backup
+	return mf, nil
+}
+
 // 通过覆写方式创建一个manifest 文件, 即先创建一个rewrite文件并进行相应的数据写入
 // 当数据写入成功时，再将rewrite文件改名为manifest文件
 // 返回值的第二个表示覆写过程中创建的change对象个数, 即当前manifest结构体已经在追踪的sst文件个数。
-func createFileAndRewrite(dir string, manifest *Manifest) (*os.File, int, error) {
+// syncDir为false时改名后不sync目录，崩溃后可能仍是旧的manifest；创建、改名与sync遇到暂时性错误时按retry重试
+func createFileAndRewrite(dir string, manifest *Manifest, syncDir bool, retry utils.RetryPolicy) (*os.File, int, error) {
 	// 创建一个remanifest文件
 	path := filepath.Join(dir, utils.ManifestRewriteFilename)
-	manifestfile, err := os.OpenFile(path, utils.DefaultFileFlag, utils.DefaultFileMode)
+	netCreations, err := writeManifestSnapshot(path, manifest, retry)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	manifestPath := filepath.Join(dir, utils.ManifestFilename)
+	if err := retry.Do(func() error { return os.Rename(path, manifestPath) }); err != nil {
+		return nil, 0, err
+	}
+
+	// 设置对文件下一个读或写的偏移量，这里设置为文件末尾
+	var manifestfile *os.File
+	err = retry.Do(func() (err error) {
+		manifestfile, err = os.OpenFile(manifestPath, utils.DefaultFileFlag, utils.DefaultFileMode)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := manifestfile.Seek(0, io.SeekEnd); err != nil {
+		manifestfile.Close()
+		return nil, 0, err
+	}
+	if !syncDir {
+		return manifestfile, netCreations, nil
+	}
+	if err := retry.DoSync(func() error { return utils.SyncDir(dir) }); err != nil {
+		manifestfile.Close()
+		return nil, 0, err
+	}
+
+	return manifestfile, netCreations, nil
+}
+
+// writeManifestSnapshot 将manifest的状态作为一个change set写入新建的path文件，sync后关闭
+// 返回其中创建的sst个数
+func writeManifestSnapshot(path string, manifest *Manifest, retry utils.RetryPolicy) (int, error) {
+	var manifestfile *os.File
+	err := retry.Do(func() (err error) {
+		// 崩溃时可能留下写了一半的临时文件，截断后重新写入，不能追加在它后面
+		manifestfile, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, utils.DefaultFileMode)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
 	//序列化magic
 	buf := make([]byte, 8)
 	copy(buf[0:4], utils.MagicText[:])
@@ -120,11 +244,11 @@ func createFileAndRewrite(dir string, manifest *Manifest) (*os.File, int, error)
 	// 将当前内存中的manifest结构抽象为一堆的change对象
 	netCreations := len(manifest.Tables)
 	changes := manifest.asChanges()
-	set := pb.ManifestChangeSet{Changes: changes}
+	set := pb.ManifestChangeSet{Changes: changes, MaxVersion: manifest.MaxVersion, FlushedWal: manifest.FlushedWal}
 	changeBuf, err := set.Marshal()
 	if err != nil {
 		manifestfile.Close()
-		return nil, 0, err
+		return 0, err
 	}
 
 	// 序列化changes中的前缀(len和crc)和一堆change对象
@@ -136,44 +260,52 @@ func createFileAndRewrite(dir string, manifest *Manifest) (*os.File, int, error)
 
 	if _, err := manifestfile.Write(buf); err != nil {
 		manifestfile.Close()
-		return nil, 0, err
+		return 0, err
 	}
-	if err := manifestfile.Sync(); err != nil {
+	if err := retry.DoSync(manifestfile.Sync); err != nil {
 		manifestfile.Close()
-		return nil, 0, err
+		return 0, err
 	}
 	// 某些系统要求一个文件在改名前必须关闭
-	if err = manifestfile.Close(); err != nil {
-		return nil, 0, err
-	}
+	return netCreations, manifestfile.Close()
+}
 
-	manifestPath := filepath.Join(dir, utils.ManifestFilename)
-	if err := os.Rename(path, manifestPath); err != nil {
-		return nil, 0, err
+// ReadManifest 以只读方式重放dir中的manifest文件，不会修改该文件
+func ReadManifest(dir string) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, utils.ManifestFilename))
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
+	manifest, _, err := ReplayManifestFile(f)
+	return manifest, err
+}
 
-	// 设置对文件下一个读或写的偏移量，这里设置为文件末尾
-	manifestfile, err = os.OpenFile(manifestPath, utils.DefaultFileFlag, utils.DefaultFileMode)
+// WriteManifest 将manifest的状态以覆写方式写入dir目录下的manifest文件
+func WriteManifest(dir string, manifest *Manifest) error {
+	f, _, err := createFileAndRewrite(dir, manifest, true, utils.RetryPolicy{})
 	if err != nil {
-		return nil, 0, err
-	}
-	if _, err := manifestfile.Seek(0, io.SeekEnd); err != nil {
-		manifestfile.Close()
-		return nil, 0, err
-	}
-	if err := utils.SyncDir(dir); err != nil {
-		manifestfile.Close()
-		return nil, 0, err
+		return err
 	}
-
-	return manifestfile, netCreations, nil
+	return f.Close()
 }
 
 // 将当前manifest结构体的状态序列化成一个changes，其中包含许多change，这些change可用于重建当前manifest结构体状态
 func (m *Manifest) asChanges() []*pb.ManifestChange {
 	changes := make([]*pb.ManifestChange, 0, len(m.Tables))
 	for sstId, tableManifest := range m.Tables {
-		changes = append(changes, newCreateChange(sstId, int(tableManifest.Level), tableManifest.Checksum))
+		change := newCreateChange(sstId, int(tableManifest.Level), tableManifest.Checksum)
+		change.MinExpiresAt, change.MaxExpiresAt = tableManifest.MinExpiresAt, tableManifest.MaxExpiresAt
+		change.CreatedAt = tableManifest.CreatedAt
+		changes = append(changes, change)
+	}
+	keys := make([]string, 0, len(m.Meta))
+	for k := range m.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		changes = append(changes, newSetMetaChange([]byte(k), m.Meta[k]))
 	}
 	return changes
 }
@@ -187,6 +319,14 @@ func newCreateChange(sstId uint64, level int, checksum []byte) *pb.ManifestChang
 	}
 }
 
+func newSetMetaChange(key, value []byte) *pb.ManifestChange {
+	return &pb.ManifestChange{
+		Op:    pb.ManifestChange_SET_META,
+		Key:   key,
+		Value: value,
+	}
+}
+
 type bufReader struct {
 	reader *bufio.Reader
 	count  int64
@@ -200,24 +340,44 @@ func (r *bufReader) Read(p []byte) (n int, err error) {
 
 // ReplayManifestFile 读取磁盘中的manifest文件，并恢复其记录的状态
 func ReplayManifestFile(file *os.File) (mf *Manifest, truncOffset int64, err error) {
-	reader := &bufReader{reader: bufio.NewReader(file)}
+	return replayManifestFile(file, &osFile.FileOption{})
+}
+
+// replayManifestFile 开启opt.IgnoreUnknownManifestOps时跳过无法识别的change并记录日志
+func replayManifestFile(file *os.File, opt *osFile.FileOption) (mf *Manifest, truncOffset int64, err error) {
+	newManifest := createNewManifest()
+	truncOffset, err = readChangeSets(file, func(changeSet *pb.ManifestChangeSet) error {
+		if opt.IgnoreUnknownManifestOps {
+			changeSet.Changes = knownChanges(changeSet.Changes, opt.Logger)
+		}
+		return applyChangeSet(newManifest, changeSet)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return newManifest, truncOffset, nil
+}
+
+// readChangeSets 校验magic后按写入顺序读取每个change set交给fn
+// 返回最后一个完整change set结束的位置
+func readChangeSets(r io.Reader, fn func(*pb.ManifestChangeSet) error) (int64, error) {
+	reader := &bufReader{reader: bufio.NewReader(r)}
 
 	// 读取magic
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(reader, magicBuf[:]); err != nil {
-		return nil, 0, utils.ErrBadMagic
+		return 0, utils.ErrBadMagic
 	}
 	if !bytes.Equal(magicBuf[0:4], utils.MagicText[:]) {
-		return nil, 0, utils.ErrBadMagic
+		return 0, utils.ErrBadMagic
 	}
 	version := binary.BigEndian.Uint32(magicBuf[4:8])
 	if version != uint32(utils.MagicVersion) {
-		return nil, 0, utils.ErrNotSupportManifestVersion
+		return 0, utils.ErrNotSupportManifestVersion
 	}
 
-	newManifest := createNewManifest()
 	var offset int64
-	// 循环读取所有changes并恢复
+	// 循环读取所有changes
 	for {
 		offset = reader.count
 
@@ -229,39 +389,82 @@ func ReplayManifestFile(file *os.File) (mf *Manifest, truncOffset int64, err err
 				// 读取到文件末尾，则跳出循环
 				break
 			}
-			return nil, 0, err
+			return 0, err
 		}
 
 		// 读取一个change对象
 		length := binary.BigEndian.Uint32(lenAndCrcBuf[0:4])
 		var changeBuf = make([]byte, length)
 		if _, err := io.ReadFull(reader, changeBuf); err != nil {
-			return nil, 0, err
+			return 0, err
 		}
 
 		// 数据校验
 		if crc32.Checksum(changeBuf, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenAndCrcBuf[4:8]) {
-			return nil, 0, utils.ErrBadChecksum
+			return 0, utils.ErrBadChecksum
 		}
 
 		var changeSet pb.ManifestChangeSet
 		if err := changeSet.Unmarshal(changeBuf); err != nil {
-			return nil, 0, err
+			return 0, err
 		}
 
-		if err := applyChangeSet(newManifest, &changeSet); err != nil {
-			return nil, 0, err
+		if err := fn(&changeSet); err != nil {
+			return 0, err
 		}
 	}
 
-	return newManifest, offset, err
+	return offset, nil
+}
+
+// ReplayChanges 另外打开磁盘上的manifest文件，按写入顺序对其中的每个change调用fn，用于审计sst的创建与删除以及元数据的设置
+// 只读取调用时已经写入的部分，不影响正在使用的manifest；覆写会把历史合并为当时的状态，更早的记录不再保留
+// fn返回错误时停止并返回该错误
+func (mf *ManifestFile) ReplayChanges(fn func(*pb.ManifestChange) error) error {
+	// 在锁内打开并确定文件大小，这时文件末尾是一个完整的change set，覆写也不会替换掉已经打开的文件
+	mf.lock.Lock()
+	f, err := os.Open(filepath.Join(mf.opt.WorkDir, utils.ManifestFilename))
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekEnd)
+	}
+	mf.lock.Unlock()
+	if f != nil {
+		defer f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = readChangeSets(io.NewSectionReader(f, 0, size), func(changeSet *pb.ManifestChangeSet) error {
+		for _, change := range changeSet.Changes {
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
 }
 
 func createNewManifest() *Manifest {
 	return &Manifest{
 		Levels: make([]levelManifest, 0),
 		Tables: make(map[uint64]TableManifest),
+		Meta:   make(map[string][]byte),
+	}
+}
+
+// knownChanges 去掉无法识别的change
+func knownChanges(changes []*pb.ManifestChange, logger utils.Logger) []*pb.ManifestChange {
+	known := changes[:0]
+	for _, change := range changes {
+		if _, ok := pb.ManifestChange_Operation_name[int32(change.Op)]; !ok {
+			logger.Warnf("skipping unknown manifest op %d of table %d", change.Op, change.Id)
+			continue
+		}
+		known = append(known, change)
 	}
+	return known
 }
 
 // 回放一堆changes
@@ -271,6 +474,12 @@ func applyChangeSet(mf *Manifest, changeSet *pb.ManifestChangeSet) error {
 			return err
 		}
 	}
+	if changeSet.MaxVersion > mf.MaxVersion {
+		mf.MaxVersion = changeSet.MaxVersion
+	}
+	if changeSet.FlushedWal > mf.FlushedWal {
+		mf.FlushedWal = changeSet.FlushedWal
+	}
 	return nil
 }
 
@@ -282,8 +491,11 @@ func applyManifestChange(mf *Manifest, change *pb.ManifestChange) error {
 			return fmt.Errorf("MANIFEST invalid, table %d exists", change.Id)
 		}
 		mf.Tables[change.Id] = TableManifest{
-			Level:    uint8(change.Level),
-			Checksum: append([]byte{}, change.Checksum...),
+			Level:        uint8(change.Level),
+			Checksum:     append([]byte{}, change.Checksum...),
+			MinExpiresAt: change.MinExpiresAt,
+			MaxExpiresAt: change.MaxExpiresAt,
+			CreatedAt:    change.CreatedAt,
 		}
 		for len(mf.Levels) <= int(change.Level) {
 			mf.Levels = append(mf.Levels, levelManifest{make(map[uint64]struct{})})
@@ -298,6 +510,8 @@ func applyManifestChange(mf *Manifest, change *pb.ManifestChange) error {
 		delete(mf.Levels[tm.Level].Tables, change.Id)
 		delete(mf.Tables, change.Id)
 		mf.Deletions++
+	case pb.ManifestChange_SET_META:
+		mf.Meta[string(change.Key)] = append([]byte{}, change.Value...)
 	default:
 		return utils.ErrManifestHasWrongOp
 	}
@@ -310,18 +524,80 @@ func (mf *ManifestFile) rewrite() error {
 	if err := mf.file.Close(); err != nil {
 		return err
 	}
-	fp, nextCreations, err := createFileAndRewrite(mf.opt.WorkDir, mf.manifest)
+	fp, nextCreations, err := createFileAndRewrite(mf.opt.WorkDir, mf.manifest, !mf.opt.DisableSyncDir, mf.opt.Retry)
 	if err != nil {
 		return err
 	}
 	mf.manifest.Creations = nextCreations
 	mf.manifest.Deletions = 0
 	mf.file = fp
+	mf.durable = mf.written // 覆写时已经sync
+	if mf.backupInterval > 0 {
+		return mf.backup()
+	}
+	return nil
+}
+
+// Rewrite 立即把manifest覆写为只包含当前状态的最小形式，不必等删除数量达到阈值，适合大量删除sst之后缩小文件
+// 与自动覆写相同，先写入REWRITEMANIFEST并sync，再改名替换MANIFEST，中途崩溃时打开的仍是完整的旧文件
+func (mf *ManifestFile) Rewrite() error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	return mf.rewrite()
+}
+
+// backup 将当前的状态写入备份文件，先写入临时文件再改名，备份文件总是完整的
+// Must be called while lock is held.
+func (mf *ManifestFile) backup() error {
+	dir := mf.opt.WorkDir
+	path := filepath.Join(dir, utils.ManifestBackupRewriteFilename)
+	if _, err := writeManifestSnapshot(path, mf.manifest, mf.opt.Retry); err != nil {
+		return errors.Wrap(err, "write manifest backup")
+	}
+	if err := mf.opt.Retry.Do(func() error {
+		return os.Rename(path, filepath.Join(dir, utils.ManifestBackupFilename))
+	}); err != nil {
+		return errors.Wrap(err, "rename manifest backup")
+	}
+	if !mf.opt.DisableSyncDir {
+		if err := mf.opt.Retry.DoSync(func() error { return utils.SyncDir(dir) }); err != nil {
+			return err
+		}
+	}
+	mf.sinceBackup = 0
 	return nil
 }
 
+// WriteSnapshot 把当前的状态写入path，返回快照中所有sst的编号
+// 快照与覆写后的MANIFEST格式相同，可以作为另一个工作目录的MANIFEST打开
+func (mf *ManifestFile) WriteSnapshot(path string) ([]uint64, error) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if _, err := writeManifestSnapshot(path, mf.manifest, mf.opt.Retry); err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(mf.manifest.Tables))
+	for id := range mf.manifest.Tables {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 // Close 关闭文件
+// Close 持有锁完成正在进行的写入与覆写，sync之后关闭文件
 func (mf *ManifestFile) Close() error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if mf.shouldRewrite() {
+		if err := mf.rewrite(); err != nil {
+			return err
+		}
+	}
+	if mf.unsynced() > 0 {
+		if err := mf.sync(); err != nil {
+			return err
+		}
+	}
 	if err := mf.file.Close(); err != nil {
 		return err
 	}
@@ -330,68 +606,328 @@ func (mf *ManifestFile) Close() error {
 
 // AddChanges 对外暴露的写比那更丰富
 func (mf *ManifestFile) AddChanges(changesParam []*pb.ManifestChange) error {
-	return mf.addChanges(changesParam)
+	return mf.addChanges(pb.ManifestChangeSet{Changes: changesParam})
 }
-func (mf *ManifestFile) addChanges(changesParam []*pb.ManifestChange) error {
-	changes := pb.ManifestChangeSet{Changes: changesParam}
-	buf, err := changes.Marshal()
+func (mf *ManifestFile) addChanges(changes pb.ManifestChangeSet) error {
+	buf, err := encodeRecord(&changes)
 	if err != nil {
 		return err
 	}
 
-	// TODO 锁粒度可以优化
+	// 锁内只修改内存中的状态并按顺序写入文件，耗时的sync在锁外进行，并发的写入共用一次sync
 	mf.lock.Lock()
-	defer mf.lock.Unlock()
-	if err := applyChangeSet(mf.manifest, &changes); err != nil {
+	seq, needSync, err := mf.apply(&changes, buf)
+	mf.lock.Unlock()
+	if err != nil || !needSync {
 		return err
 	}
-	// Rewrite manifest if it'd shrink by 1/10 and it's big enough to care
-	if mf.manifest.Deletions > utils.ManifestDeletionsRewriteThreshold &&
-		mf.manifest.Deletions > utils.ManifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions) {
+	return mf.syncTo(seq)
+}
+
+// apply 将change set应用到内存中的manifest并写入文件，返回它的序号以及返回之前是否需要sync到这个序号
+// Must be called while lock is held.
+func (mf *ManifestFile) apply(changes *pb.ManifestChangeSet, buf []byte) (uint64, bool, error) {
+	if err := applyChangeSet(mf.manifest, changes); err != nil {
+		return 0, false, err
+	}
+	mf.written++
+	if mf.shouldRewrite() {
 		if err := mf.rewrite(); err != nil {
-			return err
+			return 0, false, err
 		}
 	} else {
-		var lenCrcBuf [8]byte
-		binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(buf)))
-		binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(buf, utils.CastagnoliCrcTable))
-		buf = append(lenCrcBuf[:], buf...)
-		if _, err := mf.file.Write(buf); err != nil {
-			return err
+		if err := appendRecord(mf.file, buf); err != nil {
+			return 0, false, err
 		}
+		mf.sinceBackup++
 	}
-	err = mf.file.Sync()
-	return err
+	// 备份只可能包含已经写入的内容，在锁内完成
+	if mf.needBackup(changes) {
+		if err := mf.backup(); err != nil {
+			return 0, false, err
+		}
+	}
+	return mf.written, mf.unsynced() > 0 && mf.needSync(changes), nil
+}
+
+// encodeRecord 编码一条change set记录：len(4 B) | crc(4 B) | change set
+func encodeRecord(changes *pb.ManifestChangeSet) ([]byte, error) {
+	buf, err := changes.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(buf)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(buf, utils.CastagnoliCrcTable))
+	return append(lenCrcBuf[:], buf...), nil
+}
+
+// recordAppender 追加change set记录的文件
+type recordAppender interface {
+	io.Writer
+	Seek(offset int64, whence int) (int64, error)
+	Truncate(size int64) error
+}
+
+// appendRecord 将一条记录完整地写到f的末尾，写入失败时截断回记录开始的位置
+// 留下的半条记录在回放时无法通过校验，并且之后追加的记录也都无法读取
+// 回放后打开的manifest没有O_APPEND，每次写入前先移到文件末尾，截断之后的写入不会留下空洞
+func appendRecord(f recordAppender, buf []byte) error {
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFull(f, buf); err != nil {
+		if terr := f.Truncate(start); terr != nil {
+			return errors.Wrapf(err, "manifest left with a partial record, truncate to %d: %v", start, terr)
+		}
+		return err
+	}
+	return nil
+}
+
+// syncTo 等待序号不大于seq的写入都已经sync到磁盘
+// 同一时间只有一个协程执行sync，它覆盖开始时已经写入的所有change set，等待的协程之后通常不需要再sync
+func (mf *ManifestFile) syncTo(seq uint64) error {
+	mf.syncLock.Lock()
+	defer mf.syncLock.Unlock()
+	mf.lock.Lock()
+	if mf.durable >= seq {
+		mf.lock.Unlock()
+		return nil
+	}
+	f, target := mf.file, mf.written
+	mf.lock.Unlock()
+
+	err := mf.opt.Retry.DoSync(f.Sync)
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if err != nil {
+		// 覆写会替换并关闭f，但新文件已经sync过
+		if mf.durable >= seq {
+			return nil
+		}
+		return err
+	}
+	if target > mf.durable {
+		mf.durable = target
+	}
+	return nil
+}
+
+// unsynced 写入后尚未sync的change set数量
+func (mf *ManifestFile) unsynced() int {
+	return int(mf.written - mf.durable)
+}
+
+// shouldRewrite Rewrite manifest if it'd shrink by 1/10 and it's big enough to care
+func (mf *ManifestFile) shouldRewrite() bool {
+	return mf.manifest.Deletions > utils.ManifestDeletionsRewriteThreshold &&
+		mf.manifest.Deletions > utils.ManifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions)
+}
+
+// needSync 根据sync策略判断本次写入后是否需要sync
+func (mf *ManifestFile) needSync(changes *pb.ManifestChangeSet) bool {
+	if hasDeletion(changes) {
+		return true
+	}
+	switch mf.syncPolicy {
+	case ManifestSyncBatched:
+		return mf.unsynced() >= ManifestSyncBatchSize
+	case ManifestSyncOnClose:
+		return false
+	default:
+		return true
+	}
+}
+
+// needBackup 判断本次写入后是否需要备份
+// 与sync相同，包含删除的change set总是立即备份，否则从备份恢复时会引用已经被移除的sst
+func (mf *ManifestFile) needBackup(changes *pb.ManifestChangeSet) bool {
+	if mf.backupInterval <= 0 || mf.sinceBackup == 0 {
+		return false
+	}
+	return mf.sinceBackup >= mf.backupInterval || hasDeletion(changes)
+}
+
+func hasDeletion(changes *pb.ManifestChangeSet) bool {
+	for _, change := range changes.Changes {
+		if change.Op == pb.ManifestChange_DELETE {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called while lock is held.
+func (mf *ManifestFile) sync() error {
+	if err := mf.opt.Retry.DoSync(mf.file.Sync); err != nil {
+		return err
+	}
+	mf.durable = mf.written
+	return nil
+}
+
+// SetSyncPolicy 设置manifest的sync策略
+func (mf *ManifestFile) SetSyncPolicy(policy ManifestSyncPolicy) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	mf.syncPolicy = policy
+}
+
+// SetBackupInterval 设置每写入多少个change set将manifest备份到ManifestBackupFilename，覆写后也会备份，0表示不备份
+// 开启时立即备份一次，之后打开manifest无法回放时会改用备份
+func (mf *ManifestFile) SetBackupInterval(n int) error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	mf.backupInterval = n
+	if n <= 0 {
+		return nil
+	}
+	return mf.backup()
+}
+
+// Sync 将尚未sync的写入刷到磁盘
+func (mf *ManifestFile) Sync() error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if mf.unsynced() == 0 {
+		return nil
+	}
+	return mf.sync()
 }
 
 // AddTableMeta 存储level表到manifest的level中
 func (mf *ManifestFile) AddTableMeta(levelNum int, t *TableMeta) (err error) {
-	mf.addChanges([]*pb.ManifestChange{
-		newCreateChange(t.ID, levelNum, t.Checksum),
-	})
-	return err
+	return mf.AddTableMetas(levelNum, []*TableMeta{t})
+}
+
+// AddTableMetas 在同一个change set中将多个sst加入levelNum层，检查点取其中最大的版本号
+func (mf *ManifestFile) AddTableMetas(levelNum int, tables []*TableMeta) error {
+	return mf.AddFlushedTables(levelNum, tables, 0)
 }
 
-// RevertToManifest 检查所有必要的表文件是否存在，并删除manifest中未引用的所有表文件。
-// idMap 记录了从工作目录中读取的所有sst 的id。
-func (mf *ManifestFile) RevertToManifest(idMap map[uint64]struct{}) error {
+// AddFlushedTables 与AddTableMetas相同，同时记录这些sst来自id为walFid的内存表，0表示不记录
+func (mf *ManifestFile) AddFlushedTables(levelNum int, tables []*TableMeta, walFid uint64) error {
+	var maxVersion uint64
+	changes := make([]*pb.ManifestChange, 0, len(tables))
+	for _, t := range tables {
+		change := newCreateChange(t.ID, levelNum, t.Checksum)
+		change.MinExpiresAt, change.MaxExpiresAt = t.MinExpiresAt, t.MaxExpiresAt
+		change.CreatedAt = t.CreatedAt
+		changes = append(changes, change)
+		if t.MaxVersion > maxVersion {
+			maxVersion = t.MaxVersion
+		}
+	}
+	return mf.addChanges(pb.ManifestChangeSet{Changes: changes, MaxVersion: maxVersion, FlushedWal: walFid})
+}
+
+// RevertToManifestOpts 控制RevertToManifest如何处理manifest中未引用的sst
+type RevertToManifestOpts struct {
+	// DeleteOrphans 为true时删除未引用的sst文件，否则保留文件只返回其id
+	DeleteOrphans bool
+}
+
+// OrphanTable 工作目录中存在但manifest没有引用的sst
+type OrphanTable struct {
+	ID      uint64
+	Path    string
+	Removed bool // 是否已经被删除
+}
+
+// RevertReport RevertToManifest对工作目录做了什么，用于审计恢复过程
+type RevertReport struct {
+	// Missing manifest引用但工作目录中不存在的sst，按升序排列，不为空时RevertToManifest返回错误
+	Missing []uint64
+	// Orphans 未被引用的sst，按id升序排列；存在Missing时不删除任何文件
+	Orphans []OrphanTable
+}
+
+// RevertToManifest 检查所有必要的表文件是否存在，并找出manifest中未引用的表文件，按opt决定是否删除。
+// paths 记录了从工作目录中读取的所有sst的id与路径，见utils.LoadSSTPaths，文件名无法解析为id的文件不在其中
+// 返回错误时report同样记录了已经发现的问题与已经删除的文件
+func (mf *ManifestFile) RevertToManifest(paths map[uint64]string, opt RevertToManifestOpts) (RevertReport, error) {
+	var report RevertReport
+	idMap := make(map[uint64]struct{}, len(paths))
+	for id := range paths {
+		idMap[id] = struct{}{}
+	}
 	for id := range mf.manifest.Tables {
 		if _, exist := idMap[id]; !exist {
-			return fmt.Errorf("table %d does not exis but recorded in manifest", id)
+			report.Missing = append(report.Missing, id)
 		}
 	}
+	sort.Slice(report.Missing, func(i, j int) bool {
+		return report.Missing[i] < report.Missing[j]
+	})
 
+	for _, id := range mf.FindOrphans(idMap) {
+		report.Orphans = append(report.Orphans, OrphanTable{ID: id, Path: paths[id]})
+	}
+	if len(report.Missing) > 0 {
+		return report, fmt.Errorf("table %d does not exis but recorded in manifest", report.Missing[0])
+	}
+	if !opt.DeleteOrphans {
+		for _, orphan := range report.Orphans {
+			mf.opt.Logger.Warnf("Table %d not referenced in MANIFEST, keeping it", orphan.ID)
+		}
+		return report, nil
+	}
 	// 删除manifest中没有引用但却存在于工作目录但sst文件
+	for i := range report.Orphans {
+		orphan := &report.Orphans[i]
+		mf.opt.Logger.Warnf("Table %d not referenced in MANIFEST, removing it", orphan.ID)
+		// 使用扫描到的路径，文件名没有补零时也能删除
+		if err := utils.RemoveFile(orphan.Path, mf.opt.TrashDir); err != nil {
+			return report, errors.Wrapf(err, "removing table %d error", orphan.ID)
+		}
+		orphan.Removed = true
+	}
+	return report, nil
+}
+
+// FindOrphans 返回idMap中存在但manifest没有引用的sst id，按升序排列
+func (mf *ManifestFile) FindOrphans(idMap map[uint64]struct{}) []uint64 {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	var orphans []uint64
 	for id := range idMap {
 		if _, exist := mf.manifest.Tables[id]; !exist {
-			utils.PrintErr(fmt.Errorf("Table %d  not referenced in MANIFEST", id))
-			filePath := utils.SSTableFullPath(mf.opt.WorkDir, id)
-			if err := os.Remove(filePath); err != nil {
-				return errors.Wrapf(err, "removing table %d error", id)
-			}
+			orphans = append(orphans, id)
 		}
 	}
-	return nil
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i] < orphans[j]
+	})
+	return orphans
+}
+
+// SetMeta 记录一项用户元数据，同一个key再次设置时覆盖旧值
+func (mf *ManifestFile) SetMeta(key, value []byte) error {
+	return mf.addChanges(pb.ManifestChangeSet{Changes: []*pb.ManifestChange{newSetMetaChange(key, value)}})
+}
+
+// GetMeta 返回用户元数据的副本
+func (mf *ManifestFile) GetMeta(key []byte) ([]byte, bool) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	v, ok := mf.manifest.Meta[string(key)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, v...), true
+}
+
+// TableChecksum 返回manifest中记录的sst的checksum的副本，sst不存在时返回false
+func (mf *ManifestFile) TableChecksum(id uint64) ([]byte, bool) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	tm, ok := mf.manifest.Tables[id]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, tm.Checksum...), true
 }
 
 func (mf *ManifestFile) GetManifest() *Manifest {
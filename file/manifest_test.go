@@ -0,0 +1,203 @@
+package file
+
+import (
+	"lsm/file/osFile"
+	"lsm/pb"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// shortWriter 每次最多写入max个字节，written达到failAfter后返回ENOSPC，failAfter为0表示不失败
+type shortWriter struct {
+	*os.File
+	max       int
+	failAfter int
+	written   int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if w.failAfter > 0 && w.written >= w.failAfter {
+		return 0, syscall.ENOSPC
+	}
+	if len(b) > w.max {
+		b = b[:w.max]
+	}
+	n, err := w.File.Write(b)
+	w.written += n
+	return n, err
+}
+
+// TestAppendRecordShortWrite 短写的记录被完整写入，写到一半失败的记录被截断，之后追加的记录与整个manifest都可以回放
+func TestAppendRecordShortWrite(t *testing.T) {
+	opt := &osFile.FileOption{WorkDir: t.TempDir()}
+	mf, err := OpenManifestFile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTable := func(id uint64) {
+		if err := mf.AddTableMeta(0, &TableMeta{ID: id, Checksum: []byte{'m', 'o', 'c', 'k'}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := func(id uint64) []byte {
+		buf, err := encodeRecord(&pb.ManifestChangeSet{Changes: []*pb.ManifestChange{newCreateChange(id, 0, nil)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	reopen := func() {
+		if err := mf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if mf, err = OpenManifestFile(opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTable(1)
+	// 回放后打开的文件没有O_APPEND
+	reopen()
+
+	if err := appendRecord(&shortWriter{File: mf.file, max: 3}, record(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendRecord(&shortWriter{File: mf.file, max: 3, failAfter: 5}, record(3)); err != syscall.ENOSPC {
+		t.Fatalf("appendRecord = %v, want ENOSPC", err)
+	}
+	addTable(4)
+	reopen()
+	defer mf.Close()
+
+	tables := mf.GetManifest().Tables
+	for _, id := range []uint64{1, 2, 4} {
+		if _, ok := tables[id]; !ok {
+			t.Fatalf("table %d missing after replay: %v", id, tables)
+		}
+	}
+	if _, ok := tables[3]; ok || len(tables) != 3 {
+		t.Fatalf("tables after replay = %v, want 1, 2 and 4", tables)
+	}
+}
+
+// TestRewrite 删除数量没有达到覆写阈值时手动覆写，文件变小，重新打开后状态不变
+func TestRewrite(t *testing.T) {
+	opt := &osFile.FileOption{WorkDir: t.TempDir()}
+	mf, err := OpenManifestFile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 1000
+	for id := uint64(1); id <= n; id++ {
+		if err := mf.AddTableMeta(1, &TableMeta{ID: id, Checksum: []byte{'m', 'o', 'c', 'k'}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var deletes []*pb.ManifestChange
+	for id := uint64(1); id <= n; id++ {
+		if id%10 != 0 {
+			deletes = append(deletes, &pb.ManifestChange{Id: id, Op: pb.ManifestChange_DELETE})
+		}
+	}
+	if err := mf.AddChanges(deletes); err != nil {
+		t.Fatal(err)
+	}
+	if mf.shouldRewrite() {
+		t.Fatal("deletions already reach the automatic rewrite threshold")
+	}
+	path := filepath.Join(opt.WorkDir, utils.ManifestFilename)
+	size := func() int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	before := size()
+	if err := mf.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if after := size(); after*5 > before {
+		t.Fatalf("manifest size %d after rewrite, %d before", after, before)
+	}
+	if _, err := os.Stat(filepath.Join(opt.WorkDir, utils.ManifestRewriteFilename)); !os.IsNotExist(err) {
+		t.Fatalf("rewrite file left behind: %v", err)
+	}
+	// 覆写之后继续追加
+	if err := mf.AddTableMeta(2, &TableMeta{ID: n + 1, Checksum: []byte{'m', 'o', 'c', 'k'}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mf, err = OpenManifestFile(opt); err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	tables := mf.GetManifest().Tables
+	if len(tables) != n/10+1 {
+		t.Fatalf("%d tables after reopen, want %d", len(tables), n/10+1)
+	}
+	for id := uint64(10); id <= n; id += 10 {
+		if tm, ok := tables[id]; !ok || tm.Level != 1 {
+			t.Fatalf("table %d after reopen: %+v, %v", id, tm, ok)
+		}
+	}
+	if tm := tables[n+1]; tm.Level != 2 {
+		t.Fatalf("table %d is in level %d", n+1, tm.Level)
+	}
+}
+
+// TestSnapshotTruncatesLeftover 崩溃后留下的覆写与备份临时文件被截断后重新写入，而不是在末尾追加
+func TestSnapshotTruncatesLeftover(t *testing.T) {
+	opt := &osFile.FileOption{WorkDir: t.TempDir()}
+	for _, name := range []string{utils.ManifestRewriteFilename, utils.ManifestBackupRewriteFilename} {
+		if err := os.WriteFile(filepath.Join(opt.WorkDir, name), []byte("leftover from a crash"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mf, err := OpenManifestFile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		if err := mf.AddTableMeta(1, &TableMeta{ID: id, Checksum: []byte{'m', 'o', 'c', 'k'}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mf.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	mf.lock.Lock()
+	err = mf.backup()
+	mf.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 备份与覆写后的MANIFEST都可以作为MANIFEST打开
+	backupDir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join(opt.WorkDir, utils.ManifestBackupFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, utils.ManifestFilename), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{opt.WorkDir, backupDir} {
+		mf, err := OpenManifestFile(&osFile.FileOption{WorkDir: dir})
+		if err != nil {
+			t.Fatalf("open manifest in %s: %v", dir, err)
+		}
+		if n := len(mf.GetManifest().Tables); n != 3 {
+			t.Fatalf("%d tables in %s, want 3", n, dir)
+		}
+		mf.Close()
+	}
+}
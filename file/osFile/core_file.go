@@ -1,6 +1,9 @@
 package osFile
 
-import "io"
+import (
+	"io"
+	"lsm/utils"
+)
 
 // FileOption
 type FileOption struct {
@@ -9,6 +12,19 @@ type FileOption struct {
 	WorkDir  string
 	Flag     int
 	MaxSz    int
+	Logger   utils.Logger
+	// DisableSyncDir 创建或重命名文件后不sync所在的目录，崩溃后新文件的目录项可能丢失
+	DisableSyncDir bool
+	// WalChecksum 新写入的wal记录使用的校验算法，读取时按每条记录的标记选择
+	WalChecksum utils.ChecksumType
+	// IgnoreUnknownManifestOps 回放manifest时跳过无法识别的操作，而不是返回错误
+	IgnoreUnknownManifestOps bool
+	// Encryptor 不为nil时加密新写入的sst与wal记录
+	Encryptor utils.Encryptor
+	// TrashDir 不为空时删除的sst与wal移动到这个目录而不是直接删除
+	TrashDir string
+	// Retry manifest与sst的打开、改名与sync遇到暂时性错误时的重试策略
+	Retry utils.RetryPolicy
 }
 
 type CoreFile interface {
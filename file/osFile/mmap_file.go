@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"lsm/utils"
 	"os"
 	"path/filepath"
 
@@ -63,7 +64,11 @@ func OpenMmapFile(filename string, flag int, maxSz int) (*MmapFile, error) {
 	if flag == os.O_RDONLY {
 		writable = false
 	}
-	return OpenMmapFileUsing(fd, maxSz, writable)
+	mf, err := OpenMmapFileUsing(fd, maxSz, writable)
+	if err != nil {
+		_ = fd.Close()
+	}
+	return mf, err
 }
 
 type mmapReader struct {
@@ -185,6 +190,17 @@ func (m *MmapFile) Delete() error {
 	return os.Remove(m.Fd.Name())
 }
 
+// Trash 关闭文件并移动到trashDir，与Delete不同不会截断文件
+func (m *MmapFile) Trash(trashDir string) error {
+	if m.Fd == nil {
+		return nil
+	}
+	if err := m.Close(); err != nil {
+		return err
+	}
+	return utils.RemoveFile(m.Fd.Name(), trashDir)
+}
+
 // Close would close the osFile. It would also truncate the osFile if maxSz >= 0.
 func (m *MmapFile) Close() error {
 	if m.Fd == nil {
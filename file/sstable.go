@@ -29,13 +29,21 @@ type SSTable struct {
 	idxStart       int
 	fid            uint64
 	createdAt      time.Time
+	encryptor      utils.Encryptor
+	trashDir       string
 }
 
-// OpenSStable 打开一个 sst文件
-func OpenSStable(opt *osFile.FileOption) *SSTable {
-	omf, err := osFile.OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
-	utils.PrintErr(err)
-	return &SSTable{f: omf, fid: opt.FID, lock: &sync.RWMutex{}}
+// OpenSStable 打开一个 sst文件，遇到暂时性错误时按opt.Retry重试，重试之后仍然失败时返回错误
+func OpenSStable(opt *osFile.FileOption) (*SSTable, error) {
+	var omf *osFile.MmapFile
+	err := opt.Retry.Do(func() (err error) {
+		omf, err = osFile.OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open table %s", opt.FileName)
+	}
+	return &SSTable{f: omf, fid: opt.FID, lock: &sync.RWMutex{}, encryptor: opt.Encryptor, trashDir: opt.TrashDir}, nil
 }
 
 // Init 初始化
@@ -62,15 +70,31 @@ func (ss *SSTable) Init() error {
 func (ss *SSTable) SetMaxKey(maxKey []byte) {
 	ss.maxKey = maxKey
 }
+
+// sst的末尾依次为 | index | index len | index checksum | checksum len | footer checksum |
+// footer checksum覆盖它前面的三个字段，校验通过后才使用其中的长度定位索引
+const footerChecksumSize = 8
+
 func (ss *SSTable) initTable() (bo *pb.BlockOffset, err error) {
 	readPos := len(ss.f.Data)
 
-	// Read checksum len from the last 4 bytes.
+	// Read footer checksum from the last 8 bytes.
+	readPos -= footerChecksumSize
+	if readPos < 4 {
+		return nil, errors.Errorf("table %s is too small: %d bytes", ss.f.Fd.Name(), len(ss.f.Data))
+	}
+	footerChk := ss.f.Data[readPos:]
+
+	// Read checksum len.
 	readPos -= 4
-	buf := ss.readCheckError(readPos, 4)
-	checksumLen := int(utils.BytesToU32(buf))
-	if checksumLen < 0 {
-		return nil, errors.New("checksum length less than zero. Data corrupted")
+	checksumLen := int(utils.BytesToU32(ss.f.Data[readPos : readPos+4]))
+	footerStart := readPos - checksumLen - 4
+	if footerStart < 0 {
+		return nil, errors.Wrapf(utils.ErrChecksumMismatch, "invalid checksum length %d in footer of table: %s",
+			checksumLen, ss.f.Fd.Name())
+	}
+	if err := utils.VerifyChecksum(ss.f.Data[footerStart:readPos+4], footerChk); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify footer checksum for table: %s", ss.f.Fd.Name())
 	}
 
 	// Read checksum.
@@ -79,15 +103,24 @@ func (ss *SSTable) initTable() (bo *pb.BlockOffset, err error) {
 
 	// Read index size from the footer.
 	readPos -= 4
-	buf = ss.readCheckError(readPos, 4)
+	buf := ss.readCheckError(readPos, 4)
 	ss.idxLen = int(utils.BytesToU32(buf))
 
 	// Read index.
 	readPos -= ss.idxLen
+	if readPos < 0 {
+		return nil, errors.Errorf("invalid index length %d in footer of table: %s", ss.idxLen, ss.f.Fd.Name())
+	}
 	ss.idxStart = readPos
 	data := ss.readCheckError(readPos, ss.idxLen)
 	if err := utils.VerifyChecksum(data, expectedChk); err != nil {
-		return nil, errors.Wrapf(err, "failed to verify checksum for table: %s", ss.f.Fd.Name())
+		return nil, errors.Wrapf(err, "failed to verify index checksum for table: %s", ss.f.Fd.Name())
+	}
+	// 加密的索引在校验checksum之后解密，开启加密之前写入的索引仍是明文
+	if utils.IsEncryptedIndex(data) {
+		if data, err = utils.DecryptIndex(ss.encryptor, data); err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt index for table: %s", ss.f.Fd.Name())
+		}
 	}
 	indexTable := &pb.TableIndex{}
 	if err := proto.Unmarshal(data, indexTable); err != nil {
@@ -126,6 +159,11 @@ func (ss *SSTable) FID() uint64 {
 	return ss.fid
 }
 
+// Name 返回sst文件的路径
+func (ss *SSTable) Name() string {
+	return ss.f.Fd.Name()
+}
+
 // HasBloomFilter _
 func (ss *SSTable) HasBloomFilter() bool {
 	return ss.hasBloomFilter
@@ -172,8 +210,11 @@ func (ss *SSTable) SetCreatedAt(t *time.Time) {
 	ss.createdAt = *t
 }
 
-// Detele _
+// Detele _ 设置了TrashDir时移动到回收站
 func (ss *SSTable) Detele() error {
+	if ss.trashDir != "" {
+		return ss.f.Trash(ss.trashDir)
+	}
 	return ss.f.Delete()
 }
 
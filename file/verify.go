@@ -0,0 +1,216 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"lsm/file/osFile"
+	"lsm/pb"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// CorruptionError VerifyFile发现的第一处损坏，Offset是没有通过校验的block、索引、footer或wal记录在文件中的起始偏移
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s is corrupted at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyFile 流式读取一个sst或wal文件并校验其中每个block或记录的checksum，不需要打开存储，也不会把整个文件读入内存
+// 文件按扩展名区分，发现损坏时返回*CorruptionError，其中是第一处损坏的偏移，它会匹配utils.ErrChecksumMismatch
+// sst的索引加密时无法定位block，返回utils.ErrNoEncryptor；加密的wal记录只校验密文的checksum
+// wal末尾预分配的部分必须全为0，崩溃时写了一半的最后一条记录或最后一个批次同样报告为损坏，打开存储时会截掉它
+func VerifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch name := filepath.Base(path); {
+	case strings.HasSuffix(name, ".sst"):
+		return verifySSTable(f, path)
+	case strings.HasSuffix(name, ".wal"):
+		return verifyWal(f, path)
+	}
+	return errors.Errorf("verify %s: not an sst or wal file", path)
+}
+
+// verifySSTable 按initTable的顺序校验footer与索引，再依次读取索引中的每个block
+func verifySSTable(f *os.File, path string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	corrupted := func(off int64, format string, args ...interface{}) error {
+		return &CorruptionError{Path: path, Offset: off, Err: errors.Wrapf(utils.ErrChecksumMismatch, format, args...)}
+	}
+	read := func(off int64, n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := f.ReadAt(buf, off)
+		return buf, err
+	}
+
+	pos := size - footerChecksumSize - 4
+	if pos < 4 {
+		return corrupted(0, "table is too small: %d bytes", size)
+	}
+	tail, err := read(pos, 4+footerChecksumSize)
+	if err != nil {
+		return err
+	}
+	checksumLen := int64(utils.BytesToU32(tail[:4]))
+	footerStart := pos - checksumLen - 4
+	if footerStart < 0 {
+		return corrupted(pos, "invalid checksum length %d in footer", checksumLen)
+	}
+	footer, err := read(footerStart, int(pos+4-footerStart))
+	if err != nil {
+		return err
+	}
+	if err := utils.VerifyChecksum(footer, tail[4:]); err != nil {
+		return &CorruptionError{Path: path, Offset: footerStart, Err: errors.Wrap(err, "footer")}
+	}
+	idxStart := footerStart - int64(utils.BytesToU32(footer[:4]))
+	if idxStart < 0 {
+		return corrupted(footerStart, "invalid index length %d in footer", utils.BytesToU32(footer[:4]))
+	}
+	data, err := read(idxStart, int(footerStart-idxStart))
+	if err != nil {
+		return err
+	}
+	if err := utils.VerifyChecksum(data, footer[4:4+checksumLen]); err != nil {
+		return &CorruptionError{Path: path, Offset: idxStart, Err: errors.Wrap(err, "index")}
+	}
+	if utils.IsEncryptedIndex(data) {
+		return errors.Wrapf(utils.ErrNoEncryptor, "verify %s: index is encrypted", path)
+	}
+	index := &pb.TableIndex{}
+	if err := proto.Unmarshal(data, index); err != nil {
+		return &CorruptionError{Path: path, Offset: idxStart, Err: errors.Wrap(err, "index")}
+	}
+
+	var buf []byte
+	for i, ko := range index.GetOffsets() {
+		off, n := int64(ko.GetOffset()), int(ko.GetLen())
+		if n < 4 || off+int64(n) > idxStart {
+			return corrupted(off, "block %d of %d bytes is outside the data area", i, n)
+		}
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		b := buf[:n]
+		if _, err := f.ReadAt(b, off); err != nil {
+			return err
+		}
+		// block的末尾依次为 | checksum | checksum len |，与table.block相同
+		chkLen := int(utils.BytesToU32(b[n-4:]))
+		if chkLen > n-4 {
+			return corrupted(off, "block %d has invalid checksum length %d", i, chkLen)
+		}
+		if err := utils.VerifyChecksum(b[:n-4-chkLen], b[n-4-chkLen:n-4]); err != nil {
+			return &CorruptionError{Path: path, Offset: off, Err: errors.Wrapf(err, "block %d", i)}
+		}
+	}
+	return nil
+}
+
+// countingReader 记录已经读出的字节数，即下一条wal记录的偏移
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// verifyWal 用回放时的SafeRead逐条解析记录，记录不会以0开头，读到0说明进入了预分配的部分
+// 批次头之后的记录数量不足时报告批次头的偏移
+func verifyWal(f *os.File, path string) error {
+	reader := &countingReader{r: bufio.NewReader(f)}
+	read := SafeRead{
+		K:  make([]byte, 10),
+		V:  make([]byte, 10),
+		LF: &WalFile{f: &osFile.MmapFile{Fd: f}, opts: &osFile.FileOption{}},
+	}
+	var batchStart int64
+	var remaining int
+	incomplete := func() error {
+		return &CorruptionError{Path: path, Offset: batchStart,
+			Err: errors.Wrapf(utils.ErrChecksumMismatch, "wal batch is missing %d records", remaining)}
+	}
+	for {
+		start := reader.n
+		first, err := reader.r.Peek(1)
+		if err == io.EOF {
+			if remaining > 0 {
+				return incomplete()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first[0] == 0 {
+			if remaining > 0 {
+				return incomplete()
+			}
+			return verifyZeroTail(reader, path, start)
+		}
+		read.RecordOffset = uint32(start)
+		_, err = read.MakeEntry(reader)
+		switch {
+		case err == nil && read.BatchCount > 0:
+			if remaining > 0 {
+				return incomplete()
+			}
+			batchStart, remaining, read.BatchCount = start, read.BatchCount, 0
+		case err == nil, errors.Is(err, utils.ErrNoEncryptor):
+			// 加密记录的checksum在解密之前已经校验通过
+			if remaining > 0 {
+				remaining--
+			}
+		case err == io.EOF, err == io.ErrUnexpectedEOF, err == utils.ErrTruncate:
+			return &CorruptionError{Path: path, Offset: start, Err: errors.Wrap(utils.ErrChecksumMismatch, "wal record")}
+		default:
+			return err
+		}
+	}
+}
+
+// verifyZeroTail 检查从start开始的剩余部分全为0，否则start处的记录损坏后以0开头
+func verifyZeroTail(reader *countingReader, path string, start int64) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := reader.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return &CorruptionError{Path: path, Offset: start,
+					Err: errors.Wrap(utils.ErrChecksumMismatch, "wal record")}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
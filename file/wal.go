@@ -9,7 +9,6 @@ import (
 	"io"
 	"lsm/file/osFile"
 	"lsm/utils"
-	"os"
 	"sync"
 )
 
@@ -21,6 +20,8 @@ type WalFile struct {
 	buf     *bytes.Buffer
 	size    uint32
 	writeAt uint32
+	// validEnd Iterate校验通过的最后一条记录的末尾，Truncate不会截断到它之前
+	validEnd uint32
 }
 
 // Fid _
@@ -34,7 +35,12 @@ func (wf *WalFile) Close() error {
 	if err := wf.f.Close(); err != nil {
 		return err
 	}
-	return os.Remove(fileName)
+	return utils.RemoveFile(fileName, wf.opts.TrashDir)
+}
+
+// Release 关闭wal但保留文件，重新打开时回放其中的数据
+func (wf *WalFile) Release() error {
+	return wf.f.Close()
 }
 
 // Name _
@@ -42,33 +48,95 @@ func (wf *WalFile) Name() string {
 	return wf.f.Fd.Name()
 }
 
+// FileSize wal文件映射的大小，包含预分配但还没有写入的部分
+func (wf *WalFile) FileSize() uint32 {
+	return wf.size
+}
+
 // Size 当前已经被写入的数据
 func (wf *WalFile) Size() uint32 {
 	return wf.writeAt
 }
 
-func OpenWalFile(opt *osFile.FileOption) *WalFile {
-	mmapFile, err := osFile.OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
+// Bytes 已经写入的数据，与wal的映射共用内存，关闭wal之后不能再访问
+func (wf *WalFile) Bytes() []byte {
+	wf.lock.RLock()
+	defer wf.lock.RUnlock()
+	return wf.f.Data[:wf.writeAt]
+}
+
+// OpenWalFile 按opt.Flag打开wal文件，不带os.O_CREATE时文件不存在会返回错误
+func OpenWalFile(opt *osFile.FileOption) (*WalFile, error) {
+	mmapFile, err := osFile.OpenMmapFile(opt.FileName, opt.Flag, opt.MaxSz)
+	if err != nil {
+		return nil, err
+	}
 	walFile := &WalFile{f: mmapFile, lock: &sync.RWMutex{}, opts: opt}
 	walFile.buf = &bytes.Buffer{}
 	walFile.size = uint32(len(walFile.f.Data))
-	utils.PrintErr(err)
-	return walFile
+	return walFile, nil
 }
 
 func (wf *WalFile) Write(entry *utils.Entry) error {
 	// 落预写日志简单的同步写即可
 	// 序列化为磁盘结构
 	wf.lock.Lock()
-	plen := utils.WalCodec(wf.buf, entry)
+	defer wf.lock.Unlock()
+	var plen int
+	if enc := wf.opts.Encryptor; enc != nil {
+		var err error
+		if plen, err = utils.WalCodecEncrypted(wf.buf, entry, wf.opts.WalChecksum, enc); err != nil {
+			return errors.Wrapf(err, "encrypt wal record %s", wf.Name())
+		}
+	} else {
+		plen = utils.WalCodec(wf.buf, entry, wf.opts.WalChecksum)
+	}
 	buf := wf.buf.Bytes()
-	utils.Panic(wf.f.AppendBuffer(wf.writeAt, buf))
+	if err := wf.f.AppendBuffer(wf.writeAt, buf); err != nil {
+		return errors.Wrapf(err, "write wal %s", wf.Name())
+	}
 	wf.writeAt += uint32(plen)
-	wf.lock.Unlock()
 	return nil
 }
 
+// WriteBatch 把entries编码为一个批次，连同批次头一次追加到wal，回放时整批要么全部恢复要么全部丢弃
+// 只有一个entry时与Write相同，不写批次头
+func (wf *WalFile) WriteBatch(entries []*utils.Entry) error {
+	switch len(entries) {
+	case 0:
+		return nil
+	case 1:
+		return wf.Write(entries[0])
+	}
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	out := &bytes.Buffer{}
+	utils.WalBatchCodec(wf.buf, len(entries), wf.opts.WalChecksum)
+	out.Write(wf.buf.Bytes())
+	for _, entry := range entries {
+		if enc := wf.opts.Encryptor; enc != nil {
+			if _, err := utils.WalCodecEncrypted(wf.buf, entry, wf.opts.WalChecksum, enc); err != nil {
+				return errors.Wrapf(err, "encrypt wal record %s", wf.Name())
+			}
+		} else {
+			utils.WalCodec(wf.buf, entry, wf.opts.WalChecksum)
+		}
+		out.Write(wf.buf.Bytes())
+	}
+	if err := wf.f.AppendBuffer(wf.writeAt, out.Bytes()); err != nil {
+		return errors.Wrapf(err, "write wal %s", wf.Name())
+	}
+	wf.writeAt += uint32(out.Len())
+	return nil
+}
+
+// Sync 将已写入的数据同步到磁盘
+func (wf *WalFile) Sync() error {
+	return wf.f.Sync()
+}
+
 // Iterate 遍历wal磁盘的文件，获得数据
+// 批次中的entry先缓存起来，读完整批之后才交给fn；末尾不完整的批次整批丢弃，返回的偏移停在批次头之前
 func (wf *WalFile) Iterate(readOnly bool, offset uint32, fn utils.LogEntry) (uint32, error) {
 	reader := bufio.NewReader(wf.f.NewReader(int(offset)))
 	read := SafeRead{
@@ -78,6 +146,10 @@ func (wf *WalFile) Iterate(readOnly bool, offset uint32, fn utils.LogEntry) (uin
 		LF:           wf,
 	}
 	var validEndOffset uint32 = offset
+	var (
+		batch     []*utils.Entry // 当前批次中已经读出的entry
+		remaining int            // 当前批次中还没有读出的entry数量
+	)
 loop:
 	for {
 		e, err := read.MakeEntry(reader)
@@ -88,27 +160,56 @@ loop:
 			break loop
 		case err != nil:
 			return 0, err
+		case read.BatchCount > 0:
+			// 上一个批次还没有读完就出现新的批次头，说明上一个批次不完整
+			if remaining > 0 {
+				break loop
+			}
+			remaining, read.BatchCount = read.BatchCount, 0
+			read.RecordOffset += uint32(e.LogHeaderLen() + crc32.Size)
+			continue
 		case e.IsZero():
 			break loop
 		}
 
-		var vp utils.ValuePtr // 给kv分离的设计留下扩展,可以不用考虑其作用
 		size := uint32(int(e.LogHeaderLen()) + len(e.Key) + len(e.Value) + crc32.Size)
 		read.RecordOffset += size
+		batch = append(batch, e)
+		if remaining > 0 {
+			if remaining--; remaining > 0 {
+				continue
+			}
+		}
 		validEndOffset = read.RecordOffset
-		if err := fn(e, &vp); err != nil {
-			if err == utils.ErrStop {
-				break
+		if validEndOffset > wf.validEnd {
+			wf.validEnd = validEndOffset
+		}
+		for _, e := range batch {
+			var vp utils.ValuePtr // 给kv分离的设计留下扩展,可以不用考虑其作用
+			if err := fn(e, &vp); err != nil {
+				if err == utils.ErrStop {
+					break loop
+				}
+				return 0, errors.WithMessage(err, "Iteration function")
 			}
-			return 0, errors.WithMessage(err, "Iteration function")
 		}
+		batch = batch[:0]
 	}
 	return validEndOffset, nil
 }
 
-// Truncate _
-// TODO Truncate 函数
+// Truncate 将wal截断到end，用于恢复后去掉末尾不完整的记录，之后的写入从end开始追加
+// end不能小于已经校验或写入的有效数据的末尾，否则会丢掉已提交的记录
 func (wf *WalFile) Truncate(end int64) error {
+	valid := wf.validEnd
+	if wf.writeAt > valid {
+		valid = wf.writeAt
+	}
+	if end < int64(valid) {
+		return errors.Wrapf(utils.ErrTruncateValidData, "wal %s truncate to %d, valid data ends at %d",
+			wf.Name(), end, valid)
+	}
+	wf.writeAt = uint32(end)
 	if end <= 0 {
 		return nil
 	}
@@ -128,14 +229,46 @@ type SafeRead struct {
 
 	RecordOffset uint32
 	LF           *WalFile
+	// BatchCount MakeEntry读到批次头时为批次中entry的数量，返回的entry只有Offset与Hlen，调用方处理后置0
+	BatchCount int
 }
 
 // MakeEntry _
 func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
-	tee := utils.NewHashReader(reader)
+	// 以标记开头的记录使用xxhash、带有meta或者经过加密，否则第一个字节属于header
+	var first [1]byte
+	if _, err := io.ReadFull(reader, first[:]); err != nil {
+		return nil, err
+	}
+	ct, tagLen, hasMeta := utils.ChecksumCRC32, 0, false
+	if tag := first[0]; utils.IsWalTag(tag) {
+		hasMeta = tag&utils.WalMetaTag != 0
+		tag &^= utils.WalMetaTag
+		if tag&utils.WalEncryptedTag != 0 {
+			return r.makeEncryptedEntry(reader, utils.ChecksumType(tag&^utils.WalEncryptedTag), hasMeta)
+		}
+		ct, tagLen = utils.ChecksumType(tag), 1
+	} else {
+		reader = io.MultiReader(bytes.NewReader(first[:]), reader)
+	}
+	tee := utils.NewHashReaderWithChecksum(reader, ct)
+	var meta byte
+	var err error
+	if hasMeta {
+		if meta, err = tee.ReadByte(); err == nil && meta == 0 {
+			return r.makeBatchHeader(reader, tee, tagLen)
+		}
+	}
 	var h utils.WalHeader
-	hlen, err := h.Decode(tee)
+	var hlen int
+	if err == nil {
+		hlen, err = h.Decode(tee)
+	}
 	if err != nil {
+		// 除了读到末尾，其余错误都说明header已经损坏，例如varint溢出
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = utils.ErrTruncate
+		}
 		return nil, err
 	}
 	if h.KeyLen > uint32(1<<16) { // Key length must be below uint16.
@@ -150,9 +283,9 @@ func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
 		r.V = make([]byte, 2*vl)
 	}
 
-	e := &utils.Entry{}
+	e := &utils.Entry{Meta: meta}
 	e.Offset = r.RecordOffset
-	e.Hlen = hlen
+	e.Hlen = tagLen + hlen
 	buf := make([]byte, h.KeyLen+h.ValueLen)
 	if _, err := io.ReadFull(tee, buf[:]); err != nil {
 		if err == io.EOF {
@@ -169,10 +302,72 @@ func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
 		}
 		return nil, err
 	}
+	e.ExpiresAt = h.ExpiresAt
 	crc := utils.BytesToU32(crcBuf[:])
+	if ct == utils.ChecksumCRC32 {
+		// crc32的记录中保存的就是entry的校验和
+		e.Checksum = utils.MaskChecksum(crc)
+		if e.Verify() != nil {
+			return nil, utils.ErrTruncate
+		}
+		return e, nil
+	}
 	if crc != tee.Sum32() {
 		return nil, utils.ErrTruncate
 	}
-	e.ExpiresAt = h.ExpiresAt
+	e.Checksum = e.CalculateChecksum()
+	return e, nil
+}
+
+// makeBatchHeader 解析meta之后的批次头，tee已经读过meta
+func (r *SafeRead) makeBatchHeader(reader io.Reader, tee *utils.HashReader, tagLen int) (*utils.Entry, error) {
+	n, err := utils.DecodeWalBatchCount(tee)
+	if err != nil {
+		return nil, err
+	}
+	var crcBuf [crc32.Size]byte
+	if _, err := io.ReadFull(reader, crcBuf[:]); err != nil {
+		if err == io.EOF {
+			err = utils.ErrTruncate
+		}
+		return nil, err
+	}
+	if utils.BytesToU32(crcBuf[:]) != tee.Sum32() {
+		return nil, utils.ErrTruncate
+	}
+	r.BatchCount = n
+	return &utils.Entry{Offset: r.RecordOffset, Hlen: tagLen + tee.BytesRead}, nil
+}
+
+// makeEncryptedEntry 解析tag之后的加密记录，checksum覆盖密文，校验失败视为末尾不完整的记录
+// 校验通过但解密失败说明密钥不匹配，返回错误而不是截断
+// 记录中key与value之外的部分都计入Hlen，包括tag、密文长度以及加密带来的额外开销
+func (r *SafeRead) makeEncryptedEntry(reader io.Reader, ct utils.ChecksumType, hasMeta bool) (*utils.Entry, error) {
+	tee := utils.NewHashReaderWithChecksum(reader, ct)
+	sealed, n, err := utils.DecodeWalSealed(tee)
+	if err != nil {
+		return nil, err
+	}
+	var crcBuf [crc32.Size]byte
+	if _, err := io.ReadFull(reader, crcBuf[:]); err != nil {
+		if err == io.EOF {
+			err = utils.ErrTruncate
+		}
+		return nil, err
+	}
+	if utils.BytesToU32(crcBuf[:]) != tee.Sum32() {
+		return nil, utils.ErrTruncate
+	}
+	plain, err := utils.DecryptData(r.LF.opts.Encryptor, sealed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "wal %s record at offset %d", r.LF.Name(), r.RecordOffset)
+	}
+	e, err := utils.DecodeWalPlain(plain, hasMeta)
+	if err != nil {
+		return nil, errors.Wrapf(err, "wal %s record at offset %d", r.LF.Name(), r.RecordOffset)
+	}
+	e.Offset = r.RecordOffset
+	e.Hlen = 1 + n - len(e.Key) - len(e.Value)
+	e.Checksum = e.CalculateChecksum()
 	return e, nil
 }
@@ -3,16 +3,17 @@ module lsm
 go 1.18
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/golang/protobuf v1.5.2
 	github.com/hardcore-os/corekv v0.0.0-20220523134505-c9ae35a59097
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
+	google.golang.org/protobuf v1.27.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20210910150752-751e447fb3d0 // indirect
-	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,130 @@
+package lsm
+
+import (
+	"fmt"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// backupManifestPrefix BeginBackup在WorkDir中写入的manifest快照的文件名前缀，release时删除
+const backupManifestPrefix = "BACKUPMANIFEST-"
+
+// backupHolds 未release的备份，受保护的sst引用计数归零后暂不删除，等所有保护它的备份release后再删除
+type backupHolds struct {
+	sync.Mutex
+	holds    map[*backupHold]struct{}
+	deferred []*table
+	seq      uint64 // 用于生成manifest快照的文件名
+}
+
+// backupHold 一次备份保护的sst，ids为nil表示快照还没有确定，期间所有sst都不删除
+type backupHold struct {
+	seq uint64
+	ids map[uint64]struct{}
+}
+
+func (b *backupHolds) protects(fid uint64) bool {
+	for h := range b.holds {
+		if h.ids == nil {
+			return true
+		}
+		if _, ok := h.ids[fid]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deferDelete 引用计数归零时调用，t受保护时推迟删除并返回true
+func (b *backupHolds) deferDelete(t *table) bool {
+	b.Lock()
+	defer b.Unlock()
+	if !b.protects(t.fid) {
+		return false
+	}
+	b.deferred = append(b.deferred, t)
+	return true
+}
+
+func (b *backupHolds) add() *backupHold {
+	b.Lock()
+	defer b.Unlock()
+	if b.holds == nil {
+		b.holds = make(map[*backupHold]struct{})
+	}
+	b.seq++
+	h := &backupHold{seq: b.seq}
+	b.holds[h] = struct{}{}
+	return h
+}
+
+// update 在锁内执行fn修改保护的范围，然后删除不再受保护的sst
+func (b *backupHolds) update(fn func()) {
+	b.Lock()
+	fn()
+	var toDel []*table
+	kept := b.deferred[:0]
+	for _, t := range b.deferred {
+		if b.protects(t.fid) {
+			kept = append(kept, t)
+		} else {
+			toDel = append(toDel, t)
+		}
+	}
+	b.deferred = kept
+	b.Unlock()
+	for _, t := range toDel {
+		// 与合并后删除旧sst一样，删除失败只会留下孤儿文件
+		_ = t.Delete()
+	}
+}
+
+// BeginBackup 返回组成一致快照的文件列表，release之前合并不会删除列表中的sst，新的sst照常生成
+// 列表的第一个文件是WorkDir中一份manifest的快照，只记录列表中的sst，恢复时复制为MANIFEST；其余是sst的路径
+// 内存表中尚未刷盘的写入不在快照中，需要时先调用RotateMemtable
+// 与迭代器一样在release之前阻塞SwapFrom，不能在有SwapFrom等待时调用其他读写接口；重复调用release没有影响
+func (lsm *LSM) BeginBackup() (fileList []string, release func(), err error) {
+	if err := lsm.IsFrozen(); err != nil {
+		return nil, nil, err
+	}
+	lsm.gate.enter()
+	lm := lsm.levels
+	// 先保护所有sst再写快照，快照中的sst在写入之前不会被删除
+	hold := lm.backups.add()
+	path := filepath.Join(lsm.option.WorkDir, fmt.Sprintf("%s%d", backupManifestPrefix, hold.seq))
+	ids, err := lm.manifestFile.WriteSnapshot(path)
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			lm.backups.update(func() { delete(lm.backups.holds, hold) })
+			_ = os.Remove(path)
+			lsm.gate.leave()
+		})
+	}
+	if err != nil {
+		release()
+		return nil, nil, errors.Wrap(err, "write backup manifest")
+	}
+	protected := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		protected[id] = struct{}{}
+	}
+	lm.backups.update(func() { hold.ids = protected })
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	paths := utils.LoadSSTPaths(lsm.option.WorkDir)
+	fileList = append(fileList, path)
+	for _, id := range ids {
+		p, ok := paths[id]
+		if !ok {
+			p = lm.tablePath(id)
+		}
+		fileList = append(fileList, p)
+	}
+	return fileList, release, nil
+}
@@ -0,0 +1,56 @@
+package lsm
+
+import "lsm/utils"
+
+// Batcher 缓存写入的entry，累计大小达到maxBytes时自动提交一次WriteBatch
+// Batcher 只能由一个协程使用，Add之后的entry在提交前不能再被修改
+type Batcher struct {
+	lsm      *LSM
+	maxBytes int
+	entries  []*utils.Entry
+	size     int
+	err      error
+}
+
+// NewBatcher _
+func (lsm *LSM) NewBatcher(maxBytes int) *Batcher {
+	return &Batcher{lsm: lsm, maxBytes: maxBytes}
+}
+
+// Add 缓存一个entry，返回自动提交时产生的错误
+// 提交失败后Batcher不再接受新的entry，之后的调用都会返回同一个错误
+func (b *Batcher) Add(entry *utils.Entry) error {
+	if b.err != nil {
+		return b.err
+	}
+	sz := int(b.lsm.option.walSize(entry))
+	// WriteBatch要求整批连同批次头能放入一个内存表，放不下时先提交已缓存的entry
+	if int64(b.size+sz+utils.MaxWalBatchHeaderSize) > b.lsm.option.MemTableSize {
+		if err := b.commit(); err != nil {
+			return err
+		}
+	}
+	b.entries = append(b.entries, entry)
+	b.size += sz
+	if b.size >= b.maxBytes {
+		return b.commit()
+	}
+	return nil
+}
+
+// Flush 提交所有缓存的entry
+func (b *Batcher) Flush() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.commit()
+}
+
+func (b *Batcher) commit() error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	b.err = b.lsm.WriteBatch(b.entries)
+	b.entries, b.size = b.entries[:0], 0
+	return b.err
+}
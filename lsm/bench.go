@@ -0,0 +1,210 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lsm/utils"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// KeyDistribution 基准测试中选取key的分布
+type KeyDistribution int
+
+const (
+	DistUniform KeyDistribution = iota // 所有key被选中的概率相同
+	DistZipfian                        // 少数热点key被频繁访问，key编号越小越热
+)
+
+func (d KeyDistribution) String() string {
+	if d == DistZipfian {
+		return "zipfian"
+	}
+	return "uniform"
+}
+
+// defaultZipfS 未配置ZipfS时zipfian分布的参数，接近YCSB的默认倾斜程度
+const defaultZipfS = 1.1
+
+// WorkloadSpec 类似YCSB的负载描述，读、扫描之外的操作都是覆盖写
+// 存储没有删除接口，因此负载中不包含删除
+type WorkloadSpec struct {
+	NumKeys      int     // key的总数，开始前全部预先写入一次
+	Ops          int     // 计时阶段执行的操作数
+	ReadRatio    float64 // 点查的比例
+	ScanRatio    float64 // 范围扫描的比例，剩余的比例为写入
+	ScanLength   int     // 每次扫描最多读取的entry数，为0时取10
+	ValueSize    int     // 写入value的字节数
+	Distribution KeyDistribution
+	ZipfS        float64 // zipfian分布的参数，必须大于1，为0时取defaultZipfS
+	Seed         int64   // 随机数种子，相同的种子生成相同的操作序列
+}
+
+// OpResult 一类操作的统计
+type OpResult struct {
+	Count int
+	P50   time.Duration
+	P99   time.Duration
+}
+
+// BenchResult 一次基准测试的结果，不包含预先写入的时间
+type BenchResult struct {
+	Ops        int
+	Duration   time.Duration
+	Throughput float64 // 每秒完成的操作数
+	P99        time.Duration
+	Reads      OpResult
+	Scans      OpResult
+	Writes     OpResult
+}
+
+func (s *WorkloadSpec) validate() error {
+	switch {
+	case s.NumKeys <= 0 || s.Ops <= 0:
+		return fmt.Errorf("NumKeys %d and Ops %d must be positive", s.NumKeys, s.Ops)
+	case s.ReadRatio < 0 || s.ScanRatio < 0 || s.ReadRatio+s.ScanRatio > 1:
+		return fmt.Errorf("ReadRatio %v and ScanRatio %v must be non-negative and sum to at most 1", s.ReadRatio, s.ScanRatio)
+	case s.ScanLength < 0 || s.ValueSize < 0:
+		return fmt.Errorf("ScanLength %d and ValueSize %d must not be negative", s.ScanLength, s.ValueSize)
+	case s.ZipfS != 0 && s.ZipfS <= 1:
+		return fmt.Errorf("ZipfS %v must be larger than 1", s.ZipfS)
+	}
+	return nil
+}
+
+// RunBenchmark 在opt.WorkDir中打开一个新的存储，预先写入所有key后按spec执行混合负载，返回吞吐与延迟，结束时关闭存储
+// WorkDir必须为空或不存在，避免已有的数据影响结果；数据在结束后保留，由调用方清理
+func RunBenchmark(opt Options, spec WorkloadSpec) (BenchResult, error) {
+	if err := spec.validate(); err != nil {
+		return BenchResult{}, err
+	}
+	if files, err := ioutil.ReadDir(opt.WorkDir); err == nil && len(files) > 0 {
+		return BenchResult{}, fmt.Errorf("WorkDir %s is not empty", opt.WorkDir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return BenchResult{}, err
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return BenchResult{}, err
+	}
+	lsm, err := Open(opt)
+	if err != nil {
+		return BenchResult{}, err
+	}
+	res, err := runWorkload(lsm, spec)
+	if _, cerr := lsm.Close(); err == nil {
+		err = cerr
+	}
+	return res, err
+}
+
+func runWorkload(lsm *LSM, spec WorkloadSpec) (BenchResult, error) {
+	scanLength := spec.ScanLength
+	if scanLength == 0 {
+		scanLength = 10
+	}
+	r := rand.New(rand.NewSource(spec.Seed))
+	nextKey := func() int { return r.Intn(spec.NumKeys) }
+	if spec.Distribution == DistZipfian {
+		s := spec.ZipfS
+		if s == 0 {
+			s = defaultZipfS
+		}
+		zipf := rand.NewZipf(r, s, 1, uint64(spec.NumKeys-1))
+		nextKey = func() int { return int(zipf.Uint64()) }
+	}
+	value := make([]byte, spec.ValueSize)
+	r.Read(value)
+
+	for i := 0; i < spec.NumKeys; i++ {
+		if err := lsm.Put(benchKey(i), value); err != nil {
+			return BenchResult{}, err
+		}
+	}
+
+	var reads, scans, writes, all []time.Duration
+	start := time.Now()
+	for i := 0; i < spec.Ops; i++ {
+		key := benchKey(nextKey())
+		p := r.Float64()
+		opStart := time.Now()
+		switch {
+		case p < spec.ReadRatio:
+			if err := benchRead(lsm, key); err != nil {
+				return BenchResult{}, err
+			}
+			reads = append(reads, time.Since(opStart))
+		case p < spec.ReadRatio+spec.ScanRatio:
+			benchScan(lsm, key, scanLength)
+			scans = append(scans, time.Since(opStart))
+		default:
+			if err := lsm.Put(key, value); err != nil {
+				return BenchResult{}, err
+			}
+			writes = append(writes, time.Since(opStart))
+		}
+		all = append(all, time.Since(opStart))
+	}
+	elapsed := time.Since(start)
+
+	return BenchResult{
+		Ops:        spec.Ops,
+		Duration:   elapsed,
+		Throughput: float64(spec.Ops) / elapsed.Seconds(),
+		P99:        percentile(all, 0.99),
+		Reads:      newOpResult(reads),
+		Scans:      newOpResult(scans),
+		Writes:     newOpResult(writes),
+	}, nil
+}
+
+// benchKey 定长的key，保证key的字典序与编号一致
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("bench%012d", i))
+}
+
+// benchRead 读取key最新的版本，预先写入保证了key一定存在
+func benchRead(lsm *LSM, key []byte) error {
+	version, ok, err := lsm.Version(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.ErrKeyNotFound
+	}
+	_, err = lsm.Get(utils.KeyWithTs(key, version))
+	return err
+}
+
+// benchScan 从key开始按升序读取最多n个entry
+func benchScan(lsm *LSM, key []byte, n int) {
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	for iter.Seek(utils.KeyWithTs(key, math.MaxUint64)); iter.Valid() && n > 0; iter.Next() {
+		_ = iter.Item().Entry()
+		n--
+	}
+}
+
+func newOpResult(latencies []time.Duration) OpResult {
+	return OpResult{
+		Count: len(latencies),
+		P50:   percentile(latencies, 0.5),
+		P99:   percentile(latencies, 0.99),
+	}
+}
+
+// percentile 返回延迟的分位数，会对latencies排序
+func percentile(latencies []time.Duration, q float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	idx := int(math.Ceil(q*float64(len(latencies)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return latencies[idx]
+}
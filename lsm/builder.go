@@ -12,13 +12,14 @@ import (
 	"math"
 	"os"
 	"sort"
+	"time"
 	"unsafe"
 )
 
 type tableBuilder struct {
 	sstSize       int64
 	curBlock      *block
-	opt           *lsmOptions
+	opt           *Options
 	blockList     []*block
 	keyCount      uint32
 	keyHashes     []uint32
@@ -26,12 +27,19 @@ type tableBuilder struct {
 	baseKey       []byte
 	staleDataSize int
 	estimateSz    int64
+	minExpiresAt  uint64 // 设置了过期时间的entry中最早的过期时间，记录在manifest中供TTL合并判断
+	maxExpiresAt  uint64
+	noBloom       bool // 不生成布隆过滤器，见SkipBloomBottomLevel
+
+	err error // 加密block或索引失败的原因，flush时返回
 }
 type buildData struct {
-	blockList []*block
-	index     []byte
-	checksum  []byte
-	size      int
+	blockList      []*block
+	index          []byte
+	checksum       []byte
+	footerChecksum []byte // footer的checksum，写在文件的最后
+	size           int
+	align          int // 每个block在文件中的起始偏移按align对齐
 }
 type block struct {
 	offset            int //当前block的offset 首地址
@@ -39,15 +47,26 @@ type block struct {
 	entriesIndexStart int
 	chkLen            int
 	data              []byte
-	baseKey           []byte
-	entryOffsets      []uint32
+	baseKey           []byte   // block中的第一个key，记录在索引中
+	prevKey           []byte   // 上一个写入的key，用于计算前缀
+	restarts          []uint32 // 重启点的偏移，重启点处的entry保存完整的key
+	entries           int
 	end               int
 	estimateSz        int64
+	zoneMin, zoneMax  []byte // ZoneMapExtractor从block中entry提取出的最小值与最大值，记录在索引中
+	hasZone           bool
 }
 
+// 每隔blockRestartInterval个entry设置一个重启点，读取时在重启点上二分查找
+const blockRestartInterval = 16
+
+// block中每个entry的构成如下
+// | header | diff key | value |
+// 其中key只保存与上一个key不同的后缀，重启点处的entry保存完整的key
 type header struct {
-	overlap uint16 // Overlap with base key.
+	overlap uint16 // Overlap with previous key.
 	diff    uint16 // Length of the diff.
+	vlen    uint32 // Length of the encoded value.
 }
 
 const headerSize = uint16(unsafe.Sizeof(header{}))
@@ -58,14 +77,14 @@ func (h *header) decode(buf []byte) {
 }
 
 func (h header) encode() []byte {
-	var b [4]byte
+	var b [headerSize]byte
 	*(*header)(unsafe.Pointer(&b[0])) = h
 	return b[:]
 }
 
 func (tb *tableBuilder) add(e *utils.Entry, isStale bool) {
 	key := e.Key
-	val := utils.ValueStruct{Value: e.Value}
+	val := utils.ValueStruct{Meta: e.Meta, Value: e.Value, ExpiresAt: e.ExpiresAt}
 	// 检查是否需要分配一个新的 block
 	if tb.tryFinishBlock(e) {
 		if isStale {
@@ -78,15 +97,32 @@ func (tb *tableBuilder) add(e *utils.Entry, isStale bool) {
 			data: make([]byte, tb.opt.BlockSize), // TODO 加密block后块的大小会增加，需要预留一些填充位置
 		}
 	}
-	tb.keyHashes = append(tb.keyHashes, utils.Hash(utils.ParseKey(key)))
+	tb.keyHashes = append(tb.keyHashes, tb.opt.BloomHash.Sum(utils.ParseKey(key)))
+	tb.curBlock.addZone(tb.opt.zoneValue(e))
 
 	if version := utils.ParseTs(key); version > tb.maxVersion {
 		tb.maxVersion = version
 	}
+	if e.ExpiresAt > 0 {
+		if tb.minExpiresAt == 0 || e.ExpiresAt < tb.minExpiresAt {
+			tb.minExpiresAt = e.ExpiresAt
+		}
+		if e.ExpiresAt > tb.maxExpiresAt {
+			tb.maxExpiresAt = e.ExpiresAt
+		}
+	}
 
 	var diffKey []byte
 	if len(tb.curBlock.baseKey) == 0 {
 		tb.curBlock.baseKey = append(tb.curBlock.baseKey[:0], key...)
+	}
+	// 索引中的baseKey保持固定8字节的时间戳，只有block中的key使用变长编码
+	if tb.opt.VarintTimestamps {
+		key = utils.KeyWithVarintTs(key)
+	}
+	if tb.curBlock.entries%blockRestartInterval == 0 {
+		// 重启点保存完整的key
+		tb.curBlock.restarts = append(tb.curBlock.restarts, uint32(tb.curBlock.end))
 		diffKey = key
 	} else {
 		diffKey = tb.keyDiff(key)
@@ -97,29 +133,74 @@ func (tb *tableBuilder) add(e *utils.Entry, isStale bool) {
 	h := header{
 		overlap: uint16(len(key) - len(diffKey)),
 		diff:    uint16(len(diffKey)),
+		vlen:    val.EncodedSize(),
+	}
+	// 对齐时value之前是 | 填充长度 | 填充 |，使value在block中的偏移按align对齐
+	pad := -1
+	if align := tb.opt.valueAlign(); align > 1 {
+		valueStart := tb.curBlock.end + int(headerSize) + len(diffKey) + 1 + int(val.EncodedSize()) - len(val.Value)
+		pad = (align - valueStart%align) % align
+		h.vlen += uint32(1 + pad)
 	}
 
-	tb.curBlock.entryOffsets = append(tb.curBlock.entryOffsets, uint32(tb.curBlock.end))
+	tb.curBlock.entries++
+	tb.curBlock.prevKey = append(tb.curBlock.prevKey[:0], key...)
 
 	tb.append(h.encode())
 	tb.append(diffKey)
+	if pad >= 0 {
+		padding := tb.allocate(1 + pad)
+		padding[0] = byte(pad)
+		for i := 1; i < len(padding); i++ {
+			padding[i] = 0
+		}
+	}
 
 	dst := tb.allocate(int(val.EncodedSize()))
 	val.EncodeValue(dst)
 }
-func newTableBuilerWithSSTSize(opt *lsmOptions, size int64) *tableBuilder {
+
+// addZone 用entry提取出的值扩展block的zone范围，nil表示entry没有这个维度
+func (b *block) addZone(v []byte) {
+	if v == nil {
+		return
+	}
+	if !b.hasZone || bytes.Compare(v, b.zoneMin) < 0 {
+		b.zoneMin = utils.Copy(v)
+	}
+	if !b.hasZone || bytes.Compare(v, b.zoneMax) > 0 {
+		b.zoneMax = utils.Copy(v)
+	}
+	b.hasZone = true
+}
+
+func newTableBuilerWithSSTSize(opt *Options, size int64) *tableBuilder {
 	return &tableBuilder{
 		opt:     opt,
 		sstSize: size,
 	}
 }
-func newTableBuiler(opt *lsmOptions) *tableBuilder {
+func newTableBuiler(opt *Options) *tableBuilder {
 	return &tableBuilder{
 		opt:     opt,
 		sstSize: opt.SSTableMaxSz,
 	}
 }
 
+// forLevel 按sst将要写入的层设置是否生成布隆过滤器
+func (tb *tableBuilder) forLevel(level int) *tableBuilder {
+	tb.noBloom = tb.opt.skipBloom(level)
+	return tb
+}
+
+// bloomBits 包含n个key时布隆过滤器每个key的bit数，为0时不生成布隆过滤器
+func (tb *tableBuilder) bloomBits(n int) int {
+	if tb.noBloom {
+		return 0
+	}
+	return tb.opt.bloomBitsPerKey(n)
+}
+
 // Empty returns whether it's empty.
 func (tb *tableBuilder) empty() bool { return len(tb.keyHashes) == 0 }
 
@@ -130,21 +211,49 @@ func (tb *tableBuilder) finish() []byte {
 	utils.CondPanic(written == len(buf), nil)
 	return buf
 }
+
+const (
+	// blockOffsetOverhead 索引中每个block的offset除了baseKey之外的编码开销
+	blockOffsetOverhead = 16
+	// tableTailOverhead 索引中的计数、版本号以及footer中的长度与校验和
+	tableTailOverhead = 48
+)
+
+// wouldExceed 判断加入e之后sst的预估大小是否会超过sstSize，刷盘时据此在e之前切分出新的sst
+// 索引按每个block一个以e.Key长度估计的offset计算，布隆过滤器按key的数量计算
+// 已经完成的block的对齐填充计入了estimateSz，这里加上当前block、可能新开的block以及e的填充
+func (tb *tableBuilder) wouldExceed(e *utils.Entry) bool {
+	entryPad, blockPad := tb.alignOverhead()
+	size := tb.estimateSz + int64(headerSize) + int64(len(e.Key)) + int64(e.EncodedSize()) + entryPad + blockPad + tableTailOverhead
+	blocks := len(tb.blockList) + 1
+	if tb.curBlock != nil {
+		size += int64(tb.curBlock.end) + int64((len(tb.curBlock.restarts)+1)*4+4+8+4) + blockPad
+		blocks++
+	}
+	size += int64(blocks * (len(e.Key) + blockOffsetOverhead))
+	n := len(tb.keyHashes) + 1
+	if bits := tb.bloomBits(n); bits > 0 {
+		size += int64(bits*n/8 + 1)
+	}
+	return size > tb.sstSize
+}
+
 func (tb *tableBuilder) tryFinishBlock(e *utils.Entry) bool {
 	if tb.curBlock == nil {
 		return true
 	}
 
-	if len(tb.curBlock.entryOffsets) <= 0 {
+	if tb.curBlock.entries <= 0 {
 		return false
 	}
-	utils.CondPanic(!((uint32(len(tb.curBlock.entryOffsets))+1)*4+4+8+4 < math.MaxUint32), errors.New("Integer overflow"))
-	entriesOffsetsSize := int64((len(tb.curBlock.entryOffsets)+1)*4 +
+	utils.CondPanic(!((uint32(len(tb.curBlock.restarts))+1)*4+4+8+4 < math.MaxUint32), errors.New("Integer overflow"))
+	restartsSize := int64((len(tb.curBlock.restarts)+1)*4 +
 		4 + // size of list
 		8 + // Sum64 in checksum proto
 		4) // checksum length
-	tb.curBlock.estimateSz = int64(tb.curBlock.end) + int64(6 /*header size for entry*/) +
-		int64(len(e.Key)) + int64(e.EncodedSize()) + entriesOffsetsSize
+	entryPad, blockPad := tb.alignOverhead()
+	tb.curBlock.estimateSz = int64(tb.curBlock.end) + int64(headerSize) +
+		int64(len(e.Key)) + int64(e.EncodedSize()) + entryPad + blockPad + restartsSize
 
 	// Integer overflow check for table size.
 	utils.CondPanic(!(uint64(tb.curBlock.end)+uint64(tb.curBlock.estimateSz) < math.MaxUint32), errors.New("Integer overflow"))
@@ -152,6 +261,14 @@ func (tb *tableBuilder) tryFinishBlock(e *utils.Entry) bool {
 	return tb.curBlock.estimateSz > int64(tb.opt.BlockSize)
 }
 
+// alignOverhead 对齐时一个entry最多多占的字节数，即填充长度与最多align-1字节的填充，以及block起始偏移最多的填充
+func (tb *tableBuilder) alignOverhead() (entry, block int64) {
+	if align := tb.opt.valueAlign(); align > 1 {
+		return int64(align), int64(align - 1)
+	}
+	return 0, 0
+}
+
 // AddStaleKey 记录陈旧key所占用的空间大小，用于日志压缩时的决策
 func (tb *tableBuilder) AddStaleKey(e *utils.Entry) {
 	// Rough estimate based on how much space it will occupy in the SST.
@@ -169,12 +286,13 @@ func (tb *tableBuilder) Close() {
 	// 结合内存分配器
 }
 func (tb *tableBuilder) finishBlock() {
-	if tb.curBlock == nil || len(tb.curBlock.entryOffsets) == 0 {
+	if tb.curBlock == nil || tb.curBlock.entries == 0 {
 		return
 	}
-	// Append the entryOffsets and its length.
-	tb.append(utils.U32SliceToBytes(tb.curBlock.entryOffsets))
-	tb.append(utils.U32ToBytes(uint32(len(tb.curBlock.entryOffsets))))
+	// Append the restart points and its length.
+	tb.append(utils.U32SliceToBytes(tb.curBlock.restarts))
+	tb.append(utils.U32ToBytes(uint32(len(tb.curBlock.restarts))))
+	tb.encryptBlock()
 
 	checksum := tb.calculateChecksum(tb.curBlock.data[:tb.curBlock.end])
 
@@ -184,11 +302,26 @@ func (tb *tableBuilder) finishBlock() {
 	tb.estimateSz += tb.curBlock.estimateSz
 	tb.blockList = append(tb.blockList, tb.curBlock)
 	// TODO: 预估整理builder写入磁盘后，sst文件的大小
-	tb.keyCount += uint32(len(tb.curBlock.entryOffsets))
+	tb.keyCount += uint32(tb.curBlock.entries)
 	tb.curBlock = nil // 表示当前block 已经被序列化到内存
 	return
 }
 
+// encryptBlock 配置了Encryptor时把curBlock中已写入的entry与重启点替换为密文，checksum随后按密文计算
+func (tb *tableBuilder) encryptBlock() {
+	enc := tb.opt.Encryptor
+	if enc == nil || tb.err != nil {
+		return
+	}
+	bb := tb.curBlock
+	sealed, err := utils.EncryptData(enc, bb.data[:bb.end])
+	if err != nil {
+		tb.err = err
+		return
+	}
+	bb.data, bb.end = sealed, len(sealed)
+}
+
 // append appends to curBlock.data
 func (tb *tableBuilder) append(data []byte) {
 	dst := tb.allocate(len(data))
@@ -218,8 +351,8 @@ func (tb *tableBuilder) calculateChecksum(data []byte) []byte {
 
 func (tb *tableBuilder) keyDiff(newKey []byte) []byte {
 	var i int
-	for i = 0; i < len(newKey) && i < len(tb.curBlock.baseKey); i++ {
-		if newKey[i] != tb.curBlock.baseKey[i] {
+	for i = 0; i < len(newKey) && i < len(tb.curBlock.prevKey); i++ {
+		if newKey[i] != tb.curBlock.prevKey[i] {
 			break
 		}
 	}
@@ -229,16 +362,32 @@ func (tb *tableBuilder) keyDiff(newKey []byte) []byte {
 // TODO: 这里存在多次的用户空间拷贝过程，需要优化
 func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err error) {
 	bd := tb.done()
-	t = &table{lm: lm, fid: utils.FID(tableName)}
+	if tb.err != nil {
+		return nil, fmt.Errorf("encrypt table %s: %w", tableName, tb.err)
+	}
+	fid, ok := utils.FID(tableName)
+	if !ok {
+		return nil, fmt.Errorf("invalid table name %s", tableName)
+	}
+	t = &table{lm: lm, fid: fid, minExpiresAt: tb.minExpiresAt, maxExpiresAt: tb.maxExpiresAt,
+		createdAt: uint64(time.Now().Unix())}
 	// 如果没有builder 则创打开一个已经存在的sst文件
-	t.ss = file.OpenSStable(&file2.FileOption{
+	if t.ss, err = file.OpenSStable(&file2.FileOption{
 		FileName: tableName,
 		WorkDir:  lm.opt.WorkDir,
 		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(bd.size)})
+		MaxSz:    int(bd.size),
+
+		Encryptor: lm.opt.Encryptor,
+		TrashDir:  lm.opt.trashDir(),
+		Retry:     lm.opt.FileRetry,
+	}); err != nil {
+		return nil, err
+	}
 	buf := make([]byte, bd.size)
 	written := bd.Copy(buf)
 	utils.CondPanic(written != len(buf), fmt.Errorf("tableBuilder.flush written != len(buf)"))
+	t.checksum = utils.U64ToBytes(utils.CalculateChecksum(buf))
 	dst, err := t.ss.Bytes(0, bd.size)
 	if err != nil {
 		return nil, err
@@ -250,16 +399,24 @@ func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err
 func (bd *buildData) Copy(dst []byte) int {
 	var written int
 	for _, bl := range bd.blockList {
+		// 填充部分保持为0
+		written = alignUp(written, bd.align)
 		written += copy(dst[written:], bl.data[:bl.end])
 	}
 	written += copy(dst[written:], bd.index)
-	written += copy(dst[written:], utils.U32ToBytes(uint32(len(bd.index))))
-
-	written += copy(dst[written:], bd.checksum)
-	written += copy(dst[written:], utils.U32ToBytes(uint32(len(bd.checksum))))
+	written += copy(dst[written:], bd.footer())
+	written += copy(dst[written:], bd.footerChecksum)
 	return written
 }
 
+// footer 索引之后的 | index len | index checksum | checksum len |
+func (bd *buildData) footer() []byte {
+	footer := make([]byte, 0, 4+len(bd.checksum)+4)
+	footer = append(footer, utils.U32ToBytes(uint32(len(bd.index)))...)
+	footer = append(footer, bd.checksum...)
+	return append(footer, utils.U32ToBytes(uint32(len(bd.checksum)))...)
+}
+
 func (tb *tableBuilder) done() buildData {
 	tb.finishBlock()
 	if len(tb.blockList) == 0 {
@@ -267,19 +424,26 @@ func (tb *tableBuilder) done() buildData {
 	}
 	bd := buildData{
 		blockList: tb.blockList,
+		align:     tb.opt.valueAlign(),
 	}
 
 	var f utils.Filter
-	if tb.opt.BloomFalsePositive > 0 {
-		bits := utils.BloomBitsPerKey(len(tb.keyHashes), tb.opt.BloomFalsePositive)
+	if bits := tb.bloomBits(len(tb.keyHashes)); bits > 0 {
 		f = utils.NewFilter(tb.keyHashes, bits)
 	}
 	// TODO 构建 sst的索引
 	index, dataSize := tb.buildIndex(f)
+	if enc := tb.opt.Encryptor; enc != nil && tb.err == nil {
+		// 索引中有每个block的首个key与布隆过滤器，同样需要加密
+		if index, tb.err = utils.EncryptIndex(enc, index); tb.err != nil {
+			index = nil
+		}
+	}
 	checksum := tb.calculateChecksum(index)
 	bd.index = index
 	bd.checksum = checksum
-	bd.size = int(dataSize) + len(index) + len(checksum) + 4 + 4
+	bd.footerChecksum = tb.calculateChecksum(bd.footer())
+	bd.size = int(dataSize) + len(index) + len(checksum) + 4 + 4 + len(bd.footerChecksum)
 	return bd
 }
 
@@ -287,13 +451,21 @@ func (tb *tableBuilder) buildIndex(bloom []byte) ([]byte, uint32) {
 	tableIndex := &pb.TableIndex{}
 	if len(bloom) > 0 {
 		tableIndex.BloomFilter = bloom
+		tableIndex.BloomHash = uint32(tb.opt.BloomHash)
 	}
 	tableIndex.KeyCount = tb.keyCount
+	tableIndex.ValueMeta = true
 	tableIndex.MaxVersion = tb.maxVersion
+	tableIndex.ZoneMap = tb.opt.ZoneMapExtractor != nil
+	tableIndex.Encrypted = tb.opt.Encryptor != nil
+	if align := tb.opt.valueAlign(); align > 1 {
+		tableIndex.ValueAlign = uint32(align)
+	}
+	tableIndex.VarintTs = tb.opt.VarintTimestamps
 	tableIndex.Offsets = tb.writeBlockOffsets(tableIndex)
 	var dataSize uint32
 	for i := range tb.blockList {
-		dataSize += uint32(tb.blockList[i].end)
+		dataSize = uint32(alignUp(int(dataSize), tb.opt.valueAlign())) + uint32(tb.blockList[i].end)
 	}
 	data, err := tableIndex.Marshal()
 	utils.Panic(err)
@@ -304,6 +476,7 @@ func (tb *tableBuilder) writeBlockOffsets(tableIndex *pb.TableIndex) []*pb.Block
 	var startOffset uint32
 	var offsets []*pb.BlockOffset
 	for _, bl := range tb.blockList {
+		startOffset = uint32(alignUp(int(startOffset), tb.opt.valueAlign()))
 		offset := tb.writeBlockOffset(bl, startOffset)
 		offsets = append(offsets, offset)
 		startOffset += uint32(bl.end)
@@ -311,11 +484,17 @@ func (tb *tableBuilder) writeBlockOffsets(tableIndex *pb.TableIndex) []*pb.Block
 	return offsets
 }
 
+// alignUp 将off向上取整到align的倍数，align为1时不变
+func alignUp(off, align int) int {
+	return (off + align - 1) / align * align
+}
+
 func (b *tableBuilder) writeBlockOffset(bl *block, startOffset uint32) *pb.BlockOffset {
 	offset := &pb.BlockOffset{}
 	offset.Key = bl.baseKey
 	offset.Len = uint32(bl.end)
 	offset.Offset = startOffset
+	offset.ZoneMin, offset.ZoneMax, offset.HasZone = bl.zoneMin, bl.zoneMax, bl.hasZone
 	return offset
 }
 
@@ -329,112 +508,142 @@ func (b block) verifyCheckSum() error {
 }
 
 type blockIterator struct {
-	data         []byte
-	idx          int
-	err          error
-	baseKey      []byte
-	key          []byte
-	val          []byte
-	entryOffsets []uint32
-	block        *block
+	data      []byte
+	restarts  []uint32
+	pos       int // 当前entry的起始偏移
+	next      int // 下一个entry的起始偏移
+	err       error
+	key       []byte
+	val       []byte
+	block     *block
+	keysOnly  bool // 只解析key，不解码value
+	valueMeta bool // value以meta开头，记录meta之前生成的sst中没有meta
+	padded    bool // value之前有对齐用的填充，见ValueAlignment
+	varintTs  bool // block中key的时间戳是变长编码，见VarintTimestamps
 
 	tableID uint64
 	blockID int
 
-	prevOverlap uint16
-
 	it utils.Item
 }
 
 func (itr *blockIterator) setBlock(b *block) {
 	itr.block = b
 	itr.err = nil
-	itr.idx = 0
-	itr.baseKey = itr.baseKey[:0]
-	itr.prevOverlap = 0
+	itr.pos, itr.next = 0, 0
 	itr.key = itr.key[:0]
 	itr.val = itr.val[:0]
-	// Drop the index from the block. We don't need it anymore.
+	// Drop the restart points from the block. We don't need it anymore.
 	itr.data = b.data[:b.entriesIndexStart]
-	itr.entryOffsets = b.entryOffsets
+	itr.restarts = b.restarts
 }
 
 // seekToFirst brings us to the first element.
 func (itr *blockIterator) seekToFirst() {
-	itr.setIdx(0)
+	itr.seekToRestart(0)
 }
 func (itr *blockIterator) seekToLast() {
-	itr.setIdx(len(itr.entryOffsets) - 1)
+	itr.seekToRestart(len(itr.restarts) - 1)
+	for itr.err == nil && itr.next < len(itr.data) {
+		itr.Next()
+	}
 }
+
+// seek 先在重启点上二分找到最后一个key小于目标key的重启点，再从该重启点向后顺序查找
 func (itr *blockIterator) seek(key []byte) {
 	itr.err = nil
-	startIndex := 0 // This tells from which index we should start binary search.
-
-	foundEntryIdx := sort.Search(len(itr.entryOffsets), func(idx int) bool {
-		// If idx is less than start index then just return false.
-		if idx < startIndex {
-			return false
-		}
-		itr.setIdx(idx)
-		return utils.CompareKeys(itr.key, key) >= 0
+	idx := sort.Search(len(itr.restarts), func(i int) bool {
+		return utils.CompareKeys(itr.fullKey(itr.restartKey(i)), key) >= 0
 	})
-	itr.setIdx(foundEntryIdx)
+	if idx > 0 {
+		idx--
+	}
+	for itr.seekToRestart(idx); itr.err == nil; itr.Next() {
+		if utils.CompareKeys(itr.it.Entry().Key, key) >= 0 {
+			return
+		}
+	}
 }
 
-func (itr *blockIterator) setIdx(i int) {
-	itr.idx = i
-	if i >= len(itr.entryOffsets) || i < 0 {
-		itr.err = io.EOF
-		return
+// restartKey 重启点处的entry保存的是完整的key
+func (itr *blockIterator) restartKey(i int) []byte {
+	off := int(itr.restarts[i])
+	var h header
+	h.decode(itr.data[off:])
+	return itr.data[off+int(headerSize) : off+int(headerSize)+int(h.diff)]
+}
+
+// fullKey 将block中保存的key还原为固定8字节时间戳的格式，变长编码时返回新分配的key
+func (itr *blockIterator) fullKey(key []byte) []byte {
+	if itr.varintTs {
+		return utils.ParseVarintTsKey(key)
 	}
-	itr.err = nil
-	startOffset := int(itr.entryOffsets[i])
+	return key
+}
 
-	// Set base key.
-	if len(itr.baseKey) == 0 {
-		var baseHeader header
-		baseHeader.decode(itr.data)
-		itr.baseKey = itr.data[headerSize : headerSize+baseHeader.diff]
+func (itr *blockIterator) seekToRestart(i int) {
+	if i < 0 || i >= len(itr.restarts) {
+		itr.err = io.EOF
+		return
 	}
+	itr.key = itr.key[:0]
+	itr.parseEntry(int(itr.restarts[i]))
+}
 
-	var endOffset int
-	// idx points to the last entry in the block.
-	if itr.idx+1 == len(itr.entryOffsets) {
-		endOffset = len(itr.data)
-	} else {
-		// idx point to some entry other than the last one in the block.
-		// EndOffset of the current entry is the start offset of the next entry.
-		endOffset = int(itr.entryOffsets[itr.idx+1])
+// parseEntry 解析offset处的entry，key的前缀来自上一个entry
+func (itr *blockIterator) parseEntry(offset int) {
+	if offset >= len(itr.data) {
+		itr.err = io.EOF
+		return
 	}
+	itr.err = nil
 	defer func() {
 		if r := recover(); r != nil {
 			var debugBuf bytes.Buffer
 			fmt.Fprintf(&debugBuf, "==== Recovered====\n")
-			fmt.Fprintf(&debugBuf, "Table ID: %d\nBlock ID: %d\nEntry Idx: %d\nData len: %d\n"+
-				"StartOffset: %d\nEndOffset: %d\nEntryOffsets len: %d\nEntryOffsets: %v\n",
-				itr.tableID, itr.blockID, itr.idx, len(itr.data), startOffset, endOffset,
-				len(itr.entryOffsets), itr.entryOffsets)
+			fmt.Fprintf(&debugBuf, "Table ID: %d\nBlock ID: %d\nData len: %d\n"+
+				"Offset: %d\nRestarts len: %d\nRestarts: %v\n",
+				itr.tableID, itr.blockID, len(itr.data), offset,
+				len(itr.restarts), itr.restarts)
 			panic(debugBuf.String())
 		}
 	}()
 
-	entryData := itr.data[startOffset:endOffset]
 	var h header
-	h.decode(entryData)
-	if h.overlap > itr.prevOverlap {
-		itr.key = append(itr.key[:itr.prevOverlap], itr.baseKey[itr.prevOverlap:h.overlap]...)
+	h.decode(itr.data[offset:])
+	keyOff := offset + int(headerSize)
+	valueOff := keyOff + int(h.diff)
+	endOffset := valueOff + int(h.vlen)
+	utils.CondPanic(int(h.overlap) > len(itr.key), fmt.Errorf("overlap %d > previous key len %d", h.overlap, len(itr.key)))
+	itr.key = append(itr.key[:h.overlap], itr.data[keyOff:valueOff]...)
+	itr.pos, itr.next = offset, endOffset
+
+	// itr.key会被下一个entry复用，这里需要复制一份
+	var e *utils.Entry
+	if itr.varintTs {
+		e = utils.NewEntry(utils.ParseVarintTsKey(itr.key), nil)
+	} else {
+		e = utils.NewEntry(utils.Copy(itr.key), nil)
 	}
-
-	itr.prevOverlap = h.overlap
-	valueOff := headerSize + h.diff
-	diffKey := entryData[headerSize:valueOff]
-	itr.key = append(itr.key[:h.overlap], diffKey...)
-	e := utils.NewEntry(itr.key, nil)
+	// meta与过期时间位于value区域的开头，只读取key时也解析，value不复制
 	val := &utils.ValueStruct{}
-	val.DecodeValue(entryData[valueOff:])
-	itr.val = val.Value
-	e.Value = val.Value
+	buf := itr.data[valueOff:endOffset]
+	if itr.padded {
+		buf = buf[1+int(buf[0]):]
+	}
+	if itr.valueMeta {
+		val.DecodeValue(buf)
+	} else {
+		val.DecodeValueWithoutMeta(buf)
+	}
 	e.ExpiresAt = val.ExpiresAt
+	e.Meta = val.Meta
+	if !itr.keysOnly {
+		itr.val = val.Value
+		e.Value = val.Value
+		// block读取时已经校验过，这里只记录读出时的内容，调用方Verify时才计算entry的校验和
+		e.DeferChecksum()
+	}
 	itr.it = &Item{e: e}
 }
 
@@ -443,14 +652,14 @@ func (itr *blockIterator) Error() error {
 }
 
 func (itr *blockIterator) Next() {
-	itr.setIdx(itr.idx + 1)
+	itr.parseEntry(itr.next)
 }
 
 func (itr *blockIterator) Valid() bool {
 	return itr.err != io.EOF // TODO 这里用err比较好
 }
 func (itr *blockIterator) Rewind() bool {
-	itr.setIdx(0)
+	itr.seekToFirst()
 	return true
 }
 func (itr *blockIterator) Item() utils.Item {
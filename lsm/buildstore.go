@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// WriteSortedEntry 按BuildStore读取的格式写入一个entry：
+// key长度(uvarint) | key | value长度(uvarint) | value | ExpiresAt(uvarint)，key带有版本号后缀，与Set的key相同
+func WriteSortedEntry(w io.Writer, e *utils.Entry) error {
+	buf := make([]byte, 3*binary.MaxVarintLen64+len(e.Key)+len(e.Value))
+	n := binary.PutUvarint(buf, uint64(len(e.Key)))
+	n += copy(buf[n:], e.Key)
+	n += binary.PutUvarint(buf[n:], uint64(len(e.Value)))
+	n += copy(buf[n:], e.Value)
+	n += binary.PutUvarint(buf[n:], e.ExpiresAt)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+// BuildStore 从r中读取按CompareKeys严格递增的entry，直接写成最底层的sst，在dir中生成可以正常Open的存储
+// entry不经过内存表与wal，sst按SSTableMaxSz切分，同一个user key的所有版本位于同一个sst中；所有sst写完后一次写入manifest
+// entry乱序时返回ErrImportOrder，出错时已经写出的sst被删除；dir中已经有存储时返回错误
+func BuildStore(dir string, opt Options, r io.Reader) error {
+	opt.WorkDir = dir
+	if err := opt.validate(); err != nil {
+		return errors.Wrap(err, "invalid options")
+	}
+	if _, err := os.Stat(filepath.Join(dir, utils.ManifestFilename)); err == nil {
+		return errors.Errorf("build store: %s already contains a store", dir)
+	}
+	lsm, err := openLSM(&opt)
+	if err != nil {
+		return errors.Wrapf(err, "build store %s", dir)
+	}
+	err = lsm.levels.buildFromReader(bufio.NewReader(r), opt.MaxLevelNum-1)
+	if _, cerr := lsm.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "build store %s", dir)
+}
+
+// buildFromReader 将r中的entry写成sst并加入level层
+func (lm *levelManager) buildFromReader(r *bufio.Reader, level int) error {
+	var (
+		tables  []*table
+		lastKey []byte
+		builder = newTableBuiler(lm.opt).forLevel(level)
+	)
+	fail := func(err error) error {
+		_ = decrRefs(tables)
+		return err
+	}
+	finish := func() error {
+		fid := atomic.AddUint64(&lm.maxFID, 1)
+		t := openTable(lm, lm.tablePath(fid), builder)
+		if t == nil {
+			return errors.Errorf("failed to build sst %d", fid)
+		}
+		tables = append(tables, t)
+		return nil
+	}
+	for n := 0; ; n++ {
+		e, err := readSortedEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(errors.Wrapf(err, "read entry %d", n))
+		}
+		if lastKey != nil && utils.CompareKeys(lastKey, e.Key) >= 0 {
+			return fail(errors.Wrapf(utils.ErrImportOrder, "entry %d key %q follows %q", n, e.Key, lastKey))
+		}
+		e = lm.opt.compressEntry(e)
+		if !builder.empty() && !utils.SameKey(e.Key, lastKey) && builder.wouldExceed(e) {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+			builder = newTableBuiler(lm.opt).forLevel(level)
+		}
+		lastKey = e.Key
+		builder.add(e, false)
+	}
+	if builder.empty() {
+		// 没有entry时只生成空的存储
+		return nil
+	}
+	if err := finish(); err != nil {
+		return fail(err)
+	}
+	if !lm.opt.DisableSyncDir {
+		if err := lm.syncTableDirs(tables); err != nil {
+			return fail(err)
+		}
+	}
+	return lm.addNonOverlapping(tables, level)
+}
+
+// readSortedEntry 读取WriteSortedEntry写入的一个entry，r中没有更多entry时返回io.EOF
+func readSortedEntry(r *bufio.Reader) (*utils.Entry, error) {
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readSortedField(r, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) <= 8 {
+		return nil, errors.Errorf("key %q has no version suffix", key)
+	}
+	valueLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	value, err := readSortedField(r, valueLen)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	e := utils.NewEntry(key, value)
+	e.ExpiresAt = expiresAt
+	return e, nil
+}
+
+func readSortedField(r *bufio.Reader, n uint64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf, nil
+}
+
+// unexpectedEOF entry读到一半时遇到的EOF说明输入被截断
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package lsm
+
+import (
+	"bytes"
+	"lsm/utils"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// column family的数据与默认空间共用memtable、wal与各个level，通过key前缀隔离
+// 前缀为 cfKeyPrefix + 1字节名字长度 + 名字，长度字节保证不同名字的前缀互不为前缀
+const (
+	cfKeyPrefix   = "\x00cf"
+	maxCFNameSize = math.MaxUint8
+)
+
+// ColumnFamily 一个独立的key空间，版本号与LSM共用同一个oracle
+type ColumnFamily struct {
+	lsm    *LSM
+	name   string
+	prefix []byte
+}
+
+// CF 返回名为name的column family，不需要事先创建
+// 注意默认空间的Set/Get不做隔离，不要直接写入以cfKeyPrefix开头的key
+func (lsm *LSM) CF(name string) *ColumnFamily {
+	utils.CondPanic(len(name) == 0 || len(name) > maxCFNameSize,
+		errors.Errorf("invalid column family name length %d", len(name)))
+	prefix := make([]byte, 0, len(cfKeyPrefix)+1+len(name))
+	prefix = append(prefix, cfKeyPrefix...)
+	prefix = append(prefix, byte(len(name)))
+	prefix = append(prefix, name...)
+	return &ColumnFamily{lsm: lsm, name: name, prefix: prefix}
+}
+
+// Name _
+func (cf *ColumnFamily) Name() string { return cf.name }
+
+// Entry 返回加上了前缀的entry副本，可以与其他column family的entry放进同一个WriteBatch原子写入
+func (cf *ColumnFamily) Entry(entry *utils.Entry) *utils.Entry {
+	e := *entry
+	e.Key = cf.key(entry.Key)
+	return &e
+}
+
+// Set 写入一个key中已经带有版本号的entry
+func (cf *ColumnFamily) Set(entry *utils.Entry) error {
+	return cf.lsm.Set(cf.Entry(entry))
+}
+
+// Put 写入user key，版本号由LSM共享的oracle分配
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	return cf.Set(utils.NewEntry(utils.KeyWithTs(key, cf.lsm.orc.newTs()), value))
+}
+
+// Get 与LSM.Get相同，返回的entry中的key不含前缀
+func (cf *ColumnFamily) Get(key []byte) (*utils.Entry, error) {
+	entry, err := cf.lsm.Get(cf.key(key))
+	if err != nil || entry == nil {
+		return entry, err
+	}
+	return cf.strip(entry), nil
+}
+
+// NewIterator 只遍历本column family中的key，返回的key不含前缀
+func (cf *ColumnFamily) NewIterator(opt *utils.Options) utils.Iterator {
+	return &cfIterator{iter: cf.lsm.NewIterator(opt), cf: cf}
+}
+
+func (cf *ColumnFamily) key(key []byte) []byte {
+	out := make([]byte, 0, len(cf.prefix)+len(key))
+	return append(append(out, cf.prefix...), key...)
+}
+
+func (cf *ColumnFamily) strip(entry *utils.Entry) *utils.Entry {
+	e := *entry
+	e.Key = entry.Key[len(cf.prefix):]
+	return &e
+}
+
+// cfIterator 在LSM的迭代器上过滤出带有前缀的key，超出前缀范围后即失效
+type cfIterator struct {
+	iter utils.Iterator
+	cf   *ColumnFamily
+}
+
+func (iter *cfIterator) Next() {
+	iter.iter.Next()
+}
+func (iter *cfIterator) Valid() bool {
+	return iter.iter.Valid() && bytes.HasPrefix(iter.iter.Item().Entry().Key, iter.cf.prefix)
+}
+
+// Rewind 定位到前缀下最小的key，前缀后追加最大版本号使它排在所有带前缀的key之前
+func (iter *cfIterator) Rewind() {
+	iter.iter.Seek(utils.KeyWithTs(iter.cf.prefix, math.MaxUint64))
+}
+func (iter *cfIterator) Item() utils.Item {
+	return &Item{e: iter.cf.strip(iter.iter.Item().Entry())}
+}
+func (iter *cfIterator) Close() error {
+	return iter.iter.Close()
+}
+func (iter *cfIterator) Seek(key []byte) {
+	iter.iter.Seek(iter.cf.key(key))
+}
@@ -0,0 +1,157 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lsm/file"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 复制sst时如果源目录的合并删掉了快照中的表，最多重新获取快照的次数
+const cloneRetryTimes = 5
+
+// afterCloneWals 复制完wal之后、获取manifest快照之前调用，测试中替换它来模拟期间的刷盘与合并
+var afterCloneWals = func() {}
+
+// CloneStore 将srcDir中的存储复制到dstDir，源存储可以同时在写入
+// 复制以某一时刻的manifest快照为准，只复制快照引用的sst，并由快照重新生成dstDir的manifest
+// 注意这里不能使用硬链接，因为删除sst时会先把文件截断，这会破坏副本中的数据
+func CloneStore(srcDir, dstDir string) error {
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return err
+	}
+	// 先复制wal再获取manifest快照，这样刷盘后被删除的wal数据一定已经在快照的sst中
+	walFids, err := cloneWalFiles(srcDir, dstDir)
+	if err != nil {
+		return err
+	}
+	afterCloneWals()
+
+	var manifest *file.Manifest
+	for i := 0; ; i++ {
+		if manifest, err = file.ReadManifest(srcDir); err != nil {
+			return errors.Wrapf(err, "while reading manifest of %s", srcDir)
+		}
+		err = cloneTables(srcDir, dstDir, manifest)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(errors.Cause(err)) || i >= cloneRetryTimes {
+			return err
+		}
+	}
+
+	// 清理之前重试中复制的、不再被快照引用的sst
+	for fid, path := range utils.LoadSSTPaths(dstDir) {
+		if _, ok := manifest.Tables[fid]; !ok {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	// 快照中已经包含了某个wal刷盘后的sst，副本中就不再需要这个wal，否则恢复时会产生fid冲突
+	// 刷盘后的sst可能在获取快照之前已经被合并掉，因此按快照记录的FlushedWal判断，回放这样的wal会用旧版本遮盖新的数据
+	for _, fid := range walFids {
+		if _, ok := manifest.Tables[fid]; ok || fid <= manifest.FlushedWal {
+			if err := os.Remove(filePath(dstDir, fid)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := file.WriteManifest(dstDir, manifest); err != nil {
+		return err
+	}
+	return utils.SyncDir(dstDir)
+}
+
+func cloneWalFiles(srcDir, dstDir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return nil, err
+	}
+	var fids []uint64
+	for _, info := range files {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), walFileExt) {
+			continue
+		}
+		var fid uint64
+		if _, err := fmt.Sscanf(info.Name(), "%d"+walFileExt, &fid); err != nil {
+			continue
+		}
+		if err := copyFile(filePath(srcDir, fid), filePath(dstDir, fid)); err != nil {
+			// 复制过程中wal被刷盘删除，它的数据会出现在之后获取的manifest快照里
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			return nil, err
+		}
+		fids = append(fids, fid)
+	}
+	return fids, nil
+}
+
+// cloneTables 复制快照引用的sst，副本中的sst与源目录使用相同的布局
+func cloneTables(srcDir, dstDir string, manifest *file.Manifest) error {
+	paths := utils.LoadSSTPaths(srcDir)
+	dirs := make(map[string]struct{})
+	for fid := range manifest.Tables {
+		src, ok := paths[fid]
+		if !ok {
+			return errors.Wrapf(os.ErrNotExist, "table %d in %s", fid, srcDir)
+		}
+		rel, err := filepath.Rel(srcDir, src)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstDir, rel)
+		if _, err := os.Stat(dst); err == nil {
+			// 上一次重试中已经复制过，sst文件在写完后不会再被修改
+			continue
+		}
+		if dir := filepath.Dir(dst); dir != filepath.Clean(dstDir) {
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				return err
+			}
+			dirs[dir] = struct{}{}
+		}
+		if err := copyFile(src, dst); err != nil {
+			_ = os.Remove(dst)
+			return err
+		}
+	}
+	// 工作目录本身由CloneStore最后sync
+	for dir := range dirs {
+		if err := utils.SyncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile 复制文件内容并同步到磁盘
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "while opening %s", src)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_TRUNC, utils.DefaultFileMode)
+	if err != nil {
+		return errors.Wrapf(err, "while creating %s", dst)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "while copying %s", filepath.Base(src))
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
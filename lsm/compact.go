@@ -9,6 +9,7 @@ import (
 	"lsm/utils"
 	"math"
 	"math/rand"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -23,6 +24,7 @@ type compactionPriority struct {
 	adjusted     float64
 	dropPrefixes [][]byte
 	t            targets
+	mergeSmall   bool // 在层内合并相邻的过小sst，见fillSmallTables
 }
 
 // 归并目标
@@ -48,6 +50,8 @@ type compactDef struct {
 	thisSize int64
 
 	dropPrefixes [][]byte
+	// dropExpired 目标层之下没有重叠的数据，可以丢弃已过期的entry
+	dropExpired bool
 }
 
 func (cd *compactDef) lockLevels() {
@@ -60,12 +64,86 @@ func (cd *compactDef) unlockLevels() {
 	cd.thisLevel.RUnlock()
 }
 
-// runCompacter 启动一个compacter
-func (lm *levelManager) runCompacter(id int) {
+// compacterPool 记录每个合并协程的退出信号，SetNumCompactors据此增减协程
+type compacterPool struct {
+	sync.Mutex
+	stops []chan struct{} // 第i个协程的退出信号
+	dones []chan struct{} // 第i个协程退出后关闭
+}
+
+// compactionPause 后台合并协程每次合并期间持有mu的读锁，暂停与恢复持有写锁，因此暂停会等到正在执行的合并完成
+// paused只在持有写锁时修改，读取使用原子操作：写锁等待期间新的读锁会阻塞，Stats不能因此等待整个合并
+type compactionPause struct {
+	mu     sync.RWMutex
+	paused int32
+}
+
+// runUnlessPaused 没有暂停时执行一次合并fn
+func (p *compactionPause) runUnlessPaused(fn func()) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.isPaused() {
+		fn()
+	}
+}
+
+func (p *compactionPause) set(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	p.mu.Lock()
+	atomic.StoreInt32(&p.paused, v)
+	p.mu.Unlock()
+}
+
+func (p *compactionPause) isPaused() bool {
+	return atomic.LoadInt32(&p.paused) == 1
+}
+
+// resizeCompacters 将合并协程调整为n个，多余的协程从编号最大的开始退出，0号协程总是最后退出
+// 协程只在两次合并之间检查退出信号，等到它们退出后返回，因此不会有level停在合并中途
+func (lm *levelManager) resizeCompacters(n int) {
+	select {
+	case <-lm.lsm.closer.Wait():
+		// 已经关闭，所有协程都已退出
+		return
+	default:
+	}
+	p := &lm.pool
+	p.Lock()
+	defer p.Unlock()
+	for len(p.stops) < n {
+		stop, done := make(chan struct{}), make(chan struct{})
+		lm.lsm.closer.Add(1)
+		atomic.AddInt32(&lm.compacters, 1)
+		go lm.runCompacter(len(p.stops), stop, done)
+		p.stops = append(p.stops, stop)
+		p.dones = append(p.dones, done)
+	}
+	var dones []chan struct{}
+	for len(p.stops) > n {
+		i := len(p.stops) - 1
+		close(p.stops[i])
+		dones = append(dones, p.dones[i])
+		p.stops, p.dones = p.stops[:i], p.dones[:i]
+	}
+	for _, done := range dones {
+		<-done
+	}
+}
+
+// runCompacter 启动一个compacter，stop关闭后完成手上的合并再退出，退出后关闭done
+func (lm *levelManager) runCompacter(id int, stop, done chan struct{}) {
+	defer close(done)
 	defer lm.lsm.closer.Done()
+	defer atomic.AddInt32(&lm.compacters, -1)
 	randomDelay := time.NewTimer(time.Duration(rand.Int31n(1000)) * time.Millisecond) //生成一个随机延迟的时间
 	select {
 	case <-randomDelay.C:
+	case <-stop:
+		randomDelay.Stop()
+		return
 	case <-lm.lsm.closer.Wait():
 		randomDelay.Stop()
 		return
@@ -76,7 +154,12 @@ func (lm *levelManager) runCompacter(id int) {
 		select {
 		// Can add a done channel or other stuff.
 		case <-ticker.C:
-			lm.runOnce(id)
+			lm.lsm.pause.runUnlessPaused(func() { lm.runOnce(id) })
+		case p := <-lm.repairCh:
+			// 暂停期间的读修复直接丢弃，之后的读取会再次调度
+			lm.lsm.pause.runUnlessPaused(func() { lm.run(id, p) })
+		case <-stop:
+			return
 		case <-lm.lsm.closer.Wait():
 			return
 		}
@@ -84,6 +167,10 @@ func (lm *levelManager) runCompacter(id int) {
 }
 
 func (lm *levelManager) runOnce(id int) bool {
+	// 只读状态下不再合并，保持已加载的sst不变
+	if lm.lsm.IsFrozen() != nil {
+		return false
+	}
 	prios := lm.pickCompactLevels() //选择参与压缩的层
 	if id == 0 {
 		// 0号协程 总是倾向于压缩L0层，即对L0层提权
@@ -134,13 +221,178 @@ func (lm *levelManager) run(id int, p compactionPriority) bool {
 	case utils.ErrFillTables:
 		// 什么也不做，此时合并过程被忽略
 	default:
-		log.Printf("[taskID:%d] While running doCompact: %v\n ", id, err)
+		lm.opt.Logger.Errorf("[taskID:%d] While running doCompact: %v", id, err)
 	}
 	return false
 }
 
 // doCompact 选择level的某些表合并到目标level
 func (lm *levelManager) doCompact(id int, p compactionPriority) error {
+	l := p.level
+	cd, err := lm.fillCompactDef(id, p)
+	if err != nil {
+		return err
+	}
+	// 完成合并后 从合并状态中删除
+	defer lm.compactState.delete(cd) // Remove the ranges from compaction status.
+
+	// 执行合并计划
+	if err := lm.runCompactDef(id, l, cd); err != nil {
+		atomic.AddInt64(&lm.compactStats.failed, 1)
+		// This compaction couldn't be done successfully.
+		lm.opt.Logger.Errorf("[Compactor: %d] LOG Compact FAILED with error: %+v: %+v", id, err, cd)
+		return err
+	}
+
+	lm.opt.Logger.Infof("[Compactor: %d] Compaction for level: %d DONE", id, cd.thisLevel.levelNum)
+	return nil
+}
+
+// compactTables 将指定的sst合并到下一层，这些sst必须位于同一层
+// L0中比选中的表更旧且key范围重叠的表也必须被选中，否则旧版本会留在更高的层中遮盖新版本
+// 其他层中选中的表必须是连续的
+func (lm *levelManager) compactTables(ids []uint64) error {
+	if len(ids) == 0 {
+		return errors.New("no table to compact")
+	}
+	selected := make(map[uint64]struct{}, len(ids))
+	level := -1
+	for _, id := range ids {
+		l := lm.tableLevel(id)
+		if l < 0 {
+			return fmt.Errorf("table %d not found", id)
+		}
+		if level >= 0 && l != level {
+			return fmt.Errorf("table %d is in level %d, others are in level %d", id, l, level)
+		}
+		level = l
+		selected[id] = struct{}{}
+	}
+
+	t := lm.levelTargets()
+	cd := compactDef{
+		compactorId: -1,
+		t:           t,
+		p:           compactionPriority{level: level, t: t},
+		thisLevel:   lm.levels[level],
+	}
+	switch {
+	case level == 0:
+		cd.nextLevel = lm.levels[t.baseLevel]
+	case cd.thisLevel.isLastLevel():
+		cd.nextLevel = cd.thisLevel
+	default:
+		cd.nextLevel = lm.levels[level+1]
+	}
+
+	if err := lm.fillSelectedTables(&cd, selected); err != nil {
+		return err
+	}
+	defer lm.compactState.delete(cd)
+	return lm.runCompactDef(-1, level, cd)
+}
+
+// tableLevel 返回sst所在的层，不存在时返回-1
+func (lm *levelManager) tableLevel(fid uint64) int {
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			if t.fid == fid {
+				lh.RUnlock()
+				return lh.levelNum
+			}
+		}
+		lh.RUnlock()
+	}
+	return -1
+}
+
+// findTable 返回fid对应的sst并增加引用，用完后需要DecrRef，不存在时返回nil
+func (lm *levelManager) findTable(fid uint64) *table {
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			if t.fid == fid {
+				t.IncrRef()
+				lh.RUnlock()
+				return t
+			}
+		}
+		lh.RUnlock()
+	}
+	return nil
+}
+
+// fillSelectedTables 用选中的表填充合并计划，并在合并状态中登记
+func (lm *levelManager) fillSelectedTables(cd *compactDef, selected map[uint64]struct{}) error {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	first, last := -1, -1
+	for i, t := range cd.thisLevel.tables {
+		if _, ok := selected[t.fid]; ok {
+			if first < 0 {
+				first = i
+			}
+			last = i
+			cd.top = append(cd.top, t)
+		}
+	}
+	if len(cd.top) != len(selected) {
+		return fmt.Errorf("tables %v are not all in level %d", tablesToString(cd.top), cd.thisLevel.levelNum)
+	}
+	cd.thisRange = getKeyRange(cd.top...)
+	if cd.thisLevel.levelNum == 0 {
+		for _, t := range cd.thisLevel.tables[:last] {
+			if _, ok := selected[t.fid]; !ok && cd.thisRange.overlapsWith(getKeyRange(t)) {
+				return fmt.Errorf("table %d is older than and overlaps with the selected tables", t.fid)
+			}
+		}
+	} else if last-first+1 != len(cd.top) {
+		return fmt.Errorf("tables in level %d must be adjacent", cd.thisLevel.levelNum)
+	}
+
+	if cd.thisLevel != cd.nextLevel {
+		left, right := cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+		cd.bot = make([]*table, right-left)
+		copy(cd.bot, cd.nextLevel.tables[left:right])
+	}
+	if len(cd.bot) == 0 {
+		cd.nextRange = cd.thisRange
+	} else {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+	for _, t := range cd.top {
+		cd.thisSize += t.Size()
+	}
+	if !lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+		return errors.New("tables are being compacted")
+	}
+	return nil
+}
+
+// isIdle 没有正在执行的合并，并且合并协程不会再选出新的合并任务
+func (lm *levelManager) isIdle() bool {
+	if lm.compactState.running() {
+		return false
+	}
+	if atomic.LoadInt32(&lm.compacters) == 0 {
+		return true
+	}
+	if len(lm.repairCh) > 0 {
+		return false
+	}
+	// 与runOnce的判断保持一致
+	for _, p := range lm.pickCompactLevels() {
+		if p.level == 0 || p.adjusted >= 1.0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fillCompactDef 根据优先级选出参与合并的表，成功时合并计划已经登记在compactState中
+func (lm *levelManager) fillCompactDef(id int, p compactionPriority) (compactDef, error) {
 	l := p.level
 	utils.CondPanic(l >= lm.opt.MaxLevelNum, errors.New("[doCompact] Sanity check. l >= lm.opt.MaxLevelNum")) // Sanity check.
 	if p.t.baseLevel == 0 {
@@ -155,11 +407,18 @@ func (lm *levelManager) doCompact(id int, p compactionPriority) error {
 		dropPrefixes: p.dropPrefixes,
 	}
 
+	if p.mergeSmall {
+		cd.nextLevel = cd.thisLevel
+		if !lm.fillSmallTables(&cd) {
+			return cd, utils.ErrFillTables
+		}
+		return cd, nil
+	}
 	// 如果是第0层 对齐单独填充处理
 	if l == 0 {
 		cd.nextLevel = lm.levels[p.t.baseLevel]
 		if !lm.fillTablesL0(&cd) {
-			return utils.ErrFillTables
+			return cd, utils.ErrFillTables
 		}
 	} else {
 		cd.nextLevel = cd.thisLevel
@@ -168,21 +427,10 @@ func (lm *levelManager) doCompact(id int, p compactionPriority) error {
 			cd.nextLevel = lm.levels[l+1]
 		}
 		if !lm.fillTables(&cd) {
-			return utils.ErrFillTables
+			return cd, utils.ErrFillTables
 		}
 	}
-	// 完成合并后 从合并状态中删除
-	defer lm.compactState.delete(cd) // Remove the ranges from compaction status.
-
-	// 执行合并计划
-	if err := lm.runCompactDef(id, l, cd); err != nil {
-		// This compaction couldn't be done successfully.
-		log.Printf("[Compactor: %d] LOG Compact FAILED with error: %+v: %+v", id, err, cd)
-		return err
-	}
-
-	log.Printf("[Compactor: %d] Compaction for level: %d DONE", id, cd.thisLevel.levelNum)
-	return nil
+	return cd, nil
 }
 
 // pickCompactLevel 选择合适的level执行合并，返回判断的优先级
@@ -235,7 +483,7 @@ func (lm *levelManager) pickCompactLevels() (prios []compactionPriority) {
 			out = append(out, p)
 		}
 	}
-	prios = out
+	prios = append(out, lm.fragmentPriorities(t)...)
 
 	// 按优先级排序
 	sort.Slice(prios, func(i, j int) bool {
@@ -387,6 +635,11 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 	if len(cd.splits) == 0 {
 		cd.splits = append(cd.splits, keyRange{})
 	}
+	// 过期的entry没有墓碑，更深的层中还有同一个key的旧版本时不能丢弃
+	if nextLevel.levelNum > 0 {
+		inputs := append(append([]*table{}, cd.top...), cd.bot...)
+		cd.dropExpired = !lm.checkOverlap(inputs, nextLevel.levelNum+1)
+	}
 
 	newTables, decr, err := lm.compactBuildTables(l, cd)
 	if err != nil {
@@ -398,11 +651,13 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 			err = decErr
 		}
 	}()
+	// 旧表在替换后会被删除，需要提前统计大小
+	bytesIn := tablesSize(cd.top) + tablesSize(cd.bot)
 	changeSet := buildChangeSet(&cd, newTables)
 
 	// 删除之前先更新manifest文件
 	if err := lm.manifestFile.AddChanges(changeSet.Changes); err != nil {
-		return err
+		return lm.lsm.freeze(err)
 	}
 
 	if err := nextLevel.replaceTables(cd.bot, newTables); err != nil {
@@ -413,6 +668,8 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 		return err
 	}
 
+	lm.compactStats.record(len(cd.top)+len(cd.bot), bytesIn, newTables)
+
 	from := append(tablesToString(cd.top), tablesToString(cd.bot)...)
 	to := tablesToString(newTables)
 	if dur := time.Since(timeStart); dur > 2*time.Second {
@@ -420,8 +677,8 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 		if dur > time.Second {
 			expensive = " [E]"
 		}
-		fmt.Printf("[%d]%s LOG Compact %d->%d (%d, %d -> %d tables with %d splits)."+
-			" [%s] -> [%s], took %v\n",
+		lm.opt.Logger.Infof("[%d]%s LOG Compact %d->%d (%d, %d -> %d tables with %d splits)."+
+			" [%s] -> [%s], took %v",
 			id, expensive, thisLevel.levelNum, nextLevel.levelNum, len(cd.top), len(cd.bot),
 			len(newTables), len(cd.splits), strings.Join(from, " "), strings.Join(to, " "),
 			dur.Round(time.Millisecond))
@@ -443,7 +700,7 @@ func tablesToString(tables []*table) []string {
 func buildChangeSet(cd *compactDef, newTables []*table) pb.ManifestChangeSet {
 	changes := []*pb.ManifestChange{}
 	for _, table := range newTables {
-		changes = append(changes, newCreateChange(table.fid, cd.nextLevel.levelNum))
+		changes = append(changes, newCreateChange(table, cd.nextLevel.levelNum))
 	}
 	for _, table := range cd.top {
 		changes = append(changes, newDeleteChange(table.fid))
@@ -462,12 +719,16 @@ func newDeleteChange(id uint64) *pb.ManifestChange {
 	}
 }
 
-// newCreateChange
-func newCreateChange(id uint64, level int) *pb.ManifestChange {
+// newCreateChange 将t加入level层，同时记录t的过期时间范围与创建时间
+func newCreateChange(t *table, level int) *pb.ManifestChange {
 	return &pb.ManifestChange{
-		Id:    id,
-		Op:    pb.ManifestChange_CREATE,
-		Level: uint32(level),
+		Id:           t.fid,
+		Op:           pb.ManifestChange_CREATE,
+		Level:        uint32(level),
+		MinExpiresAt: t.minExpiresAt,
+		MaxExpiresAt: t.maxExpiresAt,
+		CreatedAt:    t.createdAt,
+		Checksum:     t.checksum,
 	}
 }
 
@@ -503,10 +764,11 @@ func (lm *levelManager) compactBuildTables(lev int, cd compactDef) ([]*table, fu
 		}
 		// 开启一个协程去处理子压缩
 		go func(kr keyRange) {
-			defer inflightBuilders.Done(nil)
+			var err error
+			defer func() { inflightBuilders.Done(err) }()
 			it := NewMergeIterator(newIterator(), false)
 			defer it.Close()
-			lm.subcompact(it, kr, cd, inflightBuilders, res)
+			err = lm.subcompact(it, kr, cd, inflightBuilders, res)
 		}(kr)
 	}
 
@@ -528,9 +790,9 @@ func (lm *levelManager) compactBuildTables(lev int, cd compactDef) ([]*table, fu
 	// 等待所有的builder刷到磁盘
 	wg.Wait()
 
-	if err == nil {
+	if err == nil && !lm.opt.DisableSyncDir {
 		// 同步刷盘，保证数据一定落盘
-		err = utils.SyncDir(lm.opt.WorkDir)
+		err = lm.syncTableDirs(newTables)
 	}
 
 	if err != nil {
@@ -728,7 +990,11 @@ func (lm *levelManager) fillTablesL0ToLbase(cd *compactDef) bool {
 	return lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
 }
 
+// l0ToL0MinAge L0到L0的合并只选择创建时间超过它的sst，测试中调小
+var l0ToL0MinAge = 10 * time.Second
+
 // fillTablesL0ToL0 l0到l0压缩
+// 与compareAndAdd相同，L0已经有合并任务时不执行，成功时登记一个任务，由compactStatus.delete减去
 func (lm *levelManager) fillTablesL0ToL0(cd *compactDef) bool {
 	if cd.compactorId != 0 {
 		// 只要0号压缩处理器可以执行，避免l0tol0的资源竞争
@@ -748,6 +1014,10 @@ func (lm *levelManager) fillTablesL0ToL0(cd *compactDef) bool {
 	lm.compactState.Lock()
 	defer lm.compactState.Unlock()
 
+	thisLevel := lm.compactState.levels[cd.thisLevel.levelNum]
+	if thisLevel.jobs > 0 {
+		return false
+	}
 	top := cd.thisLevel.tables
 	var out []*table
 	now := time.Now()
@@ -756,8 +1026,8 @@ func (lm *levelManager) fillTablesL0ToL0(cd *compactDef) bool {
 			// 在L0 to L0 的压缩过程中，不要对过大的sst文件压缩，这会造成性能抖动
 			continue
 		}
-		if now.Sub(*t.GetCreatedAt()) < 10*time.Second {
-			// 如果sst的创建时间不足10s 也不要回收
+		if now.Sub(*t.GetCreatedAt()) < l0ToL0MinAge {
+			// 如果sst的创建时间不足l0ToL0MinAge 也不要回收
 			continue
 		}
 		// 如果当前的sst 已经在压缩状态 也应该忽略
@@ -775,8 +1045,9 @@ func (lm *levelManager) fillTablesL0ToL0(cd *compactDef) bool {
 	cd.top = out
 
 	// 在这个过程中避免任何l0到其他层的合并，防止系统抖动
-	thisLevel := lm.compactState.levels[cd.thisLevel.levelNum]
 	thisLevel.ranges = append(thisLevel.ranges, infRange)
+	thisLevel.delSize += cd.thisSize
+	thisLevel.jobs++
 	for _, t := range out {
 		lm.compactState.tables[t.fid] = struct{}{}
 	}
@@ -820,9 +1091,12 @@ func iteratorsReversed(th []*table, opt *utils.Options) []utils.Iterator {
 }
 
 // 真正执行并行压缩的子压缩文件
+// 读取sst失败时返回错误，而不是把缺少数据的结果当作合并完成，已经生成的sst由调用方删除
 func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef,
-	inflightBuilders *utils.Throttle, res chan<- *table) {
+	inflightBuilders *utils.Throttle, res chan<- *table) error {
 	var lastKey []byte
+	// skipKey 当前key最新的版本已过期，这个key视为不存在，丢弃它的所有版本
+	var skipKey bool
 	addKeys := func(builder *tableBuilder) {
 		var tableKr keyRange
 		for ; it.Valid(); it.Next() {
@@ -840,6 +1114,7 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 				}
 				// 把当前的key变为 lastKey
 				lastKey = utils.SafeCopy(lastKey, key)
+				skipKey = cd.dropExpired && isExpired
 				//umVersions = 0
 				// 如果左边界没有，则当前key给到左边界
 				if len(tableKr.left) == 0 {
@@ -851,6 +1126,8 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 			// TODO 这里要区分值的指针
 			// 判断是否是过期内容，是的话就删除
 			switch {
+			case skipKey || (cd.dropExpired && isExpired):
+				// 直接丢弃
 			case isExpired:
 				builder.AddStaleKey(it.Item().Entry())
 			default:
@@ -873,7 +1150,7 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 		}
 		// 拼装table创建的参数
 		// TODO 这里可能要大改，对open table的参数复制一份opt
-		builder := newTableBuilerWithSSTSize(lm.opt, cd.t.fileSz[cd.nextLevel.levelNum])
+		builder := newTableBuilerWithSSTSize(lm.opt, cd.t.fileSz[cd.nextLevel.levelNum]).forLevel(cd.nextLevel.levelNum)
 
 		// This would do the iteration and add keys to builder.
 		addKeys(builder)
@@ -897,7 +1174,7 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 			var tbl *table
 			newFID := atomic.AddUint64(&lm.maxFID, 1) // compact的时候是没有memtable的，这里自增maxFID即可。
 			// TODO 这里的sst文件需要根据level大小变化
-			sstName := utils.SSTableFullPath(lm.opt.WorkDir, newFID)
+			sstName := lm.tablePath(newFID)
 			tbl = openTable(lm, sstName, builder)
 			if tbl == nil {
 				return
@@ -905,6 +1182,7 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 			res <- tbl
 		}(builder)
 	}
+	return iterError(it)
 }
 
 // checkOverlap 检查是否与下一层存在重合
@@ -924,6 +1202,25 @@ func (lm *levelManager) checkOverlap(tables []*table, lev int) bool {
 	return false
 }
 
+// syncTableDirs sync新建的sst所在的目录，分片布局下每个子目录只sync一次
+func (lm *levelManager) syncTableDirs(tables []*table) error {
+	if lm.opt.SSTableLayout == utils.SSTableLayoutFlat {
+		return lm.opt.FileRetry.DoSync(func() error { return utils.SyncDir(lm.opt.WorkDir) })
+	}
+	synced := make(map[string]struct{})
+	for _, t := range tables {
+		dir := filepath.Dir(lm.tablePath(t.fid))
+		if _, ok := synced[dir]; ok {
+			continue
+		}
+		if err := lm.opt.FileRetry.DoSync(func() error { return utils.SyncDir(dir) }); err != nil {
+			return err
+		}
+		synced[dir] = struct{}{}
+	}
+	return nil
+}
+
 // 判断是否过期 是可删除
 func isDeletedOrExpired(meta byte, expiresAt uint64) bool {
 	if expiresAt == 0 {
@@ -950,6 +1247,13 @@ func (lsm *LSM) newCompactStatus() *compactStatus {
 	return cs
 }
 
+// running 是否有sst正处于合并中
+func (cs *compactStatus) running() bool {
+	cs.RLock()
+	defer cs.RUnlock()
+	return len(cs.tables) > 0
+}
+
 func (cs *compactStatus) overlapsWith(level int, this keyRange) bool {
 	cs.RLock()
 	defer cs.RUnlock()
@@ -974,6 +1278,10 @@ func (cs *compactStatus) delete(cd compactDef) {
 	nextLevel := cs.levels[cd.nextLevel.levelNum]
 
 	thisLevel.delSize -= cd.thisSize
+	thisLevel.jobs--
+	if nextLevel != thisLevel {
+		nextLevel.jobs--
+	}
 	found := thisLevel.remove(cd.thisRange)
 	// The following check makes sense only if we're compacting more than one
 	// table. In case of the max level, we might rewrite a single table to
@@ -1016,6 +1324,10 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 	if nextLevel.overlapsWith(cd.nextRange) {
 		return false
 	}
+	// 每一层同时只参与一个合并任务，其他compacter选择别的层或者空闲
+	if thisLevel.jobs > 0 || nextLevel.jobs > 0 {
+		return false
+	}
 	// Check whether this level really needs compaction or not. Otherwise, we'll end up
 	// running parallel compactions for the same level.
 	// Update: We should not be checking size here. Compaction priority already did the size checks.
@@ -1024,6 +1336,10 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 	thisLevel.ranges = append(thisLevel.ranges, cd.thisRange)
 	nextLevel.ranges = append(nextLevel.ranges, cd.nextRange)
 	thisLevel.delSize += cd.thisSize
+	thisLevel.jobs++
+	if nextLevel != thisLevel {
+		nextLevel.jobs++
+	}
 	for _, t := range append(cd.top, cd.bot...) {
 		cs.tables[t.fid] = struct{}{} //tables的作用是记录当前处于压缩状态的sst文件有哪些
 	}
@@ -1034,6 +1350,7 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 type levelCompactStatus struct {
 	ranges  []keyRange
 	delSize int64
+	jobs    int // 涉及这一层的合并任务数量，作为源层或目标层
 }
 
 func (lcs *levelCompactStatus) overlapsWith(dst keyRange) bool {
@@ -0,0 +1,86 @@
+package lsm
+
+import (
+	"bytes"
+	"lsm/pb"
+	"lsm/utils"
+
+	"github.com/pkg/errors"
+)
+
+// KeyPosition entry在sst中的位置
+type KeyPosition struct {
+	Block       int    // block的序号
+	BlockOffset uint32 // block在文件中的偏移
+	EntryOffset int    // entry在解密后的block数据中的偏移
+}
+
+// DuplicateKey 同一个sst中出现了两次的(user key, 版本号)
+type DuplicateKey struct {
+	Level     int
+	TableID   uint64
+	Key       []byte // user key
+	Version   uint64
+	First     KeyPosition
+	Duplicate KeyPosition
+}
+
+// CheckNoDuplicates 扫描所有sst，返回每个sst内部重复出现的(key, 版本号)，用于确认合并是否写出了重复的entry
+// key有序时重复的entry一定相邻，这里只与前一个entry比较；乱序的sst先用CheckSSTableOrder检查
+// 不同sst之间的重复是正常的，例如重叠的L0 sst，不在检查范围内
+func (lsm *LSM) CheckNoDuplicates() ([]DuplicateKey, error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	var dups []DuplicateKey
+	for level, lh := range lsm.levels.levels {
+		lh.RLock()
+		tables := append([]*table{}, lh.tables...)
+		for _, t := range tables {
+			t.IncrRef()
+		}
+		lh.RUnlock()
+		var err error
+		for _, t := range tables {
+			if err == nil {
+				dups, err = t.checkDuplicates(level, dups)
+			}
+			_ = t.DecrRef()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dups, nil
+}
+
+// checkDuplicates 将t中与前一个entry的key和版本号都相同的entry追加到dups
+func (t *table) checkDuplicates(level int, dups []DuplicateKey) ([]DuplicateKey, error) {
+	it := t.NewIterator(&utils.Options{IsAsc: true, KeysOnly: true}).(*tableIterator)
+	defer it.Close()
+	var (
+		prev    []byte
+		prevPos KeyPosition
+	)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := it.Error(); err != nil {
+			return nil, errors.Wrapf(err, "check duplicates of table %d", t.fid)
+		}
+		var ko pb.BlockOffset
+		t.offsets(&ko, it.blockPos)
+		pos := KeyPosition{Block: it.blockPos, BlockOffset: ko.GetOffset(), EntryOffset: it.bi.pos}
+		key := it.Item().Entry().Key
+		if prev != nil && bytes.Equal(prev, key) {
+			dups = append(dups, DuplicateKey{
+				Level:     level,
+				TableID:   t.fid,
+				Key:       utils.Copy(utils.ParseKey(key)),
+				Version:   utils.ParseTs(key),
+				First:     prevPos,
+				Duplicate: pos,
+			})
+		}
+		prev = append(prev[:0], key...)
+		prevPos = pos
+	}
+	return dups, nil
+}
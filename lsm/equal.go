@@ -0,0 +1,98 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"lsm/utils"
+)
+
+// StoresEqual 按user key升序比较两个存储中每个key最新版本的value，忽略版本号，用于校验复制或迁移的结果
+// 已过期的key视为不存在；不相同时返回false与第一个不同的user key的说明
+// 读取sst的block失败或value无法解压时返回错误
+func StoresEqual(a, b *LSM) (bool, string, error) {
+	ia, ib := newLiveIterator(a), newLiveIterator(b)
+	defer ia.close()
+	defer ib.close()
+	for ia.valid || ib.valid {
+		switch {
+		case !ib.valid || (ia.valid && bytes.Compare(ia.key, ib.key) < 0):
+			return false, fmt.Sprintf("key %q only in the first store", ia.key), nil
+		case !ia.valid || bytes.Compare(ia.key, ib.key) > 0:
+			return false, fmt.Sprintf("key %q only in the second store", ib.key), nil
+		case !bytes.Equal(ia.value, ib.value):
+			return false, fmt.Sprintf("key %q has value %q in the first store and %q in the second", ia.key, ia.value, ib.value), nil
+		}
+		ia.next()
+		ib.next()
+	}
+	for _, it := range []*liveIterator{ia, ib} {
+		if err := it.iter.(*Iterator).Error(); err != nil {
+			return false, "", err
+		}
+	}
+	return true, "", nil
+}
+
+// CountKeys 返回存储中有效的user key数量：每个key只按最新版本计数，最新版本已过期的key不计入
+// 需要遍历全部key，只适合离线校验，例如迁移之后与源数据核对；只读取key与过期时间，不解码value
+// 有block损坏时返回错误而不是少计的结果
+func (lsm *LSM) CountKeys() (uint64, error) {
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true, KeysOnly: true})
+	defer iter.Close()
+	var (
+		n    uint64
+		last []byte
+	)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		key := utils.ParseKey(e.Key)
+		// 同一个user key的版本从新到旧排列，只看最新的版本
+		if last != nil && bytes.Equal(key, last) {
+			continue
+		}
+		last = append(last[:0], key...)
+		if !isDeletedOrExpired(e.Meta, e.ExpiresAt) {
+			n++
+		}
+	}
+	if err := iter.(*Iterator).Error(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// liveIterator 依次返回每个user key最新且没有过期的版本
+type liveIterator struct {
+	iter  utils.Iterator
+	key   []byte
+	value []byte
+	valid bool
+}
+
+func newLiveIterator(lsm *LSM) *liveIterator {
+	it := &liveIterator{iter: lsm.NewIterator(&utils.Options{IsAsc: true})}
+	it.iter.Rewind()
+	it.next()
+	return it
+}
+
+// next 读出当前user key最新的版本并跳过它的其余版本，最新版本已过期时继续下一个key
+func (it *liveIterator) next() {
+	it.valid = false
+	for it.iter.Valid() {
+		e := it.iter.Item().Entry()
+		key := utils.Copy(utils.ParseKey(e.Key))
+		value := utils.Copy(e.Value)
+		expired := isDeletedOrExpired(0, e.ExpiresAt)
+		for it.iter.Next(); it.iter.Valid() && bytes.Equal(utils.ParseKey(it.iter.Item().Entry().Key), key); it.iter.Next() {
+		}
+		if !expired {
+			it.key, it.value, it.valid = key, value, true
+			return
+		}
+	}
+}
+
+func (it *liveIterator) close() {
+	_ = it.iter.Close()
+}
@@ -0,0 +1,76 @@
+package lsm
+
+import "time"
+
+// FlushPolicy 内存表的刷盘策略，任意一个阈值满足时切换内存表并刷盘，为0的阈值不生效
+// 阈值在每次写入前与后台定时检查，一批写入不会被拆开，因此内存表可能超出MaxBytes或MaxEntries一批的量
+// 无论策略如何，内存表的大小都不会超过MemTableSize
+type FlushPolicy struct {
+	MaxBytes   int64
+	MaxAge     time.Duration // 内存表中最早的一次写入超过MaxAge后刷盘
+	MaxEntries int
+	// CheckInterval 后台检查的周期，为0时使用MaxAge的四分之一，最少10毫秒
+	CheckInterval time.Duration
+}
+
+const minFlushCheckInterval = 10 * time.Millisecond
+
+func (p *FlushPolicy) enabled() bool {
+	return p.MaxBytes > 0 || p.MaxAge > 0 || p.MaxEntries > 0
+}
+
+func (p *FlushPolicy) interval() time.Duration {
+	d := p.CheckInterval
+	if d <= 0 {
+		d = p.MaxAge / 4
+	}
+	if d < minFlushCheckInterval {
+		d = minFlushCheckInterval
+	}
+	return d
+}
+
+// shouldFlush 判断内存表是否达到了任意一个阈值，空的内存表不需要刷盘
+func (p *FlushPolicy) shouldFlush(mt *memTable) bool {
+	if mt.entries == 0 {
+		return false
+	}
+	return (p.MaxBytes > 0 && int64(mt.wal.Size()) >= p.MaxBytes) ||
+		(p.MaxEntries > 0 && mt.entries >= p.MaxEntries) ||
+		(p.MaxAge > 0 && time.Since(mt.firstWrite) >= p.MaxAge)
+}
+
+// applyFlushPolicy 当前内存表达到阈值时切换，需要持有写锁
+// 被切换的内存表会在之后的set中刷盘
+func (lsm *LSM) applyFlushPolicy() error {
+	if lsm.IsFrozen() == nil && lsm.option.FlushPolicy.shouldFlush(lsm.memTable) {
+		return lsm.rotate()
+	}
+	return nil
+}
+
+// runFlushPolicy 定时检查刷盘策略，这样没有新的写入时内存表也能按时刷盘
+func (lsm *LSM) runFlushPolicy() {
+	defer lsm.closer.Done()
+	ticker := time.NewTicker(lsm.option.FlushPolicy.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := lsm.checkFlushPolicy(); err != nil {
+				lsm.option.Logger.Errorf("flush by policy: %v", err)
+			}
+		case <-lsm.closer.Wait():
+			return
+		}
+	}
+}
+
+func (lsm *LSM) checkFlushPolicy() error {
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	if err := lsm.applyFlushPolicy(); err != nil {
+		return err
+	}
+	return lsm.flushImmutables()
+}
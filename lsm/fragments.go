@@ -0,0 +1,72 @@
+package lsm
+
+// smallTableDivisor 小于BaseTableSize/smallTableDivisor的sst视为过小
+const smallTableDivisor = 4
+
+func (lm *levelManager) isSmallTable(t *table) bool {
+	return t.Size()*smallTableDivisor < lm.opt.BaseTableSize
+}
+
+// smallTableRuns 返回lh中由至少两个相邻的过小sst组成的区间[start, end)，以及这些区间中sst的总数
+// 单独一个过小的sst无法与相邻的sst合并，不计算在内
+func (lm *levelManager) smallTableRuns(_ levelHandlerRLocked, lh *levelHandler) (runs [][2]int, n int) {
+	start := -1
+	for i := 0; i <= len(lh.tables); i++ {
+		if i < len(lh.tables) && lm.isSmallTable(lh.tables[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start >= 2 {
+			runs = append(runs, [2]int{start, i})
+			n += i - start
+		}
+		start = -1
+	}
+	return runs, n
+}
+
+// fragmentPriorities 相邻的过小sst达到MaxSmallTables的层，在层内合并这些sst，与跨层的合并互不影响
+// 得分为过小sst的数量与MaxSmallTables的比值
+func (lm *levelManager) fragmentPriorities(t targets) []compactionPriority {
+	if lm.opt.MaxSmallTables <= 0 {
+		return nil
+	}
+	var prios []compactionPriority
+	// L0中的sst按新旧排列而不是按key，由L0到L0的合并处理
+	for i := 1; i < len(lm.levels); i++ {
+		lh := lm.levels[i]
+		lh.RLock()
+		_, n := lm.smallTableRuns(levelHandlerRLocked{}, lh)
+		lh.RUnlock()
+		if n >= lm.opt.MaxSmallTables {
+			score := float64(n) / float64(lm.opt.MaxSmallTables)
+			prios = append(prios, compactionPriority{level: i, score: score, adjusted: score, t: t, mergeSmall: true})
+		}
+	}
+	return prios
+}
+
+// fillSmallTables 选出第一组没有在合并中的相邻过小sst，合并为大小接近BaseTableSize的sst后放回同一层
+// 这些sst都放在cd.bot中，替换时一次完成，读取不会看到新旧sst同时存在
+func (lm *levelManager) fillSmallTables(cd *compactDef) bool {
+	lh := cd.thisLevel
+	lh.RLock()
+	defer lh.RUnlock()
+
+	runs, _ := lm.smallTableRuns(levelHandlerRLocked{}, lh)
+	cd.t.fileSz = append([]int64{}, cd.t.fileSz...)
+	cd.t.fileSz[lh.levelNum] = lm.opt.BaseTableSize
+	for _, run := range runs {
+		cd.top = nil
+		cd.bot = append([]*table{}, lh.tables[run[0]:run[1]]...)
+		cd.thisRange = getKeyRange(cd.bot...)
+		cd.nextRange = cd.thisRange
+		cd.thisSize = tablesSize(cd.bot)
+		if lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+			return true
+		}
+	}
+	return false
+}
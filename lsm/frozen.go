@@ -0,0 +1,41 @@
+package lsm
+
+import "lsm/utils"
+
+// frozenError 进入只读状态的原因，errors.Is既能匹配utils.ErrStoreFrozen，也能匹配底层的写入错误
+type frozenError struct {
+	err error
+}
+
+func (e *frozenError) Error() string {
+	return "store is frozen: " + e.err.Error()
+}
+
+func (e *frozenError) Is(target error) bool {
+	return target == utils.ErrStoreFrozen
+}
+
+func (e *frozenError) Unwrap() error {
+	return e.err
+}
+
+// IsFrozen 存储因持久化写入失败进入只读状态时返回原因，否则返回nil
+// 只读状态下所有写入都返回这个错误，已经加载的内存表与sst继续服务读取，重新打开后才能恢复写入
+func (lsm *LSM) IsFrozen() error {
+	if v := lsm.frozen.Load(); v != nil {
+		return v.(*frozenError)
+	}
+	return nil
+}
+
+// freeze 持久化写入失败时进入只读状态，返回包装后的错误，err为nil时不做任何事
+// 只记录第一次失败的原因
+func (lsm *LSM) freeze(err error) error {
+	if err == nil {
+		return nil
+	}
+	if lsm.frozen.CompareAndSwap(nil, &frozenError{err: err}) {
+		lsm.option.Logger.Errorf("store is frozen, rejecting writes: %v", err)
+	}
+	return lsm.IsFrozen()
+}
@@ -0,0 +1,77 @@
+package lsm
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// healthImmutablesBacklog 等待刷盘的内存表达到这个数量时认为刷盘跟不上
+// 正常情况下刷盘在写入时同步完成，immutables堆积通常意味着刷盘变慢或者失败
+const healthImmutablesBacklog = 2
+
+// HealthState 存储整体的可用性
+type HealthState int
+
+const (
+	HealthOK          HealthState = iota
+	HealthDegraded                // 仍然接受写入，但写入被限速或刷盘积压
+	HealthUnavailable             // 写入被拒绝或阻塞，读取仍然可用
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthDegraded:
+		return "degraded"
+	case HealthUnavailable:
+		return "unavailable"
+	}
+	return "ok"
+}
+
+// Health 健康检查的结果
+type Health struct {
+	State    HealthState
+	Writable bool     // 写入是否会被接受而不阻塞
+	Reasons  []string // 降级或不可用的原因，正常时为空
+
+	NumImmutables int // 等待刷盘的内存表数量
+	L0Tables      int
+	WriteStall    WriteStallState
+}
+
+// Health 汇总只读状态、存储空间、刷盘积压与L0积压，作为健康检查的就绪信号
+// 只读取原子变量与L0的表数量，不会获取写锁，可以频繁调用
+func (lsm *LSM) Health() Health {
+	h := Health{
+		Writable:      true,
+		NumImmutables: int(atomic.LoadInt32(&lsm.numImmutables)),
+		L0Tables:      lsm.levels.levels[0].numTables(),
+		WriteStall:    lsm.writeStallState(),
+	}
+	unavailable := func(reason string) {
+		h.State, h.Writable = HealthUnavailable, false
+		h.Reasons = append(h.Reasons, reason)
+	}
+	degraded := func(reason string) {
+		if h.State == HealthOK {
+			h.State = HealthDegraded
+		}
+		h.Reasons = append(h.Reasons, reason)
+	}
+	if err := lsm.IsFrozen(); err != nil {
+		unavailable(err.Error())
+	}
+	if atomic.LoadInt32(&lsm.storeFull) != 0 {
+		unavailable(fmt.Sprintf("store size exceeds MaxStoreSize %d", lsm.option.MaxStoreSize))
+	}
+	switch h.WriteStall {
+	case WriteStallStopped:
+		unavailable(fmt.Sprintf("writes stopped: %d L0 tables, stop threshold %d", h.L0Tables, lsm.option.L0StopThreshold))
+	case WriteStallDelayed:
+		degraded(fmt.Sprintf("writes delayed: %d L0 tables, stall threshold %d", h.L0Tables, lsm.option.L0StallThreshold))
+	}
+	if h.NumImmutables >= healthImmutablesBacklog {
+		degraded(fmt.Sprintf("%d memtables waiting to be flushed", h.NumImmutables))
+	}
+	return h
+}
@@ -8,8 +8,16 @@ import (
 )
 
 type Iterator struct {
-	it    Item
-	iters []utils.Iterator
+	iter utils.Iterator
+	opt  *Options
+	lsm  *LSM       // Close时离开gate，为nil表示已经关闭
+	item utils.Item // 当前位置解压后的entry，移动时清空
+	meta byte       // 当前entry保存时的meta
+	err  error
+	// 创建时的数据来源，Clone据此创建相同的迭代器
+	iterOpt *utils.Options
+	mts     []*memTable // 从新到旧
+	tables  [][]*table  // 每一层的sst，Close之前一直持有引用
 }
 type Item struct {
 	e *utils.Entry
@@ -19,43 +27,161 @@ func (it *Item) Entry() *utils.Entry {
 	return it.e
 }
 
-// 创建迭代器
+// NewIterator 创建合并了内存表与所有level的迭代器，同一个key的多个版本按从新到旧的顺序返回
+// 目前只支持升序遍历，设置了FilterLevels时只合并指定level的数据
+// 迭代器在Close之前阻止SwapFrom替换数据
 func (lsm *LSM) NewIterator(opt *utils.Options) utils.Iterator {
-	iter := &Iterator{}
-	iter.iters = make([]utils.Iterator, 0)
-	iter.iters = append(iter.iters, lsm.memTable.NewIterator(opt))
-	for _, imm := range lsm.immutables {
-		iter.iters = append(iter.iters, imm.NewIterator(opt))
+	lsm.gate.enter()
+	iterOpt := &utils.Options{
+		IsAsc:        true,
+		KeysOnly:     opt.KeysOnly,
+		FilterLevels: opt.FilterLevels,
+		MinLevel:     opt.MinLevel,
+		MaxLevel:     opt.MaxLevel,
 	}
-	iter.iters = append(iter.iters, lsm.levels.NewIterator(opt))
-	return iter
+	it := &Iterator{opt: lsm.option, lsm: lsm, iterOpt: iterOpt}
+	if iterOpt.LevelInRange(-1) {
+		it.mts = lsm.memTables()
+	}
+	it.tables = lsm.levels.pinTables(iterOpt)
+	it.iter = it.merge()
+	return it
+}
+
+// merge 用创建时的数据来源生成合并迭代器，越新的数据越靠前，合并时相同的key优先使用前面的迭代器
+func (iter *Iterator) merge() utils.Iterator {
+	var iters []utils.Iterator
+	for _, mt := range iter.mts {
+		iters = append(iters, mt.NewIterator(iter.iterOpt))
+	}
+	for level, tables := range iter.tables {
+		if level == 0 {
+			iters = append(iters, iteratorsReversed(tables, iter.iterOpt)...)
+		} else if len(tables) > 0 {
+			iters = append(iters, NewConcatIterator(tables, iter.iterOpt))
+		}
+	}
+	return NewMergeIterator(iters, false)
+}
+
+// Clone 返回一个独立的迭代器，与iter使用相同的内存表与sst，并另外持有这些sst的引用，两者可以分别Seek、分别Close
+// 新的迭代器位于iter当前的位置，iter无效时需要先Seek或Rewind；可以在不同的协程中并行使用，例如把key空间分段扫描
+// 与NewIterator不同，Clone不会因为等待中的SwapFrom阻塞，iter结束之前替换不会开始；iter不能已经关闭
+func (iter *Iterator) Clone() *Iterator {
+	iter.lsm.gate.join()
+	clone := &Iterator{opt: iter.opt, lsm: iter.lsm, iterOpt: iter.iterOpt, mts: iter.mts, tables: iter.tables}
+	for _, tables := range clone.tables {
+		for _, t := range tables {
+			t.IncrRef()
+		}
+	}
+	clone.iter = clone.merge()
+	if iter.Valid() {
+		clone.Seek(iter.iter.Item().Entry().Key)
+	}
+	return clone
 }
 func (iter *Iterator) Next() {
-	iter.iters[0].Next()
+	iter.item = nil
+	iter.iter.Next()
+	iter.skipFiltered()
 }
 func (iter *Iterator) Valid() bool {
-	return iter.iters[0].Valid()
+	return iter.iter.Valid()
 }
 func (iter *Iterator) Rewind() {
-	iter.iters[0].Rewind()
+	iter.item = nil
+	iter.iter.Rewind()
+	iter.skipFiltered()
+}
+
+// skipFiltered 跳过不在KeyFilter范围内的key
+func (iter *Iterator) skipFiltered() {
+	for iter.Valid() && !iter.opt.acceptKey(iter.iter.Item().Entry().Key) {
+		iter.iter.Next()
+	}
 }
+
+// Item 当前的entry，Version为这个entry自己的版本号，压缩过的value已经解压
+// 解压失败时entry中保留压缩后的value，错误由Error返回；KeysOnly时没有value，Meta保留压缩标记
 func (iter *Iterator) Item() utils.Item {
-	return iter.iters[0].Item()
+	if iter.item == nil {
+		item := iter.iter.Item()
+		e := item.Entry()
+		e.Version = utils.ParseTs(e.Key)
+		iter.meta = e.Meta
+		if iter.iterOpt.KeysOnly {
+			iter.item = item
+			return item
+		}
+		if err := e.Decompress(); err != nil && iter.err == nil {
+			iter.err = err
+		}
+		iter.item = item
+	}
+	return iter.item
 }
-func (iter *Iterator) Close() error {
+
+// Error 返回遍历过程中第一个解压value的错误，或者读取sst的block时遇到的错误，出错的sst不再返回entry
+func (iter *Iterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iterError(iter.iter)
+}
+
+// iterError 返回迭代器读取sst时遇到的错误，内存表的迭代器没有错误
+func iterError(it utils.Iterator) error {
+	if e, ok := it.(interface{ Error() error }); ok {
+		return e.Error()
+	}
 	return nil
 }
 
+// Version 当前entry的版本号，同一个key的每个版本分别返回各自的版本号
+// NewIterator返回的迭代器可以断言为*Iterator后调用
+func (iter *Iterator) Version() uint64 {
+	return utils.ParseTs(iter.iter.Item().Entry().Key)
+}
+
+// Meta 当前entry保存时的标记位，BitValueCompressed表示value在存储中是压缩的，Item返回的value已经解压
+// 存储目前没有墓碑与value指针
+func (iter *Iterator) Meta() byte {
+	iter.Item()
+	return iter.meta
+}
+func (iter *Iterator) Close() error {
+	err := iter.iter.Close()
+	for _, tables := range iter.tables {
+		if derr := decrRefs(tables); err == nil {
+			err = derr
+		}
+	}
+	iter.tables = nil
+	if iter.lsm != nil {
+		iter.lsm.gate.leave()
+		iter.lsm = nil
+	}
+	return err
+}
+
 func (iter *Iterator) Seek(key []byte) {
+	iter.item = nil
+	iter.iter.Seek(key)
+	iter.skipFiltered()
 }
 
 // 内存表迭代器
 type memIterator struct {
-	innerIter utils.Iterator
+	innerIter *utils.SkipListIter
+	keysOnly  bool
 }
 
 func (m *memTable) NewIterator(opt *utils.Options) utils.Iterator {
-	return &memIterator{innerIter: m.sl.NewSkipListIterator()}
+	return &memIterator{
+		innerIter: m.sl.NewSkipListIterator().(*utils.SkipListIter),
+		keysOnly:  opt.KeysOnly,
+	}
 }
 func (iter *memIterator) Next() {
 	iter.innerIter.Next()
@@ -67,39 +193,36 @@ func (iter *memIterator) Rewind() {
 	iter.innerIter.Rewind()
 }
 func (iter *memIterator) Item() utils.Item {
+	if iter.keysOnly {
+		e := iter.innerIter.Item().Entry()
+		return &Item{e: &utils.Entry{Key: e.Key, ExpiresAt: e.ExpiresAt, Meta: e.Meta}}
+	}
 	return iter.innerIter.Item()
 }
 func (iter *memIterator) Close() error {
 	return iter.innerIter.Close()
 }
 func (iter *memIterator) Seek(key []byte) {
+	iter.innerIter.Seek(key)
 }
 
-// levelManager上的迭代器
-type levelIterator struct {
-	it    *utils.Item
-	iters []*Iterator
-}
-
-func (lm *levelManager) NewIterator(options *utils.Options) utils.Iterator {
-	return &levelIterator{}
-}
-func (iter *levelIterator) Next() {
-}
-func (iter *levelIterator) Valid() bool {
-	return false
-}
-func (iter *levelIterator) Rewind() {
-
-}
-func (iter *levelIterator) Item() utils.Item {
-	return &Item{}
-}
-func (iter *levelIterator) Close() error {
-	return nil
-}
-
-func (iter *levelIterator) Seek(key []byte) {
+// pinTables 返回每个level上的sst并增加引用，跳过的level为空
+// L0的sst之间有重叠，合并时按从新到旧的顺序各自创建迭代器，其他层使用ConcatIterator
+// 跳过不在opt指定范围内的level
+func (lm *levelManager) pinTables(opt *utils.Options) [][]*table {
+	tables := make([][]*table, len(lm.levels))
+	for _, lh := range lm.levels {
+		if !opt.LevelInRange(lh.levelNum) {
+			continue
+		}
+		lh.RLock()
+		tables[lh.levelNum] = append([]*table{}, lh.tables...)
+		for _, t := range lh.tables {
+			t.IncrRef()
+		}
+		lh.RUnlock()
+	}
+	return tables
 }
 
 // ConcatIterator 将table 数组链接成一个迭代器，这样迭代效率更高
@@ -112,7 +235,12 @@ type ConcatIterator struct {
 }
 
 // NewConcatIterator creates a new concatenated iterator
+// 每个sst的迭代器在遍历到它时才创建，因此创建时先为所有sst增加引用，Close时释放
+// 这样遍历期间被合并删除的sst，文件会推迟到Close之后才删除；调用方需要在持有level读锁时创建
 func NewConcatIterator(tbls []*table, opt *utils.Options) *ConcatIterator {
+	for _, t := range tbls {
+		t.IncrRef()
+	}
 	iters := make([]utils.Iterator, len(tbls))
 	return &ConcatIterator{
 		options: opt,
@@ -139,7 +267,7 @@ func (s *ConcatIterator) Rewind() {
 	if len(s.iters) == 0 {
 		return
 	}
-	if !s.options.IsAsc {
+	if s.options.IsAsc {
 		s.setIdx(0)
 	} else {
 		s.setIdx(len(s.iters) - 1)
@@ -147,9 +275,17 @@ func (s *ConcatIterator) Rewind() {
 	s.cur.Rewind()
 }
 
-// Valid implements y.Interface
+// Valid 当前sst读取block失败时返回false，错误由Error返回
 func (s *ConcatIterator) Valid() bool {
-	return s.cur != nil && s.cur.Valid()
+	return s.cur != nil && s.cur.Valid() && iterError(s.cur) == nil
+}
+
+// Error 返回当前sst读取block时遇到的错误，出错之后不再继续遍历后面的sst
+func (s *ConcatIterator) Error() error {
+	if s.cur == nil {
+		return nil
+	}
+	return iterError(s.cur)
 }
 
 // Item _
@@ -185,10 +321,11 @@ func (s *ConcatIterator) Next() {
 	s.cur.Next()
 	if s.cur.Valid() {
 		// Nothing to do. Just stay with the current table.
+		// 读取失败时同样停在当前的sst，Valid返回false
 		return
 	}
 	for { // In case there are empty tables.
-		if !s.options.IsAsc {
+		if s.options.IsAsc {
 			s.setIdx(s.idx + 1)
 		} else {
 			s.setIdx(s.idx - 1)
@@ -214,7 +351,9 @@ func (s *ConcatIterator) Close() error {
 			return fmt.Errorf("ConcatIterator:%+v", err)
 		}
 	}
-	return nil
+	tables := s.tables
+	s.iters, s.tables = nil, nil
+	return decrRefs(tables)
 }
 
 // MergeIterator 多路合并迭代器
@@ -261,7 +400,7 @@ func (n *node) setKey() {
 			n.entry = n.concat.Item().Entry()
 		}
 	default:
-		n.valid = n.iter.Valid()
+		n.valid = n.iter.Valid() && iterError(n.iter) == nil
 		if n.valid {
 			n.entry = n.iter.Item().Entry()
 		}
@@ -388,6 +527,14 @@ func (mi *MergeIterator) Item() utils.Item {
 	return mi.small.iter.Item()
 }
 
+// Error 返回两侧读取sst时遇到的第一个错误，出错的一侧不再参与合并
+func (mi *MergeIterator) Error() error {
+	if err := iterError(mi.left.iter); err != nil {
+		return err
+	}
+	return iterError(mi.right.iter)
+}
+
 // Close implements Iterator.
 func (mi *MergeIterator) Close() error {
 	err1 := mi.left.iter.Close()
@@ -402,7 +549,8 @@ func (mi *MergeIterator) Close() error {
 func NewMergeIterator(iters []utils.Iterator, reverse bool) utils.Iterator {
 	switch len(iters) {
 	case 0:
-		return &Iterator{}
+		// 没有数据源时返回一个空的迭代器
+		return NewConcatIterator(nil, &utils.Options{IsAsc: !reverse})
 	case 1:
 		return iters[0]
 	case 2:
@@ -4,31 +4,68 @@ import (
 	"bytes"
 	"lsm/file"
 	file2 "lsm/file/osFile"
+	"lsm/pb"
 	"lsm/utils"
+	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
-func (lsm *LSM) initLevelManager(opt *lsmOptions) *levelManager {
+// initLevelManager 打开manifest并加载其中的sst，失败时返回错误
+func (lsm *LSM) initLevelManager(opt *Options) (*levelManager, error) {
 	lm := &levelManager{lsm: lsm}
 	lm.compactState = lsm.newCompactStatus()
 	lm.opt = opt
+	if opt.ReadRepair {
+		lm.repairCh = make(chan compactionPriority, 16)
+	}
+	if opt.SSTableLayout == utils.SSTableLayoutSharded {
+		if err := createSSTableShards(opt.WorkDir); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := lm.loadManifest(); err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := lm.build(); err != nil {
+		_ = lm.close()
+		return nil, err
 	}
-	lm.build()
-	return lm
+	return lm, nil
+}
+
+// createSSTableShards 创建分片布局的所有子目录，之后新建sst时不必再检查目录是否存在
+func createSSTableShards(dir string) error {
+	for shard := 0; shard < 256; shard++ {
+		if err := os.MkdirAll(utils.SSTableShardPath(dir, shard), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tablePath 按配置的布局返回新建sst的路径
+func (lm *levelManager) tablePath(fid uint64) string {
+	return lm.opt.SSTableLayout.Path(lm.opt.WorkDir, fid)
 }
 
 type levelManager struct {
 	maxFID       uint64 // 已经分配出去的最大fid，只要创建了memtable 就算已分配
-	opt          *lsmOptions
+	opt          *Options
 	manifestFile *file.ManifestFile
 	levels       []*levelHandler
 	lsm          *LSM
 	compactState *compactStatus
+	compactStats compactStats
+	repairCh     chan compactionPriority // 读修复调度的合并任务，未开启ReadRepair时为nil
+	compacters   int32                   // 正在运行的合并协程数量
+	pool         compacterPool
+	backups      backupHolds
 }
 
 func (lm *levelManager) close() error {
@@ -44,27 +81,216 @@ func (lm *levelManager) close() error {
 }
 
 func (lm *levelManager) Get(key []byte) (*utils.Entry, error) {
-	var (
-		entry *utils.Entry
-		err   error
-	)
-	// L0层查询
-	if entry, err = lm.levels[0].Get(key); entry != nil {
-		return entry, err
+	return lm.get(key, &ReadStats{})
+}
+
+// get 与Get相同，查找过的sst与读取的block记录在stats中
+func (lm *levelManager) get(key []byte, stats *ReadStats) (*utils.Entry, error) {
+	entry, level, t, err := lm.locate(key, stats)
+	if entry != nil {
+		stats.Level, stats.TableID = level, t.fid
+		lm.readRepair(key, level)
+	}
+	return entry, err
+}
+
+// locate 从L0开始逐层查找key，同时返回命中的level与sst，没有找到时level为-1
+func (lm *levelManager) locate(key []byte, stats *ReadStats) (*utils.Entry, int, *table, error) {
+	for level := 0; level < lm.opt.MaxLevelNum; level++ {
+		entry, t, err := lm.levels[level].search(key, stats)
+		if entry != nil {
+			return entry, level, t, err
+		}
+		if !lm.ignoreReadError(err) {
+			return nil, -1, nil, err
+		}
+	}
+	return nil, -1, nil, utils.ErrKeyNotFound
+}
+
+// version 查找key的最新版本，deleted表示该版本已经删除或过期，L0中的sst互相重叠，需要比较所有包含该key的sst
+func (lm *levelManager) version(seekKey []byte) (maxTs uint64, deleted, found bool, err error) {
+	l0 := lm.levels[0]
+	l0.RLock()
+	tables := append([]*table{}, l0.tables...)
+	l0.RUnlock()
+	for _, t := range tables {
+		ts, del, ok, err := t.version(seekKey)
+		if !lm.ignoreReadError(err) {
+			return 0, false, false, err
+		}
+		if ok && ts > maxTs {
+			maxTs, deleted, found = ts, del, true
+		}
+	}
+	if found {
+		return maxTs, deleted, true, nil
 	}
-	// L1-7层查询
 	for level := 1; level < lm.opt.MaxLevelNum; level++ {
-		ld := lm.levels[level]
-		if entry, err = ld.Get(key); entry != nil {
-			return entry, err
+		lh := lm.levels[level]
+		lh.RLock()
+		t := lh.getTable(seekKey)
+		lh.RUnlock()
+		if t == nil {
+			continue
+		}
+		ts, del, ok, err := t.version(seekKey)
+		if !lm.ignoreReadError(err) {
+			return 0, false, false, err
+		}
+		if ok {
+			return ts, del, true, nil
+		}
+	}
+	return 0, false, false, nil
+}
+
+// ignoreReadError 判断查询sst时遇到的错误能否忽略
+// 开启BestEffortRead时，sst损坏只记录日志，继续在更旧的sst中查找可读的版本；ErrReadAmpExceeded不是损坏，不能忽略
+func (lm *levelManager) ignoreReadError(err error) bool {
+	if err == nil || err == utils.ErrKeyNotFound {
+		return true
+	}
+	if !lm.opt.BestEffortRead || err == utils.ErrReadAmpExceeded {
+		return false
+	}
+	lm.opt.Logger.Warnf("best effort read skips corrupted table: %v", err)
+	return true
+}
+
+// readRepair 在level及更低的层中有多个sst可能包含该key时，调度一次该层的合并来消除旧版本
+// 这里只检查内存中的key范围与布隆过滤器，调度失败时直接放弃，不会阻塞读取
+func (lm *levelManager) readRepair(key []byte, level int) {
+	if lm.repairCh == nil {
+		return
+	}
+	var n int
+	for i := level; i < len(lm.levels); i++ {
+		n += lm.levels[i].numMayContain(key)
+	}
+	if n < 2 {
+		return
+	}
+	p := compactionPriority{level: level, score: 1, adjusted: 1, t: lm.levelTargets()}
+	select {
+	case lm.repairCh <- p:
+	default:
+	}
+}
+
+// verify 校验所有level中sst的block
+func (lm *levelManager) verify() error {
+	for _, lh := range lm.levels {
+		lh.RLock()
+		tables := append([]*table{}, lh.tables...)
+		lh.RUnlock()
+		for _, t := range tables {
+			if err := t.verify(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTableOrder 检查每个sst中的key是否有序，开启RepairSSTableOrder时用重新排序后的sst替换乱序的sst
+// 修复时会分配新的fid，因此需要在recovery确定maxFID之后调用
+func (lm *levelManager) checkTableOrder() error {
+	if !lm.opt.CheckSSTableOrder && !lm.opt.RepairSSTableOrder {
+		return nil
+	}
+	for _, lh := range lm.levels {
+		lh.RLock()
+		tables := append([]*table{}, lh.tables...)
+		lh.RUnlock()
+		for _, t := range tables {
+			err := t.checkOrder()
+			if err == nil {
+				continue
+			}
+			if errors.Cause(err) != utils.ErrSSTableOrder || !lm.opt.RepairSSTableOrder {
+				return err
+			}
+			lm.opt.Logger.Warnf("repair sstable order: %v", err)
+			if err := lm.repairOrder(lh, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// repairOrder 将sst中的entry排序后写入新的sst，并通过manifest替换原来的sst，完全相同的key只保留一个
+func (lm *levelManager) repairOrder(lh *levelHandler, t *table) error {
+	var entries []*utils.Entry
+	it := t.NewIterator(&utils.Options{IsAsc: true}).(*tableIterator)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := it.Error(); err != nil {
+			it.Close()
+			return err
+		}
+		e := it.Item().Entry()
+		entries = append(entries, &utils.Entry{
+			Key:       utils.Copy(e.Key),
+			Value:     utils.Copy(e.Value),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+		})
+	}
+	it.Close()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return utils.CompareKeys(entries[i].Key, entries[j].Key) < 0
+	})
+
+	builder := newTableBuiler(lm.opt).forLevel(lh.levelNum)
+	for i, e := range entries {
+		if i > 0 && utils.CompareKeys(entries[i-1].Key, e.Key) == 0 {
+			continue
 		}
+		builder.add(e, false)
 	}
-	return entry, utils.ErrKeyNotFound
+	fid := atomic.AddUint64(&lm.maxFID, 1)
+	newTable := openTable(lm, lm.tablePath(fid), builder)
+	if newTable == nil {
+		return errors.Errorf("repair sstable order: failed to build table %d", fid)
+	}
+	defer newTable.DecrRef()
+	if err := lm.manifestFile.AddChanges([]*pb.ManifestChange{
+		newCreateChange(newTable, lh.levelNum),
+		newDeleteChange(t.fid),
+	}); err != nil {
+		return err
+	}
+	return lh.replaceTables([]*table{t}, []*table{newTable})
+}
+
+// totalSize 所有level中sst文件的总大小
+func (lm *levelManager) totalSize() int64 {
+	var size int64
+	for _, lh := range lm.levels {
+		size += lh.getTotalSize()
+	}
+	return size
 }
 
 func (lm *levelManager) loadManifest() (err error) {
-	lm.manifestFile, err = file.OpenManifestFile(&file2.FileOption{WorkDir: lm.opt.WorkDir})
-	return err
+	lm.manifestFile, err = file.OpenManifestFile(&file2.FileOption{
+		WorkDir:        lm.opt.WorkDir,
+		Logger:         lm.opt.Logger,
+		DisableSyncDir: lm.opt.DisableSyncDir,
+
+		IgnoreUnknownManifestOps: lm.opt.IgnoreUnknownManifestOps,
+		TrashDir:                 lm.opt.trashDir(),
+		Retry:                    lm.opt.FileRetry,
+	})
+	if err != nil {
+		return err
+	}
+	lm.manifestFile.SetSyncPolicy(lm.opt.ManifestSyncPolicy)
+	if lm.opt.ManifestBackupInterval > 0 {
+		return lm.manifestFile.SetBackupInterval(lm.opt.ManifestBackupInterval)
+	}
+	return nil
 }
 
 func (lm *levelManager) build() error {
@@ -79,19 +305,45 @@ func (lm *levelManager) build() error {
 
 	manifest := lm.manifestFile.GetManifest()
 	// 对比 manifest文件的正确性
-	if err := lm.manifestFile.RevertToManifest(utils.LoadSSTIdMap(lm.opt.WorkDir)); err != nil {
+	paths := utils.LoadSSTPaths(lm.opt.WorkDir)
+	report, err := lm.manifestFile.RevertToManifest(paths,
+		file.RevertToManifestOpts{DeleteOrphans: lm.opt.DeleteOrphans})
+	if err != nil {
 		return err
 	}
 
 	var maxFID uint64
+	// 孤儿sst即使已经删除也不再复用它们的fid
+	for _, orphan := range report.Orphans {
+		if orphan.ID > maxFID {
+			maxFID = orphan.ID
+		}
+	}
 	for fid, tableInfo := range manifest.Tables {
-		filePath := utils.SSTableFullPath(lm.opt.WorkDir, fid)
+		filePath, ok := paths[fid]
+		if !ok {
+			filePath = lm.tablePath(fid)
+		}
 		if fid > maxFID {
 			maxFID = fid
 		}
-		t := openTable(lm, filePath, nil)
+		t, err := loadTable(lm, filePath, nil)
+		if err != nil {
+			// sst的footer或索引损坏时无法定位任何数据，BestEffortRead下跳过这个sst，其中的数据不可见
+			if !lm.opt.BestEffortRead {
+				return errors.Wrapf(err, "open table %d", fid)
+			}
+			lm.opt.Logger.Warnf("skip table %d: %v", fid, err)
+			continue
+		}
+		t.minExpiresAt, t.maxExpiresAt = tableInfo.MinExpiresAt, tableInfo.MaxExpiresAt
+		t.checksum = tableInfo.Checksum
+		// 没有记录创建时间的旧manifest仍然使用文件的时间
+		if t.createdAt = tableInfo.CreatedAt; t.createdAt != 0 {
+			createdAt := time.Unix(int64(t.createdAt), 0)
+			t.ss.SetCreatedAt(&createdAt)
+		}
 		lm.levels[tableInfo.Level].add(t)
-		lm.levels[tableInfo.Level].addSize(t) // 记录一个level的文件总大小
 	}
 	// 对每一层进行排序
 	for i := 0; i < lm.opt.MaxLevelNum; i++ {
@@ -104,28 +356,214 @@ func (lm *levelManager) build() error {
 
 // 向L0层flush一个sstable
 func (lm *levelManager) flush(immutable *memTable) (err error) {
-	// 分配一个fid
-	fid := immutable.wal.Fid()
-	sstName := utils.SSTableFullPath(lm.opt.WorkDir, fid)
+	return lm.flushToLevel(immutable, 0)
+}
+
+// flushToLevel 将内存表写成sst后直接放入level层
+// level大于0时内存表的key范围不能与0到level层中已有的sst重叠，否则返回ErrFlushOverlap
+func (lm *levelManager) flushToLevel(immutable *memTable, level int) (err error) {
+	tables, err := lm.buildFlushTables(immutable, level)
+	if err != nil {
+		return err
+	}
+	return lm.installFlushed(tables, level)
+}
 
-	// 构建一个 builder
-	builder := newTableBuiler(lm.opt)
+// buildFlushed 刷盘时在内存中生成sst的入口，测试时替换它来观察并发刷盘
+var buildFlushed = (*levelManager).splitFlushTables
+
+// buildFlushBatch 为每个immutable生成sst，多于一个时并发生成，结果与错误按imms的顺序返回
+// 切分出的sst的fid在所有builder生成之后按imms的顺序分配，与逐个刷盘时相同，不受并发的先后影响
+func (lm *levelManager) buildFlushBatch(imms []*memTable) ([][]*table, []error) {
+	tables := make([][]*table, len(imms))
+	errs := make([]error, len(imms))
+	if len(imms) == 1 {
+		builders := buildFlushed(lm, imms[0], 0)
+		tables[0], errs[0] = lm.writeFlushTables(imms[0], builders, lm.flushFids(imms[0], len(builders)))
+		return tables, errs
+	}
+	builders := make([][]*tableBuilder, len(imms))
+	parallel := func(fn func(i int)) {
+		var wg sync.WaitGroup
+		for i := range imms {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				fn(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+	parallel(func(i int) { builders[i] = buildFlushed(lm, imms[i], 0) })
+	fids := make([][]uint64, len(imms))
+	for i, imm := range imms {
+		fids[i] = lm.flushFids(imm, len(builders[i]))
+	}
+	parallel(func(i int) { tables[i], errs[i] = lm.writeFlushTables(imms[i], builders[i], fids[i]) })
+	return tables, errs
+}
+
+// installFlushed 将刷盘生成的sst写入manifest并加入level层，调用方需要按immutables的顺序调用
+func (lm *levelManager) installFlushed(tables []*table, level int) (err error) {
+	if level == 0 {
+		if err = lm.registerFlushed(tables, 0); err != nil {
+			return err
+		}
+		for _, t := range tables {
+			lm.levels[0].add(t)
+		}
+	} else if err = lm.addNonOverlapping(tables, level); err != nil {
+		return err
+	}
+	atomic.AddInt64(&lm.compactStats.flushes, 1)
+	atomic.AddInt64(&lm.compactStats.flushBytes, tablesSize(tables))
+	if lm.opt.OnFlushComplete != nil {
+		for _, t := range tables {
+			lm.lsm.flushEvents = append(lm.lsm.flushEvents, flushEvent{
+				fid:    t.fid,
+				minKey: utils.Copy(t.ss.MinKey()),
+				maxKey: utils.Copy(t.ss.MaxKey()),
+			})
+		}
+	}
+	return
+}
+
+// buildFlushTables 将内存表写成sst，数据块超过SSTableMaxSz时在两个user key之间切分出新的sst
+// 同一个key的所有版本总是位于同一个sst中，第一个sst沿用wal的fid，其余的分配新的fid
+func (lm *levelManager) buildFlushTables(immutable *memTable, level int) ([]*table, error) {
+	builders := lm.splitFlushTables(immutable, level)
+	return lm.writeFlushTables(immutable, builders, lm.flushFids(immutable, len(builders)))
+}
+
+// splitFlushTables 将内存表中的entry依次加入builder，加入下一个user key会超过SSTableMaxSz时换一个新的builder
+func (lm *levelManager) splitFlushTables(immutable *memTable, level int) []*tableBuilder {
+	var (
+		builders []*tableBuilder
+		lastKey  []byte
+		builder  = newTableBuiler(lm.opt).forLevel(level)
+	)
 	iter := immutable.sl.NewSkipListIterator()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		entry := iter.Item().Entry()
+		if !builder.empty() && !utils.SameKey(entry.Key, lastKey) && builder.wouldExceed(entry) {
+			builders = append(builders, builder)
+			builder = newTableBuiler(lm.opt).forLevel(level)
+		}
+		lastKey = utils.SafeCopy(lastKey, entry.Key)
 		builder.add(entry, false)
 	}
-	// 创建一个 table 对象
-	table := openTable(lm, sstName, builder)
-	err = lm.manifestFile.AddTableMeta(0, &file.TableMeta{
-		ID:       fid,
-		Checksum: []byte{'m', 'o', 'c', 'k'},
+	return append(builders, builder)
+}
+
+// flushFids 第一个sst沿用wal的fid，其余n-1个依次分配新的fid
+func (lm *levelManager) flushFids(immutable *memTable, n int) []uint64 {
+	fids := []uint64{immutable.wal.Fid()}
+	for len(fids) < n {
+		fids = append(fids, atomic.AddUint64(&lm.maxFID, 1))
+	}
+	return fids
+}
+
+// writeFlushTables 将builders写成fids对应的sst，任何一个失败时删除已经写出的sst
+func (lm *levelManager) writeFlushTables(immutable *memTable, builders []*tableBuilder, fids []uint64) ([]*table, error) {
+	tables := make([]*table, 0, len(builders))
+	for i, builder := range builders {
+		t := openTable(lm, lm.tablePath(fids[i]), builder)
+		if t == nil {
+			_ = decrRefs(tables)
+			return nil, errors.Errorf("flush memtable %d: failed to build sst %d", immutable.wal.Fid(), fids[i])
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// registerFlushed 将刷盘生成的sst在同一个change set中写入manifest，失败时删除这些sst，内存表保留在原处继续服务读取
+// 第一个sst使用内存表的fid，change set中同时记录这个wal已经刷盘，内存表按fid的顺序刷盘
+func (lm *levelManager) registerFlushed(tables []*table, level int) error {
+	if err := lm.manifestFile.AddFlushedTables(level, lm.flushedMetas(tables), tables[0].fid); err != nil {
+		_ = decrRefs(tables)
+		return errors.Wrapf(err, "flush memtable %d", tables[0].fid)
+	}
+	return nil
+}
+
+// flushedMetas 刷盘生成的sst写入manifest的元数据
+func (lm *levelManager) flushedMetas(tables []*table) []*file.TableMeta {
+	metas := make([]*file.TableMeta, 0, len(tables))
+	for _, t := range tables {
+		metas = append(metas, &file.TableMeta{
+			ID:           t.fid,
+			Checksum:     t.checksum,
+			MaxVersion:   lm.lsm.checkpointVersion(t),
+			MinExpiresAt: t.minExpiresAt,
+			MaxExpiresAt: t.maxExpiresAt,
+			CreatedAt:    t.createdAt,
+		})
+	}
+	return metas
+}
+
+// flushFiltered 将内存表回放时跳过的entry写成L0的sst，全部使用新分配的fid
+// 不记录wal已经刷盘，wal随内存表刷盘删除之前崩溃时再次回放，写出的entry与已有的完全相同
+func (lm *levelManager) flushFiltered(immutable *memTable) error {
+	builders := lm.splitFlushTables(&memTable{sl: immutable.filtered}, 0)
+	fids := make([]uint64, 0, len(builders))
+	for range builders {
+		fids = append(fids, atomic.AddUint64(&lm.maxFID, 1))
+	}
+	tables, err := lm.writeFlushTables(immutable, builders, fids)
+	if err != nil {
+		return err
+	}
+	if err := lm.manifestFile.AddTableMetas(0, lm.flushedMetas(tables)); err != nil {
+		_ = decrRefs(tables)
+		return errors.Wrapf(err, "flush filtered keys of wal %d", immutable.wal.Fid())
+	}
+	lm.levels[0].addBatch(tables)
+	return nil
+}
+
+// addNonOverlapping 检查重叠后将tables加入level层
+// 检查与加入在同一次加锁内完成，上面各层持有读锁，避免合并在两者之间向level写入重叠的sst
+func (lm *levelManager) addNonOverlapping(tables []*table, level int) error {
+	for _, lh := range lm.levels[:level] {
+		lh.RLock()
+		defer lh.RUnlock()
+	}
+	lh := lm.levels[level]
+	lh.Lock()
+	defer lh.Unlock()
+	kr := getKeyRange(tables...)
+	overlap := lm.compactState.overlapsWith(level, kr)
+	for _, upper := range lm.levels[:level] {
+		for _, ut := range upper.tables {
+			overlap = overlap || getKeyRange(ut).overlapsWith(kr)
+		}
+	}
+	left, right := lh.overlappingTables(levelHandlerRLocked{}, kr)
+	if overlap || right > left {
+		_ = decrRefs(tables)
+		return errors.Wrapf(utils.ErrFlushOverlap, "flush memtable %d to level %d", tables[0].fid, level)
+	}
+	if err := lm.registerFlushed(tables, level); err != nil {
+		return err
+	}
+	lh.tables = append(lh.tables, tables...)
+	for _, t := range tables {
+		lh.addSize(t)
+	}
+	sort.Slice(lh.tables, func(i, j int) bool {
+		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[j].ss.MinKey()) < 0
 	})
-	// manifest写入失败直接panic
-	utils.Panic(err)
-	// 更新manifest文件
-	lm.levels[0].add(table)
-	return
+	return nil
+}
+
+// flushEvent 一次完成的刷盘，由写锁的持有者记录
+type flushEvent struct {
+	fid            uint64
+	minKey, maxKey []byte
 }
 
 //--------- level处理器 -------
@@ -138,18 +576,30 @@ type levelHandler struct {
 	lm             *levelManager
 }
 
+// close 关闭level中所有sst的文件与mmap，不删除文件，之后不能再读取这些sst
 func (lh *levelHandler) close() error {
+	lh.RLock()
+	defer lh.RUnlock()
+	for _, t := range lh.tables {
+		if err := t.ss.Close(); err != nil {
+			return errors.Wrapf(err, "close table %d", t.fid)
+		}
+	}
 	return nil
 }
 func (lh *levelHandler) add(t *table) {
 	lh.Lock()
 	defer lh.Unlock()
 	lh.tables = append(lh.tables, t)
+	lh.addSize(t) // 记录一个level的文件总大小
 }
 func (lh *levelHandler) addBatch(ts []*table) {
 	lh.Lock()
 	defer lh.Unlock()
 	lh.tables = append(lh.tables, ts...)
+	for _, t := range ts {
+		lh.addSize(t)
+	}
 }
 
 func (lh *levelHandler) getTotalSize() int64 {
@@ -174,16 +624,32 @@ func (lh *levelHandler) numTables() int {
 	return len(lh.tables)
 }
 
+// numMayContain 可能包含key的sst数量
+func (lh *levelHandler) numMayContain(key []byte) int {
+	lh.RLock()
+	defer lh.RUnlock()
+	var n int
+	for _, t := range lh.tables {
+		if t.mayContain(key) {
+			n++
+		}
+	}
+	return n
+}
+
 func (lh *levelHandler) Get(key []byte) (*utils.Entry, error) {
+	entry, _, err := lh.search(key, &ReadStats{})
+	return entry, err
+}
+
+// search 与Get相同，同时返回命中的sst
+func (lh *levelHandler) search(key []byte, stats *ReadStats) (*utils.Entry, *table, error) {
 	// 如果是第0层文件则进行特殊处理
 	if lh.levelNum == 0 {
-		// TODO：logic...
 		// 获取可能存在key的sst
-		return lh.searchL0SST(key)
-	} else {
-		// TODO：logic...
-		return lh.searchLNSST(key)
+		return lh.searchL0SST(key, stats)
 	}
+	return lh.searchLNSST(key, stats)
 }
 
 func (lh *levelHandler) Sort() {
@@ -202,31 +668,37 @@ func (lh *levelHandler) Sort() {
 	}
 }
 
-func (lh *levelHandler) searchL0SST(key []byte) (*utils.Entry, error) {
+func (lh *levelHandler) searchL0SST(key []byte, stats *ReadStats) (*utils.Entry, *table, error) {
 	var version uint64
 	for _, table := range lh.tables {
-		if entry, err := table.Serach(key, &version); err == nil {
-			return entry, nil
+		entry, err := table.Serach(key, &version, stats)
+		if err == nil {
+			return entry, table, nil
+		}
+		if !lh.lm.ignoreReadError(err) {
+			return nil, nil, err
 		}
 	}
-	return nil, utils.ErrKeyNotFound
+	return nil, nil, utils.ErrKeyNotFound
 }
-func (lh *levelHandler) searchLNSST(key []byte) (*utils.Entry, error) {
+func (lh *levelHandler) searchLNSST(key []byte, stats *ReadStats) (*utils.Entry, *table, error) {
 	table := lh.getTable(key)
 	var version uint64
 	if table == nil {
-		return nil, utils.ErrKeyNotFound
+		return nil, nil, utils.ErrKeyNotFound
 	}
-	if entry, err := table.Serach(key, &version); err == nil {
-		return entry, nil
-	}
-	return nil, utils.ErrKeyNotFound
+	entry, err := table.Serach(key, &version, stats)
+	return entry, table, err
 }
+
+// getTable 按user key查找范围覆盖key的sst，这样查询时key中的版本号不必与sst边界上的版本一致
+// 同一个key的版本可能跨越两个相邻的sst，较新的版本在前一个sst中
 func (lh *levelHandler) getTable(key []byte) *table {
-	for i := len(lh.tables) - 1; i >= 0; i-- {
-		if bytes.Compare(key, lh.tables[i].ss.MinKey()) > -1 &&
-			bytes.Compare(key, lh.tables[i].ss.MaxKey()) < 1 {
-			return lh.tables[i]
+	userKey := utils.ParseKey(key)
+	for _, t := range lh.tables {
+		if bytes.Compare(userKey, utils.ParseKey(t.ss.MinKey())) > -1 &&
+			bytes.Compare(userKey, utils.ParseKey(t.ss.MaxKey())) < 1 {
+			return t
 		}
 	}
 	return nil
@@ -247,8 +719,9 @@ func (lh *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (i
 	left := sort.Search(len(lh.tables), func(i int) bool {
 		return utils.CompareKeys(kr.left, lh.tables[i].ss.MaxKey()) <= 0
 	})
+	// 第一个最小key大于范围右边界的sst，它及之后的sst都不重叠
 	right := sort.Search(len(lh.tables), func(i int) bool {
-		return utils.CompareKeys(kr.right, lh.tables[i].ss.MaxKey()) < 0
+		return utils.CompareKeys(kr.right, lh.tables[i].ss.MinKey()) < 0
 	})
 	return left, right
 }
@@ -285,7 +758,11 @@ func (lh *levelHandler) replaceTables(toDel, toAdd []*table) error {
 	// Assign tables.
 	lh.tables = newTables
 	sort.Slice(lh.tables, func(i, j int) bool {
-		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[i].ss.MinKey()) < 0
+		// L0按fid保持新旧顺序，其他层按key排序
+		if lh.levelNum == 0 {
+			return lh.tables[i].fid < lh.tables[j].fid
+		}
+		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[j].ss.MinKey()) < 0
 	})
 	lh.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
 	return decrRefs(toDel)
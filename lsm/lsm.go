@@ -1,18 +1,53 @@
 package lsm
 
-import "lsm/utils"
+import (
+	"context"
+	"fmt"
+	"lsm/file"
+	"lsm/utils"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 type LSM struct {
 	memTable   *memTable
 	immutables []*memTable
 	levels     *levelManager
-	option     *lsmOptions
+	option     *Options
 	closer     *utils.Closer
 	maxMemFID  uint32
+	orc        *oracle
+	writeLock  sync.Mutex // 保证写入与内存表的切换串行执行
+	walStats   walStats
+	stallStats writeStallStats
+	frozen     atomic.Value // 存放*frozenError，设置后不再改变
+	// flushEvents 持有写锁期间完成、尚未通知OnFlushComplete的刷盘
+	flushEvents []flushEvent
+	// ingestBytes 打开以来写入的key与value字节数，用于计算写放大
+	ingestBytes int64
+
+	// numImmutables、immutableMemory与storeFull在持有写锁时更新，供Health不加锁读取
+	numImmutables   int32
+	immutableMemory int64 // immutables的跳表内存占用之和
+	storeFull       int32 // 最近一次写入是否因为超过MaxStoreSize被拒绝
+	// mts 存放[]*memTable，当前memtable在前、immutables从新到旧，memTable或immutables改变后在写锁下更新，供读取不加锁获取快照
+	mts atomic.Value
+
+	// gate 读写请求在执行期间登记，SwapFrom等待它们结束后替换数据
+	gate swapGate
+	// compacting StartCompacter是否启动了后台合并，SwapFrom重新打开后据此重新启动
+	compacting bool
+	rowCache   *rowCache // 未开启RowCacheSize时为nil
+	// pause PauseCompaction设置的暂停状态，SwapFrom重新打开后保持不变
+	pause compactionPause
 }
 
-//lsmOptions _
-type lsmOptions struct {
+// Options 打开LSM的配置项，DefaultOptions返回一份可以直接使用的配置
+type Options struct {
 	WorkDir      string
 	MemTableSize int64
 	SSTableMaxSz int64
@@ -20,6 +55,25 @@ type lsmOptions struct {
 	BlockSize int
 	// BloomFalsePositive is the false positive probabiltiy of bloom filter.
 	BloomFalsePositive float64
+	// BloomBitsPerKey 布隆过滤器中每个key占用的bit数，与BloomFalsePositive最多设置一个，两者都为0时不生成布隆过滤器
+	// 哈希函数的数量按bits*ln2计算，10 bits/key的误判率约为1%
+	BloomBitsPerKey int
+	// BloomHash 新生成的sst中布隆过滤器使用的哈希函数，每个sst记录自己的函数，修改后已有的sst仍然可以读取
+	BloomHash utils.BloomHash
+
+	// MemTableMaxEntries 内存表最多容纳的entry数量，与MemTableSize任意一个达到时切换内存表，0表示不限制
+	// 值很小的大量entry会让跳表变慢、刷盘生成的sst索引过大，可以用它限制
+	MemTableMaxEntries int
+	// MaxImmutableMemory 等待刷盘的immutables的跳表内存占用之和的上限，0表示不限制
+	// 切换内存表会超过上限时，先在当前写入的协程中把已有的immutables刷盘再切换，写入因此等待刷盘完成
+	// 没有设置MaxRecoveryMemory时恢复回放的wal同样受它限制；上限小于一个内存表时队列中最多保留一个immutable
+	MaxImmutableMemory int64
+
+	// SkipListMaxHeight 内存表中跳表的最大高度，不能超过utils.MaxSkipListHeight，0表示使用这个上限
+	// 数据量很大时高度过低会让查找路径变长
+	SkipListMaxHeight int
+	// SkipListBranchProb 跳表节点每升高一层的概率，0表示使用utils.DefaultSkipListBranchProb
+	SkipListBranchProb float64
 
 	// compact
 	NumCompactors       int
@@ -29,86 +83,1001 @@ type lsmOptions struct {
 	BaseTableSize       int64
 	NumLevelZeroTables  int
 	MaxLevelNum         int
+	// MaxSmallTables L1及以下的一层中相邻的过小sst（小于BaseTableSize的1/4）达到这个数量时，
+	// 在层内把它们合并为接近BaseTableSize的sst，减少读取时需要查找的sst，0表示不合并
+	MaxSmallTables int
+	// TTLCompactionInterval 后台检查含有已过期entry的sst并合并它们的周期，0表示不检查
+	// 不需要读写请求触发，开启SyncCompaction时不启动
+	TTLCompactionInterval time.Duration
+	// SyncCompaction 不启动后台合并协程，合并只在调用CompactAll或CompactTables时于调用方的协程中执行
+	// 便于测试得到确定的level形状
+	SyncCompaction bool
+	// L0StallThreshold L0的sst数量达到后每次写入前延迟一小段时间，让合并跟上写入，0表示不限速
+	L0StallThreshold int
+	// L0StopThreshold L0的sst数量达到后写入阻塞，直到合并把L0降到阈值以下，0表示不阻塞
+	L0StopThreshold int
+
+	// MaxStoreSize 为sst与wal文件的总大小上限，超过后Set返回ErrStoreFull，0表示不限制
+	// 已经过期的entry作为删除标记不受限制，写入它们再合并可以回收空间
+	MaxStoreSize int64
+
+	// Logger 用于输出诊断信息，为空时使用utils.DefaultLogger
+	Logger utils.Logger
+
+	// DeleteOrphans 打开时删除manifest未引用的sst文件，默认保留以便恢复工具检查
+	DeleteOrphans bool
+
+	// KeyFilter 只服务返回true的user key，其余key在迭代与Get时都会被忽略，为空表示不过滤
+	// 恢复时范围外的key不加载到内存表，直接从wal写入L0的sst，之后不带KeyFilter打开可以读到它们
+	KeyFilter func(userKey []byte) bool
+
+	// VersionFunc 替换默认的版本号分配方式，便于测试与基准得到确定的时间戳
+	// 返回值必须单调递增，否则新写入的数据可能被旧版本遮盖；为空时使用单调递增的计数器
+	VersionFunc func() uint64
+
+	// SyncWrites 每次写入wal后都sync到磁盘，默认只写入mmap，由操作系统决定何时落盘
+	SyncWrites bool
+	// WalChecksum 新写入的wal记录的校验算法，默认为crc32；每条记录自带算法标记，切换后旧的wal仍然可以回放
+	WalChecksum utils.ChecksumType
+	// Encryptor 不为nil时加密新写入的sst block、sst索引与wal记录，checksum覆盖密文，密钥由调用方管理
+	// sst索引与wal记录开头的标记以及TableIndex.Encrypted显式记录数据是否加密，开启之前写入的明文数据仍然可以读取；关闭之后读到加密的数据返回ErrNoEncryptor
+	// wal记录的预估大小包含加密的开销，内存表能容纳的entry相应变少
+	Encryptor utils.Encryptor
+
+	// BestEffortRead Get遇到损坏的sst时不直接返回错误，而是记录日志后继续查找更旧的版本
+	// 这样可能读到被覆盖前的旧值，换来部分损坏时的可用性
+	BestEffortRead bool
+
+	// CheckSSTableOrder 打开时检查每个sst中的key是否严格递增，发现乱序时返回所在的sst与block
+	CheckSSTableOrder bool
+	// RepairSSTableOrder 打开时将乱序的sst重新排序，写成新的sst后替换，隐含CheckSSTableOrder
+	RepairSSTableOrder bool
+
+	// RecoveryProgress 打开时回放wal的进度，每个wal每处理几MB调用一次，回放结束时bytesDone等于bytesTotal
+	// bytesTotal为wal文件的大小，其中包含预分配而没有写入的部分
+	RecoveryProgress func(fid uint64, bytesDone, bytesTotal int64)
+	// StrictWALRecovery 打开时遇到无法打开的wal（例如扫描目录之后被外部删除）直接失败，默认记录日志后跳过
+	StrictWALRecovery bool
+
+	// FlushPolicy 除了写满MemTableSize之外，按大小、时间或entry数量切换内存表并刷盘
+	FlushPolicy FlushPolicy
+
+	// OnFlushComplete 内存表刷盘为sst并写入manifest后调用，参数为新sst的fid与key范围
+	// 回调在写锁释放后、触发刷盘的Set返回前执行，执行期间会阻塞这次Set
+	OnFlushComplete func(tableID uint64, minKey, maxKey []byte)
+
+	// ReadRepair 读取时发现多个sst包含同一个key，则在后台调度合并来消除旧版本
+	ReadRepair bool
+
+	// DisableSyncDir 创建sst与覆写manifest后不再sync工作目录，用于tmpfs或测试中省去这部分开销
+	// 这会削弱崩溃一致性：崩溃后新文件的目录项可能丢失，manifest可能引用不存在的sst，生产环境不要开启
+	DisableSyncDir bool
+
+	// SSTableLayout 新建sst的目录布局，默认全部平铺在WorkDir中
+	// 打开时两种布局的sst都能找到，切换布局后已有的sst保留在原来的位置
+	SSTableLayout utils.SSTableLayout
+
+	// ManifestSyncPolicy manifest的sync策略，默认每次写入都sync
+	// 放宽策略可以减少刷盘与合并时的sync次数，但崩溃时可能丢失最近注册的sst，详见file.ManifestSyncPolicy
+	ManifestSyncPolicy file.ManifestSyncPolicy
+	// IgnoreUnknownManifestOps 打开时跳过manifest中无法识别的操作并记录日志，默认直接返回ErrManifestHasWrongOp
+	// 用于让旧版本打开新版本写入的manifest；被跳过的记录不会出现在之后覆写的manifest中
+	IgnoreUnknownManifestOps bool
+	// ManifestBackupInterval 大于0时每写入这么多个change set、每次覆写以及每次删除sst后，将manifest备份到MANIFEST.bak
+	// 打开时manifest无法回放则改用备份恢复，备份之后注册的sst作为孤儿表保留；默认不备份
+	ManifestBackupInterval int
+	// TrashRetention 大于0时flush、合并与RevertToManifest删除的wal与sst先移动到WorkDir下的.trash目录，
+	// 保留这么长时间后由后台协程删除，便于在错误的合并之后找回数据；0表示直接删除
+	TrashRetention time.Duration
+	// ValueCompressionThreshold 大于0时长度超过它的value用flate压缩后写入，entry的Meta中记录BitValueCompressed，读取时自动解压
+	// 压缩后没有变小的value原样保存；0表示不压缩
+	ValueCompressionThreshold int
+	// RowCacheSize 大于0时按user key缓存Get读到的entry，缓存的key、value与每项的开销之和不超过这么多字节，按LRU淘汰
+	// 每次写入都会先淘汰这个key的缓存，与写入并发的查询读到的entry不会被缓存，因此不会读到旧数据；0表示不缓存
+	RowCacheSize int64
+	// RebuildKeepTables RebuildFromWAL时把目录中已有的sst重新注册到L0，否则这些sst作为孤儿表保留
+	RebuildKeepTables bool
+	// FileRetry manifest与sst的打开、改名与sync遇到EINTR、EAGAIN等暂时性错误时的重试策略，用于网络文件系统
+	// ENOSPC、EROFS等错误不重试；sync返回EIO时也不重试，因为此时无法确认数据是否落盘；零值表示不重试
+	FileRetry utils.RetryPolicy
+	// WalRetainAfterFlush 大于0时刷盘后的wal压缩后移动到WorkDir下的.wal-retained目录，保留这么长时间后由后台协程删除
+	// 用于刷盘生成的sst之后被发现损坏时找回数据；恢复时默认忽略保留的wal，因为其中的数据已经在sst中
+	WalRetainAfterFlush time.Duration
+	// ReplayRetainedWALs 打开时把保留的wal解压回WorkDir，分配新的fid后与其他wal一样回放，之后重新刷盘
+	ReplayRetainedWALs bool
+	// VerifyMonotonicVersions Open时扫描所有sst中的entry，存在版本号大于恢复出的版本号水位的entry时返回ErrVersionRegression
+	// 这样的entry会遮住之后分配的更小的版本号，通常说明manifest的检查点或sst已经损坏；打开的时间与数据量成正比
+	// wal中的版本号在回放时已经计入水位，不会违反
+	VerifyMonotonicVersions bool
+	// ZoneMapExtractor 从entry中提取一个可以按字节序比较的维度，例如时间序列value中的时间戳，返回nil表示entry没有这个维度
+	// 生成sst时在索引中记录每个block提取值的最小值与最大值，ScanZone据此跳过不相交的block
+	// 压缩的value解压后再提取；修改提取方式后已有的sst需要合并重写，否则ScanZone会按旧的范围跳过block
+	ZoneMapExtractor func(e *utils.Entry) []byte
+	// MaxReadAmplification 一次Get最多查找的sst数量，超过时返回ErrReadAmpExceeded，0表示不限制
+	// 查找的sst过多通常说明L0堆积或者合并落后，需要合并之后再读
+	MaxReadAmplification int
+	// ValueAlignment 新生成的sst中block的起始偏移与每个value的偏移按这个字节数对齐，0或1表示不填充
+	// 必须是不超过256的2的幂；mmap读取时对齐的value在部分架构上更快，代价是每个entry最多多占ValueAlignment字节
+	// 对齐方式记录在sst的索引中，修改后已有的sst仍然可以读取
+	ValueAlignment int
+	// VarintTimestamps 新生成的sst中block里的key用变长编码保存时间戳，版本号较小时每个key可以省下5到6个字节
+	// 跳表与索引中仍然使用固定8字节的时间戳，读取block时还原，因此比较与排序不受影响；编码方式记录在sst的索引中
+	VarintTimestamps bool
+	// FlushConcurrency 多个immutable排队时最多同时刷盘的数量，0或1表示逐个刷盘
+	// 生成sst并发进行，写入manifest与加入L0仍按immutable的顺序，切分出的sst的fid也按这个顺序分配
+	// 同一个key在不同内存表中的版本由版本号区分
+	FlushConcurrency int
+	// SkipBloomBottomLevel 为true时写入最底层的sst不生成布隆过滤器，节省最底层索引占用的内存
+	// 不存在的key大多在上层就被过滤掉，最底层的布隆过滤器作用有限；没有布隆过滤器的sst读取时直接查找索引
+	SkipBloomBottomLevel bool
+	// MaxRecoveryMemory 打开时回放wal得到的immutables的内存占用上限，超过时边回放边刷盘到L0，0表示使用MaxImmutableMemory
+	// 只限制恢复过程，运行时切换内存表不受影响，因此可以限制崩溃后回放积压wal的内存而不让写入等待刷盘
+	MaxRecoveryMemory int64
 }
 
-func initLSM(opt *lsmOptions) *LSM {
-	lsm := &LSM{option: opt}
-	lsm.levels = lsm.initLevelManager(opt)
-	lsm.memTable, lsm.immutables = lsm.recovery()
-	lsm.closer = utils.NewCloser(1)
+// Open 检查配置后打开workDir中的存储，并启动后台合并
+// 配置不合法、manifest或sst无法加载以及回放wal失败时返回错误
+func Open(opt Options) (*LSM, error) {
+	if err := opt.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	lsm, err := openLSM(&opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.VerifyMonotonicVersions {
+		if err := lsm.verifyMonotonicVersions(); err != nil {
+			// 不刷盘，保留wal与sst原样供排查
+			lsm.closer.Close()
+			_ = lsm.release()
+			return nil, err
+		}
+	}
+	lsm.StartCompacter()
+	return lsm, nil
+}
+
+func initLSM(opt *Options) *LSM {
+	lsm, err := openLSM(opt)
+	utils.Panic(err)
 	return lsm
 }
-func (lsm *LSM) Close() error {
-	if lsm.memTable != nil {
-		if err := lsm.memTable.close(); err != nil {
-			return err
-		}
+
+// openLSM 与initLSM相同，恢复失败时返回错误
+func openLSM(opt *Options) (*LSM, error) {
+	if err := opt.validate(); err != nil {
+		return nil, err
 	}
-	for i := range lsm.immutables {
-		if err := lsm.immutables[i].close(); err != nil {
-			return err
-		}
+	if opt.Logger == nil {
+		opt.Logger = utils.DefaultLogger
 	}
-	if err := lsm.levels.close(); err != nil {
+	lsm := &LSM{option: opt}
+	if err := lsm.load(); err != nil {
+		return nil, err
+	}
+	return lsm, nil
+}
+
+// load 从WorkDir恢复level与内存表，并启动刷盘策略，不启动后台合并
+// 恢复或检查sst顺序失败时关闭已经打开的sst与内存表并返回错误，wal保留
+func (lsm *LSM) load() error {
+	opt := lsm.option
+	var err error
+	if lsm.levels, err = lsm.initLevelManager(opt); err != nil {
+		return err
+	}
+	if lsm.memTable, lsm.immutables, err = lsm.recovery(); err != nil {
+		_ = lsm.levels.close()
+		return err
+	}
+	lsm.publishMemTables()
+	lsm.numImmutables = int32(len(lsm.immutables))
+	lsm.immutableMemory = 0
+	for _, imm := range lsm.immutables {
+		lsm.immutableMemory += imm.Size()
+	}
+	if err = lsm.levels.checkTableOrder(); err != nil {
+		_ = lsm.release()
 		return err
 	}
+	lsm.orc = lsm.newOracle()
+	lsm.rowCache = newRowCache(opt.RowCacheSize)
+	lsm.closer = utils.NewCloser(0)
+	if opt.FlushPolicy.enabled() {
+		lsm.closer.Add(1)
+		go lsm.runFlushPolicy()
+	}
+	if opt.TrashRetention > 0 {
+		lsm.closer.Add(1)
+		go lsm.runTrashPurge()
+	}
+	if opt.WalRetainAfterFlush > 0 {
+		lsm.closer.Add(1)
+		go lsm.runRetainedWalPurge()
+	}
+	return nil
+}
+
+// CloseSummary Close之后存储的最终状态，可以作为一次干净关闭的记录
+type CloseSummary struct {
+	NumTables  int
+	TotalSize  int64 // 所有sst的总大小
+	MaxVersion uint64
+}
+
+// Close 等待后台的合并与刷盘策略结束，将memtable与immutables刷盘后sync并关闭manifest
+// 只读状态下无法刷盘，memtable只关闭而保留wal，重新打开时回放
+func (lsm *LSM) Close() (CloseSummary, error) {
 	// 等待合并过程的结束
 	lsm.closer.Close()
-	return nil
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	if lsm.IsFrozen() == nil {
+		if lsm.memTable.entries != 0 {
+			if err := lsm.rotate(); err != nil {
+				return CloseSummary{}, err
+			}
+		}
+		if err := lsm.flushImmutables(); err != nil {
+			return CloseSummary{}, err
+		}
+		if err := lsm.memTable.close(); err != nil {
+			return CloseSummary{}, err
+		}
+	} else {
+		for _, mt := range append(lsm.immutables, lsm.memTable) {
+			if err := mt.release(); err != nil {
+				return CloseSummary{}, err
+			}
+		}
+	}
+	if err := lsm.levels.close(); err != nil {
+		return CloseSummary{}, err
+	}
+	summary := CloseSummary{MaxVersion: lsm.levels.manifestFile.GetManifest().MaxVersion}
+	for _, lh := range lsm.levels.levels {
+		summary.NumTables += lh.numTables()
+		summary.TotalSize += lh.getTotalSize()
+	}
+	return summary, nil
 }
 
 func (lsm *LSM) StartCompacter() {
-	n := lsm.option.NumCompactors //用于配置有几个compact协程
-	lsm.closer.Add(n)
-	for i := 0; i < n; i++ {
-		go lsm.levels.runCompacter(i)
+	if lsm.option.SyncCompaction {
+		return
+	}
+	lsm.compacting = true
+	lsm.levels.resizeCompacters(lsm.option.NumCompactors) //用于配置有几个compact协程
+	if lsm.option.TTLCompactionInterval > 0 {
+		lsm.closer.Add(1)
+		go lsm.levels.runTTLCompacter()
+	}
+}
+
+// SetNumCompactors 在运行时调整后台合并协程的数量，n为0时停止后台合并
+// 减少时等待多余的协程完成手上的合并后退出再返回；新的数量同时记录在NumCompactors中，SwapFrom重新启动时沿用
+// 还没有调用StartCompacter或开启了SyncCompaction时只记录数量；停止后台合并后L0达到L0StopThreshold时写入会一直阻塞，需要调用CompactAll
+func (lsm *LSM) SetNumCompactors(n int) error {
+	if n < 0 {
+		return fmt.Errorf("NumCompactors %d must not be negative", n)
+	}
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	lsm.option.NumCompactors = n
+	if lsm.compacting {
+		lsm.levels.resizeCompacters(n)
+	}
+	return nil
+}
+
+// PauseCompaction 暂停后台合并，等正在执行的合并完成后返回，之后合并协程保持空闲但不退出
+// 只影响后台的合并协程与TTL合并，CompactAll、CompactTables与刷盘照常执行；暂停期间L0达到L0StopThreshold时写入会阻塞
+func (lsm *LSM) PauseCompaction() {
+	lsm.pause.set(true)
+}
+
+// ResumeCompaction 恢复PauseCompaction暂停的后台合并，合并协程在下一次检查时开始追赶
+func (lsm *LSM) ResumeCompaction() {
+	lsm.pause.set(false)
+}
+
+// validate 检查配置项是否合法
+func (opt *Options) validate() error {
+	if opt.WorkDir == "" {
+		return errors.New("WorkDir is empty")
+	}
+	// 内存表至少要能容纳一个只有1字节key与时间戳的entry
+	minSize := opt.walSize(&utils.Entry{Key: make([]byte, 1+8)})
+	if opt.MemTableSize < minSize {
+		return fmt.Errorf("MemTableSize %d is smaller than the minimum %d", opt.MemTableSize, minSize)
+	}
+	switch {
+	case opt.SSTableMaxSz <= 0:
+		return fmt.Errorf("SSTableMaxSz %d must be positive", opt.SSTableMaxSz)
+	case opt.BlockSize <= 0:
+		return fmt.Errorf("BlockSize %d must be positive", opt.BlockSize)
+	case opt.BloomFalsePositive < 0 || opt.BloomFalsePositive >= 1:
+		return fmt.Errorf("BloomFalsePositive %v must be in [0, 1)", opt.BloomFalsePositive)
+	case opt.BloomBitsPerKey < 0:
+		return fmt.Errorf("BloomBitsPerKey %d must not be negative", opt.BloomBitsPerKey)
+	case opt.BloomBitsPerKey > 0 && opt.BloomFalsePositive > 0:
+		return fmt.Errorf("only one of BloomBitsPerKey %d and BloomFalsePositive %v can be set", opt.BloomBitsPerKey, opt.BloomFalsePositive)
+	case !opt.BloomHash.Valid():
+		return fmt.Errorf("unknown BloomHash %d", opt.BloomHash)
+	case opt.SkipListMaxHeight < 0 || opt.SkipListMaxHeight > utils.MaxSkipListHeight:
+		return fmt.Errorf("SkipListMaxHeight %d must be in [0, %d]", opt.SkipListMaxHeight, utils.MaxSkipListHeight)
+	case opt.SkipListBranchProb < 0 || opt.SkipListBranchProb >= 1:
+		return fmt.Errorf("SkipListBranchProb %v must be in [0, 1)", opt.SkipListBranchProb)
+	case opt.MaxImmutableMemory < 0:
+		return fmt.Errorf("MaxImmutableMemory %d must not be negative", opt.MaxImmutableMemory)
+	case opt.MaxRecoveryMemory < 0:
+		return fmt.Errorf("MaxRecoveryMemory %d must not be negative", opt.MaxRecoveryMemory)
+	case opt.ManifestBackupInterval < 0:
+		return fmt.Errorf("ManifestBackupInterval %d must not be negative", opt.ManifestBackupInterval)
+	case opt.NumCompactors < 0:
+		return fmt.Errorf("NumCompactors %d must not be negative", opt.NumCompactors)
+	case opt.BaseLevelSize <= 0 || opt.BaseTableSize <= 0:
+		return fmt.Errorf("BaseLevelSize %d and BaseTableSize %d must be positive", opt.BaseLevelSize, opt.BaseTableSize)
+	case opt.LevelSizeMultiplier <= 0 || opt.TableSizeMultiplier <= 0:
+		return fmt.Errorf("LevelSizeMultiplier %d and TableSizeMultiplier %d must be positive", opt.LevelSizeMultiplier, opt.TableSizeMultiplier)
+	case opt.MaxSmallTables < 0:
+		return fmt.Errorf("MaxSmallTables %d must not be negative", opt.MaxSmallTables)
+	case opt.TrashRetention < 0:
+		return fmt.Errorf("TrashRetention %v must not be negative", opt.TrashRetention)
+	case opt.ValueCompressionThreshold < 0:
+		return fmt.Errorf("ValueCompressionThreshold %d must not be negative", opt.ValueCompressionThreshold)
+	case opt.RowCacheSize < 0:
+		return fmt.Errorf("RowCacheSize %d must not be negative", opt.RowCacheSize)
+	case opt.FileRetry.Retries < 0 || opt.FileRetry.Interval < 0:
+		return fmt.Errorf("FileRetry retries %d and interval %v must not be negative", opt.FileRetry.Retries, opt.FileRetry.Interval)
+	case opt.WalRetainAfterFlush < 0:
+		return fmt.Errorf("WalRetainAfterFlush %v must not be negative", opt.WalRetainAfterFlush)
+	case opt.ValueAlignment < 0 || opt.ValueAlignment > 256 || opt.ValueAlignment&(opt.ValueAlignment-1) != 0:
+		return fmt.Errorf("ValueAlignment %d must be a power of two no larger than 256", opt.ValueAlignment)
+	case opt.FlushConcurrency < 0:
+		return fmt.Errorf("FlushConcurrency %d must not be negative", opt.FlushConcurrency)
+	case opt.MaxReadAmplification < 0:
+		return fmt.Errorf("MaxReadAmplification %d must not be negative", opt.MaxReadAmplification)
+	case opt.RebuildKeepTables && opt.DeleteOrphans:
+		return errors.New("RebuildKeepTables and DeleteOrphans cannot both be set")
+	case opt.TTLCompactionInterval < 0:
+		return fmt.Errorf("TTLCompactionInterval %v must not be negative", opt.TTLCompactionInterval)
+	case opt.NumLevelZeroTables <= 0:
+		return fmt.Errorf("NumLevelZeroTables %d must be positive", opt.NumLevelZeroTables)
+	case opt.MaxLevelNum < 2:
+		// L0至少需要一层可以合并下去
+		return fmt.Errorf("MaxLevelNum %d must be at least 2", opt.MaxLevelNum)
+	}
+	if opt.L0StallThreshold > 0 && opt.L0StopThreshold > 0 && opt.L0StallThreshold > opt.L0StopThreshold {
+		return fmt.Errorf("L0StallThreshold %d is larger than L0StopThreshold %d", opt.L0StallThreshold, opt.L0StopThreshold)
+	}
+	return nil
+}
+
+// exceedsImmutableMemory 判断n个共占用queued字节的immutables再加入size字节后是否超过MaxImmutableMemory
+// 队列为空时总是允许加入
+func (opt *Options) exceedsImmutableMemory(queued, size int64, n int) bool {
+	return exceedsMemory(opt.MaxImmutableMemory, queued, size, n)
+}
+
+// exceedsRecoveryMemory 与exceedsImmutableMemory相同，用于恢复时回放的wal，上限为MaxRecoveryMemory
+func (opt *Options) exceedsRecoveryMemory(queued, size int64, n int) bool {
+	limit := opt.MaxRecoveryMemory
+	if limit == 0 {
+		limit = opt.MaxImmutableMemory
+	}
+	return exceedsMemory(limit, queued, size, n)
+}
+
+func exceedsMemory(limit, queued, size int64, n int) bool {
+	return limit > 0 && n > 0 && queued+size > limit
+}
+
+// acceptKey 判断带时间戳的key是否在KeyFilter的范围内
+func (opt *Options) acceptKey(key []byte) bool {
+	return opt.KeyFilter == nil || opt.KeyFilter(utils.ParseKey(key))
+}
+
+// compressEntry value超过ValueCompressionThreshold并且压缩后变小时，返回保存压缩后value的副本，否则返回entry本身
+func (opt *Options) compressEntry(entry *utils.Entry) *utils.Entry {
+	if opt.ValueCompressionThreshold <= 0 || len(entry.Value) <= opt.ValueCompressionThreshold ||
+		entry.Meta&utils.BitValueCompressed != 0 {
+		return entry
+	}
+	value, ok := utils.CompressValue(entry.Value)
+	if !ok {
+		return entry
+	}
+	compressed := *entry
+	compressed.Value = value
+	compressed.Meta |= utils.BitValueCompressed
+	return &compressed
+}
+
+// skipBloom 写入level层的sst是否不生成布隆过滤器
+func (opt *Options) skipBloom(level int) bool {
+	return opt.SkipBloomBottomLevel && level == opt.MaxLevelNum-1
+}
+
+// flushConcurrency 同时刷盘的immutable数量，至少为1
+func (opt *Options) flushConcurrency() int {
+	if opt.FlushConcurrency > 1 {
+		return opt.FlushConcurrency
+	}
+	return 1
+}
+
+// valueAlign 生成sst时使用的对齐字节数，不对齐时为1
+func (opt *Options) valueAlign() int {
+	if opt.ValueAlignment > 1 {
+		return opt.ValueAlignment
+	}
+	return 1
+}
+
+// walSize 预估entry写入wal占用的空间，配置了Encryptor时加上每条记录加密的开销
+func (opt *Options) walSize(e *utils.Entry) int64 {
+	return int64(utils.EstimateWalCodecSize(e) + utils.WalEncryptionOverhead(opt.Encryptor))
+}
+
+// walBatchSize 与walSize相同，用于WriteBatch写入的一批entry，包括批次头，批次头不加密
+func (opt *Options) walBatchSize(entries []*utils.Entry) int64 {
+	return utils.EstimateWalCodecSizeBatch(entries) + int64(len(entries)*utils.WalEncryptionOverhead(opt.Encryptor))
+}
+
+// zoneValue 用ZoneMapExtractor提取entry的zone值，没有配置时返回nil
+func (opt *Options) zoneValue(e *utils.Entry) []byte {
+	if opt.ZoneMapExtractor == nil {
+		return nil
+	}
+	if e.Meta&utils.BitValueCompressed != 0 {
+		plain := *e
+		if err := plain.Decompress(); err != nil {
+			return nil
+		}
+		e = &plain
+	}
+	return opt.ZoneMapExtractor(e)
+}
+
+// bloomBitsPerKey 包含n个key的sst中布隆过滤器每个key的bit数，为0时不生成布隆过滤器
+func (opt *Options) bloomBitsPerKey(n int) int {
+	if opt.BloomBitsPerKey > 0 {
+		return opt.BloomBitsPerKey
+	}
+	if opt.BloomFalsePositive > 0 {
+		return utils.BloomBitsPerKey(n, opt.BloomFalsePositive)
+	}
+	return 0
+}
+
+// WaitForIdle 等待immutable全部刷盘并且没有正在执行或等待执行的合并，ctx取消时返回ctx.Err()
+// 未启动合并协程时只等待正在执行的合并
+func (lsm *LSM) WaitForIdle(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !lsm.isIdle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
+	return nil
+}
+
+func (lsm *LSM) isIdle() bool {
+	lsm.writeLock.Lock()
+	imms := len(lsm.immutables)
+	lsm.writeLock.Unlock()
+	return imms == 0 && lsm.levels.isIdle()
 }
 
 // Set _
-func (lsm *LSM) Set(entry *utils.Entry) (err error) {
+// entry的Meta不能带有BitValueCompressed，value是否压缩由ValueCompressionThreshold决定，否则返回ErrReservedMeta
+func (lsm *LSM) Set(entry *utils.Entry) error {
+	if entry.Meta&utils.BitValueCompressed != 0 {
+		return utils.ErrReservedMeta
+	}
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	err := lsm.setLocked(entry)
+	// 超过MaxStoreSize时在写锁之外合并一次，回收了空间再重试
+	if err == utils.ErrStoreFull && lsm.reclaimStoreSpace() {
+		err = lsm.setLocked(entry)
+	}
+	return err
+}
+
+// setLocked 获取写锁写入一个entry
+func (lsm *LSM) setLocked(entry *utils.Entry) error {
+	lsm.throttleWrite()
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	if err := lsm.applyFlushPolicy(); err != nil {
+		return err
+	}
+	return lsm.set(entry)
+}
+
+// WriteBatch 原子地写入一批entry，整批只获取一次写锁
+// 整批entry总是写入同一个内存表与wal，不会被内存表的切换拆开，因此编码后的总大小不能超过MemTableSize，数量不能超过MemTableMaxEntries
+// 整批在wal中是一个批次，崩溃后回放时要么全部恢复要么全部丢弃；写入前的检查失败时不写入任何entry
+func (lsm *LSM) WriteBatch(entries []*utils.Entry) error {
+	for _, entry := range entries {
+		if entry.Meta&utils.BitValueCompressed != 0 {
+			return utils.ErrReservedMeta
+		}
+	}
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	// 先压缩，按写入的大小检查整批能否放进内存表
+	if lsm.option.ValueCompressionThreshold > 0 {
+		compressed := make([]*utils.Entry, len(entries))
+		for i, entry := range entries {
+			compressed[i] = lsm.option.compressEntry(entry)
+		}
+		entries = compressed
+	}
+	for _, entry := range entries {
+		if lsm.option.walSize(entry) > lsm.option.MemTableSize {
+			return utils.ErrEntryTooLarge
+		}
+	}
+	size := lsm.option.walBatchSize(entries)
+	if size > lsm.option.MemTableSize || (lsm.option.MemTableMaxEntries > 0 && len(entries) > lsm.option.MemTableMaxEntries) {
+		return utils.ErrBatchTooLarge
+	}
+	// 上一次写入超过了MaxStoreSize，整批无法重试，先在写锁之外合并一次
+	if atomic.LoadInt32(&lsm.storeFull) != 0 {
+		lsm.reclaimStoreSpace()
+	}
+	lsm.throttleWrite()
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	// 当前内存表放不下整批entry时提前切换
+	if err := lsm.applyFlushPolicy(); err != nil {
+		return err
+	}
+	if err := lsm.IsFrozen(); err != nil {
+		return err
+	}
+	if err := lsm.checkStoreSize(entries...); err != nil {
+		return err
+	}
+	if err := lsm.makeRoom(size, len(entries)); err != nil {
+		return err
+	}
+	if err := lsm.memTable.setBatch(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		lsm.written(entry)
+	}
+	return lsm.flushImmutables()
+}
+
+// unlockWrite 释放写锁，然后通知持有写锁期间完成的刷盘，回调中可以再次调用LSM的方法
+func (lsm *LSM) unlockWrite() {
+	events := lsm.flushEvents
+	lsm.flushEvents = nil
+	lsm.writeLock.Unlock()
+	for _, e := range events {
+		lsm.option.OnFlushComplete(e.fid, e.minKey, e.maxKey)
+	}
+}
+
+func (lsm *LSM) set(entry *utils.Entry) (err error) {
+	if err = lsm.IsFrozen(); err != nil {
+		return err
+	}
+	entry = lsm.option.compressEntry(entry)
+	// 超过内存表大小的entry永远无法写入，直接返回错误，避免不断地切换内存表
+	if lsm.option.walSize(entry) > lsm.option.MemTableSize {
+		return utils.ErrEntryTooLarge
+	}
+	// 检查存储空间是否已经超过上限
+	if err = lsm.checkStoreSize(entry); err != nil {
+		return err
+	}
 	// 检查当前memtable是否写满，是的话创建新的memtable,并将当前内存表写到immutables中
 	// 否则写入当前memtable中
-	if int64(lsm.memTable.wal.Size())+
-		int64(utils.EstimateWalCodecSize(entry)) > lsm.option.MemTableSize {
-		lsm.immutables = append(lsm.immutables, lsm.memTable)
-		lsm.memTable = lsm.NewMemtable()
+	if err = lsm.makeRoom(lsm.option.walSize(entry), 1); err != nil {
+		return err
 	}
 
 	if err = lsm.memTable.set(entry); err != nil {
 		return err
 	}
-	// 检查是否存在immutable需要刷盘，
-	for _, immutable := range lsm.immutables {
-		if err = lsm.levels.flush(immutable); err != nil {
+	lsm.written(entry)
+	return lsm.flushImmutables()
+}
+
+// written 更新写入内存表之后的row cache与统计
+func (lsm *LSM) written(entry *utils.Entry) {
+	lsm.rowCache.invalidate(utils.ParseKey(entry.Key))
+	atomic.AddInt64(&lsm.ingestBytes, int64(len(entry.Key)+len(entry.Value)))
+}
+
+// flushImmutables 检查是否存在immutable需要刷盘
+// 每次从队首取出最多FlushConcurrency个immutable并发生成sst，再按队列顺序逐个写入manifest并移出队列
+// 失败时队列中只留下还没有刷盘的immutables，它们已经生成的sst被删除，之后由wal重新生成
+func (lsm *LSM) flushImmutables() (err error) {
+	if len(lsm.immutables) == 0 {
+		return nil
+	}
+	for len(lsm.immutables) > 0 {
+		batch := lsm.immutables
+		if n := lsm.option.flushConcurrency(); len(batch) > n {
+			batch = batch[:n]
+		}
+		built, errs := lsm.levels.buildFlushBatch(batch)
+		for i, immutable := range batch {
+			if err = errs[i]; err == nil {
+				err = lsm.levels.installFlushed(built[i], 0)
+			}
+			if err != nil {
+				for _, tables := range built[i+1:] {
+					_ = decrRefs(tables)
+				}
+				return lsm.freeze(err)
+			}
+			size := immutable.Size()
+			lsm.immutables = lsm.immutables[1:]
+			lsm.publishMemTables()
+			err = immutable.closeFlushed()
+			utils.Panic(err)
+			atomic.AddInt32(&lsm.numImmutables, -1)
+			atomic.AddInt64(&lsm.immutableMemory, -size)
+		}
+	}
+	// TODO 将lsm的immutables队列置空，这里可以优化一下节省内存空间
+	lsm.immutables = make([]*memTable, 0)
+	lsm.publishMemTables()
+	return nil
+}
+
+// publishMemTables 更新读取使用的内存表快照，持有写锁时调用
+func (lsm *LSM) publishMemTables() {
+	mts := make([]*memTable, 0, len(lsm.immutables)+1)
+	if lsm.memTable != nil {
+		mts = append(mts, lsm.memTable)
+	}
+	for i := len(lsm.immutables) - 1; i >= 0; i-- {
+		mts = append(mts, lsm.immutables[i])
+	}
+	lsm.mts.Store(mts)
+}
+
+// memTables 返回最近一次publishMemTables时的内存表快照，当前memtable在前，不需要持有写锁
+func (lsm *LSM) memTables() []*memTable {
+	mts, _ := lsm.mts.Load().([]*memTable)
+	return mts
+}
+
+// makeRoom 当前memtable放不下size字节或n个entry时，将它移入immutables并创建新的memtable
+func (lsm *LSM) makeRoom(size int64, n int) error {
+	maxEntries := lsm.option.MemTableMaxEntries
+	if int64(lsm.memTable.wal.Size())+size > lsm.option.MemTableSize ||
+		(maxEntries > 0 && lsm.memTable.entries+n > maxEntries) {
+		return lsm.rotate()
+	}
+	return nil
+}
+
+// rotate 将当前memtable移入immutables并创建新的memtable
+// 移入后会超过MaxImmutableMemory时先把已有的immutables刷盘，刷盘失败时不切换
+func (lsm *LSM) rotate() error {
+	size := lsm.memTable.Size()
+	if lsm.option.exceedsImmutableMemory(atomic.LoadInt64(&lsm.immutableMemory), size, len(lsm.immutables)) {
+		if err := lsm.flushImmutables(); err != nil {
 			return err
 		}
-		err = immutable.close()
-		utils.Panic(err)
 	}
-	if len(lsm.immutables) != 0 {
-		// TODO 将lsm的immutables队列置空，这里可以优化一下节省内存空间
-		lsm.immutables = make([]*memTable, 0)
+	// 新的fid与已有文件冲突时不切换，冻结存储而不是覆盖文件
+	mt, err := lsm.NewMemtable()
+	if err != nil {
+		return lsm.freeze(err)
 	}
-	return err
+	lsm.immutables = append(lsm.immutables, lsm.memTable)
+	atomic.AddInt32(&lsm.numImmutables, 1)
+	atomic.AddInt64(&lsm.immutableMemory, size)
+	lsm.memTable = mt
+	lsm.publishMemTables()
+	return nil
+}
+
+// checkStoreSize 写入前检查存储总大小，持有写锁时调用，不在这里合并
+// 已经过期的entry是删除标记，总是允许写入
+func (lsm *LSM) checkStoreSize(entries ...*utils.Entry) error {
+	if lsm.option.MaxStoreSize <= 0 {
+		return nil
+	}
+	var need int64
+	for _, entry := range entries {
+		if !isDeletedOrExpired(entry.Meta, entry.ExpiresAt) {
+			need += lsm.option.walSize(entry)
+		}
+	}
+	if need == 0 {
+		return nil
+	}
+	if lsm.storeSize()+need > lsm.option.MaxStoreSize {
+		atomic.StoreInt32(&lsm.storeFull, 1)
+		return utils.ErrStoreFull
+	}
+	atomic.StoreInt32(&lsm.storeFull, 0)
+	return nil
+}
+
+// reclaimStoreSpace 在写锁之外执行一次合并，尝试回收超过MaxStoreSize的空间，返回是否发生了合并
+// 开启SyncCompaction时不合并，由调用方执行CompactAll
+func (lsm *LSM) reclaimStoreSpace() bool {
+	if lsm.option.SyncCompaction {
+		return false
+	}
+	return lsm.levels.runOnce(0)
+}
+
+// storeSize 当前所有sst文件与wal文件已写入数据的总大小
+func (lsm *LSM) storeSize() int64 {
+	size := lsm.levels.totalSize()
+	if lsm.memTable != nil {
+		size += int64(lsm.memTable.wal.Size())
+	}
+	for _, imm := range lsm.immutables {
+		size += int64(imm.wal.Size())
+	}
+	return size
+}
+
+// FindOrphans 返回工作目录中存在但manifest未引用的sst id
+func (lsm *LSM) FindOrphans() []uint64 {
+	return lsm.levels.manifestFile.FindOrphans(utils.LoadSSTIdMap(lsm.option.WorkDir))
+}
+
+// SetMeta 在manifest中记录一项用户元数据，例如schema版本与创建时间，便于工具检查兼容性
+// 元数据与数据的key空间相互独立，manifest覆写后仍然保留
+func (lsm *LSM) SetMeta(key, value []byte) error {
+	if err := lsm.IsFrozen(); err != nil {
+		return err
+	}
+	return lsm.freeze(lsm.levels.manifestFile.SetMeta(key, value))
+}
+
+// GetMeta 返回SetMeta记录的元数据
+func (lsm *LSM) GetMeta(key []byte) ([]byte, bool) {
+	return lsm.levels.manifestFile.GetMeta(key)
+}
+
+// CompactTables 将指定id的sst合并到下一层
+func (lsm *LSM) CompactTables(ids []uint64) error {
+	return lsm.levels.compactTables(ids)
+}
+
+// RotateMemtable 提前切换当前memtable并刷盘，刷盘后删除它的wal，适合在计划维护前释放wal占用的空间
+// memtable为空时只刷盘已有的immutables
+func (lsm *LSM) RotateMemtable() error {
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	if err := lsm.IsFrozen(); err != nil {
+		return err
+	}
+	if lsm.memTable.entries != 0 {
+		if err := lsm.rotate(); err != nil {
+			return err
+		}
+	}
+	return lsm.flushImmutables()
+}
+
+// FlushToLevel 将当前memtable刷盘后直接放入level层，跳过从L0逐层合并下去的过程
+// 适合key全局有序、互不重叠的批量导入；调用方需要保证这一点，与0到level层中的sst重叠时返回ErrFlushOverlap
+// 已有的immutables先按正常流程刷到L0，memtable为空时不做任何事
+func (lsm *LSM) FlushToLevel(level int) error {
+	if level < 0 || level >= len(lsm.levels.levels) {
+		return fmt.Errorf("invalid level %d", level)
+	}
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	if err := lsm.IsFrozen(); err != nil {
+		return err
+	}
+	if err := lsm.flushImmutables(); err != nil {
+		return err
+	}
+	if lsm.memTable.entries == 0 {
+		return nil
+	}
+	if err := lsm.levels.flushToLevel(lsm.memTable, level); err != nil {
+		if errors.Is(err, utils.ErrFlushOverlap) {
+			return err
+		}
+		return lsm.freeze(err)
+	}
+	mt, err := lsm.NewMemtable()
+	if err != nil {
+		return lsm.freeze(err)
+	}
+	old := lsm.memTable
+	lsm.memTable = mt
+	lsm.publishMemTables()
+	utils.Panic(old.closeFlushed())
+	return nil
+}
+
+// CompactAll 在当前协程中反复合并，直到没有得分达到1的level，合并失败只记录日志
+// 返回时本次调用发起的合并均已完成
+func (lsm *LSM) CompactAll() error {
+	// 非0的id不会无条件合并L0，L0同样要达到NumLevelZeroTables
+	for lsm.levels.runOnce(1) {
+	}
+	return lsm.IsFrozen()
+}
+
+// Verify 读取所有sst的每个block并校验checksum
+func (lsm *LSM) Verify() error {
+	return lsm.levels.verify()
+}
+
+// TableChecksum 返回manifest中记录的sst整个文件的crc32与重新读取文件计算的结果，用于怀疑某一个sst损坏时单独检查
+// 计算期间持有sst的引用，合并不会删除它，不需要停止读写；之前注册时只记录了占位checksum的sst返回utils.ErrNoTableChecksum
+func (lsm *LSM) TableChecksum(id uint64) (stored uint64, actual uint64, match bool, err error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	t := lsm.levels.findTable(id)
+	if t == nil {
+		return 0, 0, false, errors.Errorf("table %d not found", id)
+	}
+	defer t.DecrRef()
+	if actual, err = fileChecksum(t.ss.Name()); err != nil {
+		return 0, 0, false, errors.Wrapf(err, "checksum table %d", id)
+	}
+	checksum, ok := lsm.levels.manifestFile.TableChecksum(id)
+	if !ok {
+		return 0, actual, false, errors.Errorf("table %d not found in manifest", id)
+	}
+	if len(checksum) != 8 {
+		return 0, actual, false, errors.Wrapf(utils.ErrNoTableChecksum, "table %d", id)
+	}
+	stored = utils.BytesToU64(checksum)
+	return stored, actual, stored == actual, nil
+}
+
+// Version 返回user key最新版本的时间戳，key不存在或最新版本已经删除、过期时返回false
+// 查找顺序与Get相同，只读取key而不解码value
+func (lsm *LSM) Version(key []byte) (uint64, bool, error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	return lsm.version(key)
+}
+
+func (lsm *LSM) version(key []byte) (uint64, bool, error) {
+	seekKey := utils.KeyWithTs(key, math.MaxUint64)
+	if !lsm.option.acceptKey(seekKey) {
+		return 0, false, nil
+	}
+	for _, mt := range lsm.memTables() {
+		if ts, deleted, ok := mt.version(seekKey); ok {
+			return ts, !deleted, nil
+		}
+	}
+	ts, deleted, ok, err := lsm.levels.version(seekKey)
+	if err != nil || !ok || deleted {
+		return 0, false, err
+	}
+	return ts, true, nil
+}
+
+// GetAllVersions 返回user key在内存表与各个level中保留的所有版本，按从新到旧排序，entry的Version为版本号
+// 重叠的L0 sst中版本相同的entry只返回一次；有value无法解压时返回错误，而不是只返回前面的版本
+func (lsm *LSM) GetAllVersions(key []byte) ([]*utils.Entry, error) {
+	seekKey := utils.KeyWithTs(key, math.MaxUint64)
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	var entries []*utils.Entry
+	for iter.Seek(seekKey); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		if !utils.SameKey(seekKey, e.Key) {
+			break
+		}
+		entries = append(entries, &utils.Entry{
+			Key:       utils.Copy(e.Key),
+			Value:     utils.Copy(e.Value),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+			Version:   utils.ParseTs(e.Key),
+		})
+	}
+	if err := iter.(*Iterator).Error(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Locate 返回Get读到key时命中的数据源，便于把慢查询对应到具体的sst
+// 在内存表中命中时level为-1、tableID为0，没有找到时found为false
+func (lsm *LSM) Locate(key []byte) (level int, tableID uint64, found bool, err error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	if !lsm.option.acceptKey(key) {
+		return -1, 0, false, nil
+	}
+	for _, mt := range lsm.memTables() {
+		if entry, _ := mt.Get(key); entry != nil {
+			return -1, 0, true, nil
+		}
+	}
+	entry, level, t, err := lsm.levels.locate(key, &ReadStats{})
+	if entry == nil {
+		if err == utils.ErrKeyNotFound {
+			err = nil
+		}
+		return -1, 0, false, err
+	}
+	return level, t.fid, true, nil
+}
+
+// GetOptions 调整单次Get的行为，零值与Get相同
+type GetOptions struct {
+	// BypassCache 不读取也不填充row cache，用于区分缓存的问题与磁盘上的损坏
+	// sst没有block缓存，block总是从文件中读取并重新校验checksum
+	BypassCache bool
 }
 
 // Get _
 func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
+	return lsm.GetWithOptions(key, GetOptions{})
+}
+
+// GetWithOptions 与Get相同，按opts读取，查找顺序仍然是内存表、immutables再到各个level
+func (lsm *LSM) GetWithOptions(key []byte, opts GetOptions) (*utils.Entry, error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	if opts.BypassCache {
+		entry, err := lsm.get(key, &ReadStats{})
+		if entry != nil {
+			if derr := entry.Decompress(); derr != nil {
+				return nil, derr
+			}
+		}
+		return entry, err
+	}
+	if e := lsm.rowCache.get(key); e != nil {
+		return e, nil
+	}
+	start := lsm.rowCache.begin()
+	entry, err := lsm.get(key, &ReadStats{})
+	if entry != nil {
+		if derr := entry.Decompress(); derr != nil {
+			entry, err = nil, derr
+		}
+	}
+	if err == nil {
+		lsm.rowCache.end(key, entry, start)
+	} else {
+		lsm.rowCache.end(key, nil, start)
+	}
+	return entry, err
+}
+
+// get 查找key，返回的entry中压缩过的value还没有解压，查找过的数据源记录在stats中
+func (lsm *LSM) get(key []byte, stats *ReadStats) (*utils.Entry, error) {
 	var (
 		entry *utils.Entry
 		err   error
 	)
-	// 从内存表中查询,先查活跃表，在查不变表
-	if entry, err = lsm.memTable.Get(key); entry != nil {
-		return entry, err
+	if !lsm.option.acceptKey(key) {
+		return nil, utils.ErrKeyNotFound
 	}
-
-	for i := len(lsm.immutables) - 1; i >= 0; i-- {
-		if entry, err = lsm.immutables[i].Get(key); entry != nil {
+	// 从内存表中查询,先查活跃表，在查不变表
+	// 刷盘策略可能在后台切换memtable，这里使用发布的快照
+	for _, mt := range lsm.memTables() {
+		stats.Memtables++
+		if entry, err = mt.Get(key); entry != nil {
 			return entry, err
 		}
 	}
 	// 从level manger查询
-	return lsm.levels.Get(key)
+	return lsm.levels.get(key, stats)
 }
@@ -1,20 +1,36 @@
 package lsm
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"lsm/file"
+	"lsm/file/osFile"
+	"lsm/pb"
 	"lsm/utils"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
 var (
 	// 初始化opt
 
-	opt = &lsmOptions{
+	opt = &Options{
 		WorkDir:             "../work_test",
 		SSTableMaxSz:        1024,
 		MemTableSize:        1024,
@@ -67,11 +83,4598 @@ func TestCompact(t *testing.T) {
 	runTest(test, 10)
 }
 
+// TestMaxStoreSize 超过存储上限后拒绝写入，回收空间后恢复写入
+func TestMaxStoreSize(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MaxStoreSize = 8 << 10
+	})
+	var keys [][]byte
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		e := buildEntry()
+		if err = lsm.Set(e); err == nil {
+			keys = append(keys, e.Key)
+		}
+	}
+	assert.Equal(t, utils.ErrStoreFull, err)
+	assert.True(t, lsm.storeSize() <= lsm.option.MaxStoreSize)
+	assert.Equal(t, HealthUnavailable, lsm.Health().State)
+	full := lsm.storeSize()
+
+	// 存储已满时仍然可以写入删除标记，合并到最后一层时丢弃被删除的key
+	for _, key := range keys {
+		assert.Nil(t, lsm.Set(&utils.Entry{Key: key, ExpiresAt: 1}))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	for level := 0; level < len(lsm.levels.levels); level++ {
+		var ids []uint64
+		for _, tbl := range lsm.levels.levels[level].tables {
+			ids = append(ids, tbl.fid)
+		}
+		if len(ids) > 0 {
+			assert.Nil(t, lsm.CompactTables(ids))
+		}
+	}
+	assert.True(t, lsm.storeSize() < full/2, "store size %d after compaction, %d when full", lsm.storeSize(), full)
+	_, err = lsm.Get(keys[0])
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+
+	e := buildEntry()
+	assert.Nil(t, lsm.Set(e))
+	v, err := lsm.Get(e.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, v.Value)
+	assert.True(t, lsm.Health().Writable)
+}
+
+// TestOrphanTables 未被manifest引用的sst默认保留，只有开启DeleteOrphans才会删除
+func TestOrphanTables(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, lsm.Set(buildEntry()))
+	}
+	assert.Empty(t, lsm.FindOrphans())
+	tables := lsm.levels.levels[0].tables
+	assert.NotEmpty(t, tables)
+	orphan := tables[0].fid
+	assert.Nil(t, lsm.levels.manifestFile.AddChanges([]*pb.ManifestChange{newDeleteChange(orphan)}))
+	assert.Equal(t, []uint64{orphan}, lsm.FindOrphans())
+
+	lsm = initLSM(lsm.option)
+	assert.Equal(t, []uint64{orphan}, lsm.FindOrphans())
+	_, err := os.Stat(utils.SSTableFullPath(lsm.option.WorkDir, orphan))
+	assert.Nil(t, err)
+
+	lsm.option.DeleteOrphans = true
+	lsm = initLSM(lsm.option)
+	assert.Empty(t, lsm.FindOrphans())
+	_, err = os.Stat(utils.SSTableFullPath(lsm.option.WorkDir, orphan))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestCloneStore 副本可以正常打开，且与源存储的数据一致
+func TestCloneStore(t *testing.T) {
+	src := buildTestLSM(t, nil)
+	var entries []*utils.Entry
+	for i := 0; i < 50; i++ {
+		e := buildEntry()
+		entries = append(entries, e)
+		assert.Nil(t, src.Set(e))
+	}
+	dir := t.TempDir()
+	assert.Nil(t, CloneStore(src.option.WorkDir, dir))
+
+	o := *src.option
+	o.WorkDir = dir
+	clone := initLSM(&o)
+	assert.Nil(t, clone.Verify())
+	for _, e := range entries {
+		v, err := clone.Get(e.Key)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, v.Value)
+	}
+}
+
+// TestCloneStoreDuringCompaction 复制wal之后源存储把它刷盘并合并掉，副本不能再回放这个wal，否则已经删除的key会重新出现
+func TestCloneStoreDuringCompaction(t *testing.T) {
+	src := buildTestLSM(t, nil)
+	key := utils.KeyWithTs([]byte("clone-key"), 1)
+	assert.Nil(t, src.Set(utils.NewEntry(key, []byte("v1"))))
+	defer func() { afterCloneWals = func() {} }()
+	afterCloneWals = func() {
+		afterCloneWals = func() {}
+		// 删除标记与旧版本一起合并到最后一层时整个key被丢弃
+		assert.Nil(t, src.Set(&utils.Entry{Key: utils.KeyWithTs([]byte("clone-key"), 2), ExpiresAt: 1}))
+		fid := src.memTable.wal.Fid()
+		assert.Nil(t, src.RotateMemtable())
+		assert.Nil(t, src.CompactTables([]uint64{fid}))
+		assert.Equal(t, -1, src.levels.tableLevel(fid))
+	}
+	dir := t.TempDir()
+	assert.Nil(t, CloneStore(src.option.WorkDir, dir))
+
+	o := *src.option
+	o.WorkDir = dir
+	clone := initLSM(&o)
+	_, err := clone.Get(key)
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+// TestBlockPrefixCompression 共享长前缀的key只保存差异部分，并且能够被完整还原
+func TestBlockPrefixCompression(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.BlockSize = 4 << 10
+	})
+	builder := newTableBuiler(lsm.option)
+	var keys [][]byte
+	var fullSize int
+	for i := 0; i < 1000; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("tenant-0001/type-order/uuid-%08d", i)), 1)
+		e := utils.NewEntry(key, []byte(fmt.Sprintf("v%d", i)))
+		keys = append(keys, key)
+		fullSize += int(headerSize) + len(key) + int(e.EncodedSize())
+		builder.AddKey(e)
+	}
+	var dataSize int
+	bd := builder.done()
+	for _, b := range bd.blockList {
+		dataSize += b.end
+	}
+	assert.True(t, dataSize < fullSize/2, "block size %d, without prefix compression %d", dataSize, fullSize)
+
+	tbl := openTable(lsm.levels, utils.SSTableFullPath(lsm.option.WorkDir, 1), builder)
+	assert.NotNil(t, tbl)
+	assert.Equal(t, keys[len(keys)-1], tbl.ss.MaxKey())
+	iter := tbl.NewIterator(&utils.Options{IsAsc: true})
+	i := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[i], iter.Item().Entry().Key)
+		assert.Equal(t, []byte(fmt.Sprintf("v%d", i)), iter.Item().Entry().Value)
+		i++
+	}
+	assert.Equal(t, len(keys), i)
+	assert.Nil(t, iter.Close())
+
+	// 逐个seek，其中包含了每个重启点以及重启点前后的key
+	for i, key := range keys {
+		iter := tbl.NewIterator(&utils.Options{IsAsc: true})
+		iter.Seek(key)
+		assert.True(t, iter.Valid())
+		assert.Equal(t, key, iter.Item().Entry().Key)
+		assert.Equal(t, []byte(fmt.Sprintf("v%d", i)), iter.Item().Entry().Value)
+		assert.Nil(t, iter.Close())
+	}
+}
+
+// TestStats 按已知的写入与合并操作检查统计结果
+func TestStats(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		// 每次刷盘只生成一个sst
+		o.SSTableMaxSz = 4 << 10
+		o.NumLevelZeroTables = 2
+	})
+	for i := 1; i <= 30; i++ {
+		e := buildEntry()
+		e.Key = utils.KeyWithTs(e.Key, uint64(i))
+		assert.Nil(t, lsm.Set(e))
+	}
+	s := lsm.Stats()
+	assert.Equal(t, uint64(30), s.MaxVersion)
+	assert.Equal(t, 0, s.NumImmutables)
+	assert.Equal(t, lsm.memTable.Size(), s.MemTableSize)
+	assert.Equal(t, lsm.option.MaxLevelNum, len(s.Levels))
+	l0 := s.Levels[0]
+	assert.True(t, l0.NumTables > 0)
+	assert.Equal(t, int64(l0.NumTables), s.Compaction.Flushes)
+	assert.Equal(t, lsm.levels.totalSize(), l0.Size)
+	assert.Equal(t, int64(0), s.Compaction.Compactions)
+
+	assert.True(t, lsm.levels.runOnce(0))
+	s = lsm.Stats()
+	assert.Equal(t, int64(1), s.Compaction.Compactions)
+	assert.Equal(t, int64(l0.NumTables), s.Compaction.TablesIn)
+	assert.Equal(t, l0.Size, s.Compaction.BytesIn)
+	assert.Equal(t, 0, s.Levels[0].NumTables)
+	var tables int
+	var size int64
+	for _, ls := range s.Levels {
+		tables += ls.NumTables
+		size += ls.Size
+	}
+	assert.Equal(t, int64(tables), s.Compaction.TablesOut)
+	assert.Equal(t, size, s.Compaction.BytesOut)
+	assert.Equal(t, uint64(30), s.MaxVersion)
+}
+
+// TestKeyFilter 不在KeyFilter范围内的key查询不到，但恢复时不会被丢弃，不带KeyFilter重新打开后仍然存在
+func TestKeyFilter(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	var keys [][]byte
+	for i := 0; i < 40; i++ {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("%c-%04d", 'a'+i%2, i)), 1), []byte("v"))
+		keys = append(keys, e.Key)
+		assert.Nil(t, lsm.Set(e))
+	}
+	// 最后写入的几个key还在wal中，重新打开时需要回放
+	assert.NotNil(t, lsm.memTable.sl.Search(keys[len(keys)-1]))
+
+	lsm.option.KeyFilter = func(userKey []byte) bool {
+		return userKey[0] == 'a'
+	}
+	lsm = initLSM(lsm.option)
+	// 范围外的key不加载到回放出的内存表，而是直接写入L0的sst
+	last := keys[len(keys)-1]
+	for _, mt := range lsm.memTables() {
+		assert.Nil(t, mt.sl.Search(last))
+	}
+	var inL0 bool
+	for _, tbl := range lsm.levels.levels[0].tables {
+		_, err := tbl.Serach(last, new(uint64), &ReadStats{})
+		inL0 = inL0 || err == nil
+	}
+	assert.True(t, inL0)
+	for i, key := range keys {
+		e, err := lsm.Get(key)
+		if i%2 == 0 {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v"), e.Value)
+		} else {
+			assert.Equal(t, utils.ErrKeyNotFound, err)
+		}
+	}
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, byte('a'), iter.Item().Entry().Key[0])
+	}
+	assert.Nil(t, iter.Close())
+
+	// 关闭时回放出的内存表刷盘并删除wal，范围外的key已经在sst中
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+	lsm.option.KeyFilter = nil
+	lsm = initLSM(lsm.option)
+	for _, key := range keys {
+		e, err := lsm.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), e.Value)
+	}
+}
+
+// TestVersionFunc 使用固定的版本号序列写入，检查sst中key的排列顺序
+func TestVersionFunc(t *testing.T) {
+	versions := []uint64{5, 7, 8, 12, 20, 21}
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.VersionFunc = func() uint64 {
+			v := versions[0]
+			versions = versions[1:]
+			return v
+		}
+	})
+	for _, key := range []string{"k2", "k1", "k2", "k3", "k1", "k2"} {
+		assert.Nil(t, lsm.Put([]byte(key), []byte(key)))
+	}
+	assert.Nil(t, lsm.levels.flush(lsm.memTable))
+
+	// 同一个key的新版本排在前面
+	expected := [][]byte{
+		utils.KeyWithTs([]byte("k1"), 20),
+		utils.KeyWithTs([]byte("k1"), 7),
+		utils.KeyWithTs([]byte("k2"), 21),
+		utils.KeyWithTs([]byte("k2"), 8),
+		utils.KeyWithTs([]byte("k2"), 5),
+		utils.KeyWithTs([]byte("k3"), 12),
+	}
+	var keys [][]byte
+	iter := lsm.levels.levels[0].tables[0].NewIterator(&utils.Options{IsAsc: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Item().Entry().Key)
+	}
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, expected, keys)
+
+	// 默认的oracle从已有数据中最大的版本号继续分配
+	lsm.option.VersionFunc = nil
+	assert.Equal(t, uint64(22), lsm.newOracle().newTs())
+}
+
+// TestEntryTooLarge 无法放入内存表的entry直接返回错误
+func TestEntryTooLarge(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 128
+	})
+	e := utils.NewEntry(utils.KeyWithTs([]byte("key"), 1), make([]byte, 1024))
+	assert.Equal(t, utils.ErrEntryTooLarge, lsm.Set(e))
+	fid := lsm.memTable.wal.Fid()
+	assert.Equal(t, utils.ErrEntryTooLarge, lsm.Set(e))
+	assert.Equal(t, fid, lsm.memTable.wal.Fid())
+
+	e.Value = []byte("v")
+	assert.Nil(t, lsm.Set(e))
+
+	assert.Panics(t, func() {
+		buildTestLSM(t, func(o *Options) {
+			o.MemTableSize = 16
+		})
+	})
+}
+
+// TestReadRepair 多个L0的sst中都包含同一个key时，读取会调度一次合并
+func TestReadRepair(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.ReadRepair = true
+	})
+	for i := uint64(1); i <= 3; i++ {
+		flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("key"), i), []byte("v")))
+	}
+	assert.Equal(t, 3, lsm.levels.levels[0].numTables())
+
+	// 重复读取不会阻塞，多余的调度请求被丢弃
+	key := utils.KeyWithTs([]byte("key"), 3)
+	for i := 0; i < 100; i++ {
+		_, err := lsm.Get(key)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, cap(lsm.levels.repairCh), len(lsm.levels.repairCh))
+
+	assert.True(t, lsm.levels.run(0, <-lsm.levels.repairCh))
+	assert.Equal(t, 0, lsm.levels.levels[0].numTables())
+	e, err := lsm.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), e.Value)
+}
+
+// TestBatcher 达到maxBytes时自动提交，提交的错误会返回给调用方
+func TestBatcher(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	b := lsm.NewBatcher(512)
+	first := buildEntry()
+	assert.Nil(t, b.Add(first))
+	_, err := lsm.Get(first.Key)
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+
+	var entries []*utils.Entry
+	for i := 0; i < 10; i++ {
+		e := buildEntry()
+		entries = append(entries, e)
+		assert.Nil(t, b.Add(e))
+	}
+	// 已经自动提交过，第一个entry可以读到
+	v, err := lsm.Get(first.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, first.Value, v.Value)
+	assert.Nil(t, b.Flush())
+	for _, e := range entries {
+		v, err := lsm.Get(e.Key)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, v.Value)
+	}
+
+	big := utils.NewEntry([]byte("big12345678"), make([]byte, 2048))
+	assert.Equal(t, utils.ErrEntryTooLarge, b.Add(big))
+	assert.Equal(t, utils.ErrEntryTooLarge, b.Add(buildEntry()))
+	assert.Equal(t, utils.ErrEntryTooLarge, b.Flush())
+}
+
+// TestWriteBatchWalSize WriteBatch写入wal的字节数是批次头加上逐条编码的记录，预估值不会低估，加密时同样如此
+func TestWriteBatchWalSize(t *testing.T) {
+	enc, err := utils.NewAESEncryptor(1, bytes.Repeat([]byte{7}, 32))
+	assert.Nil(t, err)
+	for _, encryptor := range []utils.Encryptor{nil, enc} {
+		lsm := buildTestLSM(t, func(o *Options) { o.Encryptor, o.MemTableSize = encryptor, 4096 })
+		var batch []*utils.Entry
+		for i := 0; i < 5; i++ {
+			batch = append(batch, buildEntry())
+		}
+		before := lsm.memTable.wal.Size()
+		assert.Nil(t, lsm.WriteBatch(batch))
+		written := int64(lsm.memTable.wal.Size() - before)
+		estimate := lsm.option.walBatchSize(batch)
+		assert.True(t, estimate >= written, "estimate %d, written %d", estimate, written)
+		var records int64
+		for _, e := range batch {
+			records += lsm.option.walSize(e)
+		}
+		assert.Equal(t, records+utils.MaxWalBatchHeaderSize, estimate)
+		if encryptor != nil {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		encoded := int64(utils.WalBatchCodec(buf, len(batch), lsm.option.WalChecksum))
+		for _, e := range batch {
+			encoded += int64(utils.WalCodec(buf, e, lsm.option.WalChecksum))
+		}
+		assert.Equal(t, encoded, written)
+		// 每条记录最多多估header与ExpiresAt的空间，批次头最多多估数量varint未用到的字节
+		assert.True(t, estimate-written <= int64(len(batch)*29+binary.MaxVarintLen32-1), "estimate %d, written %d", estimate, written)
+	}
+}
+
+// TestWALStats 写wal的字节数与每次写入、sync的耗时都计入Stats
+func TestWALStats(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.SyncWrites = true })
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, lsm.Set(buildEntry()))
+	}
+	ws := lsm.Stats().WAL
+	assert.Equal(t, int64(lsm.memTable.wal.Size()), ws.AppendBytes)
+	for _, ls := range []LatencyStats{ws.AppendLatency, ws.SyncLatency} {
+		assert.Equal(t, int64(3), ls.Count)
+		assert.True(t, ls.Max > 0 && ls.Max <= ls.Total)
+		var n int64
+		for _, c := range ls.Buckets {
+			n += c
+		}
+		assert.Equal(t, ls.Count, n)
+	}
+
+	lsm = buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Set(buildEntry()))
+	ws = lsm.Stats().WAL
+	assert.Equal(t, int64(1), ws.AppendLatency.Count)
+	assert.Equal(t, int64(0), ws.SyncLatency.Count)
+}
+
+// TestWalTruncate wal中有效记录之后是垃圾数据时，恢复后恰好截断到最后一条有效记录的末尾
+func TestWalTruncate(t *testing.T) {
+	garbages := [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // header的varint溢出
+		{0x05, 0x03, 0x00, 'a', 'b', 'c'},                                  // 不完整的记录
+	}
+	for _, garbage := range garbages {
+		lsm := buildTestLSM(t, nil)
+		var entries []*utils.Entry
+		for i := 0; i < 5; i++ {
+			e := buildEntry()
+			entries = append(entries, e)
+			assert.Nil(t, lsm.Set(e))
+		}
+		wal := lsm.memTable.wal
+		end := wal.Size()
+		f, err := os.OpenFile(wal.Name(), os.O_RDWR, 0)
+		assert.Nil(t, err)
+		_, err = f.WriteAt(garbage, int64(end))
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+
+		mt, err := lsm.RecoveryMemTable(wal.Fid())
+		assert.Nil(t, err)
+		fi, err := os.Stat(wal.Name())
+		assert.Nil(t, err)
+		assert.Equal(t, int64(end), fi.Size())
+		assert.Equal(t, end, mt.wal.Size())
+		for _, e := range entries {
+			v, _ := mt.Get(e.Key)
+			assert.NotNil(t, v)
+		}
+		// 不允许截断到有效记录之前
+		assert.Equal(t, utils.ErrTruncateValidData, errors.Cause(mt.wal.Truncate(int64(end)-1)))
+	}
+}
+
+// TestWalChecksum 使用xxhash写入的wal可以正常回放，按记录的标记选择算法，损坏的记录仍然能被发现
+func TestWalChecksum(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.WalChecksum = utils.ChecksumXXHash })
+	var keys [][]byte
+	for i := 0; i < 5; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1)
+		keys = append(keys, key)
+		assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte("value"))))
+	}
+	wal := lsm.memTable.wal
+	end := wal.Size()
+	data, err := os.ReadFile(wal.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, utils.WalChecksumTag, data[0])
+
+	// 回放时不依赖当前的配置
+	lsm.option.WalChecksum = utils.ChecksumCRC32
+	mt, err := lsm.RecoveryMemTable(wal.Fid())
+	assert.Nil(t, err)
+	assert.Equal(t, end, mt.wal.Size())
+	for _, key := range keys {
+		e, _ := mt.Get(key)
+		assert.NotNil(t, e)
+	}
+
+	// 改动最后一条记录value的最后一个字节，回放在它之前停止
+	f, err := os.OpenFile(wal.Name(), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{'x'}, int64(end)-crc32.Size-1)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	mt, err = lsm.RecoveryMemTable(wal.Fid())
+	assert.Nil(t, err)
+	assert.Less(t, mt.wal.Size(), end)
+	for i, key := range keys {
+		e, _ := mt.Get(key)
+		assert.Equal(t, i < len(keys)-1, e != nil)
+	}
+}
+
+// TestSSTableOrder 打开时检查出乱序的sst，修复模式下重新排序后替换
+func TestSSTableOrder(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	builder := newTableBuiler(lsm.option)
+	for _, k := range []string{"a", "c", "b", "d"} {
+		builder.add(utils.NewEntry(utils.KeyWithTs([]byte(k), 1), []byte(k)), false)
+	}
+	fid := lsm.levels.maxFID + 1
+	lsm.levels.maxFID = fid
+	tbl := openTable(lsm.levels, utils.SSTableFullPath(lsm.option.WorkDir, fid), builder)
+	assert.Nil(t, lsm.levels.manifestFile.AddTableMeta(0, &file.TableMeta{ID: fid, Checksum: []byte{'m', 'o', 'c', 'k'}}))
+	lsm.levels.levels[0].add(tbl)
+
+	assert.Nil(t, lsm.levels.checkTableOrder())
+	lsm.option.CheckSSTableOrder = true
+	err := lsm.levels.checkTableOrder()
+	assert.Equal(t, utils.ErrSSTableOrder, errors.Cause(err))
+	assert.Contains(t, err.Error(), fmt.Sprintf("table %d block 0", fid))
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	// 打开时检查出乱序返回错误
+	_, err = Open(*lsm.option)
+	assert.Equal(t, utils.ErrSSTableOrder, errors.Cause(err))
+
+	lsm.option.RepairSSTableOrder = true
+	lsm = initLSM(lsm.option)
+	manifest := lsm.levels.manifestFile.GetManifest()
+	_, ok := manifest.Tables[fid]
+	assert.False(t, ok)
+	assert.Len(t, manifest.Tables, 1)
+	assert.Nil(t, lsm.levels.levels[0].tables[0].checkOrder())
+	for _, k := range []string{"a", "b", "c", "d"} {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(k), 1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(k), e.Value)
+	}
+}
+
+// TestL0CompactionOverlap L0合并到base level时只重写与L0的key范围重叠的sst
+func TestL0CompactionOverlap(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.NumLevelZeroTables = 1 })
+	for _, prefix := range []string{"a", "b", "c", "d"} {
+		fid := flushL0Table(t, lsm,
+			utils.NewEntry(utils.KeyWithTs([]byte(prefix+"1"), 1), []byte("v1")),
+			utils.NewEntry(utils.KeyWithTs([]byte(prefix+"2"), 1), []byte("v1")))
+		assert.Nil(t, lsm.CompactTables([]uint64{fid}))
+	}
+	baseLevel := lsm.levels.levelTargets().baseLevel
+	base := lsm.levels.levels[baseLevel]
+	assert.Equal(t, 4, base.numTables())
+	before := make(map[uint64]string)
+	for _, tbl := range base.tables {
+		before[tbl.fid] = string(utils.ParseKey(tbl.ss.MinKey()))
+	}
+
+	// 新的L0表只与b开头的sst重叠
+	flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("b1"), 2), []byte("v2")))
+	tablesIn := lsm.Stats().Compaction.TablesIn
+	assert.True(t, lsm.levels.runOnce(0))
+	assert.Equal(t, 0, lsm.levels.levels[0].numTables())
+	assert.Equal(t, 4, base.numTables())
+	var minKeys []string
+	for _, tbl := range base.tables {
+		minKey := string(utils.ParseKey(tbl.ss.MinKey()))
+		minKeys = append(minKeys, minKey)
+		if _, ok := before[tbl.fid]; ok {
+			assert.NotEqual(t, "b1", minKey)
+		} else {
+			assert.Equal(t, "b1", minKey)
+		}
+	}
+	// 合并后level内的sst仍然按key有序
+	assert.Equal(t, []string{"a1", "b1", "c1", "d1"}, minKeys)
+	assert.Equal(t, tablesIn+2, lsm.Stats().Compaction.TablesIn)
+	e, err := lsm.Get(utils.KeyWithTs([]byte("b1"), 2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), e.Value)
+}
+
+// TestOnFlushComplete 每个刷盘生成的sst恰好通知一次，回调中可以读取存储
+func TestOnFlushComplete(t *testing.T) {
+	type event struct{ min, max []byte }
+	events := make(map[uint64]event)
+	var lsm *LSM
+	lsm = buildTestLSM(t, func(o *Options) {
+		o.OnFlushComplete = func(tableID uint64, minKey, maxKey []byte) {
+			_, ok := events[tableID]
+			assert.False(t, ok)
+			events[tableID] = event{minKey, maxKey}
+			e, err := lsm.Get(minKey)
+			assert.Nil(t, err)
+			assert.NotNil(t, e)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key-%04d", i)), 1), make([]byte, 32))
+		assert.Nil(t, lsm.Set(e))
+	}
+	l0 := lsm.levels.levels[0]
+	assert.True(t, len(events) > 1)
+	assert.Equal(t, l0.numTables(), len(events))
+	for _, tbl := range l0.tables {
+		e, ok := events[tbl.fid]
+		assert.True(t, ok)
+		assert.Equal(t, tbl.ss.MinKey(), e.min)
+		assert.Equal(t, tbl.ss.MaxKey(), e.max)
+	}
+}
+
+// TestFlushPolicy 写入很慢时按MaxAge刷盘，写入很快时按MaxEntries刷盘
+func TestFlushPolicy(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.FlushPolicy = FlushPolicy{MaxAge: 50 * time.Millisecond}
+	})
+	var keys [][]byte
+	for i := 0; i < 3; i++ {
+		e := buildEntry()
+		keys = append(keys, e.Key)
+		assert.Nil(t, lsm.Set(e))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool {
+		return lsm.Stats().Compaction.Flushes == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	lsm.writeLock.Lock()
+	assert.Equal(t, 0, lsm.memTable.entries)
+	lsm.writeLock.Unlock()
+	for _, key := range keys {
+		e, err := lsm.Get(key)
+		assert.Nil(t, err)
+		assert.NotNil(t, e)
+	}
+
+	lsm = buildTestLSM(t, func(o *Options) {
+		o.FlushPolicy = FlushPolicy{MaxEntries: 4}
+	})
+	for i := 0; i < 9; i++ {
+		assert.Nil(t, lsm.Set(buildEntry()))
+	}
+	assert.Equal(t, int64(2), lsm.Stats().Compaction.Flushes)
+	assert.Equal(t, 1, lsm.memTable.entries)
+}
+
+// TestVersion 依次在base level、L0与内存表中写入更新的版本，Version总是返回最新的版本，最新版本删除后返回false
+func TestVersion(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	key := []byte("key")
+	_, ok, err := lsm.Version(key)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	fid := flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs(key, 1), []byte("v1")))
+	assert.Nil(t, lsm.CompactTables([]uint64{fid}))
+	ts, ok, err := lsm.Version(key)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), ts)
+
+	for i := uint64(2); i <= 3; i++ {
+		flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs(key, i), []byte("v")))
+		ts, ok, err = lsm.Version(key)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, i, ts)
+	}
+
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs(key, 4), []byte("v4"))))
+	ts, ok, err = lsm.Version(key)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), ts)
+
+	// 最新版本是删除标记时key不存在，不返回更旧的版本，删除标记刷盘到L0后同样如此
+	assert.Nil(t, lsm.Set(&utils.Entry{Key: utils.KeyWithTs(key, 5), ExpiresAt: 1}))
+	_, ok, err = lsm.Version(key)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, lsm.RotateMemtable())
+	_, ok, err = lsm.Version(key)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs(key, 6), []byte("v6"))))
+	ts, ok, err = lsm.Version(key)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(6), ts)
+
+	// 前缀相同的其他key不影响结果
+	_, ok, err = lsm.Version([]byte("ke"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+// TestCompareAndSwap 多个协程基于同一个版本并发写入，只有一个能成功
+func TestCompareAndSwap(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	key := []byte("counter")
+	ok, err := lsm.CompareAndSwap(key, []byte("0"), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// key已经存在
+	ok, err = lsm.CompareAndSwap(key, []byte("x"), 0)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	version, _, err := lsm.Version(key)
+	assert.Nil(t, err)
+	var (
+		wg   sync.WaitGroup
+		wins int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := lsm.CompareAndSwap(key, []byte(fmt.Sprintf("%d", i)), version)
+			assert.Nil(t, err)
+			if ok {
+				atomic.AddInt32(&wins, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), wins)
+	newVersion, ok, err := lsm.Version(key)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, newVersion > version)
+
+	// 删除后key视为不存在，基于删除前或删除标记的版本都不能写入
+	deleted := lsm.MakeKey(key)
+	assert.Nil(t, lsm.Set(&utils.Entry{Key: deleted, ExpiresAt: 1}))
+	for _, expected := range []uint64{newVersion, utils.ParseTs(deleted)} {
+		ok, err = lsm.CompareAndSwap(key, []byte("x"), expected)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+	ok, err = lsm.CompareAndSwap(key, []byte("recreated"), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	version, ok, err = lsm.Version(key)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	e, err := lsm.Get(utils.KeyWithTs(key, version))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("recreated"), e.Value)
+	}
+}
+
+// TestRecoveryProgress 回放多个wal时，每个wal的进度单调递增并在结束时到达文件大小
+func TestRecoveryProgress(t *testing.T) {
+	defer func(interval int64) { recoveryProgressInterval = interval }(recoveryProgressInterval)
+	recoveryProgressInterval = 256
+
+	lsm := buildTestLSM(t, nil)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			assert.Nil(t, lsm.memTable.set(buildEntry()))
+		}
+		lsm.rotate()
+	}
+	type progress struct{ done, total int64 }
+	reports := make(map[uint64][]progress)
+	lsm.option.RecoveryProgress = func(fid uint64, done, total int64) {
+		reports[fid] = append(reports[fid], progress{done, total})
+	}
+	lsm = initLSM(lsm.option)
+	assert.Len(t, lsm.immutables, 3)
+	for _, imm := range lsm.immutables {
+		rs := reports[imm.wal.Fid()]
+		assert.True(t, len(rs) > 1)
+		for i := 1; i < len(rs); i++ {
+			assert.True(t, rs[i].done > rs[i-1].done)
+		}
+		last := rs[len(rs)-1]
+		assert.Equal(t, last.total, last.done)
+	}
+}
+
+// TestPlanCompaction 规划结果与随后真正执行的合并一致，规划本身不改变存储
+func TestPlanCompaction(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.NumLevelZeroTables = 2 })
+	base := flushL0Table(t, lsm,
+		utils.NewEntry(utils.KeyWithTs([]byte("a"), 1), []byte("v")),
+		utils.NewEntry(utils.KeyWithTs([]byte("c"), 1), []byte("v")))
+	assert.Nil(t, lsm.CompactTables([]uint64{base}))
+	for i := uint64(2); i <= 4; i++ {
+		flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("b"), i), []byte("v")))
+	}
+
+	plans := lsm.PlanCompaction()
+	assert.NotEmpty(t, plans)
+	plan := plans[0]
+	assert.Equal(t, 0, plan.Level)
+	assert.Len(t, plan.Tables, 3)
+	assert.Len(t, plan.NextTables, 1)
+	assert.True(t, plan.InputSize > 0 && plan.EstimatedOutputSize <= plan.InputSize)
+	assert.True(t, plan.WriteAmplification > 1)
+	assert.False(t, lsm.levels.compactState.running())
+	assert.Equal(t, plans, lsm.PlanCompaction())
+
+	before := lsm.Stats().Compaction
+	assert.True(t, lsm.levels.runOnce(0))
+	after := lsm.Stats().Compaction
+	assert.Equal(t, int64(len(plan.Tables)+len(plan.NextTables)), after.TablesIn-before.TablesIn)
+	assert.Equal(t, plan.InputSize, after.BytesIn-before.BytesIn)
+	manifest := lsm.levels.manifestFile.GetManifest()
+	for _, fid := range append(plan.Tables, plan.NextTables...) {
+		_, ok := manifest.Tables[fid]
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 0, lsm.levels.levels[0].numTables())
+	assert.Equal(t, 1, lsm.levels.levels[plan.NextLevel].numTables())
+}
+
+// TestFrozen 刷盘时manifest写入失败后进入只读状态，拒绝写入但继续服务读取
+func TestFrozen(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("sst"), 1), []byte("v1")))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("imm"), 2), []byte("v2"))))
+	assert.Nil(t, lsm.IsFrozen())
+
+	// 关闭manifest文件，模拟磁盘变为只读
+	assert.Nil(t, lsm.levels.manifestFile.Close())
+	lsm.writeLock.Lock()
+	lsm.rotate()
+	lsm.writeLock.Unlock()
+	err := lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("mem"), 3), []byte("v3")))
+	assert.True(t, errors.Is(err, utils.ErrStoreFrozen))
+	assert.Equal(t, err, lsm.IsFrozen())
+	assert.Equal(t, 1, len(lsm.immutables))
+
+	err = lsm.Put([]byte("rejected"), []byte("v"))
+	assert.True(t, errors.Is(err, utils.ErrStoreFrozen))
+	ok, err := lsm.CompareAndSwap([]byte("rejected"), []byte("v"), 0)
+	assert.False(t, ok)
+	assert.True(t, errors.Is(err, utils.ErrStoreFrozen))
+	assert.True(t, errors.Is(lsm.WriteBatch([]*utils.Entry{
+		utils.NewEntry(utils.KeyWithTs([]byte("rejected"), 4), []byte("v"))}), utils.ErrStoreFrozen))
+	assert.False(t, lsm.levels.runOnce(0))
+
+	for i, key := range []string{"sst", "imm", "mem"} {
+		entry, err := lsm.Get(utils.KeyWithTs([]byte(key), uint64(i+1)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("v%d", i+1), string(entry.Value))
+	}
+	_, found, err := lsm.Version([]byte("rejected"))
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+// TestIteratorLevels 只合并指定level的数据源
+func TestIteratorLevels(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	ln := flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("ln"), 1), []byte("v")))
+	assert.Nil(t, lsm.CompactTables([]uint64{ln}))
+	flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("l0"), 2), []byte("v")))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("mem"), 3), []byte("v"))))
+	baseLevel := lsm.levels.levelTargets().baseLevel
+
+	keys := func(opt *utils.Options) []string {
+		iter := lsm.NewIterator(opt)
+		defer iter.Close()
+		var out []string
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			out = append(out, string(utils.ParseKey(iter.Item().Entry().Key)))
+		}
+		return out
+	}
+	assert.Equal(t, []string{"l0", "ln", "mem"}, keys(&utils.Options{}))
+	assert.Equal(t, []string{"l0"}, keys(&utils.Options{FilterLevels: true, MinLevel: 0, MaxLevel: 0}))
+	assert.Equal(t, []string{"ln"}, keys(&utils.Options{FilterLevels: true, MinLevel: baseLevel, MaxLevel: baseLevel}))
+	assert.Equal(t, []string{"l0", "mem"}, keys(&utils.Options{FilterLevels: true, MinLevel: -1, MaxLevel: 0}))
+	assert.Nil(t, keys(&utils.Options{FilterLevels: true, MinLevel: 1, MaxLevel: baseLevel - 1}))
+
+	// 只遍历内存表时不会打开任何sst的迭代器
+	refs := func() (n int32) {
+		for _, lh := range lsm.levels.levels {
+			for _, tbl := range lh.tables {
+				n += atomic.LoadInt32(&tbl.ref)
+			}
+		}
+		return n
+	}
+	before := refs()
+	iter := lsm.NewIterator(&utils.Options{FilterLevels: true, MinLevel: -1, MaxLevel: -1})
+	var memKeys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		memKeys = append(memKeys, string(utils.ParseKey(iter.Item().Entry().Key)))
+	}
+	assert.Equal(t, before, refs())
+	assert.Nil(t, iter.Close())
+	assert.Equal(t, []string{"mem"}, memKeys)
+}
+
+// TestFlushToLevel 不重叠的内存表直接刷到L3，不经过合并
+func TestFlushToLevel(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	for _, key := range []string{"a", "b"} {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(key), 1), []byte(key))))
+	}
+	assert.Nil(t, lsm.FlushToLevel(3))
+	for i, lh := range lsm.levels.levels {
+		if i == 3 {
+			assert.Equal(t, 1, lh.numTables())
+		} else {
+			assert.Equal(t, 0, lh.numTables())
+		}
+	}
+	assert.Equal(t, int64(0), lsm.Stats().Compaction.Compactions)
+	assert.Equal(t, int64(1), lsm.Stats().Compaction.Flushes)
+
+	// 与L3或L0重叠时拒绝，内存表保持不变
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("ab"), 2), []byte("ab"))))
+	assert.True(t, errors.Is(lsm.FlushToLevel(3), utils.ErrFlushOverlap))
+	entry, err := lsm.Get(utils.KeyWithTs([]byte("ab"), 2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ab"), entry.Value)
+	flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("x"), 3), []byte("x")))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("x"), 4), []byte("x2"))))
+	assert.True(t, errors.Is(lsm.FlushToLevel(3), utils.ErrFlushOverlap))
+	assert.True(t, errors.Is(lsm.FlushToLevel(1), utils.ErrFlushOverlap))
+	assert.NotNil(t, lsm.FlushToLevel(len(lsm.levels.levels)))
+	assert.Nil(t, lsm.FlushToLevel(0))
+
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("z"), 5), []byte("z"))))
+	assert.Nil(t, lsm.FlushToLevel(3))
+	assert.Equal(t, 2, lsm.levels.levels[3].numTables())
+	assert.Equal(t, "a", string(utils.ParseKey(lsm.levels.levels[3].tables[0].ss.MinKey())))
+
+	// 重新打开后sst仍位于L3
+	lsm = initLSM(lsm.option)
+	assert.Equal(t, 2, lsm.levels.levels[3].numTables())
+	for _, key := range []string{"a", "b", "z"} {
+		ts, ok, err := lsm.Version([]byte(key))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		entry, err := lsm.Get(utils.KeyWithTs([]byte(key), ts))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(key), entry.Value)
+	}
+}
+
+// TestSSTableFooterChecksum 索引、footer或最后一个block损坏的sst打开失败，BestEffortRead下跳过
+func TestSSTableFooterChecksum(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// offset 根据sst的大小与索引长度计算要翻转的字节
+		offset func(size, idxLen int64) int64
+		msg    string
+	}{
+		{"index", func(size, idxLen int64) int64 { return size - 24 - idxLen }, "index checksum"},
+		{"footer", func(size, idxLen int64) int64 { return size - 24 }, "footer checksum"},
+		// 只有一个block，打开时读取最大key的block校验失败
+		{"last block", func(size, idxLen int64) int64 { return 0 }, "read max key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lsm := buildTestLSM(t, nil)
+			bad := flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("bad"), 1), []byte("v")))
+			flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("good"), 2), []byte("v")))
+
+			// 末尾依次为 | index len | checksum(8) | checksum len | footer checksum(8) |
+			f, err := os.OpenFile(utils.SSTableFullPath(lsm.option.WorkDir, bad), os.O_RDWR, 0)
+			assert.Nil(t, err)
+			fi, err := f.Stat()
+			assert.Nil(t, err)
+			buf := make([]byte, 4)
+			_, err = f.ReadAt(buf, fi.Size()-24)
+			assert.Nil(t, err)
+			off := tc.offset(fi.Size(), int64(utils.BytesToU32(buf)))
+			_, err = f.ReadAt(buf[:1], off)
+			assert.Nil(t, err)
+			buf[0] ^= 0xff
+			_, err = f.WriteAt(buf[:1], off)
+			assert.Nil(t, err)
+			assert.Nil(t, f.Close())
+
+			func() {
+				defer func() {
+					err, _ := recover().(error)
+					assert.Equal(t, utils.ErrChecksumMismatch, errors.Cause(err))
+					assert.Contains(t, err.Error(), fmt.Sprintf("open table %d", bad))
+					assert.Contains(t, err.Error(), tc.msg)
+				}()
+				initLSM(lsm.option)
+			}()
+
+			lsm.option.BestEffortRead = true
+			lsm = initLSM(lsm.option)
+			assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+			_, err = lsm.levels.Get(utils.KeyWithTs([]byte("bad"), 1))
+			assert.Equal(t, utils.ErrKeyNotFound, err)
+			entry, err := lsm.levels.Get(utils.KeyWithTs([]byte("good"), 2))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v"), entry.Value)
+		})
+	}
+}
+
+// TestGetAllVersions 返回分布在内存表与L0中的所有版本，重叠sst中的相同版本只返回一次
+func TestGetAllVersions(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	flushL0Table(t, lsm,
+		utils.NewEntry(utils.KeyWithTs([]byte("k"), 1), []byte("v1")),
+		utils.NewEntry(utils.KeyWithTs([]byte("k0"), 1), []byte("other")))
+	flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("k"), 2), []byte("v2")))
+	flushL0Table(t, lsm,
+		utils.NewEntry(utils.KeyWithTs([]byte("k"), 2), []byte("v2")),
+		utils.NewEntry(utils.KeyWithTs([]byte("kk"), 2), []byte("other")))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("k"), 3), []byte("v3"))))
+
+	entries, err := lsm.GetAllVersions([]byte("k"))
+	assert.Nil(t, err)
+	var (
+		versions []uint64
+		values   []string
+	)
+	for _, e := range entries {
+		versions = append(versions, e.Version)
+		values = append(values, string(e.Value))
+		assert.Equal(t, "k", string(utils.ParseKey(e.Key)))
+	}
+	assert.Equal(t, []uint64{3, 2, 1}, versions)
+	assert.Equal(t, []string{"v3", "v2", "v1"}, values)
+
+	entries, err = lsm.GetAllVersions([]byte("missing"))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	// 调用方不能使用BitValueCompressed
+	reserved := utils.NewEntry(utils.KeyWithTs([]byte("r"), 1), []byte("plain"))
+	reserved.Meta = utils.BitValueCompressed
+	assert.Equal(t, utils.ErrReservedMeta, lsm.Set(reserved))
+	assert.Equal(t, utils.ErrReservedMeta, lsm.WriteBatch([]*utils.Entry{reserved}))
+
+	// 无法解压的value
+	bad := &utils.Entry{Key: utils.KeyWithTs([]byte("k"), 4), Value: []byte("not compressed"), Meta: utils.BitValueCompressed}
+	assert.Nil(t, lsm.memTable.set(bad))
+	_, err = lsm.GetAllVersions([]byte("k"))
+	assert.NotNil(t, err)
+}
+
+// TestSyncCompaction 开启SyncCompaction后不启动合并协程，只在显式调用时合并
+func TestSyncCompaction(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 2
+	})
+	lsm.StartCompacter()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&lsm.levels.compacters))
+	for i := uint64(1); i <= 4; i++ {
+		flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("k"), i), []byte("v")))
+	}
+	assert.Nil(t, lsm.WaitForIdle(context.Background()))
+	assert.Equal(t, 4, lsm.levels.levels[0].numTables())
+	assert.Equal(t, int64(0), lsm.Stats().Compaction.Compactions)
+
+	assert.Nil(t, lsm.CompactAll())
+	assert.True(t, lsm.Stats().Compaction.Compactions > 0)
+	assert.True(t, lsm.levels.levels[0].numTables() < 2)
+	for _, p := range lsm.levels.pickCompactLevels() {
+		assert.True(t, p.adjusted < 1)
+	}
+	entry, err := lsm.Get(utils.KeyWithTs([]byte("k"), 4))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), entry.Value)
+}
+
+// TestVersionCheckpoint 刷盘时manifest记录版本号检查点，重新打开后分配的版本号不会回退
+func TestVersionCheckpoint(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("v")))
+	// 分配出去但没有写入sst的版本号同样被检查点覆盖
+	for i := 0; i < 10; i++ {
+		lsm.orc.newTs()
+	}
+	handedOut := lsm.orc.newTs()
+	assert.Nil(t, lsm.FlushToLevel(0))
+	assert.Equal(t, handedOut, lsm.levels.manifestFile.GetManifest().MaxVersion)
+	assert.True(t, lsm.levels.maxVersion() < handedOut)
+
+	lsm = initLSM(lsm.option)
+	assert.Equal(t, handedOut, lsm.levels.manifestFile.GetManifest().MaxVersion)
+	assert.True(t, lsm.orc.newTs() > handedOut)
+
+	// 检查点之后的版本号从wal中恢复
+	assert.Nil(t, lsm.Put([]byte("b"), []byte("v")))
+	last, ok, err := lsm.Version([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	lsm = initLSM(lsm.option)
+	assert.True(t, lsm.orc.newTs() > last)
+}
+
+// TestWriteStall 合并被限速时，写入会在L0达到L0StopThreshold后阻塞，L0不会无限增长
+func TestWriteStall(t *testing.T) {
+	var (
+		lsm   *LSM
+		maxL0 int32
+	)
+	lsm = buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.SSTableMaxSz = 4 << 10 // 每次刷盘只生成一个sst
+		o.NumLevelZeroTables = 2
+		o.L0StallThreshold = 3
+		o.L0StopThreshold = 5
+		o.OnFlushComplete = func(uint64, []byte, []byte) {
+			if n := int32(lsm.levels.levels[0].numTables()); n > atomic.LoadInt32(&maxL0) {
+				atomic.StoreInt32(&maxL0, n)
+			}
+		}
+	})
+	assert.Equal(t, WriteStallNone, lsm.Stats().WriteStall.State)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// 每20毫秒只做一次合并
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				lsm.levels.runOnce(0)
+			}
+		}
+	}()
+	value := make([]byte, 100)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%05d", i)), value))
+	}
+	close(done)
+	wg.Wait()
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxL0), int32(5))
+	stall := lsm.Stats().WriteStall
+	assert.Greater(t, stall.Delays, int64(0))
+	assert.Greater(t, stall.Stops, int64(0))
+	assert.Greater(t, stall.StallTime, time.Duration(0))
+	for i := 0; i < 300; i++ {
+		_, ok, err := lsm.Version([]byte(fmt.Sprintf("key%05d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+}
+
+// TestDisableSyncDir 关闭目录sync后读写、刷盘、合并与重新打开的结果不变
+func TestDisableSyncDir(t *testing.T) {
+	type shape struct {
+		tables []int
+		values []string
+	}
+	run := func(disable bool) shape {
+		lsm := buildTestLSM(t, func(o *Options) {
+			o.DisableSyncDir = disable
+			o.SyncCompaction = true
+			o.NumLevelZeroTables = 2
+		})
+		for i := 0; i < 4; i++ {
+			assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("v%d", i))))
+			assert.Nil(t, lsm.FlushToLevel(0))
+		}
+		assert.Nil(t, lsm.CompactAll())
+		lsm = initLSM(lsm.option)
+		var out shape
+		for _, lh := range lsm.levels.levels {
+			out.tables = append(out.tables, lh.numTables())
+		}
+		for i := 0; i < 4; i++ {
+			entries, err := lsm.GetAllVersions([]byte(fmt.Sprintf("key%d", i)))
+			assert.Nil(t, err)
+			assert.Len(t, entries, 1)
+			out.values = append(out.values, string(entries[0].Value))
+		}
+		return out
+	}
+	synced := run(false)
+	assert.Equal(t, []string{"v0", "v1", "v2", "v3"}, synced.values)
+	assert.Equal(t, synced, run(true))
+}
+
+// TestAmplification 写入、刷盘与合并的字节数分别计入写放大的分子与分母
+func TestAmplification(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.SyncCompaction = true })
+	value := make([]byte, 50)
+	var ingest int64
+	put := func() {
+		for i := 0; i < 3; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			assert.Nil(t, lsm.Put(key, value))
+			ingest += int64(len(key) + 8 + len(value))
+		}
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	put()
+	amp := lsm.Stats().Amplification
+	assert.Equal(t, ingest, amp.IngestBytes)
+	flushed := lsm.levels.levels[0].tables[0].Size()
+	assert.Equal(t, flushed, amp.TableWriteBytes)
+	assert.Equal(t, float64(flushed)/float64(ingest), amp.WriteAmplification)
+	assert.Equal(t, flushed, amp.LiveSize)
+	assert.Equal(t, 1.0, amp.SpaceAmplification)
+
+	// 覆盖写入相同的key后合并到L1
+	put()
+	var ids []uint64
+	flushed = 0
+	for _, tbl := range lsm.levels.levels[0].tables {
+		flushed += tbl.Size()
+		ids = append(ids, tbl.fid)
+	}
+	assert.Nil(t, lsm.CompactTables(ids))
+	s := lsm.Stats()
+	amp = s.Amplification
+	assert.Equal(t, ingest, amp.IngestBytes)
+	assert.Equal(t, flushed, s.Compaction.FlushBytes)
+	assert.Greater(t, s.Compaction.BytesOut, int64(0))
+	assert.Equal(t, flushed+s.Compaction.BytesOut, amp.TableWriteBytes)
+	assert.Greater(t, amp.WriteAmplification, 1.0)
+	assert.GreaterOrEqual(t, amp.SpaceAmplification, 1.0)
+}
+
+// TestSequenceIterator 跨sst与内存表按版本号回放写入，版本号相同时按user key排序
+func TestSequenceIterator(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.SyncCompaction = true })
+	assert.Nil(t, lsm.Put([]byte("c"), []byte("1")))
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Nil(t, lsm.Put([]byte("b"), []byte("3")))
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("4")))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("x"), 10), []byte("10x"))))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("w"), 10), []byte("10w"))))
+
+	collect := func(iter utils.Iterator) (values []string) {
+		for ; iter.Valid(); iter.Next() {
+			e := iter.Item().Entry()
+			assert.Equal(t, utils.ParseTs(e.Key), e.Version)
+			values = append(values, string(e.Value))
+		}
+		return values
+	}
+	iter, err := lsm.SequenceIterator(0)
+	assert.Nil(t, err)
+	iter.Rewind()
+	assert.Equal(t, []string{"1", "2", "3", "4", "10w", "10x"}, collect(iter))
+	iter.Seek(utils.KeyWithTs(nil, 3))
+	assert.Equal(t, []string{"3", "4", "10w", "10x"}, collect(iter))
+	iter.Seek(utils.KeyWithTs([]byte("x"), 10))
+	assert.Equal(t, []string{"10x"}, collect(iter))
+	assert.Nil(t, iter.Close())
+
+	iter, err = lsm.SequenceIterator(4)
+	assert.Nil(t, err)
+	iter.Rewind()
+	assert.Equal(t, []string{"4", "10w", "10x"}, collect(iter))
+
+	// sst的block损坏时返回错误，而不是只返回内存表中的entry
+	var tbl *table
+	for _, lh := range lsm.levels.levels {
+		if len(lh.tables) > 0 {
+			tbl = lh.tables[0]
+		}
+	}
+	data, err := tbl.read(0, 1)
+	assert.Nil(t, err)
+	data[0] ^= 0xff
+	_, err = lsm.SequenceIterator(0)
+	assert.Equal(t, utils.ErrChecksumMismatch, errors.Cause(err))
+}
+
+// TestLocate 刷盘与合并之后，Locate返回key所在的level与sst
+func TestLocate(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.SyncCompaction = true })
+	key := utils.KeyWithTs([]byte("a"), 1)
+	assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte("v"))))
+	level, id, found, err := lsm.Locate(key)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, -1, level)
+	assert.Equal(t, uint64(0), id)
+
+	fid := lsm.memTable.wal.Fid()
+	assert.Nil(t, lsm.RotateMemtable())
+	level, id, found, err = lsm.Locate(key)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 0, level)
+	assert.Equal(t, fid, id)
+
+	assert.Nil(t, lsm.CompactTables([]uint64{fid}))
+	level, id, found, err = lsm.Locate(key)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Greater(t, level, 0)
+	assert.Equal(t, lsm.levels.levels[level].tables[0].fid, id)
+	assert.NotEqual(t, fid, id)
+
+	level, id, found, err = lsm.Locate(utils.KeyWithTs([]byte("b"), 1))
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, -1, level)
+	assert.Equal(t, uint64(0), id)
+}
+
+// TestIteratorPinsTables 迭代器打开期间被合并删除的sst，文件推迟到迭代器关闭后才删除
+func TestIteratorPinsTables(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.SyncCompaction = true })
+	const chunks, perChunk = 4, 10
+	for c := 0; c < chunks; c++ {
+		for i := 0; i < perChunk; i++ {
+			key := fmt.Sprintf("key%03d", c*perChunk+i)
+			assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(key), 1), []byte(key))))
+		}
+		assert.Nil(t, lsm.FlushToLevel(1))
+	}
+	var ids []uint64
+	for _, tbl := range lsm.levels.levels[1].tables {
+		ids = append(ids, tbl.fid)
+	}
+	assert.Equal(t, chunks, len(ids))
+
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+	iter.Rewind()
+	var n int
+	for ; n < perChunk/2; n++ {
+		assert.True(t, iter.Valid())
+		iter.Next()
+	}
+	// 后台合并在迭代过程中把L1的sst合并到L2
+	done := make(chan error)
+	go func() { done <- lsm.CompactTables(ids) }()
+	for ; iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		assert.Equal(t, fmt.Sprintf("key%03d", n), string(e.Value))
+		n++
+	}
+	assert.Nil(t, <-done)
+	assert.Equal(t, chunks*perChunk, n)
+	assert.Equal(t, 0, lsm.levels.levels[1].numTables())
+	manifest := lsm.levels.manifestFile.GetManifest()
+	for _, id := range ids {
+		_, ok := manifest.Tables[id]
+		assert.False(t, ok)
+		_, err := os.Stat(utils.SSTableFullPath(lsm.option.WorkDir, id))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, iter.Close())
+	for _, id := range ids {
+		_, err := os.Stat(utils.SSTableFullPath(lsm.option.WorkDir, id))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+// TestFlushSplitsTables 大于SSTableMaxSz的内存表刷盘为多个互不重叠的sst，同一个key的版本不会被拆开
+func TestFlushSplitsTables(t *testing.T) {
+	for _, align := range []int{0, 256} {
+		testFlushSplitsTables(t, align)
+	}
+}
+
+func testFlushSplitsTables(t *testing.T, align int) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 64 << 10
+		o.SSTableMaxSz = 4 << 10
+		o.BloomFalsePositive = 0.01
+		// 对齐的填充也计入预估大小
+		o.ValueAlignment = align
+	})
+	const n = 200
+	value := make([]byte, 40)
+	for i := 0; i < n; i++ {
+		for ts := uint64(1); ts <= 2; ts++ {
+			assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), ts), value)))
+		}
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+
+	tables := lsm.levels.levels[0].tables
+	assert.Greater(t, len(tables), 1)
+	manifest := lsm.levels.manifestFile.GetManifest()
+	var keys uint32
+	for i, tbl := range tables {
+		assert.LessOrEqual(t, tbl.Size(), lsm.option.SSTableMaxSz)
+		tm, ok := manifest.Tables[tbl.fid]
+		assert.True(t, ok)
+		assert.Equal(t, uint8(0), tm.Level)
+		keys += tbl.ss.Indexs().KeyCount
+		if i > 0 {
+			prev := utils.ParseKey(tables[i-1].ss.MaxKey())
+			assert.Less(t, string(prev), string(utils.ParseKey(tbl.ss.MinKey())))
+		}
+	}
+	assert.Equal(t, uint32(2*n), keys)
+	for i := 0; i < n; i++ {
+		for ts := uint64(1); ts <= 2; ts++ {
+			e, err := lsm.levels.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), ts))
+			assert.Nil(t, err)
+			assert.Equal(t, ts, utils.ParseTs(e.Key))
+		}
+	}
+}
+
+// TestMemTableMaxEntries 大量很小的entry先达到数量上限，内存表在写满MemTableSize之前切换
+func TestMemTableMaxEntries(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 64 << 10
+		o.MemTableMaxEntries = 10
+	})
+	for i := 0; i < 25; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("k%02d", i)), 1), nil)))
+	}
+	assert.Equal(t, 2, lsm.levels.levels[0].numTables())
+	for _, tbl := range lsm.levels.levels[0].tables {
+		assert.Equal(t, uint32(10), tbl.ss.Indexs().KeyCount)
+	}
+	assert.Equal(t, 5, lsm.memTable.entries)
+	assert.Less(t, int64(lsm.memTable.wal.Size()), lsm.option.MemTableSize)
+
+	// 一批entry放不下当前内存表时整批写入新的内存表，超过上限的一批直接拒绝
+	batch := func(n int) (entries []*utils.Entry) {
+		for i := 0; i < n; i++ {
+			entries = append(entries, utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("b%02d", i)), 1), nil))
+		}
+		return entries
+	}
+	assert.Nil(t, lsm.WriteBatch(batch(6)))
+	assert.Equal(t, 3, lsm.levels.levels[0].numTables())
+	assert.Equal(t, 6, lsm.memTable.entries)
+	assert.Equal(t, utils.ErrBatchTooLarge, lsm.WriteBatch(batch(11)))
+}
+
+// TestOpen 默认配置可以直接打开存储，不合法的配置返回错误
+func TestOpen(t *testing.T) {
+	_, err := Open(DefaultOptions(""))
+	assert.NotNil(t, err)
+	_, err = Open(DefaultOptions(t.TempDir()).WithBlockSize(0))
+	assert.NotNil(t, err)
+	_, err = Open(DefaultOptions(t.TempDir()).WithL0Thresholds(8, 4))
+	assert.NotNil(t, err)
+	_, err = Open(DefaultOptions(t.TempDir()).WithSkipList(utils.MaxSkipListHeight+1, 0))
+	assert.NotNil(t, err)
+
+	lsm, err := Open(DefaultOptions(t.TempDir()).WithMemTableSize(1 << 20).WithSyncCompaction(true))
+	assert.Nil(t, err)
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("v")))
+	assert.Nil(t, lsm.RotateMemtable())
+	e, err := lsm.Get(utils.KeyWithTs([]byte("a"), math.MaxUint64))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), e.Value)
+}
+
+// TestRotateMemtable 提前切换memtable生成sst并删除旧的wal，可以与写入并发执行
+func TestRotateMemtable(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("v")))
+	fid := lsm.memTable.wal.Fid()
+	walName := filePath(lsm.option.WorkDir, fid)
+	_, err := os.Stat(walName)
+	assert.Nil(t, err)
+
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+	assert.Equal(t, fid, lsm.levels.levels[0].tables[0].fid)
+	_, err = os.Stat(walName)
+	assert.True(t, os.IsNotExist(err))
+
+	// memtable为空时不会生成新的sst
+	fid = lsm.memTable.wal.Fid()
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+	assert.Equal(t, fid, lsm.memTable.wal.Fid())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("w%d-%d", w, i)), []byte("v")))
+			}
+		}(w)
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	wg.Wait()
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 50; i++ {
+			_, ok, err := lsm.Version([]byte(fmt.Sprintf("w%d-%d", w, i)))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+		}
+	}
+}
+
+// TestBestEffortRead 上层sst的block损坏时，BestEffortRead从下层读到旧版本
+func TestBestEffortRead(t *testing.T) {
+	for _, bestEffort := range []bool{false, true} {
+		lsm := buildTestLSM(t, func(o *Options) { o.BestEffortRead = bestEffort })
+		old := flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("key"), 1), []byte("v1")))
+		assert.Nil(t, lsm.CompactTables([]uint64{old}))
+		flushL0Table(t, lsm, utils.NewEntry(utils.KeyWithTs([]byte("key"), 2), []byte("v2")))
+
+		// 破坏L0中新表第一个block的数据
+		data, err := lsm.levels.levels[0].tables[0].read(0, 1)
+		assert.Nil(t, err)
+		data[0] ^= 0xff
+
+		e, err := lsm.Get(utils.KeyWithTs([]byte("key"), math.MaxUint64))
+		if bestEffort {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v1"), e.Value)
+		} else {
+			assert.Nil(t, e)
+			assert.Equal(t, utils.ErrChecksumMismatch, errors.Cause(err))
+		}
+	}
+}
+
+// TestCompactionReadError 合并时读取到损坏的block，合并失败并保留原来的sst，而不是丢掉读不出的数据
+func TestCompactionReadError(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	fid := flushL0Table(t, lsm,
+		utils.NewEntry(utils.KeyWithTs([]byte("a"), 1), []byte("v1")),
+		utils.NewEntry(utils.KeyWithTs([]byte("b"), 1), []byte("v1")))
+	data, err := lsm.levels.levels[0].tables[0].read(0, 1)
+	assert.Nil(t, err)
+	data[0] ^= 0xff
+
+	err = lsm.CompactTables([]uint64{fid})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), utils.ErrChecksumMismatch.Error())
+	assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+	_, ok := lsm.levels.manifestFile.GetManifest().Tables[fid]
+	assert.True(t, ok)
+}
+
+// TestCompactTables 合并指定的sst，并检查参数的合法性
+func TestCompactTables(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	var fids []uint64
+	for i := uint64(1); i <= 3; i++ {
+		fids = append(fids, flushL0Table(t, lsm,
+			utils.NewEntry(utils.KeyWithTs([]byte("a"), i), []byte(fmt.Sprintf("a%d", i))),
+			utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("b%d", i)), i), []byte("b"))))
+	}
+	assert.NotNil(t, lsm.CompactTables(nil))
+	assert.NotNil(t, lsm.CompactTables([]uint64{1000}))
+	// 更旧的重叠表没有被选中
+	assert.NotNil(t, lsm.CompactTables(fids[1:]))
+
+	assert.Nil(t, lsm.CompactTables(fids[:2]))
+	assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+	manifest := lsm.levels.manifestFile.GetManifest()
+	assert.Len(t, manifest.Tables, 2)
+	for _, fid := range fids[:2] {
+		_, ok := manifest.Tables[fid]
+		assert.False(t, ok)
+	}
+	var next []uint64
+	for _, lh := range lsm.levels.levels[1:] {
+		for _, tbl := range lh.tables {
+			next = append(next, tbl.fid)
+		}
+	}
+	assert.Len(t, next, 1)
+	// 不同层的表不能一起合并
+	assert.NotNil(t, lsm.CompactTables([]uint64{fids[2], next[0]}))
+
+	assert.Nil(t, lsm.CompactTables(fids[2:]))
+	assert.Equal(t, 0, lsm.levels.levels[0].numTables())
+	for i := uint64(1); i <= 3; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("b%d", i)), i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("b"), e.Value)
+	}
+}
+
+// TestManifestSyncPolicy 放宽manifest的sync策略后，重新打开仍然能恢复出一致的状态
+func TestManifestSyncPolicy(t *testing.T) {
+	for _, policy := range []file.ManifestSyncPolicy{file.ManifestSyncBatched, file.ManifestSyncOnClose} {
+		lsm := buildTestLSM(t, func(o *Options) {
+			o.ManifestSyncPolicy = policy
+			o.NumLevelZeroTables = 2
+		})
+		var entries []*utils.Entry
+		for i := 0; i < 50; i++ {
+			e := buildEntry()
+			entries = append(entries, e)
+			assert.Nil(t, lsm.Set(e))
+		}
+		assert.True(t, lsm.levels.runOnce(0))
+
+		lsm = initLSM(lsm.option)
+		assert.Empty(t, lsm.FindOrphans())
+		assert.Nil(t, lsm.Verify())
+		for _, e := range entries {
+			v, err := lsm.Get(e.Key)
+			assert.Nil(t, err)
+			assert.Equal(t, e.Value, v.Value)
+		}
+	}
+}
+
+// TestWaitForIdle 大量写入后等待合并结束，之后各层的状态不再变化
+func TestWaitForIdle(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.NumLevelZeroTables = 2
+	})
+	lsm.StartCompacter()
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, lsm.Set(buildEntry()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(t, lsm.WaitForIdle(ctx))
+	s := lsm.Stats()
+	assert.True(t, s.Compaction.Compactions > 0)
+	assert.True(t, s.Levels[0].NumTables < lsm.option.NumLevelZeroTables)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, s, lsm.Stats())
+
+	// 有sst处于合并状态时一直等待到ctx结束
+	cs := lsm.levels.compactState
+	cs.Lock()
+	cs.tables[0] = struct{}{}
+	cs.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lsm.WaitForIdle(ctx))
+	cs.Lock()
+	delete(cs.tables, 0)
+	cs.Unlock()
+}
+
+// TestIterator 合并内存表与所有level，KeysOnly时不解码value
+func TestIterator(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key-%04d", i)), 1)
+		keys = append(keys, key)
+		assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("v%d-1", i)))))
+	}
+	// 部分key写入新版本，新版本排在旧版本前面
+	for i := 0; i < 100; i += 10 {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key-%04d", i)), 2)
+		keys = append(keys, key)
+		assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("v%d-2", i)))))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return utils.CompareKeys(keys[i], keys[j]) < 0
+	})
+	valueOf := func(key []byte) []byte {
+		var i int
+		fmt.Sscanf(string(utils.ParseKey(key)), "key-%d", &i)
+		return []byte(fmt.Sprintf("v%d-%d", i, utils.ParseTs(key)))
+	}
+
+	for _, keysOnly := range []bool{false, true} {
+		iter := lsm.NewIterator(&utils.Options{IsAsc: true, KeysOnly: keysOnly})
+		var got [][]byte
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			e := iter.Item().Entry()
+			got = append(got, e.Key)
+			if keysOnly {
+				assert.Empty(t, e.Value)
+			} else {
+				assert.Equal(t, valueOf(e.Key), e.Value)
+			}
+		}
+		assert.Equal(t, keys, got)
+
+		iter.Seek(utils.KeyWithTs([]byte("key-0050"), math.MaxUint64))
+		assert.True(t, iter.Valid())
+		assert.Equal(t, utils.KeyWithTs([]byte("key-0050"), 2), iter.Item().Entry().Key)
+		assert.Nil(t, iter.Close())
+	}
+
+	// KeysOnly时sst中的value区域不会被解码
+	tbl := lsm.levels.levels[0].tables[0]
+	iter := tbl.NewIterator(&utils.Options{IsAsc: true, KeysOnly: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Nil(t, iter.(*tableIterator).bi.val)
+	}
+	assert.Nil(t, iter.Close())
+}
+
+// TestColumnFamily 不同column family之间的key互相隔离，跨column family的批量写入位于同一个内存表
+func TestColumnFamily(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	users, orders := lsm.CF("users"), lsm.CF("orders")
+	assert.Nil(t, users.Put([]byte("alice"), []byte("u1")))
+	assert.Nil(t, orders.Set(utils.NewEntry(utils.KeyWithTs([]byte("alice"), 100), []byte("o1"))))
+
+	// 同名的key在另一个column family和默认空间都不可见
+	e, err := orders.Get(utils.KeyWithTs([]byte("alice"), 100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("o1"), e.Value)
+	assert.Equal(t, utils.KeyWithTs([]byte("alice"), 100), e.Key)
+	e, _ = users.Get(utils.KeyWithTs([]byte("alice"), 100))
+	assert.Nil(t, e)
+	e, _ = lsm.Get(utils.KeyWithTs([]byte("alice"), 100))
+	assert.Nil(t, e)
+
+	// 跨column family的批量写入，写入前先把当前内存表写到快满，整批仍然进入同一个内存表
+	for lsm.memTable.wal.Size() < uint32(lsm.option.MemTableSize)-64 {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(randStr(12)), 1), []byte("x"))))
+	}
+	var batch []*utils.Entry
+	for i := 0; i < 4; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key-%d", i)), 1)
+		batch = append(batch,
+			users.Entry(utils.NewEntry(key, []byte("u"))),
+			orders.Entry(utils.NewEntry(key, []byte("o"))))
+	}
+	assert.Nil(t, lsm.WriteBatch(batch))
+	for _, e := range batch {
+		v, err := lsm.memTable.Get(e.Key)
+		assert.Nil(t, err)
+		assert.NotNil(t, v)
+	}
+	assert.Equal(t, utils.ErrBatchTooLarge, lsm.WriteBatch([]*utils.Entry{
+		users.Entry(utils.NewEntry(utils.KeyWithTs([]byte("big"), 1), make([]byte, lsm.option.MemTableSize/2))),
+		orders.Entry(utils.NewEntry(utils.KeyWithTs([]byte("big"), 1), make([]byte, lsm.option.MemTableSize/2))),
+	}))
+
+	// 迭代器只返回本column family的key，并去掉前缀
+	iter := orders.NewIterator(&utils.Options{IsAsc: true})
+	var got []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		got = append(got, string(utils.ParseKey(iter.Item().Entry().Key)))
+		assert.Equal(t, "o", string(iter.Item().Entry().Value)[:1])
+	}
+	assert.Equal(t, []string{"alice", "key-0", "key-1", "key-2", "key-3"}, got)
+	iter.Seek(utils.KeyWithTs([]byte("key-2"), math.MaxUint64))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, utils.KeyWithTs([]byte("key-2"), 1), iter.Item().Entry().Key)
+	assert.Nil(t, iter.Close())
+
+	// 崩溃时批次的最后一条记录只写了一半，回放时整批丢弃，不会只恢复其中一个column family
+	var torn []*utils.Entry
+	for i := 0; i < 4; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("torn-%d", i)), 1)
+		torn = append(torn,
+			users.Entry(utils.NewEntry(key, []byte("u"))),
+			orders.Entry(utils.NewEntry(key, []byte("o"))))
+	}
+	assert.Nil(t, lsm.WriteBatch(torn))
+	walData := lsm.memTable.wal.Bytes()
+	copy(walData[len(walData)-crc32.Size:], make([]byte, crc32.Size))
+
+	// 重新打开后各column family的数据仍然隔离
+	lsm = initLSM(lsm.option)
+	e, err = lsm.CF("users").Get(utils.KeyWithTs([]byte("key-3"), 1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("u"), e.Value)
+	for _, e := range torn {
+		_, err := lsm.Get(e.Key)
+		assert.Equal(t, utils.ErrKeyNotFound, err)
+	}
+	// 截掉不完整的批次之后可以继续写入
+	assert.Nil(t, lsm.WriteBatch(torn[:2]))
+	lsm = initLSM(lsm.option)
+	for _, e := range torn[:2] {
+		v, err := lsm.Get(e.Key)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, v.Value)
+	}
+}
+
+// flushL0Table 将entry写入一个新的L0 sst，返回sst的id
+func flushL0Table(t *testing.T, lsm *LSM, entries ...*utils.Entry) uint64 {
+	for _, e := range entries {
+		assert.Nil(t, lsm.Set(e))
+	}
+	fid := lsm.memTable.wal.Fid()
+	assert.Nil(t, lsm.levels.flush(lsm.memTable))
+	mt, err := lsm.NewMemtable()
+	assert.Nil(t, err)
+	lsm.memTable = mt
+	lsm.publishMemTables()
+	return fid
+}
+
+func benchmarkEntries(n int) []*utils.Entry {
+	entries := make([]*utils.Entry, n)
+	for i := range entries {
+		entries[i] = utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key-%08d", i)), 1), make([]byte, 64))
+	}
+	return entries
+}
+
+func benchmarkIterator(b *testing.B, keysOnly bool) {
+	o := *opt
+	o.WorkDir = b.TempDir()
+	o.MemTableSize = 1 << 20
+	lsm := initLSM(&o)
+	for _, e := range benchmarkEntries(20000) {
+		if err := lsm.Set(e); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter := lsm.NewIterator(&utils.Options{IsAsc: true, KeysOnly: keysOnly})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			_ = iter.Item().Entry()
+		}
+		iter.Close()
+	}
+}
+
+func BenchmarkIterator(b *testing.B) {
+	benchmarkIterator(b, false)
+}
+
+func BenchmarkIteratorKeysOnly(b *testing.B) {
+	benchmarkIterator(b, true)
+}
+
+func BenchmarkSet(b *testing.B) {
+	o := *opt
+	o.WorkDir = b.TempDir()
+	o.MemTableSize = 64 << 20
+	lsm := initLSM(&o)
+	entries := benchmarkEntries(b.N)
+	b.ResetTimer()
+	for _, e := range entries {
+		if err := lsm.Set(e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatcher(b *testing.B) {
+	o := *opt
+	o.WorkDir = b.TempDir()
+	o.MemTableSize = 64 << 20
+	lsm := initLSM(&o)
+	entries := benchmarkEntries(b.N)
+	b.ResetTimer()
+	batcher := lsm.NewBatcher(64 << 10)
+	for _, e := range entries {
+		if err := batcher.Add(e); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := batcher.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkWALWrite 分别报告写wal、sync与其余部分的平均耗时
+func BenchmarkWALWrite(b *testing.B) {
+	for _, syncWrites := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sync=%v", syncWrites), func(b *testing.B) {
+			o := *opt
+			o.WorkDir = b.TempDir()
+			o.MemTableSize = 64 << 20
+			o.SyncWrites = syncWrites
+			lsm := initLSM(&o)
+			entries := benchmarkEntries(b.N)
+			b.ResetTimer()
+			start := time.Now()
+			for _, e := range entries {
+				if err := lsm.Set(e); err != nil {
+					b.Fatal(err)
+				}
+			}
+			total := time.Since(start)
+			ws := lsm.Stats().WAL
+			n := float64(b.N)
+			b.ReportMetric(float64(ws.AppendLatency.Total)/n, "wal-append-ns/op")
+			b.ReportMetric(float64(ws.SyncLatency.Total)/n, "wal-sync-ns/op")
+			b.ReportMetric(float64(total-ws.AppendLatency.Total-ws.SyncLatency.Total)/n, "other-ns/op")
+		})
+	}
+}
+
 func buildLSM() *LSM {
 	// init DB Basic Test
 	lsm := initLSM(opt)
 	return lsm
 }
+
+// buildTestLSM 使用独立的临时目录构建lsm，避免与其他用例的后台合并互相干扰
+func buildTestLSM(t *testing.T, setOpt func(o *Options)) *LSM {
+	o := *opt
+	o.WorkDir = t.TempDir()
+	if setOpt != nil {
+		setOpt(&o)
+	}
+	return initLSM(&o)
+}
+
+func TestClose(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	lsm.StartCompacter()
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")))
+	}
+	summary, err := lsm.Close()
+	assert.Nil(t, err)
+	assert.True(t, summary.NumTables > 0)
+	assert.True(t, summary.TotalSize > 0)
+	assert.Equal(t, uint64(200), summary.MaxVersion)
+	// memtable已经刷盘，不会留下wal
+	wals, err := filepath.Glob(filepath.Join(lsm.option.WorkDir, "*"+walFileExt))
+	assert.Nil(t, err)
+	assert.Empty(t, wals)
+
+	lsm = initLSM(lsm.option)
+	var n int
+	for _, lh := range lsm.levels.levels {
+		n += lh.numTables()
+	}
+	assert.Equal(t, summary.NumTables, n)
+	for i := 0; i < 200; i++ {
+		version, ok, err := lsm.Version([]byte(fmt.Sprintf("key%03d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(i+1), version)
+	}
+}
+
+// TestReplayChanges 按写入顺序读出manifest中每一次sst的创建与删除
+func TestReplayChanges(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 2
+	})
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	assert.Nil(t, lsm.CompactAll())
+
+	live := map[uint64]bool{}
+	var creates, deletes int
+	assert.Nil(t, lsm.levels.manifestFile.ReplayChanges(func(change *pb.ManifestChange) error {
+		switch change.Op {
+		case pb.ManifestChange_CREATE:
+			assert.False(t, live[change.Id])
+			live[change.Id] = true
+			creates++
+		case pb.ManifestChange_DELETE:
+			// 删除总是在创建之后
+			assert.True(t, live[change.Id])
+			delete(live, change.Id)
+			deletes++
+		}
+		return nil
+	}))
+	assert.True(t, creates > 6)
+	assert.True(t, deletes > 0)
+	manifest := lsm.levels.manifestFile.GetManifest()
+	assert.Len(t, live, len(manifest.Tables))
+	for id := range manifest.Tables {
+		assert.True(t, live[id])
+	}
+
+	// fn返回的错误会终止遍历
+	stop := errors.New("stop")
+	var n int
+	err := lsm.levels.manifestFile.ReplayChanges(func(*pb.ManifestChange) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, n)
+}
+
+// TestRecoveryMissingWal 扫描目录之后消失的wal在恢复时被跳过，StrictWALRecovery时打开失败
+func TestRecoveryMissingWal(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("v")))
+	lost := lsm.memTable.wal.Fid()
+
+	defer func() { openWalFile = file.OpenWalFile }()
+	openWalFile = func(opt *osFile.FileOption) (*file.WalFile, error) {
+		if opt.FID == lost {
+			assert.Nil(t, os.Remove(opt.FileName))
+		}
+		return file.OpenWalFile(opt)
+	}
+	lsm = initLSM(lsm.option)
+	_, ok, err := lsm.Version([]byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	// 跳过之后存储可以正常写入
+	assert.Nil(t, lsm.Put([]byte("b"), []byte("v")))
+	_, ok, err = lsm.Version([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	kept := lsm.memTable.wal.Fid()
+
+	lsm.option.StrictWALRecovery = true
+	openWalFile = func(opt *osFile.FileOption) (*file.WalFile, error) {
+		if opt.FID == kept {
+			assert.Nil(t, os.Remove(opt.FileName))
+		}
+		return file.OpenWalFile(opt)
+	}
+	_, err = Open(*lsm.option)
+	assert.True(t, os.IsNotExist(errors.Cause(err)), "%v", err)
+}
+
+// TestConcurrentCompactors 多个compacter与大量写入并发执行后，manifest与各层的sst仍然一致，合并状态全部清空
+// l0ToL0中不限制sst的创建时间，0号compacter还会按L0调整得分小于1的情况执行L0到L0的合并
+// 配合go test -race运行可以检查合并状态的并发访问
+func TestConcurrentCompactors(t *testing.T) {
+	t.Run("default", func(t *testing.T) { testConcurrentCompactors(t, false) })
+	t.Run("l0ToL0", func(t *testing.T) {
+		defer func(age time.Duration) { l0ToL0MinAge = age }(l0ToL0MinAge)
+		l0ToL0MinAge = 0
+		testConcurrentCompactors(t, true)
+	})
+}
+
+func testConcurrentCompactors(t *testing.T, l0ToL0 bool) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 2
+		o.BaseLevelSize = 8 << 10
+		o.LevelSizeMultiplier = 2
+		o.BaseTableSize = 2 << 10
+	})
+	const writers, compactors, n = 4, 4, 300
+	done := make(chan struct{})
+	var cwg, wwg sync.WaitGroup
+	for id := 0; id < compactors; id++ {
+		cwg.Add(1)
+		go func(id int) {
+			defer cwg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					lsm.levels.runOnce(id)
+					if l0ToL0 && id == 0 {
+						// base level超过目标大小时L0的调整得分小于1，不合并到base level而是在L0内部合并
+						lsm.levels.run(id, compactionPriority{level: 0, score: 1, adjusted: 0.5, t: lsm.levels.levelTargets()})
+					}
+				}
+			}
+		}(id)
+	}
+	value := make([]byte, 64)
+	for w := 0; w < writers; w++ {
+		wwg.Add(1)
+		go func(w int) {
+			defer wwg.Done()
+			for i := 0; i < n; i++ {
+				assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("w%d-%05d", w, i)), value))
+			}
+		}(w)
+	}
+	wwg.Wait()
+	close(done)
+	cwg.Wait()
+	assert.Greater(t, lsm.Stats().Compaction.Compactions, int64(0))
+	assert.Zero(t, lsm.Stats().Compaction.Failed)
+	// 所有合并结束后每一层的任务数与合并中的区间都已清空
+	for i, lcs := range lsm.levels.compactState.levels {
+		assert.Zero(t, lcs.jobs, "level %d", i)
+		assert.Empty(t, lcs.ranges, "level %d", i)
+	}
+
+	// 每个sst只出现在一层中，与manifest记录的层一致
+	manifest := lsm.levels.manifestFile.GetManifest()
+	numTables := 0
+	for _, lh := range lsm.levels.levels {
+		for _, tbl := range lh.tables {
+			tm, ok := manifest.Tables[tbl.fid]
+			assert.True(t, ok, "table %d is not in the manifest", tbl.fid)
+			assert.Equal(t, uint8(lh.levelNum), tm.Level)
+			numTables++
+		}
+	}
+	assert.Equal(t, len(manifest.Tables), numTables)
+	// manifest中没有重复注册的sst
+	live := map[uint64]bool{}
+	assert.Nil(t, lsm.levels.manifestFile.ReplayChanges(func(change *pb.ManifestChange) error {
+		if change.Op == pb.ManifestChange_CREATE {
+			assert.False(t, live[change.Id], "table %d is created twice", change.Id)
+			live[change.Id] = true
+		} else {
+			delete(live, change.Id)
+		}
+		return nil
+	}))
+	assert.Len(t, live, numTables)
+
+	check := func(lsm *LSM) {
+		for w := 0; w < writers; w++ {
+			for i := 0; i < n; i++ {
+				_, ok, err := lsm.Version([]byte(fmt.Sprintf("w%d-%05d", w, i)))
+				assert.Nil(t, err)
+				assert.True(t, ok)
+			}
+		}
+	}
+	check(lsm)
+	check(initLSM(lsm.option))
+}
+
+// TestHealth L0积压达到限速阈值后健康状态变为降级，达到阻塞阈值后不可写
+func TestHealth(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 2
+		o.L0StallThreshold = 2
+		o.L0StopThreshold = 4
+	})
+	h := lsm.Health()
+	assert.Equal(t, HealthOK, h.State)
+	assert.True(t, h.Writable)
+	assert.Empty(t, h.Reasons)
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v")))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	h = lsm.Health()
+	assert.Equal(t, HealthDegraded, h.State)
+	assert.True(t, h.Writable)
+	assert.Equal(t, WriteStallDelayed, h.WriteStall)
+	assert.Len(t, h.Reasons, 1)
+
+	for i := 2; i < 4; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v")))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	h = lsm.Health()
+	assert.Equal(t, HealthUnavailable, h.State)
+	assert.False(t, h.Writable)
+	assert.Equal(t, 4, h.L0Tables)
+
+	assert.Nil(t, lsm.CompactAll())
+	assert.Equal(t, HealthOK, lsm.Health().State)
+}
+
+// TestMeta 用户元数据写入manifest，覆写manifest与重新打开后仍然保留
+func TestMeta(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	_, ok := lsm.GetMeta([]byte("schema"))
+	assert.False(t, ok)
+	assert.Nil(t, lsm.SetMeta([]byte("schema"), []byte("1")))
+	assert.Nil(t, lsm.SetMeta([]byte("schema"), []byte("2")))
+	assert.Nil(t, lsm.SetMeta([]byte("created"), []byte("2022-06-01")))
+	// 元数据不在数据的key空间中
+	_, ok, err := lsm.Version([]byte("schema"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 大量删除触发manifest覆写
+	mf := lsm.levels.manifestFile
+	n := utils.ManifestDeletionsRewriteThreshold + 1
+	var creates, deletes []*pb.ManifestChange
+	for i := 0; i < n; i++ {
+		creates = append(creates, &pb.ManifestChange{Id: uint64(1<<20 + i), Op: pb.ManifestChange_CREATE})
+		deletes = append(deletes, newDeleteChange(uint64(1<<20+i)))
+	}
+	assert.Nil(t, mf.AddChanges(creates))
+	assert.Nil(t, mf.AddChanges(deletes))
+	assert.Zero(t, mf.GetManifest().Deletions)
+
+	for _, lsm := range []*LSM{lsm, initLSM(lsm.option)} {
+		v, ok := lsm.GetMeta([]byte("schema"))
+		assert.True(t, ok)
+		assert.Equal(t, []byte("2"), v)
+		v, ok = lsm.GetMeta([]byte("created"))
+		assert.True(t, ok)
+		assert.Equal(t, []byte("2022-06-01"), v)
+	}
+}
+
+// TestIgnoreUnknownManifestOps manifest中有无法识别的操作时默认打开失败，开启IgnoreUnknownManifestOps后跳过
+func TestIgnoreUnknownManifestOps(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("v")))
+	assert.Nil(t, lsm.RotateMemtable())
+
+	// 模拟新版本写入的操作，追加到manifest末尾
+	set := pb.ManifestChangeSet{Changes: []*pb.ManifestChange{
+		{Id: 1 << 20, Op: pb.ManifestChange_Operation(99)},
+		{Op: pb.ManifestChange_SET_META, Key: []byte("k"), Value: []byte("v")},
+	}}
+	buf, err := set.Marshal()
+	assert.Nil(t, err)
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(buf)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(buf, utils.CastagnoliCrcTable))
+	f, err := os.OpenFile(filepath.Join(lsm.option.WorkDir, utils.ManifestFilename), os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = f.Write(append(lenCrcBuf[:], buf...))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	assert.Panics(t, func() { initLSM(lsm.option) })
+
+	lsm.option.IgnoreUnknownManifestOps = true
+	lsm = initLSM(lsm.option)
+	_, ok, err := lsm.Version([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// 同一个change set中可以识别的操作仍然生效
+	v, ok := lsm.GetMeta([]byte("k"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("v"), v)
+}
+
+func TestRunBenchmark(t *testing.T) {
+	for _, dist := range []KeyDistribution{DistUniform, DistZipfian} {
+		o := *opt
+		o.WorkDir = filepath.Join(t.TempDir(), "bench")
+		res, err := RunBenchmark(o, WorkloadSpec{
+			NumKeys:      200,
+			Ops:          500,
+			ReadRatio:    0.5,
+			ScanRatio:    0.1,
+			ScanLength:   5,
+			ValueSize:    32,
+			Distribution: dist,
+			Seed:         1,
+		})
+		assert.Nil(t, err, dist.String())
+		assert.Equal(t, 500, res.Ops)
+		assert.Equal(t, res.Ops, res.Reads.Count+res.Scans.Count+res.Writes.Count)
+		assert.True(t, res.Reads.Count > 0 && res.Scans.Count > 0 && res.Writes.Count > 0)
+		assert.True(t, res.Throughput > 0)
+		assert.True(t, res.P99 > 0 && res.Reads.P50 <= res.Reads.P99)
+
+		// 已有数据的目录不能用于基准测试
+		_, err = RunBenchmark(o, WorkloadSpec{NumKeys: 1, Ops: 1})
+		assert.NotNil(t, err)
+	}
+	_, err := RunBenchmark(*opt, WorkloadSpec{NumKeys: 1, Ops: 1, ReadRatio: 0.8, ScanRatio: 0.5})
+	assert.NotNil(t, err)
+}
+
+// TestEncryption 开启加密后wal与sst中都没有明文的key与value，重新打开后可以正确读出
+func TestEncryption(t *testing.T) {
+	enc, err := utils.NewAESEncryptor(1, bytes.Repeat([]byte{7}, 32))
+	assert.Nil(t, err)
+	// 开启加密之前写入的明文数据仍然可以读取
+	lsm := buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Put([]byte("plainkey"), []byte("plainvalue")))
+	assert.Nil(t, lsm.RotateMemtable())
+	lsm.option.Encryptor = enc
+	lsm = initLSM(lsm.option)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("secretkey%03d", i)) }
+	value := func(i int) []byte { return []byte(fmt.Sprintf("secretvalue%03d", i)) }
+	containsSecret := func(pattern string) bool {
+		files, err := filepath.Glob(filepath.Join(lsm.option.WorkDir, pattern))
+		assert.Nil(t, err)
+		assert.NotEmpty(t, files)
+		for _, name := range files {
+			data, err := os.ReadFile(name)
+			assert.Nil(t, err)
+			if bytes.Contains(data, []byte("secret")) {
+				return true
+			}
+		}
+		return false
+	}
+	check := func(n int) {
+		for i := 0; i < n; i++ {
+			version, ok, err := lsm.Version(key(i))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			e, err := lsm.Get(utils.KeyWithTs(key(i), version))
+			assert.Nil(t, err)
+			assert.Equal(t, value(i), e.Value)
+		}
+		e, err := lsm.Get(utils.KeyWithTs([]byte("plainkey"), 1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("plainvalue"), e.Value)
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, lsm.Put(key(i), value(i)))
+	}
+	assert.False(t, containsSecret("*"+walFileExt))
+	// 没有Encryptor时无法回放加密的wal，Open返回错误并保留wal
+	noEnc := *lsm.option
+	noEnc.Encryptor = nil
+	_, err = Open(noEnc)
+	assert.True(t, errors.Is(err, utils.ErrNoEncryptor), "%v", err)
+	// wal中加密的记录可以回放
+	lsm = initLSM(lsm.option)
+	check(5)
+
+	for i := 5; i < 100; i++ {
+		assert.Nil(t, lsm.Put(key(i), value(i)))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.False(t, containsSecret("*.sst"))
+	assert.Nil(t, lsm.Verify())
+	check(100)
+
+	lsm = initLSM(lsm.option)
+	check(100)
+
+	// 是否加密记录在索引中，不根据数据末尾的标记猜测
+	plain := 0
+	for _, tbl := range lsm.levels.levels[0].tables {
+		if !tbl.ss.Indexs().Encrypted {
+			plain++
+		}
+	}
+	assert.Equal(t, 1, plain)
+	sealed, err := utils.EncryptData(enc, []byte("index"))
+	assert.Nil(t, err)
+	index, err := (&pb.TableIndex{KeyCount: 1}).Marshal()
+	assert.Nil(t, err)
+	// 明文的末尾恰好与加密数据的尾部相同
+	index = append(index, sealed[len(sealed)-12:]...)
+	assert.False(t, utils.IsEncryptedIndex(index))
+	encIndex, err := utils.EncryptIndex(enc, index)
+	assert.Nil(t, err)
+	assert.True(t, utils.IsEncryptedIndex(encIndex))
+	decrypted, err := utils.DecryptIndex(enc, encIndex)
+	assert.Nil(t, err)
+	assert.Equal(t, index, decrypted)
+
+	_, err = utils.DecryptData(nil, []byte("data"))
+	assert.Equal(t, utils.ErrNoEncryptor, err)
+}
+
+// TestMaxImmutableMemory 刷盘跟不上写入时immutables的内存占用不超过MaxImmutableMemory，恢复积压的wal时同样如此
+func TestMaxImmutableMemory(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	// 只写入内存表并切换而不刷盘，模拟刷盘跟不上写入，积压出20个immutables
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, lsm.memTable.set(utils.NewEntry(utils.KeyWithTs(key(i), uint64(i+1)), []byte("value"))))
+		assert.Nil(t, lsm.rotate())
+	}
+	assert.Len(t, lsm.immutables, 20)
+	assert.Equal(t, lsm.Stats().ImmutablesSize, atomic.LoadInt64(&lsm.immutableMemory))
+	memTableSize := lsm.immutables[0].Size()
+
+	limit := 3 * memTableSize
+	lsm.option.MaxImmutableMemory = limit
+	lsm = initLSM(lsm.option)
+	assert.True(t, atomic.LoadInt64(&lsm.immutableMemory) <= limit)
+	assert.Equal(t, lsm.Stats().ImmutablesSize, atomic.LoadInt64(&lsm.immutableMemory))
+	assert.True(t, len(lsm.immutables) > 0 && len(lsm.immutables) <= 3)
+
+	for i := 20; i < 40; i++ {
+		assert.Nil(t, lsm.memTable.set(utils.NewEntry(utils.KeyWithTs(key(i), uint64(i+1)), []byte("value"))))
+		assert.Nil(t, lsm.rotate())
+		assert.True(t, atomic.LoadInt64(&lsm.immutableMemory) <= limit)
+	}
+	for i := 0; i < 40; i++ {
+		e, err := lsm.Get(utils.KeyWithTs(key(i), uint64(i+1)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), e.Value)
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Empty(t, lsm.immutables)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&lsm.immutableMemory))
+}
+
+// TestStoresEqual 忽略版本号比较两个存储，不同时报告第一个不同的key
+func TestStoresEqual(t *testing.T) {
+	a := buildTestLSM(t, nil)
+	b := buildTestLSM(t, nil)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, a.Put(key(i), []byte("old")))
+		assert.Nil(t, a.Put(key(i), []byte(fmt.Sprintf("value%d", i))))
+	}
+	// b中的版本号与a不同，并且一部分数据已经刷盘
+	for i := 99; i >= 0; i-- {
+		assert.Nil(t, b.Put(key(i), []byte(fmt.Sprintf("value%d", i))))
+	}
+	assert.Nil(t, b.RotateMemtable())
+	equal, diff, err := StoresEqual(a, b)
+	assert.Nil(t, err)
+	assert.True(t, equal, diff)
+
+	dir := t.TempDir()
+	assert.Nil(t, CloneStore(a.option.WorkDir, dir))
+	o := *a.option
+	o.WorkDir = dir
+	equal, _, err = StoresEqual(a, initLSM(&o))
+	assert.Nil(t, err)
+	assert.True(t, equal)
+
+	assert.Nil(t, b.Put(key(80), []byte("changed")))
+	assert.Nil(t, b.Put(key(50), []byte("changed")))
+	equal, diff, err = StoresEqual(a, b)
+	assert.Nil(t, err)
+	assert.False(t, equal)
+	assert.Contains(t, diff, `"key050"`)
+
+	assert.Nil(t, a.Put(key(10), []byte("first")))
+	assert.Nil(t, a.Put([]byte("key010a"), []byte("extra")))
+	equal, diff, _ = StoresEqual(b, a)
+	assert.False(t, equal)
+	assert.Contains(t, diff, `"key010"`)
+	assert.Nil(t, a.Put(key(10), []byte("value10")))
+	_, diff, _ = StoresEqual(a, b)
+	assert.Equal(t, `key "key010a" only in the first store`, diff)
+	_, diff, _ = StoresEqual(b, a)
+	assert.Equal(t, `key "key010a" only in the second store`, diff)
+}
+
+// TestMultiGet 批量查询的结果与逐个Get相同，包括内存表、L0与更低层中的key、重复的key以及不存在的key
+func TestMultiGet(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 2
+		o.BloomFalsePositive = 0.01
+	})
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, lsm.Put(key(i), []byte(fmt.Sprintf("value%d", i))))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Nil(t, lsm.CompactAll())
+	for i := 0; i < 200; i += 3 {
+		assert.Nil(t, lsm.Put(key(i), []byte(fmt.Sprintf("new%d", i))))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	for i := 0; i < 200; i += 7 {
+		assert.Nil(t, lsm.Put(key(i), []byte(fmt.Sprintf("mem%d", i))))
+	}
+	assert.True(t, lsm.levels.levels[0].numTables() > 0)
+
+	var keys [][]byte
+	for i := 210; i >= 0; i -= 2 {
+		keys = append(keys, utils.KeyWithTs(key(i), math.MaxUint64))
+	}
+	keys = append(keys, keys[3], utils.KeyWithTs(key(5), 6), utils.KeyWithTs([]byte("missing"), math.MaxUint64))
+	entries, err := lsm.MultiGet(keys)
+	assert.Nil(t, err)
+	assert.Len(t, entries, len(keys))
+	for i, k := range keys {
+		e, err := lsm.Get(k)
+		if err == utils.ErrKeyNotFound {
+			assert.Nil(t, entries[i], "%q", k)
+			continue
+		}
+		assert.Nil(t, err)
+		if assert.NotNil(t, entries[i], "%q", k) {
+			assert.Equal(t, e.Key, entries[i].Key)
+			assert.Equal(t, e.Value, entries[i].Value)
+		}
+	}
+	assert.Nil(t, entries[0])
+	assert.Equal(t, []byte("value5"), entries[len(keys)-2].Value)
+	assert.Nil(t, entries[len(keys)-1])
+}
+
+func BenchmarkMultiGet(b *testing.B) {
+	o := *opt
+	o.WorkDir = b.TempDir()
+	o.MemTableSize = 64 << 10
+	o.SSTableMaxSz = 64 << 10
+	o.BlockSize = 4 << 10
+	o.BloomFalsePositive = 0.01
+	o.SyncCompaction = true
+	lsm := initLSM(&o)
+	// 每隔10个key取一个，相邻的几个key位于同一个block中
+	keys := make([][]byte, 0, 100)
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := lsm.Put(key, []byte("value")); err != nil {
+			b.Fatal(err)
+		}
+		if i%10 == 0 && len(keys) < 100 {
+			keys = append(keys, utils.KeyWithTs(key, math.MaxUint64))
+		}
+	}
+	if err := lsm.RotateMemtable(); err != nil {
+		b.Fatal(err)
+	}
+	if err := lsm.CompactAll(); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("MultiGet", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := lsm.MultiGet(keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, key := range keys {
+				if _, err := lsm.Get(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// TestSSTableLayout 分片布局的sst位于sst/xx子目录中，超过5位的id也能还原，切换布局后仍能找到已有的sst
+func TestSSTableLayout(t *testing.T) {
+	for _, id := range []uint64{1, 123456, 1234567890} {
+		for _, l := range []utils.SSTableLayout{utils.SSTableLayoutFlat, utils.SSTableLayoutSharded} {
+			fid, ok := utils.FID(l.Path("dir", id))
+			assert.True(t, ok)
+			assert.Equal(t, id, fid)
+		}
+	}
+
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SSTableLayout = utils.SSTableLayoutSharded
+	})
+	var entries []*utils.Entry
+	for i := 0; i < 50; i++ {
+		e := buildEntry()
+		entries = append(entries, e)
+		assert.Nil(t, lsm.Set(e))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	paths := utils.LoadSSTPaths(lsm.option.WorkDir)
+	assert.NotEmpty(t, paths)
+	for id, p := range paths {
+		assert.Equal(t, utils.SSTableLayoutSharded.Path(lsm.option.WorkDir, id), p)
+	}
+	dir := t.TempDir()
+	assert.Nil(t, CloneStore(lsm.option.WorkDir, dir))
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+
+	for _, d := range []string{lsm.option.WorkDir, dir} {
+		o := *lsm.option
+		o.WorkDir = d
+		o.SSTableLayout = utils.SSTableLayoutFlat
+		reopened := initLSM(&o)
+		assert.Nil(t, reopened.Verify())
+		for _, e := range entries {
+			v, err := reopened.Get(e.Key)
+			assert.Nil(t, err)
+			assert.Equal(t, e.Value, v.Value)
+		}
+		_, err := reopened.Close()
+		assert.Nil(t, err)
+	}
+}
+
+// TestManifestBackup manifest损坏后从备份恢复；备份在删除sst后立即更新，合并之后恢复不会引用已经移除的sst
+func TestManifestBackup(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 2
+		o.ManifestBackupInterval = 100
+	})
+	for i := uint64(1); i <= 4; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("k%d", i)), i), []byte("v"))))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	assert.Nil(t, lsm.CompactAll())
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+
+	// 破坏manifest中第一个change set的数据，校验和不再匹配
+	dir := lsm.option.WorkDir
+	path := filepath.Join(dir, utils.ManifestFilename)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0666))
+
+	lsm = initLSM(lsm.option)
+	assert.Nil(t, lsm.Verify())
+	for i := uint64(1); i <= 4; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("k%d", i)), math.MaxUint64))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), e.Value)
+	}
+	corrupt, err := os.ReadFile(filepath.Join(dir, utils.ManifestCorruptFilename))
+	assert.Nil(t, err)
+	assert.Equal(t, data, corrupt)
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+
+	// 没有备份时仍然无法打开
+	assert.Nil(t, os.Remove(filepath.Join(dir, utils.ManifestBackupFilename)))
+	data, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0666))
+	lsm.option.ManifestBackupInterval = 0
+	assert.Panics(t, func() { initLSM(lsm.option) })
+}
+
+// TestRevertReport 报告列出缺失的sst与孤儿sst，存在缺失时返回错误且不删除任何文件
+func TestRevertReport(t *testing.T) {
+	dir := t.TempDir()
+	mf, err := file.OpenManifestFile(&osFile.FileOption{WorkDir: dir})
+	assert.Nil(t, err)
+	defer mf.Close()
+	for _, id := range []uint64{1, 2} {
+		assert.Nil(t, mf.AddTableMeta(0, &file.TableMeta{ID: id}))
+	}
+	// 3的文件名没有补零
+	orphans := []file.OrphanTable{
+		{ID: 3, Path: filepath.Join(dir, "3.sst")},
+		{ID: 4, Path: utils.SSTableFullPath(dir, 4)},
+	}
+	for _, p := range []string{utils.SSTableFullPath(dir, 1), orphans[0].Path, orphans[1].Path} {
+		assert.Nil(t, os.WriteFile(p, nil, 0666))
+	}
+
+	opt := file.RevertToManifestOpts{DeleteOrphans: true}
+	report, err := mf.RevertToManifest(utils.LoadSSTPaths(dir), opt)
+	assert.NotNil(t, err)
+	assert.Equal(t, file.RevertReport{Missing: []uint64{2}, Orphans: orphans}, report)
+	for _, orphan := range orphans {
+		_, err := os.Stat(orphan.Path)
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, os.WriteFile(utils.SSTableFullPath(dir, 2), nil, 0666))
+	report, err = mf.RevertToManifest(utils.LoadSSTPaths(dir), opt)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Missing)
+	for i := range orphans {
+		orphans[i].Removed = true
+		_, err := os.Stat(orphans[i].Path)
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Equal(t, orphans, report.Orphans)
+}
+
+// TestMergeSmallTables 一层中相邻的过小sst达到MaxSmallTables后在层内合并，数据不变
+func TestMergeSmallTables(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.MaxSmallTables = 8
+	})
+	buildFragmentedLevel(t, lsm, 1, 20, 10)
+	assert.Equal(t, 20, lsm.levels.levels[1].numTables())
+
+	assert.Nil(t, lsm.CompactAll())
+	n := lsm.levels.levels[1].numTables()
+	assert.True(t, n > 0 && n <= 2, "level 1 has %d tables", n)
+	assert.Nil(t, lsm.Verify())
+	for i := 0; i < 20*10; i++ {
+		e, err := lsm.Get(utils.KeyWithTs(fragmentKey(i), math.MaxUint64))
+		assert.Nil(t, err)
+		assert.Equal(t, fragmentKey(i), e.Value)
+	}
+	// 合并之后不再有需要合并的sst
+	assert.Empty(t, lsm.levels.fragmentPriorities(lsm.levels.levelTargets()))
+}
+
+// buildFragmentedLevel 通过FlushToLevel在level层生成tables个互不重叠的sst，每个包含perTable个key
+func buildFragmentedLevel(t testing.TB, lsm *LSM, level, tables, perTable int) {
+	for i := 0; i < tables; i++ {
+		for j := 0; j < perTable; j++ {
+			key := fragmentKey(i*perTable + j)
+			if err := lsm.Set(utils.NewEntry(utils.KeyWithTs(key, 1), key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lsm.FlushToLevel(level); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fragmentKey(i int) []byte {
+	return []byte(fmt.Sprintf("fragment%08d", i))
+}
+
+// BenchmarkMergeSmallTables 比较合并过小sst前后扫描整个层的耗时
+func BenchmarkMergeSmallTables(b *testing.B) {
+	for _, merge := range []bool{false, true} {
+		name := "fragmented"
+		if merge {
+			name = "merged"
+		}
+		b.Run(name, func(b *testing.B) {
+			o := *opt
+			o.WorkDir = b.TempDir()
+			o.SyncCompaction = true
+			o.MaxSmallTables = 8
+			lsm := initLSM(&o)
+			defer lsm.Close()
+			buildFragmentedLevel(b, lsm, 1, 200, 10)
+			if merge {
+				if err := lsm.CompactAll(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+				for iter.Rewind(); iter.Valid(); iter.Next() {
+				}
+				iter.Close()
+			}
+		})
+	}
+}
+
+// TestEntryChecksumFromTable 从sst中读出的entry带有校验和，修改value后校验失败
+func TestEntryChecksumFromTable(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	e := utils.NewEntry(utils.KeyWithTs([]byte("key"), 1), []byte("value"))
+	assert.Nil(t, lsm.Set(e))
+	got, err := lsm.Get(e.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.ErrNoChecksum, got.Verify())
+	assert.Nil(t, lsm.RotateMemtable())
+
+	got, err = lsm.Get(e.Key)
+	assert.Nil(t, err)
+	// 读取时不计算校验和，第一次Verify时才按读出时的内容计算
+	assert.Equal(t, uint32(0), got.Checksum)
+	assert.Nil(t, got.Verify())
+	assert.Equal(t, e.CalculateChecksum(), got.Checksum)
+	got.Value = []byte("other")
+	assert.True(t, errors.Is(got.Verify(), utils.ErrChecksumMismatch))
+
+	// 读出之后、第一次Verify之前的修改同样会被发现
+	got, err = lsm.Get(e.Key)
+	assert.Nil(t, err)
+	got.ExpiresAt = 1
+	assert.True(t, errors.Is(got.Verify(), utils.ErrChecksumMismatch))
+}
+
+// TestTTLCompaction 过期的entry在没有任何读写的情况下被定时的TTL合并回收
+func TestTTLCompaction(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 1 << 20
+		o.SSTableMaxSz = 1 << 20
+		o.TTLCompactionInterval = 50 * time.Millisecond
+	})
+	defer lsm.Close()
+	expiresAt := uint64(time.Now().Add(time.Second).Unix())
+	for i := 0; i < 100; i++ {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("ttl%04d", i)), 1), []byte(randStr(128)))
+		e.ExpiresAt = expiresAt
+		assert.Nil(t, lsm.Set(e))
+	}
+	live := utils.NewEntry(utils.KeyWithTs([]byte("live"), 1), []byte("value"))
+	assert.Nil(t, lsm.Set(live))
+	assert.Nil(t, lsm.RotateMemtable())
+
+	// 过期时间范围记录在sst与manifest中
+	l0 := lsm.levels.levels[0].tables
+	assert.Equal(t, 1, len(l0))
+	assert.Equal(t, expiresAt, l0[0].minExpiresAt)
+	assert.Equal(t, expiresAt, l0[0].maxExpiresAt)
+	tm := lsm.levels.manifestFile.GetManifest().Tables[l0[0].fid]
+	assert.Equal(t, expiresAt, tm.MinExpiresAt)
+	assert.Equal(t, expiresAt, tm.MaxExpiresAt)
+
+	before := lsm.levels.totalSize()
+	lsm.StartCompacter()
+	assert.Eventually(t, func() bool {
+		return lsm.levels.totalSize() < before/2
+	}, 10*time.Second, 50*time.Millisecond)
+
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(utils.ParseKey(iter.Item().Entry().Key)))
+	}
+	assert.Equal(t, []string{"live"}, keys)
+	got, err := lsm.Get(utils.KeyWithTs([]byte("live"), math.MaxUint64))
+	assert.Nil(t, err)
+	assert.Equal(t, live.Value, got.Value)
+}
+
+// TestSwapFrom 读取进行中时替换数据，每次读取看到的要么全是旧数据要么全是新数据
+func TestSwapFrom(t *testing.T) {
+	const n = 50
+	key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("swap%03d", i)), 1) }
+	lsm := buildTestLSM(t, nil)
+	for i := 0; i < n; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(key(i), []byte("old"))))
+		if i == n/2 {
+			assert.Nil(t, lsm.RotateMemtable())
+		}
+	}
+	staging := buildTestLSM(t, nil)
+	for i := 0; i < n; i++ {
+		assert.Nil(t, staging.Set(utils.NewEntry(key(i), []byte("new"))))
+	}
+	_, err := staging.Close()
+	assert.Nil(t, err)
+
+	stop := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// 一次遍历中的所有value必须相同
+				iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+				var values []string
+				for iter.Rewind(); iter.Valid(); iter.Next() {
+					values = append(values, string(iter.Item().Entry().Value))
+				}
+				iter.Close()
+				if len(values) != n {
+					errs <- fmt.Errorf("scan saw %d entries", len(values))
+					return
+				}
+				for _, v := range values {
+					if v != values[0] {
+						errs <- fmt.Errorf("scan mixed %q and %q", values[0], v)
+						return
+					}
+				}
+				e, err := lsm.Get(key(n - 1))
+				if err != nil || (string(e.Value) != "old" && string(e.Value) != "new") {
+					errs <- fmt.Errorf("get: %v %v", e, err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, lsm.SwapFrom(staging.option.WorkDir))
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	_, err = os.Stat(staging.option.WorkDir)
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < n; i++ {
+		e, err := lsm.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), e.Value)
+	}
+	// 替换之后的写入与重新打开
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("after"), 2), []byte("v"))))
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	lsm = initLSM(lsm.option)
+	e, err := lsm.Get(utils.KeyWithTs([]byte("after"), 2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), e.Value)
+	e, err = lsm.Get(key(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), e.Value)
+}
+
+// TestSwapFromReleasesFiles 反复替换后WorkDir中打开的文件数量不变，旧数据的sst文件与mmap被关闭
+func TestSwapFromReleasesFiles(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("/proc/self/fd is not available")
+	}
+	// openFiles 统计当前进程打开的位于dir中的文件，包括替换时随旧数据移走并删除的文件
+	openFiles := func(dir string) int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		assert.Nil(t, err)
+		var n int
+		for _, fd := range fds {
+			path, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+			if err == nil && (strings.HasPrefix(path, dir+string(filepath.Separator)) ||
+				strings.HasPrefix(path, dir+swapOldSuffix+string(filepath.Separator))) {
+				n++
+			}
+		}
+		return n
+	}
+	lsm := buildTestLSM(t, nil)
+	dir, err := filepath.EvalSymlinks(lsm.option.WorkDir)
+	assert.Nil(t, err)
+	var counts []int
+	for round := 0; round < 4; round++ {
+		staging := buildTestLSM(t, nil)
+		for i := 0; i < 50; i++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("swap%03d", i)), 1)
+			assert.Nil(t, staging.Set(utils.NewEntry(key, []byte(fmt.Sprintf("value%d", round)))))
+		}
+		_, err := staging.Close()
+		assert.Nil(t, err)
+		assert.Nil(t, lsm.SwapFrom(staging.option.WorkDir))
+		assert.True(t, lsm.levels.levels[0].numTables() > 0)
+		counts = append(counts, openFiles(dir))
+	}
+	for _, n := range counts {
+		assert.Equal(t, counts[0], n, "open files after each swap: %v", counts)
+	}
+}
+
+// BenchmarkManifestAddTableMeta 并发注册sst时manifest的吞吐，每次写入都sync
+func BenchmarkManifestAddTableMeta(b *testing.B) {
+	o := *opt
+	o.WorkDir = b.TempDir()
+	o.SyncCompaction = true
+	lsm := initLSM(&o)
+	defer lsm.Close()
+	mf := lsm.levels.manifestFile
+	var fid uint64 = 1 << 32
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			id := atomic.AddUint64(&fid, 1)
+			if err := mf.AddTableMeta(6, &file.TableMeta{ID: id, Checksum: []byte{'m', 'o', 'c', 'k'}}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// TestMakeKey MakeKey生成的key按user key升序、同一个key按版本从新到旧排序，Get可以用user key找到最新的版本
+func TestMakeKey(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	a1 := lsm.MakeKey([]byte("a"))
+	b1 := lsm.MakeKey([]byte("b"))
+	a2 := lsm.MakeKey([]byte("a"))
+	assert.Equal(t, []byte("a"), utils.ParseKey(a1))
+	assert.Equal(t, utils.ParseTs(a1)+2, utils.ParseTs(a2))
+	assert.True(t, utils.CompareKeys(a2, a1) < 0)
+	assert.True(t, utils.CompareKeys(a1, b1) < 0)
+	assert.True(t, utils.CompareKeys(a2, b1) < 0)
+
+	assert.Nil(t, lsm.Set(utils.NewEntry(a1, []byte("a1"))))
+	assert.Nil(t, lsm.Set(utils.NewEntry(b1, []byte("b1"))))
+	assert.Nil(t, lsm.Set(utils.NewEntry(a2, []byte("a2"))))
+	assert.Nil(t, lsm.RotateMemtable())
+	for key, want := range map[string]string{"a": "a2", "b": "b1"} {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(key), math.MaxUint64))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(want), e.Value)
+	}
+	// Put分配的版本号在MakeKey之后
+	assert.Nil(t, lsm.Put([]byte("a"), []byte("a3")))
+	version, ok, err := lsm.Version([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, utils.ParseTs(a2)+1, version)
+}
+
+// TestTrashRetention 刷盘与合并删除的wal与sst先进入.trash，保留期之后被删除
+func TestTrashRetention(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 1 << 20
+		o.SSTableMaxSz = 1 << 20
+		o.SyncCompaction = true
+		o.NumLevelZeroTables = 1
+		o.TrashRetention = 300 * time.Millisecond
+	})
+	defer lsm.Close()
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("trash%d", i)), 1), []byte("value"))))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	var l0 []uint64
+	for _, tbl := range lsm.levels.levels[0].tables {
+		l0 = append(l0, tbl.fid)
+	}
+	assert.Equal(t, 2, len(l0))
+	assert.Nil(t, lsm.CompactAll())
+	assert.Equal(t, 0, lsm.levels.levels[0].numTables())
+
+	trash := filepath.Join(lsm.option.WorkDir, utils.TrashDirname)
+	names := func() map[string]bool {
+		infos, _ := os.ReadDir(trash)
+		m := make(map[string]bool)
+		for _, info := range infos {
+			m[info.Name()] = true
+		}
+		return m
+	}
+	got := names()
+	var wals int
+	for name := range got {
+		if filepath.Ext(name) == walFileExt {
+			wals++
+		}
+	}
+	assert.Equal(t, 2, wals)
+	for _, fid := range l0 {
+		assert.True(t, got[filepath.Base(utils.SSTableFullPath(lsm.option.WorkDir, fid))], "table %d not in trash", fid)
+	}
+	e, err := lsm.Get(utils.KeyWithTs([]byte("trash0"), math.MaxUint64))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), e.Value)
+
+	assert.Eventually(t, func() bool {
+		return len(names()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// TestIteratorVersion 迭代器对同一个key的每个版本返回各自的版本号
+func TestIteratorVersion(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	for _, v := range []uint64{3, 7} {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("key"), v), []byte(fmt.Sprintf("v%d", v)))))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("key"), 9), []byte("v9"))))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("other"), 1), []byte("v1"))))
+
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true}).(*Iterator)
+	defer iter.Close()
+	var versions []uint64
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		assert.Equal(t, iter.Version(), e.Version)
+		assert.Equal(t, []byte(fmt.Sprintf("v%d", iter.Version())), e.Value)
+		assert.Equal(t, byte(0), iter.Meta())
+		versions = append(versions, iter.Version())
+	}
+	assert.Equal(t, []uint64{9, 7, 3, 1}, versions)
+}
+
+func TestBloomBitsPerKey(t *testing.T) {
+	opt := DefaultOptions(t.TempDir())
+	opt.BloomBitsPerKey = 10
+	_, err := Open(opt)
+	assert.NotNil(t, err)
+	_, err = Open(DefaultOptions(t.TempDir()).WithBloomHash(utils.BloomHashXXHash + 1))
+	assert.NotNil(t, err)
+
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 1 << 20
+		o.SSTableMaxSz = 1 << 20
+		o.BloomBitsPerKey = 10
+		o.BloomHash = utils.BloomHashXXHash
+	})
+	defer lsm.Close()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("bloom%03d", i)), 1), []byte("value"))))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+	idx := lsm.levels.levels[0].tables[0].ss.Indexs()
+	assert.Equal(t, uint32(utils.BloomHashXXHash), idx.BloomHash)
+	// 100个key每个10bit，加上记录哈希函数数量的1字节
+	assert.Equal(t, 100*10/8+1, len(idx.BloomFilter))
+	for i := 0; i < 100; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("bloom%03d", i)), math.MaxUint64))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), e.Value)
+	}
+	results, err := lsm.MultiGet([][]byte{utils.KeyWithTs([]byte("bloom050"), math.MaxUint64)})
+	assert.Nil(t, err)
+	assert.NotNil(t, results[0])
+}
+
+func TestBeginBackup(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 1 << 20
+		o.SSTableMaxSz = 1 << 20
+		o.NumLevelZeroTables = 2
+	})
+	defer lsm.Close()
+	put := func(round, n int) {
+		for i := 0; i < n; i++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("backup%03d", i)), uint64(round+1))
+			assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("value%d", round)))))
+		}
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	for round := 0; round < 3; round++ {
+		put(round, 50)
+	}
+	files, release, err := lsm.BeginBackup()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(files))
+
+	// 不断写入并合并，列表中的sst都会被合并掉
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 3; round < 8; round++ {
+			put(round, 50)
+			assert.Nil(t, lsm.CompactAll())
+		}
+	}()
+	restore := t.TempDir()
+	copyFile := func(src, dst string) {
+		data, err := os.ReadFile(src)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(dst, data, 0666))
+	}
+	copyFile(files[0], filepath.Join(restore, utils.ManifestFilename))
+	for _, f := range files[1:] {
+		rel, err := filepath.Rel(lsm.option.WorkDir, f)
+		assert.Nil(t, err)
+		copyFile(f, filepath.Join(restore, rel))
+	}
+	<-done
+	for _, f := range files {
+		_, err := os.Stat(f)
+		assert.Nil(t, err, "%s removed before release", f)
+	}
+	release()
+	release()
+	for _, f := range files {
+		_, err := os.Stat(f)
+		assert.True(t, os.IsNotExist(err), "%s not removed after release", f)
+	}
+
+	restored := buildTestLSM(t, func(o *Options) {
+		o.WorkDir = restore
+	})
+	defer restored.Close()
+	for i := 0; i < 50; i++ {
+		versions, err := restored.GetAllVersions([]byte(fmt.Sprintf("backup%03d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(versions))
+		assert.Equal(t, uint64(3), versions[0].Version)
+		assert.Equal(t, []byte("value2"), versions[0].Value)
+	}
+}
+
+// TestValueCompression 超过阈值并且可以压缩的value压缩后写入，经过wal回放与flush后都能解压读出
+func TestValueCompression(t *testing.T) {
+	enc, err := utils.NewAESEncryptor(1, bytes.Repeat([]byte{7}, 32))
+	assert.Nil(t, err)
+	random := make([]byte, 512)
+	rand.Read(random)
+	values := [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("compressible"), 100),
+		random, // 压缩后不会变小
+	}
+	compressed := []bool{false, true, false}
+	for _, setOpt := range []func(o *Options){
+		func(o *Options) {},
+		func(o *Options) { o.WalChecksum = utils.ChecksumXXHash },
+		func(o *Options) { o.Encryptor = enc },
+	} {
+		lsm := buildTestLSM(t, func(o *Options) {
+			o.MemTableSize = 1 << 20
+			o.SSTableMaxSz = 1 << 20
+			o.ValueCompressionThreshold = 64
+			setOpt(o)
+		})
+		key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("compress%d", i)), 1) }
+		for i, v := range values {
+			assert.Nil(t, lsm.Set(utils.NewEntry(key(i), v)))
+		}
+		check := func() {
+			for i, v := range values {
+				e, err := lsm.Get(key(i))
+				assert.Nil(t, err)
+				assert.Equal(t, v, e.Value)
+				assert.Equal(t, byte(0), e.Meta)
+			}
+			results, err := lsm.MultiGet([][]byte{key(1), key(2)})
+			assert.Nil(t, err)
+			assert.Equal(t, values[1], results[0].Value)
+			assert.Equal(t, values[2], results[1].Value)
+			iter := lsm.NewIterator(&utils.Options{IsAsc: true}).(*Iterator)
+			i := 0
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				assert.Equal(t, values[i], iter.Item().Entry().Value)
+				assert.Equal(t, compressed[i], iter.Meta()&utils.BitValueCompressed != 0)
+				i++
+			}
+			assert.Nil(t, iter.Error())
+			assert.Nil(t, iter.Close())
+			assert.Equal(t, len(values), i)
+			// 只读取key时不解压，Meta中仍然可以看到压缩标记
+			iter = lsm.NewIterator(&utils.Options{IsAsc: true, KeysOnly: true}).(*Iterator)
+			i = 0
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				assert.Empty(t, iter.Item().Entry().Value)
+				assert.Equal(t, compressed[i], iter.Meta()&utils.BitValueCompressed != 0)
+				i++
+			}
+			assert.Nil(t, iter.Error())
+			assert.Nil(t, iter.Close())
+			assert.Equal(t, len(values), i)
+		}
+		check()
+		// 内存表中保存的是压缩后的value
+		raw, err := lsm.memTable.Get(key(1))
+		assert.Nil(t, err)
+		assert.True(t, len(raw.Value) < len(values[1]))
+		// meta随wal回放
+		lsm = initLSM(lsm.option)
+		check()
+		assert.Nil(t, lsm.RotateMemtable())
+		assert.Equal(t, 1, lsm.levels.levels[0].numTables())
+		check()
+		assert.Nil(t, lsm.Verify())
+		lsm.Close()
+	}
+}
+
+// TestRowCache Get读到的entry被缓存，写入立即淘汰，与写入并发的查询不会读到旧数据
+func TestRowCache(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 1 << 20
+		o.SSTableMaxSz = 1 << 20
+		o.RowCacheSize = 4 << 10
+	})
+	defer lsm.Close()
+	key := func(k string) []byte { return utils.KeyWithTs([]byte(k), 1) }
+	set := func(k, v string) {
+		assert.Nil(t, lsm.Set(utils.NewEntry(key(k), []byte(v))))
+	}
+	set("row", "v1")
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Nil(t, lsm.rowCache.get(key("row")))
+	e, err := lsm.Get(key("row"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), e.Value)
+	// 再次查询直接从缓存返回，版本号不同的查询不命中
+	assert.Equal(t, []byte("v1"), lsm.rowCache.get(key("row")).Value)
+	assert.Nil(t, lsm.rowCache.get(utils.KeyWithTs([]byte("row"), 2)))
+	e, err = lsm.Get(key("row"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), e.Value)
+
+	set("row", "v2")
+	assert.Nil(t, lsm.rowCache.get(key("row")))
+	e, err = lsm.Get(key("row"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), e.Value)
+
+	// 缓存的总大小不超过RowCacheSize
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("fill%03d", i)
+		set(k, strings.Repeat("x", 100))
+		_, err := lsm.Get(key(k))
+		assert.Nil(t, err)
+	}
+	assert.True(t, lsm.rowCache.size <= lsm.option.RowCacheSize, "size %d", lsm.rowCache.size)
+	assert.Nil(t, lsm.rowCache.get(key("fill000")))
+
+	// 每次写入之后的查询都能读到刚写入的value
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_, _ = lsm.Get(key("hot"))
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2000; i++ {
+		value := fmt.Sprintf("hot%d", i)
+		set("hot", value)
+		e, err := lsm.Get(key("hot"))
+		assert.Nil(t, err)
+		if !assert.Equal(t, []byte(value), e.Value) {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkRowCache(b *testing.B) {
+	for _, size := range []int64{0, 1 << 20} {
+		b.Run(fmt.Sprintf("RowCacheSize=%d", size), func(b *testing.B) {
+			o := *opt
+			o.WorkDir = b.TempDir()
+			o.MemTableSize = 64 << 10
+			o.SSTableMaxSz = 64 << 10
+			o.BlockSize = 4 << 10
+			o.BloomFalsePositive = 0.01
+			o.SyncCompaction = true
+			o.RowCacheSize = size
+			lsm := initLSM(&o)
+			defer lsm.Close()
+			const numKeys = 10000
+			for i := 0; i < numKeys; i++ {
+				if err := lsm.Put(benchKey(i), []byte("value")); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := lsm.RotateMemtable(); err != nil {
+				b.Fatal(err)
+			}
+			if err := lsm.CompactAll(); err != nil {
+				b.Fatal(err)
+			}
+			// 少数热点key占了大部分查询
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), defaultZipfS, 1, numKeys-1)
+			keys := make([][]byte, 4096)
+			for i := range keys {
+				keys[i] = utils.KeyWithTs(benchKey(int(zipf.Uint64())), math.MaxUint64)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := lsm.Get(keys[n%len(keys)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestEmptyValue 长度为0的value是正常的数据，经过wal恢复、刷盘与合并后仍然可以读到，不会被当作不存在
+func TestEmptyValue(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.SyncCompaction = true
+		o.ValueCompressionThreshold = 1
+	})
+	key := utils.KeyWithTs([]byte("empty"), 1)
+	check := func(level int) {
+		e, err := lsm.Get(key)
+		assert.Nil(t, err)
+		if assert.NotNil(t, e) {
+			assert.Equal(t, key, e.Key)
+			assert.Len(t, e.Value, 0)
+		}
+		l, _, found, err := lsm.Locate(key)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, level, l)
+		iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+		defer iter.Close()
+		iter.Seek(key)
+		if assert.True(t, iter.Valid()) {
+			assert.Equal(t, key, iter.Item().Entry().Key)
+			assert.Len(t, iter.Item().Entry().Value, 0)
+		}
+		_, err = lsm.Get(utils.KeyWithTs([]byte("missing"), 1))
+		assert.Equal(t, utils.ErrKeyNotFound, err)
+	}
+	assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte{})))
+	check(-1)
+
+	// 从wal恢复
+	lsm = initLSM(lsm.option)
+	check(-1)
+
+	assert.Nil(t, lsm.RotateMemtable())
+	check(0)
+	_, fid, _, _ := lsm.Locate(key)
+	assert.Nil(t, lsm.CompactTables([]uint64{fid}))
+	l, _, _, _ := lsm.Locate(key)
+	assert.Greater(t, l, 0)
+	check(l)
+}
+
+// TestRebuildFromWAL 删除manifest后只用wal重建，RebuildKeepTables时已有的sst中的数据也能找回
+func TestRebuildFromWAL(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		lsm := buildTestLSM(t, func(o *Options) { o.MemTableSize = 1 << 20 })
+		flushed := utils.KeyWithTs([]byte("flushed"), 3)
+		logged := utils.KeyWithTs([]byte("logged"), 2)
+		assert.Nil(t, lsm.Set(utils.NewEntry(flushed, []byte("sst"))))
+		assert.Nil(t, lsm.RotateMemtable())
+		assert.Nil(t, lsm.Set(utils.NewEntry(logged, []byte("wal"))))
+		// 不刷盘直接关闭，模拟崩溃后manifest丢失
+		assert.Nil(t, lsm.release())
+		assert.Nil(t, os.Remove(filepath.Join(lsm.option.WorkDir, utils.ManifestFilename)))
+
+		opt := *lsm.option
+		opt.RebuildKeepTables = keep
+		assert.Nil(t, RebuildFromWAL(opt.WorkDir, opt))
+		lsm = initLSM(lsm.option)
+		e, err := lsm.Get(logged)
+		assert.Nil(t, err)
+		if assert.NotNil(t, e) {
+			assert.Equal(t, []byte("wal"), e.Value)
+		}
+		e, err = lsm.Get(flushed)
+		if keep {
+			assert.Nil(t, err)
+			if assert.NotNil(t, e) {
+				assert.Equal(t, []byte("sst"), e.Value)
+			}
+			assert.Empty(t, lsm.FindOrphans())
+		} else {
+			assert.Equal(t, utils.ErrKeyNotFound, err)
+			assert.Len(t, lsm.FindOrphans(), 1)
+		}
+		// 重新注册的sst中的版本号也计入检查点
+		if keep {
+			assert.Equal(t, uint64(3), lsm.orc.nextTs)
+		} else {
+			assert.Equal(t, uint64(2), lsm.orc.nextTs)
+		}
+		_, err = lsm.Close()
+		assert.Nil(t, err)
+	}
+
+	opt := *buildTestLSM(t, func(*Options) {}).option
+	opt.RebuildKeepTables, opt.DeleteOrphans = true, true
+	assert.NotNil(t, RebuildFromWAL(opt.WorkDir, opt))
+
+	// DeleteOrphans不能删除重建之前的sst
+	lsm := buildTestLSM(t, func(o *Options) { o.MemTableSize = 1 << 20 })
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("flushed"), 1), []byte("sst"))))
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Nil(t, lsm.release())
+	tables := utils.LoadSSTIdMap(lsm.option.WorkDir)
+	assert.Len(t, tables, 1)
+	assert.Nil(t, os.Remove(filepath.Join(lsm.option.WorkDir, utils.ManifestFilename)))
+	opt = *lsm.option
+	opt.DeleteOrphans = true
+	assert.Nil(t, RebuildFromWAL(opt.WorkDir, opt))
+	assert.Equal(t, tables, utils.LoadSSTIdMap(opt.WorkDir))
+	lsm = initLSM(lsm.option)
+	assert.Len(t, lsm.FindOrphans(), 1)
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+}
+
+// TestTableCreatedAt 刷盘生成的sst记录创建时间，重新打开与manifest覆写后保持不变，旧的manifest记录为零值
+func TestTableCreatedAt(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.MemTableSize = 1 << 20 })
+	before := time.Now().Add(-time.Second)
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("a"), 1), []byte("v"))))
+	assert.Nil(t, lsm.RotateMemtable())
+	tables := lsm.Tables()
+	if !assert.Len(t, tables, 1) {
+		return
+	}
+	created := tables[0].CreatedAt
+	assert.Equal(t, 0, tables[0].Level)
+	assert.False(t, created.Before(before.Truncate(time.Second)))
+	assert.False(t, created.After(time.Now()))
+	assert.True(t, tables[0].Age() < time.Minute)
+
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+	dir := lsm.option.WorkDir
+	manifest, err := file.ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, file.WriteManifest(dir, manifest))
+	lsm = initLSM(lsm.option)
+	tables = lsm.Tables()
+	if assert.Len(t, tables, 1) {
+		assert.Equal(t, created, tables[0].CreatedAt)
+		assert.Equal(t, created, *lsm.levels.levels[0].tables[0].GetCreatedAt())
+	}
+
+	// 没有CreatedAt字段的旧记录
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	manifest, err = file.ReadManifest(dir)
+	assert.Nil(t, err)
+	for id, tm := range manifest.Tables {
+		tm.CreatedAt = 0
+		manifest.Tables[id] = tm
+	}
+	assert.Nil(t, file.WriteManifest(dir, manifest))
+	lsm = initLSM(lsm.option)
+	tables = lsm.Tables()
+	if assert.Len(t, tables, 1) {
+		assert.True(t, tables[0].CreatedAt.IsZero())
+		assert.Equal(t, time.Duration(0), tables[0].Age())
+	}
+}
+
+// TestIteratorClone 两个Clone并行扫描不相交的两段key，合起来恰好是全部的key；原迭代器关闭与合并都不影响Clone
+func TestIteratorClone(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.NumLevelZeroTables = 2
+		o.SyncCompaction = true
+	})
+	const n = 300
+	key := func(i int) []byte { return []byte(fmt.Sprintf("clone%04d", i)) }
+	for i := 0; i < n; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs(key(i), 1), []byte("v"))))
+		if i%100 == 99 {
+			assert.Nil(t, lsm.RotateMemtable())
+		}
+	}
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true}).(*Iterator)
+	iter.Seek(utils.KeyWithTs(key(10), math.MaxUint64))
+	clone := iter.Clone()
+	if assert.True(t, clone.Valid()) {
+		assert.Equal(t, iter.Item().Entry().Key, clone.Item().Entry().Key)
+	}
+	assert.Nil(t, clone.Close())
+
+	lower, upper := iter.Clone(), iter.Clone()
+	assert.Nil(t, iter.Close())
+	// 合并删除了原来的sst，Clone持有的引用保证它们仍然可读
+	assert.Nil(t, lsm.CompactAll())
+	live := make(map[uint64]bool)
+	for _, info := range lsm.Tables() {
+		live[info.ID] = true
+	}
+	removed := 0
+	for _, tables := range lower.tables {
+		for _, tbl := range tables {
+			if !live[tbl.fid] {
+				removed++
+			}
+		}
+	}
+	assert.Greater(t, removed, 0)
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("zzz"), 1), []byte("v"))))
+
+	split := utils.KeyWithTs(key(n/2), math.MaxUint64)
+	scan := func(it *Iterator, start, end []byte, out *[]string) {
+		defer it.Close()
+		for it.Seek(start); it.Valid(); it.Next() {
+			k := it.Item().Entry().Key
+			if end != nil && utils.CompareKeys(k, end) >= 0 {
+				break
+			}
+			*out = append(*out, string(utils.ParseKey(k)))
+		}
+	}
+	var a, b []string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); scan(lower, utils.KeyWithTs(key(0), math.MaxUint64), split, &a) }()
+	go func() { defer wg.Done(); scan(upper, split, utils.KeyWithTs([]byte("zzz"), math.MaxUint64), &b) }()
+	wg.Wait()
+	assert.Len(t, a, n/2)
+	assert.Len(t, b, n-n/2)
+	all := append(a, b...)
+	for i := 0; i < n; i++ {
+		assert.Equal(t, string(key(i)), all[i])
+	}
+}
+
+// TestSetNumCompactors 写入的同时把合并协程从1个调整到4个再到0个，数据不丢失也不损坏
+func TestSetNumCompactors(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 1 << 10
+		o.NumLevelZeroTables = 2
+		o.NumCompactors = 1
+		o.L0StallThreshold, o.L0StopThreshold = 0, 0
+	})
+	lsm.StartCompacter()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lsm.levels.compacters))
+	assert.NotNil(t, lsm.SetNumCompactors(-1))
+
+	const n = 3000
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < n; i++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 1)
+			assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("val%05d", i)))))
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, lsm.SetNumCompactors(4))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&lsm.levels.compacters))
+	time.Sleep(500 * time.Millisecond)
+	assert.Nil(t, lsm.SetNumCompactors(0))
+	// 返回时多余的协程已经退出，不再有后台合并
+	assert.Equal(t, int32(0), atomic.LoadInt32(&lsm.levels.compacters))
+	assert.Equal(t, 0, lsm.option.NumCompactors)
+	<-written
+
+	assert.Nil(t, lsm.Verify())
+	for i := 0; i < n; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 1))
+		if assert.Nil(t, err) {
+			assert.Equal(t, fmt.Sprintf("val%05d", i), string(e.Value))
+		}
+	}
+	// 再次启动后可以继续合并
+	assert.Nil(t, lsm.SetNumCompactors(2))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lsm.levels.compacters))
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+	// 关闭之后不再启动协程
+	assert.Nil(t, lsm.SetNumCompactors(1))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&lsm.levels.compacters))
+}
+
+// TestCheckNoDuplicates 注入重复(key, 版本号)的sst能被找出并报告位置，同一个key的不同版本不算重复
+func TestCheckNoDuplicates(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("x"), 1), []byte("x"))))
+	assert.Nil(t, lsm.RotateMemtable())
+	dups, err := lsm.CheckNoDuplicates()
+	assert.Nil(t, err)
+	assert.Empty(t, dups)
+
+	builder := newTableBuiler(lsm.option)
+	for _, e := range []struct {
+		k  string
+		ts uint64
+	}{{"a", 1}, {"b", 2}, {"b", 1}, {"b", 1}, {"c", 1}} {
+		builder.add(utils.NewEntry(utils.KeyWithTs([]byte(e.k), e.ts), []byte(e.k)), false)
+	}
+	fid := lsm.levels.maxFID + 1
+	lsm.levels.maxFID = fid
+	tbl := openTable(lsm.levels, utils.SSTableFullPath(lsm.option.WorkDir, fid), builder)
+	assert.Nil(t, lsm.levels.manifestFile.AddTableMeta(0, &file.TableMeta{ID: fid, Checksum: []byte{'m', 'o', 'c', 'k'}}))
+	lsm.levels.levels[0].add(tbl)
+
+	dups, err = lsm.CheckNoDuplicates()
+	assert.Nil(t, err)
+	if assert.Len(t, dups, 1) {
+		d := dups[0]
+		assert.Equal(t, 0, d.Level)
+		assert.Equal(t, fid, d.TableID)
+		assert.Equal(t, []byte("b"), d.Key)
+		assert.Equal(t, uint64(1), d.Version)
+		assert.Equal(t, 0, d.First.Block)
+		assert.Equal(t, d.First.Block, d.Duplicate.Block)
+		assert.Less(t, d.First.EntryOffset, d.Duplicate.EntryOffset)
+	}
+}
+
+// TestBuildStore 从有序的entry流直接生成最底层的sst，打开后可以读回所有版本；乱序或截断的输入返回错误
+func TestBuildStore(t *testing.T) {
+	o := *opt
+	o.SSTableMaxSz = 8 << 10
+	var buf bytes.Buffer
+	const n = 1000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		// 版本号从新到旧排列才是CompareKeys的顺序
+		for ts := uint64(2); ts >= 1; ts-- {
+			e := utils.NewEntry(utils.KeyWithTs(key, ts), []byte(fmt.Sprintf("val%05d-%d", i, ts)))
+			assert.Nil(t, WriteSortedEntry(&buf, e))
+		}
+	}
+	dir := t.TempDir()
+	assert.Nil(t, BuildStore(dir, o, bytes.NewReader(buf.Bytes())))
+	assert.NotNil(t, BuildStore(dir, o, bytes.NewReader(buf.Bytes())))
+
+	o.WorkDir = dir
+	lsm := initLSM(&o)
+	bottom := o.MaxLevelNum - 1
+	assert.Greater(t, lsm.levels.levels[bottom].numTables(), 1)
+	for level := 0; level < bottom; level++ {
+		assert.Equal(t, 0, lsm.levels.levels[level].numTables())
+	}
+	assert.Nil(t, lsm.Verify())
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		for ts := uint64(1); ts <= 2; ts++ {
+			e, err := lsm.Get(utils.KeyWithTs(key, ts))
+			if assert.Nil(t, err) {
+				assert.Equal(t, fmt.Sprintf("val%05d-%d", i, ts), string(e.Value))
+			}
+		}
+		v, ok, err := lsm.Version(key)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(2), v)
+	}
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+
+	// 乱序的输入
+	buf.Reset()
+	for _, k := range []string{"a", "c", "b"} {
+		assert.Nil(t, WriteSortedEntry(&buf, utils.NewEntry(utils.KeyWithTs([]byte(k), 1), []byte(k))))
+	}
+	dir = t.TempDir()
+	err = BuildStore(dir, o, &buf)
+	assert.Equal(t, utils.ErrImportOrder, errors.Cause(err))
+	assert.Empty(t, utils.LoadSSTPaths(dir))
+
+	// 截断的输入
+	buf.Reset()
+	assert.Nil(t, WriteSortedEntry(&buf, utils.NewEntry(utils.KeyWithTs([]byte("a"), 1), []byte("a"))))
+	err = BuildStore(t.TempDir(), o, bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+}
+
+// TestGetBypassCache row cache中的entry过时后，BypassCache仍然读到sst中的value，并且不会改动缓存
+func TestGetBypassCache(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.RowCacheSize = 1 << 20
+	})
+	key := utils.KeyWithTs([]byte("k"), 1)
+	assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte("on-disk"))))
+	assert.Nil(t, lsm.RotateMemtable())
+	e, err := lsm.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("on-disk"), e.Value)
+
+	// 模拟缓存的bug：直接改掉缓存中的value
+	lsm.rowCache.items["k"].Value.(*rowCacheItem).entry.Value = []byte("stale")
+	e, err = lsm.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("stale"), e.Value)
+
+	e, err = lsm.GetWithOptions(key, GetOptions{BypassCache: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("on-disk"), e.Value)
+	e, err = lsm.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("stale"), e.Value)
+
+	_, err = lsm.GetWithOptions(utils.KeyWithTs([]byte("missing"), 1), GetOptions{BypassCache: true})
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+// TestWalRetainAfterFlush 刷盘后的wal压缩保留到期后删除，恢复时默认忽略，ReplayRetainedWALs时解压回放
+func TestWalRetainAfterFlush(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.WalRetainAfterFlush = time.Hour
+	})
+	retained := func() []string {
+		names, _ := filepath.Glob(filepath.Join(lsm.option.retainedWalDir(), "*"+retainedWalExt))
+		return names
+	}
+	const n = 100
+	for i := 0; i < n; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1)
+		assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("val%03d", i)))))
+	}
+	walFid := lsm.memTable.wal.Fid()
+	assert.Nil(t, lsm.RotateMemtable())
+	// 测试配置的内存表很小，写入期间已经切换过几次
+	flushed := len(retained())
+	assert.Greater(t, flushed, 0)
+	_, err := os.Stat(filePath(lsm.option.WorkDir, walFid))
+	assert.True(t, os.IsNotExist(err))
+
+	// 默认忽略保留的wal
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	lsm = initLSM(lsm.option)
+	assert.Empty(t, lsm.immutables)
+	assert.Equal(t, 0, lsm.memTable.entries)
+	assert.Len(t, retained(), flushed)
+
+	// 解压回WorkDir后作为新的wal回放
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	lsm.option.ReplayRetainedWALs = true
+	lsm = initLSM(lsm.option)
+	assert.Empty(t, retained())
+	replayed := 0
+	for _, imm := range lsm.immutables {
+		replayed += imm.entries
+		assert.Greater(t, imm.wal.Fid(), walFid)
+	}
+	assert.Equal(t, n, replayed)
+	for i := 0; i < n; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1))
+		if assert.Nil(t, err) {
+			assert.Equal(t, fmt.Sprintf("val%03d", i), string(e.Value))
+		}
+	}
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	// 关闭时回放出的数据重新刷盘，wal再次被保留
+	assert.Len(t, retained(), flushed)
+
+	// 到期后删除
+	lsm.option.ReplayRetainedWALs = false
+	lsm.option.WalRetainAfterFlush = 200 * time.Millisecond
+	lsm = initLSM(lsm.option)
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("k"), 2), []byte("v"))))
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.NotEmpty(t, retained())
+	assert.Eventually(t, func() bool { return len(retained()) == 0 }, 2*time.Second, 20*time.Millisecond)
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+}
+
+// TestVerifyMonotonicVersions 版本号超过manifest检查点的sst在打开时被发现，默认不检查
+func TestVerifyMonotonicVersions(t *testing.T) {
+	o := *opt
+	o.WorkDir = t.TempDir()
+	o.VerifyMonotonicVersions = true
+	lsm, err := Open(o)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v")))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	lsm, err = Open(o)
+	assert.Nil(t, err)
+
+	// 注入一个版本号大得不可能的entry，manifest中记录的检查点仍然是当前的水位
+	const huge = uint64(1) << 60
+	builder := newTableBuiler(lsm.option)
+	builder.add(utils.NewEntry(utils.KeyWithTs([]byte("bad"), huge), []byte("v")), false)
+	fid := lsm.levels.maxFID + 1
+	lsm.levels.maxFID = fid
+	tbl := openTable(lsm.levels, lsm.levels.tablePath(fid), builder)
+	watermark := atomic.LoadUint64(&lsm.orc.nextTs)
+	assert.Nil(t, lsm.levels.manifestFile.AddTableMeta(0, &file.TableMeta{ID: fid, Checksum: []byte{'m', 'o', 'c', 'k'}, MaxVersion: watermark}))
+	lsm.levels.levels[0].add(tbl)
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+
+	_, err = Open(o)
+	assert.Equal(t, utils.ErrVersionRegression, errors.Cause(err))
+	assert.Contains(t, err.Error(), fmt.Sprintf("level 0 table %d key \"bad\" version %d", fid, huge))
+	assert.Contains(t, err.Error(), fmt.Sprintf("watermark %d", watermark))
+
+	o.VerifyMonotonicVersions = false
+	lsm, err = Open(o)
+	assert.Nil(t, err)
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+}
+
+// TestScanZone sst中zone范围与查询范围不相交的block不会被读取，返回的是范围内key的最新版本
+func TestScanZone(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	_, err := lsm.ScanZone(nil, nil)
+	assert.Equal(t, utils.ErrNoZoneMap, err)
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+
+	// value的前8字节是大端序的时间戳
+	zoneValue := func(ts uint64) []byte {
+		v := make([]byte, 8, 24)
+		binary.BigEndian.PutUint64(v, ts)
+		return append(v, "payload-payload"...)
+	}
+	lsm = buildTestLSM(t, func(o *Options) {
+		o.BlockSize = 128
+		o.ZoneMapExtractor = func(e *utils.Entry) []byte {
+			if len(e.Value) < 8 {
+				return nil
+			}
+			return e.Value[:8]
+		}
+	})
+	builder := newTableBuiler(lsm.option)
+	const n = 100
+	for i := 0; i < n; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("k%03d", i)), 1)
+		builder.add(utils.NewEntry(key, zoneValue(uint64(i*10))), false)
+	}
+	fid := lsm.levels.maxFID + 1
+	lsm.levels.maxFID = fid
+	tbl := openTable(lsm.levels, utils.SSTableFullPath(lsm.option.WorkDir, fid), builder)
+	assert.Nil(t, lsm.levels.manifestFile.AddTableMeta(0, &file.TableMeta{ID: fid, Checksum: []byte{'m', 'o', 'c', 'k'}, MaxVersion: 1}))
+	lsm.levels.levels[0].add(tbl)
+	// 重新打开，zone map从索引中读出
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+	lsm = initLSM(lsm.option)
+	defer lsm.Close()
+
+	// k031的新版本移出了范围，k055的新版本在内存表中移入了范围
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("k031"), 2), zoneValue(9999))))
+	assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("k055"), 2), zoneValue(350))))
+
+	read := map[int]bool{}
+	loadZoneBlock = func(tb *table, idx int) (*block, error) {
+		read[idx] = true
+		return tb.block(idx)
+	}
+	defer func() { loadZoneBlock = (*table).block }()
+
+	lo, hi := zoneValue(300)[:8], zoneValue(395)[:8]
+	entries, err := lsm.ScanZone(lo, hi)
+	assert.Nil(t, err)
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, string(utils.ParseKey(e.Key)))
+	}
+	assert.Equal(t, []string{"k030", "k032", "k033", "k034", "k035", "k036", "k037", "k038", "k039", "k055"}, keys)
+	assert.Equal(t, uint64(2), entries[len(entries)-1].Version)
+
+	var tables []*table
+	for _, lh := range lsm.levels.levels {
+		tables = append(tables, lh.tables...)
+	}
+	if assert.Len(t, tables, 1) {
+		offsets := tables[0].ss.Indexs().GetOffsets()
+		assert.True(t, tables[0].ss.Indexs().ZoneMap)
+		assert.Greater(t, len(offsets), 4)
+		assert.NotEmpty(t, read)
+		for i, ko := range offsets {
+			overlaps := bytes.Compare(ko.ZoneMax, lo) >= 0 && bytes.Compare(ko.ZoneMin, hi) <= 0
+			assert.Equal(t, overlaps, read[i], "block %d", i)
+		}
+	}
+}
+
+// TestMaxReadAmplification L0堆积时Get查找的sst超过MaxReadAmplification返回错误，合并之后恢复正常
+func TestMaxReadAmplification(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MaxReadAmplification = 3
+	})
+	defer lsm.Close()
+	const n = 6
+	for i := 0; i < n; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1)
+		assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte("v"))))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	assert.Len(t, lsm.levels.levels[0].tables, n)
+
+	// L0从旧到新查找，最新的sst中的key需要查找全部n个sst
+	last := utils.KeyWithTs([]byte(fmt.Sprintf("key%d", n-1)), 1)
+	_, stats, err := lsm.GetWithSource(last)
+	assert.Equal(t, utils.ErrReadAmpExceeded, err)
+	assert.Equal(t, 3, stats.Tables)
+	_, err = lsm.Get(last)
+	assert.Equal(t, utils.ErrReadAmpExceeded, err)
+	// 第一个sst中就能找到的key不受影响
+	e, stats, err := lsm.GetWithSource(utils.KeyWithTs([]byte("key0"), 1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), e.Value)
+	assert.Equal(t, 1, stats.Tables)
+	assert.Equal(t, 0, stats.Level)
+	assert.Equal(t, 1, stats.Memtables)
+
+	lsm.option.MaxReadAmplification = 0
+	_, stats, err = lsm.GetWithSource(last)
+	assert.Nil(t, err)
+	assert.Equal(t, n, stats.Tables)
+	assert.GreaterOrEqual(t, stats.Blocks, n)
+	assert.Equal(t, lsm.levels.levels[0].tables[n-1].fid, stats.TableID)
+
+	lsm.option.MaxReadAmplification = 3
+	var ids []uint64
+	for _, tbl := range lsm.levels.levels[0].tables {
+		ids = append(ids, tbl.fid)
+	}
+	assert.Nil(t, lsm.CompactTables(ids))
+	assert.Empty(t, lsm.levels.levels[0].tables)
+	e, stats, err = lsm.GetWithSource(last)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), e.Value)
+	assert.Equal(t, 1, stats.Tables)
+	assert.Greater(t, stats.Level, 0)
+	_, stats, err = lsm.GetWithSource(utils.KeyWithTs([]byte("missing"), 1))
+	assert.Equal(t, utils.ErrKeyNotFound, err)
+	assert.Equal(t, -1, stats.Level)
+}
+
+// TestPauseCompaction 暂停期间后台合并不执行，恢复后合并追赶上来
+func TestPauseCompaction(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.NumLevelZeroTables = 2
+	})
+	defer lsm.Close()
+	lsm.PauseCompaction()
+	lsm.StartCompacter()
+	assert.True(t, lsm.Stats().Compaction.Paused)
+	const n = 4
+	for i := 0; i < n; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1)
+		assert.Nil(t, lsm.Set(utils.NewEntry(key, []byte("v"))))
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	// 合并协程启动时最多随机等待1秒
+	time.Sleep(1500 * time.Millisecond)
+	s := lsm.Stats()
+	assert.Zero(t, s.Compaction.Compactions)
+	assert.Equal(t, n, s.Levels[0].NumTables)
+
+	lsm.ResumeCompaction()
+	assert.False(t, lsm.Stats().Compaction.Paused)
+	deadline := time.Now().Add(5 * time.Second)
+	for lsm.Stats().Compaction.Compactions == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotZero(t, lsm.Stats().Compaction.Compactions)
+	for i := 0; i < n; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), e.Value)
+	}
+}
+
+// TestValueAlignment 对齐后block的偏移与mmap中每个value的地址都是ValueAlignment的倍数，没有对齐的sst修改配置后仍然可以读取
+func TestValueAlignment(t *testing.T) {
+	o := *opt
+	o.WorkDir = t.TempDir()
+	o.ValueAlignment = 3
+	assert.NotNil(t, o.validate())
+
+	lsm := buildTestLSM(t, nil)
+	defer func() { lsm.Close() }()
+	const n = 200
+	// 有没有过期时间的value编码前缀长度不同
+	future := uint64(time.Now().Add(time.Hour).Unix())
+	set := func(from int) {
+		for i := from; i < from+n; i++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1)
+			// 长度不同的key与value，不对齐时value的偏移是任意的
+			assert.Nil(t, lsm.Set(&utils.Entry{Key: key, Value: []byte(strings.Repeat("v", i%13+1)), ExpiresAt: uint64(i%2) * future}))
+		}
+		assert.Nil(t, lsm.RotateMemtable())
+	}
+	set(0)
+	lsm.option.ValueAlignment = 8
+	set(n)
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+	lsm = initLSM(lsm.option)
+
+	var aligned int
+	for _, tbl := range lsm.levels.levels[0].tables {
+		idx := tbl.ss.Indexs()
+		if idx.ValueAlign != 8 {
+			continue
+		}
+		aligned++
+		for _, ko := range idx.GetOffsets() {
+			assert.Zero(t, ko.Offset%8)
+		}
+		it := tbl.NewIterator(&utils.Options{IsAsc: true})
+		for it.Rewind(); it.Valid(); it.Next() {
+			v := it.Item().Entry().Value
+			assert.Zero(t, uintptr(unsafe.Pointer(&v[0]))%8, "%s", it.Item().Entry().Key)
+		}
+		assert.Nil(t, it.Close())
+	}
+	assert.NotZero(t, aligned)
+	for i := 0; i < 2*n; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1))
+		if assert.Nil(t, err) {
+			assert.Equal(t, strings.Repeat("v", i%13+1), string(e.Value))
+			assert.Equal(t, uint64(i%2)*future, e.ExpiresAt)
+		}
+	}
+	assert.Nil(t, lsm.Verify())
+}
+
+// BenchmarkValueAlignment 对比对齐与不对齐时在mmap的sst中随机读取的吞吐
+func BenchmarkValueAlignment(b *testing.B) {
+	for _, align := range []int{1, 8} {
+		b.Run(fmt.Sprintf("align%d", align), func(b *testing.B) {
+			o := *opt
+			o.WorkDir = b.TempDir()
+			o.SSTableMaxSz = 64 << 20
+			o.BlockSize = 4 << 10
+			o.ValueAlignment = align
+			lsm := initLSM(&o)
+			defer lsm.Close()
+			const n = 100000
+			builder := newTableBuiler(lsm.option)
+			keys := make([][]byte, n)
+			for i := range keys {
+				keys[i] = utils.KeyWithTs([]byte(fmt.Sprintf("key%07d", i)), 1)
+				builder.add(utils.NewEntry(keys[i], []byte(fmt.Sprintf("value%d", i))), false)
+			}
+			fid := lsm.levels.maxFID + 1
+			lsm.levels.maxFID = fid
+			tbl := openTable(lsm.levels, lsm.levels.tablePath(fid), builder)
+			defer tbl.ss.Close()
+			r := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var maxVs uint64
+				if _, err := tbl.Serach(keys[r.Intn(n)], &maxVs, &ReadStats{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestCountKeys 覆盖写与删除之后，CountKeys等于有效的user key数量
+func TestCountKeys(t *testing.T) {
+	lsm := buildTestLSM(t, nil)
+	defer lsm.Close()
+	n, err := lsm.CountKeys()
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+
+	const total = 100
+	for i := 0; i < total; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v1")))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	// 覆盖写前一半key，一部分已经刷盘，一部分还在内存表中
+	for i := 0; i < total/2; i++ {
+		assert.Nil(t, lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v2")))
+		if i == total/4 {
+			assert.Nil(t, lsm.RotateMemtable())
+		}
+	}
+	n, err = lsm.CountKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(total), n)
+
+	// 用已过期的新版本删除每隔10个的key，包括覆盖写过的key
+	var deleted uint64
+	for i := 0; i < total; i += 10 {
+		key := lsm.MakeKey([]byte(fmt.Sprintf("key%03d", i)))
+		assert.Nil(t, lsm.Set(&utils.Entry{Key: key, ExpiresAt: 1}))
+		deleted++
+	}
+	n, err = lsm.CountKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(total)-deleted, n)
+	assert.Nil(t, lsm.RotateMemtable())
+	n, err = lsm.CountKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(total)-deleted, n)
+
+	// 只读取key，无法解压的value同样计入
+	bad := &utils.Entry{Key: lsm.MakeKey([]byte("bad")), Value: []byte("not compressed"), Meta: utils.BitValueCompressed}
+	assert.Nil(t, lsm.memTable.set(bad))
+	n, err = lsm.CountKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(total)-deleted+1, n)
+	assert.Nil(t, lsm.RotateMemtable())
+
+	// 损坏的block
+	tbl := lsm.levels.levels[0].tables[0]
+	var ko pb.BlockOffset
+	tbl.offsets(&ko, 0)
+	f, err := os.OpenFile(tbl.ss.Name(), os.O_WRONLY, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, int64(ko.Offset)+1)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, err = lsm.CountKeys()
+	assert.True(t, errors.Is(err, utils.ErrChecksumMismatch), "%v", err)
+}
+
+// TestVarintTimestamps 时间戳变长编码的sst更小，大小不同的时间戳读回后与固定编码的sst顺序相同
+func TestVarintTimestamps(t *testing.T) {
+	build := func(varint bool) *LSM {
+		lsm := buildTestLSM(t, func(o *Options) {
+			o.MemTableSize = 64 << 10
+			o.SSTableMaxSz = 64 << 10
+			o.VarintTimestamps = varint
+		})
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i%100))
+			ts := uint64(i + 1)
+			if i%3 == 0 {
+				ts = 1<<40 + uint64(i)
+			}
+			assert.Nil(t, lsm.Set(utils.NewEntry(utils.KeyWithTs(key, ts), []byte(fmt.Sprintf("v%d", i)))))
+		}
+		assert.Nil(t, lsm.RotateMemtable())
+		_, err := lsm.Close()
+		assert.Nil(t, err)
+		return initLSM(lsm.option)
+	}
+	fixed, varint := build(false), build(true)
+	defer fixed.Close()
+	defer varint.Close()
+
+	size := func(lsm *LSM) (n int64) {
+		for _, tbl := range lsm.levels.levels[0].tables {
+			assert.Equal(t, lsm.option.VarintTimestamps, tbl.ss.Indexs().VarintTs)
+			n += tbl.Size()
+		}
+		return n
+	}
+	assert.Less(t, size(varint), size(fixed))
+
+	var want [][]byte
+	fi := fixed.NewIterator(&utils.Options{IsAsc: true})
+	vi := varint.NewIterator(&utils.Options{IsAsc: true})
+	vi.Rewind()
+	for fi.Rewind(); fi.Valid(); fi.Next() {
+		if !assert.True(t, vi.Valid()) {
+			break
+		}
+		fe, ve := fi.Item().Entry(), vi.Item().Entry()
+		assert.Equal(t, fe.Key, ve.Key)
+		assert.Equal(t, fe.Value, ve.Value)
+		want = append(want, utils.Copy(fe.Key))
+		vi.Next()
+	}
+	assert.False(t, vi.Valid())
+	assert.Nil(t, fi.Close())
+	assert.Nil(t, vi.Close())
+	assert.Len(t, want, 300)
+	for _, key := range want {
+		e, err := varint.Get(key)
+		if assert.Nil(t, err) {
+			assert.Equal(t, key, e.Key)
+		}
+	}
+	// 关闭编码之后新旧两种sst都可以读取
+	varint.option.VarintTimestamps = false
+	assert.Nil(t, varint.Set(utils.NewEntry(utils.KeyWithTs([]byte("key000"), 1<<50), []byte("new"))))
+	assert.Nil(t, varint.RotateMemtable())
+	versions, err := varint.GetAllVersions([]byte("key000"))
+	assert.Nil(t, err)
+	if assert.Len(t, versions, 4) {
+		assert.Equal(t, []byte("new"), versions[0].Value)
+	}
+}
+
+// TestFlushConcurrency 排队的immutables并发生成sst，刷盘之后每个key读到的是最新的版本
+func TestFlushConcurrency(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 64 << 10
+		o.FlushConcurrency = 3
+	})
+	defer lsm.Close()
+	var running, maxRunning int32
+	buildFlushed = func(lm *levelManager, imm *memTable, level int) []*tableBuilder {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return lm.splitFlushTables(imm, level)
+	}
+	defer func() { buildFlushed = (*levelManager).splitFlushTables }()
+
+	// 每个内存表都写入同一批key的新版本，再直接移入immutables排队
+	const n, keys = 5, 20
+	lsm.writeLock.Lock()
+	for i := 1; i <= n; i++ {
+		for k := 0; k < keys; k++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("key%02d", k)), uint64(i))
+			assert.Nil(t, lsm.memTable.set(utils.NewEntry(key, []byte(fmt.Sprintf("v%d", i)))))
+		}
+		assert.Nil(t, lsm.rotate())
+	}
+	lsm.writeLock.Unlock()
+	assert.Len(t, lsm.immutables, n)
+
+	assert.Nil(t, lsm.RotateMemtable())
+	assert.Empty(t, lsm.immutables)
+	assert.Equal(t, int32(3), maxRunning)
+	assert.Len(t, lsm.levels.levels[0].tables, n)
+	for i := 1; i < n; i++ {
+		assert.Less(t, lsm.levels.levels[0].tables[i-1].fid, lsm.levels.levels[0].tables[i].fid)
+	}
+	for k := 0; k < keys; k++ {
+		key := []byte(fmt.Sprintf("key%02d", k))
+		version, ok, err := lsm.Version(key)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(n), version)
+		versions, err := lsm.GetAllVersions(key)
+		assert.Nil(t, err)
+		if assert.Len(t, versions, n) {
+			assert.Equal(t, []byte(fmt.Sprintf("v%d", n)), versions[0].Value)
+		}
+	}
+
+	// 内存表切分成多个sst时，切分出的sst的fid仍按immutables的顺序分配，这里让后面的immutable先生成完
+	split := buildTestLSM(t, func(o *Options) {
+		o.MemTableSize = 64 << 10
+		o.FlushConcurrency = n
+	})
+	defer split.Close()
+	firstFid := split.memTable.wal.Fid()
+	buildFlushed = func(lm *levelManager, imm *memTable, level int) []*tableBuilder {
+		time.Sleep(time.Duration(n-int(imm.wal.Fid()-firstFid)) * 20 * time.Millisecond)
+		return lm.splitFlushTables(imm, level)
+	}
+	split.writeLock.Lock()
+	for i := 1; i <= n; i++ {
+		for k := 0; k < keys; k++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("key%02d", k)), uint64(i))
+			assert.Nil(t, split.memTable.set(utils.NewEntry(key, bytes.Repeat([]byte{byte('0' + i)}, 100))))
+		}
+		assert.Nil(t, split.rotate())
+	}
+	split.writeLock.Unlock()
+	assert.Nil(t, split.RotateMemtable())
+	// L0按刷盘的顺序排列，第一个sst沿用wal的fid，切分出的sst的fid应当随之递增
+	l0 := split.levels.levels[0].tables
+	assert.Greater(t, len(l0), n)
+	var splitFids []uint64
+	for _, tbl := range l0 {
+		if tbl.fid >= firstFid+n {
+			splitFids = append(splitFids, tbl.fid)
+		}
+	}
+	assert.Len(t, splitFids, len(l0)-n)
+	assert.True(t, sort.SliceIsSorted(splitFids, func(i, j int) bool { return splitFids[i] < splitFids[j] }), "%v", splitFids)
+}
+
+// TestReserveFIDs 目录中的sst或wal的id不小于将要分配的fid时调高maxFid，新的memtable不会覆盖已有的sst
+func TestReserveFIDs(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(utils.SSTableFullPath(dir, 7), nil, 0666))
+	assert.Nil(t, os.WriteFile(filePath(dir, 9), nil, 0666))
+	l := &LSM{option: &Options{WorkDir: dir}}
+	// 只按manifest计算maxFid时下一个fid是4，之后会依次分配到7
+	maxFid := uint64(3)
+	err := l.reserveFIDs(&maxFid)
+	assert.True(t, errors.Is(err, utils.ErrFIDCollision))
+	assert.Equal(t, uint64(9), maxFid)
+	assert.Nil(t, l.reserveFIDs(&maxFid))
+	assert.Equal(t, uint64(9), maxFid)
+
+	lsm := buildTestLSM(t, nil)
+	next := atomic.LoadUint64(&lsm.levels.maxFID) + 1
+	assert.Nil(t, os.WriteFile(lsm.levels.tablePath(next), []byte("table"), 0666))
+	// 恢复时返回错误，不打开任何wal
+	_, _, err = lsm.recovery()
+	assert.True(t, errors.Is(err, utils.ErrFIDCollision))
+	_, err = lsm.NewMemtable()
+	assert.True(t, errors.Is(err, utils.ErrFIDCollision))
+	// 切换内存表时冻结存储，当前的memtable不变
+	assert.Nil(t, os.WriteFile(lsm.levels.tablePath(next+1), []byte("table"), 0666))
+	assert.Nil(t, lsm.Set(utils.NewEntry(lsm.MakeKey([]byte("k")), []byte("v"))))
+	mt := lsm.memTable
+	err = lsm.RotateMemtable()
+	assert.True(t, errors.Is(err, utils.ErrFIDCollision))
+	assert.True(t, errors.Is(lsm.IsFrozen(), utils.ErrFIDCollision))
+	assert.Equal(t, mt, lsm.memTable)
+	assert.Empty(t, lsm.immutables)
+	for _, fid := range []uint64{next, next + 1} {
+		data, err := os.ReadFile(lsm.levels.tablePath(fid))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("table"), data)
+	}
+}
+
+// TestVerifyFile 不打开存储校验sst与wal，返回第一处损坏的block或记录的偏移
+func TestVerifyFile(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.MemTableSize, o.SSTableMaxSz = 1<<20, 1<<20 })
+	for i := 0; i < 200; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1)
+		assert.Nil(t, lsm.Set(&utils.Entry{Key: key, Value: []byte(strings.Repeat("v", 32))}))
+	}
+	var batch []*utils.Entry
+	for i := 0; i < 3; i++ {
+		batch = append(batch, utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("batch%d", i)), 1), []byte("v")))
+	}
+	assert.Nil(t, lsm.WriteBatch(batch))
+	// wal是预分配的，复制出来的文件末尾全为0
+	var walOffsets []uint32
+	walEnd, err := lsm.memTable.wal.Iterate(true, 0, func(e *utils.Entry, _ *utils.ValuePtr) error {
+		walOffsets = append(walOffsets, e.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	walData, err := os.ReadFile(lsm.memTable.wal.Name())
+	assert.Nil(t, err)
+	assert.Nil(t, lsm.RotateMemtable())
+	tbl := lsm.levels.levels[0].tables[0]
+	sstPath := lsm.levels.tablePath(tbl.fid)
+	offsets := tbl.ss.Indexs().GetOffsets()
+	assert.True(t, len(offsets) >= 3)
+	_, err = lsm.Close()
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	corrupt := func(name string, data []byte, off int) string {
+		path := filepath.Join(dir, name)
+		data = append([]byte(nil), data...)
+		if off >= 0 {
+			data[off] ^= 0xff
+		}
+		assert.Nil(t, os.WriteFile(path, data, 0666))
+		return path
+	}
+	checkOffset := func(err error, off int64) {
+		var cerr *file.CorruptionError
+		if assert.True(t, errors.As(err, &cerr), "%v", err) {
+			assert.Equal(t, off, cerr.Offset)
+		}
+		assert.True(t, errors.Is(err, utils.ErrChecksumMismatch))
+	}
+
+	sstData, err := os.ReadFile(sstPath)
+	assert.Nil(t, err)
+	assert.Nil(t, file.VerifyFile(corrupt("00001.sst", sstData, -1)))
+	mid := offsets[len(offsets)/2]
+	checkOffset(file.VerifyFile(corrupt("00002.sst", sstData, int(mid.Offset+mid.Len/2))), int64(mid.Offset))
+	// 损坏索引时报告索引的起始偏移
+	last := offsets[len(offsets)-1]
+	checkOffset(file.VerifyFile(corrupt("00003.sst", sstData, int(last.Offset+last.Len))), int64(last.Offset+last.Len))
+
+	assert.Nil(t, file.VerifyFile(corrupt("00004.wal", walData, -1)))
+	bad := walOffsets[len(walOffsets)/2]
+	checkOffset(file.VerifyFile(corrupt("00005.wal", walData, int(bad)+5)), int64(bad))
+	// 预分配部分中的非0字节同样是损坏
+	checkOffset(file.VerifyFile(corrupt("00006.wal", walData, int(walEnd)+100)), int64(walEnd))
+	// 最后一个批次缺少记录时报告批次头的偏移
+	lastRecord := walOffsets[len(walOffsets)-1]
+	batchStart := walOffsets[len(walOffsets)-len(batch)] - uint32(utils.WalBatchCodec(&bytes.Buffer{}, len(batch), utils.ChecksumCRC32))
+	tornData := append([]byte(nil), walData...)
+	copy(tornData[lastRecord:walEnd], make([]byte, walEnd-lastRecord))
+	tornPath := filepath.Join(dir, "00007.wal")
+	assert.Nil(t, os.WriteFile(tornPath, tornData, 0666))
+	checkOffset(file.VerifyFile(tornPath), int64(batchStart))
+	assert.NotNil(t, file.VerifyFile(corrupt("MANIFEST", walData, -1)))
+}
+
+// TestSkipBloomBottomLevel 最底层的sst不生成布隆过滤器，其余层不受影响，读取时直接查找索引
+func TestSkipBloomBottomLevel(t *testing.T) {
+	const n = 500
+	key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), 1) }
+	// 返回最底层所有布隆过滤器的总大小
+	build := func(skip bool) int {
+		lsm := buildTestLSM(t, func(o *Options) {
+			o.MaxLevelNum, o.BloomFalsePositive, o.SkipBloomBottomLevel = 2, 0.01, skip
+			o.MemTableSize, o.SSTableMaxSz = 64<<10, 64<<10
+		})
+		defer func() { lsm.Close() }()
+		for i := 0; i < n; i++ {
+			assert.Nil(t, lsm.Set(&utils.Entry{Key: key(i), Value: []byte(fmt.Sprintf("v%d", i))}))
+		}
+		assert.Nil(t, lsm.RotateMemtable())
+		var ids []uint64
+		for _, tbl := range lsm.levels.levels[0].tables {
+			ids = append(ids, tbl.fid)
+		}
+		assert.Nil(t, lsm.CompactTables(ids))
+		// 之后刷盘的sst留在L0
+		assert.Nil(t, lsm.Set(&utils.Entry{Key: key(n), Value: []byte(fmt.Sprintf("v%d", n))}))
+		assert.Nil(t, lsm.RotateMemtable())
+		if assert.Len(t, lsm.levels.levels[0].tables, 1) {
+			assert.True(t, lsm.levels.levels[0].tables[0].ss.HasBloomFilter())
+		}
+
+		var bloomSize int
+		assert.NotEmpty(t, lsm.levels.levels[1].tables)
+		for _, tbl := range lsm.levels.levels[1].tables {
+			assert.Equal(t, !skip, tbl.ss.HasBloomFilter())
+			bloomSize += len(tbl.ss.Indexs().BloomFilter)
+		}
+		for i := 0; i <= n; i++ {
+			e, err := lsm.Get(key(i))
+			if assert.Nil(t, err, "key %d", i) {
+				assert.Equal(t, []byte(fmt.Sprintf("v%d", i)), e.Value)
+			}
+		}
+		_, err := lsm.Get(key(n + 1))
+		assert.Equal(t, utils.ErrKeyNotFound, errors.Cause(err))
+		return bloomSize
+	}
+	withBloom, withoutBloom := build(false), build(true)
+	assert.Zero(t, withoutBloom)
+	assert.True(t, withBloom > 0)
+	t.Logf("bottom level bloom filters: %d bytes, saved by SkipBloomBottomLevel: %d bytes", withBloom, withBloom-withoutBloom)
+}
+
+// TestMaxRecoveryMemory 回放的wal超过MaxRecoveryMemory时边回放边刷盘，运行时切换内存表不受这个上限影响
+func TestMaxRecoveryMemory(t *testing.T) {
+	o := *opt
+	o.WorkDir = t.TempDir()
+	o.MaxRecoveryMemory = -1
+	assert.NotNil(t, o.validate())
+
+	lsm := buildTestLSM(t, nil)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	// 积压20个没有刷盘的immutables，重新打开时全部需要回放
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, lsm.memTable.set(utils.NewEntry(utils.KeyWithTs(key(i), uint64(i+1)), []byte("value"))))
+		assert.Nil(t, lsm.rotate())
+	}
+	replayed := atomic.LoadInt64(&lsm.immutableMemory)
+	limit := 3 * lsm.immutables[0].Size()
+	assert.True(t, replayed > limit)
+	assert.Empty(t, lsm.levels.levels[0].tables)
+
+	// 回放过程中同时占用的内存不超过上限加上一个内存表，跳表的高度是随机的，每个内存表的大小略有不同
+	var peak, memSize int64
+	observeRecoveryMemory = func(queued, size int64) {
+		if queued+size > peak {
+			peak = queued + size
+		}
+		if size > memSize {
+			memSize = size
+		}
+	}
+	defer func() { observeRecoveryMemory = func(queued, size int64) {} }()
+	lsm.option.MaxRecoveryMemory = limit
+	lsm = initLSM(lsm.option)
+	assert.True(t, peak > limit/2 && peak <= limit+memSize, "peak %d, limit %d, memtable %d", peak, limit, memSize)
+	assert.True(t, atomic.LoadInt64(&lsm.immutableMemory) <= limit)
+	assert.True(t, len(lsm.immutables) > 0 && len(lsm.immutables) <= 3)
+	// 超过上限的部分在回放时已经刷盘
+	assert.Equal(t, 20, len(lsm.immutables)+len(lsm.levels.levels[0].tables))
+
+	// MaxImmutableMemory为0，运行时的immutables不受限制
+	for i := 20; i < 30; i++ {
+		assert.Nil(t, lsm.memTable.set(utils.NewEntry(utils.KeyWithTs(key(i), uint64(i+1)), []byte("value"))))
+		assert.Nil(t, lsm.rotate())
+	}
+	assert.True(t, atomic.LoadInt64(&lsm.immutableMemory) > limit)
+	for i := 0; i < 30; i++ {
+		e, err := lsm.Get(utils.KeyWithTs(key(i), uint64(i+1)))
+		if assert.Nil(t, err) {
+			assert.Equal(t, []byte("value"), e.Value)
+		}
+	}
+}
+
+// TestTableChecksum manifest记录每个sst整个文件的checksum，重新打开与合并之后仍然可以校验，文件损坏时报告不匹配
+func TestTableChecksum(t *testing.T) {
+	lsm := buildTestLSM(t, func(o *Options) { o.MemTableSize, o.SSTableMaxSz = 64<<10, 64<<10 })
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, lsm.Set(&utils.Entry{Key: utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1), Value: []byte("value")}))
+	}
+	assert.Nil(t, lsm.RotateMemtable())
+	check := func(id uint64) uint64 {
+		stored, actual, match, err := lsm.TableChecksum(id)
+		assert.Nil(t, err)
+		assert.True(t, match)
+		assert.Equal(t, stored, actual)
+		assert.NotZero(t, stored)
+		return stored
+	}
+	id := lsm.levels.levels[0].tables[0].fid
+	sum := check(id)
+	_, err := lsm.Close()
+	assert.Nil(t, err)
+	lsm = initLSM(lsm.option)
+	assert.Equal(t, sum, check(id))
+
+	assert.Nil(t, lsm.CompactTables([]uint64{id}))
+	_, _, _, err = lsm.TableChecksum(id)
+	assert.NotNil(t, err)
+	tbl := lsm.levels.levels[lsm.levels.levelTargets().baseLevel].tables[0]
+	check(tbl.fid)
+
+	// 直接修改文件中的一个字节，不影响已经加载的索引
+	f, err := os.OpenFile(tbl.ss.Name(), os.O_WRONLY, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	stored, actual, match, err := lsm.TableChecksum(tbl.fid)
+	assert.Nil(t, err)
+	assert.False(t, match)
+	assert.NotEqual(t, stored, actual)
+
+	// 占位的checksum无法比较
+	builder := newTableBuiler(lsm.option)
+	builder.add(&utils.Entry{Key: utils.KeyWithTs([]byte("mock"), 1), Value: []byte("v")}, false)
+	fid := lsm.levels.maxFID + 1
+	lsm.levels.maxFID = fid
+	mock := openTable(lsm.levels, utils.SSTableFullPath(lsm.option.WorkDir, fid), builder)
+	assert.Nil(t, lsm.levels.manifestFile.AddTableMeta(0, &file.TableMeta{ID: fid, Checksum: []byte{'m', 'o', 'c', 'k'}}))
+	lsm.levels.levels[0].add(mock)
+	_, _, _, err = lsm.TableChecksum(fid)
+	assert.True(t, errors.Is(err, utils.ErrNoTableChecksum))
+}
+
+// TestPauseDoesNotBlockStats 暂停等待正在执行的合并时，读取暂停状态不会阻塞
+func TestPauseDoesNotBlockStats(t *testing.T) {
+	var p compactionPause
+	running, finish := make(chan struct{}), make(chan struct{})
+	go p.runUnlessPaused(func() {
+		close(running)
+		<-finish
+	})
+	<-running
+	paused := make(chan struct{})
+	go func() {
+		p.set(true)
+		close(paused)
+	}()
+	// 等待set开始等待写锁
+	time.Sleep(20 * time.Millisecond)
+	read := make(chan bool)
+	go func() { read <- p.isPaused() }()
+	select {
+	case v := <-read:
+		assert.False(t, v)
+	case <-time.After(time.Second):
+		t.Fatal("isPaused blocked behind a pending pause")
+	}
+	close(finish)
+	<-paused
+	assert.True(t, p.isPaused())
+}
+
 func buildEntry() *utils.Entry {
 	rand.Seed(time.Now().Unix())
 	key := []byte(fmt.Sprintf("%s%s", randStr(16), "12345678"))
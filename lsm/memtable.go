@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/pkg/errors"
+	"hash/crc32"
 	"io/ioutil"
 	"lsm/file"
 	"lsm/file/osFile"
@@ -14,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 const walFileExt string = ".wal"
@@ -25,18 +27,33 @@ type memTable struct {
 	sl         *utils.SkipList
 	buf        *bytes.Buffer
 	maxVersion uint64
+	entries    int             // 写入的entry数量，只在持有写锁时访问
+	firstWrite time.Time       // 第一次写入的时间
+	filtered   *utils.SkipList // 回放时不在KeyFilter范围内的entry，回放结束后直接写入L0
 }
 
-func (lsm *LSM) NewMemtable() *memTable {
+// NewMemtable 分配新的fid并创建对应的wal，fid已经被sst使用时返回ErrFIDCollision
+func (lsm *LSM) NewMemtable() (*memTable, error) {
 	newFid := atomic.AddUint64(&(lsm.levels.maxFID), 1)
+	// 新的memtable刷盘时会写入同一个fid的sst，不能覆盖已有的sst
+	if _, err := os.Stat(lsm.levels.tablePath(newFid)); err == nil {
+		return nil, errors.Wrapf(utils.ErrFIDCollision, "table %d", newFid)
+	}
 	fileOpt := &osFile.FileOption{
-		WorkDir:  lsm.option.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(lsm.option.MemTableSize),
-		FID:      newFid,
-		FileName: filePath(lsm.option.WorkDir, newFid),
+		WorkDir:     lsm.option.WorkDir,
+		Flag:        os.O_CREATE | os.O_RDWR,
+		MaxSz:       int(lsm.option.MemTableSize),
+		FID:         newFid,
+		FileName:    filePath(lsm.option.WorkDir, newFid),
+		WalChecksum: lsm.option.WalChecksum,
+		Encryptor:   lsm.option.Encryptor,
+		TrashDir:    lsm.option.trashDir(),
+	}
+	wal, err := file.OpenWalFile(fileOpt)
+	if err != nil {
+		return nil, err
 	}
-	return &memTable{wal: file.OpenWalFile(fileOpt), sl: utils.NewSkipList(int64(1 << 20)), lsm: lsm}
+	return &memTable{wal: wal, sl: lsm.newSkipList(), lsm: lsm}, nil
 }
 
 // Close
@@ -50,18 +67,91 @@ func (m *memTable) close() error {
 	return nil
 }
 
+// newSkipList 按配置的高度创建内存表使用的跳表
+func (lsm *LSM) newSkipList() *utils.SkipList {
+	return utils.NewSkipListWithHeight(int64(1<<20), lsm.option.SkipListMaxHeight, lsm.option.SkipListBranchProb)
+}
+
+// release 关闭memtable但保留wal文件
+func (m *memTable) release() error {
+	if err := m.wal.Release(); err != nil {
+		return err
+	}
+	if m.filtered != nil {
+		_ = m.filtered.Close()
+	}
+	return m.sl.Close()
+}
+
 func (m *memTable) set(entry *utils.Entry) error {
 	// 写到wal 日志中，防止崩溃
-	if err := m.wal.Write(entry); err != nil {
+	if err := m.writeWal(entry); err != nil {
+		return err
+	}
+	return m.add(entry)
+}
+
+// setBatch 把entries作为一个批次写入wal后再依次加入跳表，回放时整批要么全部恢复要么全部丢弃
+func (m *memTable) setBatch(entries []*utils.Entry) error {
+	if err := m.writeWal(entries...); err != nil {
 		return err
 	}
+	for _, entry := range entries {
+		if err := m.add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add 把已经写入wal的entry加入跳表
+func (m *memTable) add(entry *utils.Entry) error {
 	// 写到memtable中
 	if err := m.sl.Add(entry); err != nil {
 		return err
 	}
+	if ts := utils.ParseTs(entry.Key); ts > atomic.LoadUint64(&m.maxVersion) {
+		atomic.StoreUint64(&m.maxVersion, ts)
+	}
+	if m.entries == 0 {
+		m.firstWrite = time.Now()
+	}
+	m.entries++
+	return nil
+}
+
+// writeWal 写入wal并统计写入与sync的耗时，多个entry作为一个批次写入
+func (m *memTable) writeWal(entries ...*utils.Entry) error {
+	ws := &m.lsm.walStats
+	size, start := m.wal.Size(), time.Now()
+	if err := m.wal.WriteBatch(entries); err != nil {
+		return m.lsm.freeze(err)
+	}
+	ws.append.observe(time.Since(start))
+	atomic.AddInt64(&ws.appendBytes, int64(m.wal.Size()-size))
+	if !m.lsm.option.SyncWrites {
+		return nil
+	}
+	start = time.Now()
+	if err := m.wal.Sync(); err != nil {
+		return m.lsm.freeze(err)
+	}
+	ws.sync.observe(time.Since(start))
 	return nil
 }
 
+// version 返回跳表中与seekKey的user key相同的最新版本，deleted表示该版本已经删除或过期
+func (m *memTable) version(seekKey []byte) (ts uint64, deleted, ok bool) {
+	iter := m.sl.NewSkipListIterator().(*utils.SkipListIter)
+	defer iter.Close()
+	iter.Seek(seekKey)
+	if !iter.Valid() || !utils.SameKey(seekKey, iter.Key()) {
+		return 0, false, false
+	}
+	e := iter.Item().Entry()
+	return utils.ParseTs(e.Key), isDeletedOrExpired(e.Meta, e.ExpiresAt), true
+}
+
 func (m *memTable) Get(key []byte) (*utils.Entry, error) {
 	// 索引检查当前的key是否在表中 O(1) 的时间复杂度
 	// 从内存表中获取数据
@@ -73,11 +163,13 @@ func (m *memTable) Size() int64 {
 }
 
 //recovery
-func (lsm *LSM) recovery() (*memTable, []*memTable) {
+// 目录中已有的文件占用了将要分配的fid时返回ErrFIDCollision，此时不修改任何文件
+// 读取目录、回放wal或刷盘失败时返回错误，已经回放出的内存表关闭但保留wal
+func (lsm *LSM) recovery() (*memTable, []*memTable, error) {
 	// 从工作目录中获取所有文件
 	files, err := ioutil.ReadDir(lsm.option.WorkDir)
 	if err != nil {
-		utils.Panic(err)
+		return nil, nil, err
 	}
 	var walFileId []uint64
 	maxFid := lsm.levels.maxFID
@@ -87,7 +179,9 @@ func (lsm *LSM) recovery() (*memTable, []*memTable) {
 			fileNameLen := len(file.Name())
 			fid, err := strconv.ParseUint(file.Name()[:fileNameLen-len(walFileExt)], 10, 64)
 			if err != nil {
-				utils.Panic(err)
+				// 不是存储生成的wal，保留文件
+				lsm.option.Logger.Warnf("skipping %s during recovery: %v", file.Name(), err)
+				continue
 			}
 			if maxFid < fid {
 				// 当前wal文件的fid比maxFid大，因此进行更新
@@ -96,44 +190,149 @@ func (lsm *LSM) recovery() (*memTable, []*memTable) {
 			walFileId = append(walFileId, fid)
 		}
 	}
+	// 恢复出的retained wal也会分配fid，因此在它们之前检查
+	if err := lsm.reserveFIDs(&maxFid); err != nil {
+		return nil, nil, err
+	}
+
+	if lsm.option.ReplayRetainedWALs {
+		walFileId = append(walFileId, lsm.restoreRetainedWals(&maxFid)...)
+	}
 
 	// 由于wal文件的存在，所以对fids进行一下排序
 	sort.Slice(walFileId, func(i, j int) bool {
 		return walFileId[i] < walFileId[j]
 	})
+	// 回放时写出的sst从maxfid之后分配fid，因此在回放之前更新
+	// 由于初始化时一定是串行执行的，因此这里不需要原子操作
+	lsm.levels.maxFID = maxFid
 
 	// 对memTable进行恢复
-	var imms []*memTable
+	var (
+		imms     []*memTable
+		immsSize int64
+	)
+	fail := func(err error) (*memTable, []*memTable, error) {
+		for _, imm := range imms {
+			_ = imm.release()
+		}
+		return nil, nil, err
+	}
 	for _, fid := range walFileId {
-		memTable, err := lsm.RecoveryMemTable(fid)
-		utils.Panic(err)
-		if memTable.sl.Size() != 0 {
+		memTable, err := lsm.openRecoveryMemTable(fid)
+		if err != nil {
+			// 扫描目录之后被删除或无法打开的wal默认跳过，StrictWALRecovery时打开失败
+			if lsm.option.StrictWALRecovery {
+				return fail(err)
+			}
+			lsm.option.Logger.Errorf("skipping wal %d during recovery: %v", fid, err)
+			continue
+		}
+		if err := memTable.UpdateSkipList(); err != nil {
+			_ = memTable.release()
+			return fail(err)
+		}
+		observeRecoveryMemory(immsSize, memTable.Size())
+		if memTable.entries != 0 {
+			// 积压的wal很多时，回放出的immutables超过MaxRecoveryMemory就先刷盘，避免打开时占用大量内存
+			if lsm.option.exceedsRecoveryMemory(immsSize, memTable.Size(), len(imms)) {
+				for len(imms) > 0 {
+					if err := lsm.levels.flush(imms[0]); err != nil {
+						imms = append(imms, memTable)
+						return fail(err)
+					}
+					// 刷盘之后从imms中移除，之后失败时不再release它
+					imm := imms[0]
+					imms = imms[1:]
+					if err := imm.closeFlushed(); err != nil {
+						imms = append(imms, memTable)
+						return fail(err)
+					}
+				}
+				immsSize = 0
+			}
 			imms = append(imms, memTable)
+			immsSize += memTable.Size()
+			continue
+		}
+		// 跳表的arena即使为空也有头节点占用的空间，这里按回放的entry数量判断，空的wal直接删除
+		if err := memTable.close(); err != nil {
+			return fail(err)
 		}
 	}
-	// 更新最终的maxfid，
-	// 由于初始化时一定是串行执行的，因此这里不需要原子操作
-	lsm.levels.maxFID = maxFid
-	return lsm.NewMemtable(), imms
+	mt, err := lsm.NewMemtable()
+	if err != nil {
+		return fail(err)
+	}
+	return mt, imms, nil
+}
+
+// reserveFIDs 保证之后分配的fid大于目录中所有sst与wal的id，maxFid不够大时调高它并返回ErrFIDCollision
+// maxFid由manifest、孤儿表与wal分别计算，这里直接按文件再检查一遍，避免新的memtable复用已有sst的fid
+func (lsm *LSM) reserveFIDs(maxFid *uint64) error {
+	highest := *maxFid
+	for fid := range utils.LoadSSTIdMap(lsm.option.WorkDir) {
+		if fid > highest {
+			highest = fid
+		}
+	}
+	files, err := ioutil.ReadDir(lsm.option.WorkDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), walFileExt) {
+			continue
+		}
+		if fid, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), walFileExt), 10, 64); err == nil && fid > highest {
+			highest = fid
+		}
+	}
+	if highest == *maxFid {
+		return nil
+	}
+	err = errors.Wrapf(utils.ErrFIDCollision, "next fid %d, existing file %d", *maxFid+1, highest)
+	*maxFid = highest
+	return err
 }
 
+// RecoveryMemTable 打开fid对应的wal并回放到新的跳表中
 func (lsm *LSM) RecoveryMemTable(fid uint64) (*memTable, error) {
+	mt, err := lsm.openRecoveryMemTable(fid)
+	if err != nil {
+		return nil, err
+	}
+	if err := mt.UpdateSkipList(); err != nil {
+		_ = mt.release()
+		return nil, errors.WithMessage(err, "while updating skiplist")
+	}
+	return mt, nil
+}
+
+// openRecoveryMemTable 打开fid对应的wal，还没有回放
+func (lsm *LSM) openRecoveryMemTable(fid uint64) (*memTable, error) {
 	fileOpt := &osFile.FileOption{
-		WorkDir:  lsm.option.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(lsm.option.MemTableSize),
-		FID:      fid,
-		FileName: filePath(lsm.option.WorkDir, fid),
+		WorkDir: lsm.option.WorkDir,
+		// 恢复时不创建文件，扫描之后被删除的wal返回错误
+		Flag:        os.O_RDWR,
+		MaxSz:       int(lsm.option.MemTableSize),
+		FID:         fid,
+		FileName:    filePath(lsm.option.WorkDir, fid),
+		WalChecksum: lsm.option.WalChecksum,
+		Encryptor:   lsm.option.Encryptor,
+		TrashDir:    lsm.option.trashDir(),
 	}
-	s := utils.NewSkipList(int64(1 << 20))
+	s := lsm.newSkipList()
 	mt := &memTable{
 		sl:  s,
 		buf: &bytes.Buffer{},
 		lsm: lsm,
 	}
-	mt.wal = file.OpenWalFile(fileOpt)
-	err := mt.UpdateSkipList()
-	utils.CondPanic(err != nil, errors.WithMessage(err, "while updating skiplist"))
+	wal, err := openWalFile(fileOpt)
+	if err != nil {
+		return nil, errors.WithMessage(err, "while opening wal")
+	}
+	mt.wal = wal
 	return mt, nil
 }
 func filePath(dir string, fid uint64) string {
@@ -145,18 +344,76 @@ func (m *memTable) UpdateSkipList() error {
 	if m.wal == nil || m.sl == nil {
 		return nil
 	}
-	endOff, err := m.wal.Iterate(true, 0, m.replayFunction(m.lsm.option))
+	endOff, err := m.wal.Iterate(true, 0, m.withProgress(m.replayFunction(m.lsm.option)))
 	if err != nil {
 		return errors.WithMessage(err, fmt.Sprintf("while iterating wal: %s", m.wal.Name()))
 	}
-	return m.wal.Truncate(int64(endOff))
+	if progress := m.lsm.option.RecoveryProgress; progress != nil {
+		total := int64(m.wal.FileSize())
+		progress(m.wal.Fid(), total, total)
+	}
+	// endOff是最后一条校验通过的记录的末尾，截掉之后不完整的记录
+	if err := m.wal.Truncate(int64(endOff)); err != nil {
+		return err
+	}
+	return m.flushFiltered()
+}
+
+// flushFiltered 将回放时跳过的entry写成L0的sst，wal之后随内存表刷盘删除时它们不会丢失
+func (m *memTable) flushFiltered() error {
+	if m.filtered == nil {
+		return nil
+	}
+	defer func() {
+		_ = m.filtered.Close()
+		m.filtered = nil
+	}()
+	return m.lsm.levels.flushFiltered(m)
+}
+
+// openWalFile 恢复时打开wal的函数，测试中替换它来模拟文件在扫描之后消失
+var openWalFile = file.OpenWalFile
+
+// observeRecoveryMemory 每回放完一个wal调用一次，参数为已经回放的immutables与刚回放的内存表的内存占用，测试中替换它记录峰值
+var observeRecoveryMemory = func(queued, size int64) {}
+
+// recoveryProgressInterval 回放wal时每处理这么多字节调用一次RecoveryProgress
+var recoveryProgressInterval int64 = 4 << 20
+
+// withProgress 在回放函数外包装RecoveryProgress的调用
+func (m *memTable) withProgress(fn utils.LogEntry) utils.LogEntry {
+	progress := m.lsm.option.RecoveryProgress
+	if progress == nil {
+		return fn
+	}
+	fid, total := m.wal.Fid(), int64(m.wal.FileSize())
+	var reported int64
+	return func(e *utils.Entry, vp *utils.ValuePtr) error {
+		if err := fn(e, vp); err != nil {
+			return err
+		}
+		done := int64(e.Offset) + int64(e.LogHeaderLen()+len(e.Key)+len(e.Value)+crc32.Size)
+		if done-reported >= recoveryProgressInterval {
+			reported = done
+			progress(fid, done, total)
+		}
+		return nil
+	}
 }
 
-func (m *memTable) replayFunction(opt *lsmOptions) func(*utils.Entry, *utils.ValuePtr) error {
+func (m *memTable) replayFunction(opt *Options) func(*utils.Entry, *utils.ValuePtr) error {
 	return func(e *utils.Entry, _ *utils.ValuePtr) error { // Function for replaying.
 		if ts := utils.ParseTs(e.Key); ts > m.maxVersion {
 			m.maxVersion = ts
 		}
+		// 不在KeyFilter范围内的key不加载到内存表，回放结束后写入L0，wal删除后不会丢失
+		if !opt.acceptKey(e.Key) {
+			if m.filtered == nil {
+				m.filtered = m.lsm.newSkipList()
+			}
+			return m.filtered.Add(e)
+		}
+		m.entries++
 		return m.sl.Add(e)
 	}
 }
@@ -0,0 +1,155 @@
+package lsm
+
+import (
+	"lsm/utils"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// MultiGet 批量查询带版本号的key，每个key的结果与单独调用Get相同，按输入顺序返回，没有找到的key对应nil
+// 内存表与immutables只取一次快照，每一层的读锁只获取一次
+// 落在同一个sst中的key排好序后共用一个迭代器查找，相邻的key位于同一个block时只读取一次
+func (lsm *LSM) MultiGet(keys [][]byte) ([]*utils.Entry, error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	results := make([]*utils.Entry, len(keys))
+	mts := lsm.memTables()
+
+	var pending []int
+	for i, key := range keys {
+		if !lsm.option.acceptKey(key) {
+			continue
+		}
+		for _, mt := range mts {
+			if e, _ := mt.Get(key); e != nil {
+				results[i] = e
+				break
+			}
+		}
+		if results[i] == nil {
+			pending = append(pending, i)
+		}
+	}
+	if err := lsm.levels.multiGet(keys, pending, results); err != nil {
+		return nil, err
+	}
+	for _, e := range results {
+		if e == nil {
+			continue
+		}
+		if err := e.Decompress(); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// multiGet 从L0开始逐层查找keys[pending]，找到的entry写入results
+func (lm *levelManager) multiGet(keys [][]byte, pending []int, results []*utils.Entry) error {
+	sort.Slice(pending, func(i, j int) bool {
+		return utils.CompareKeys(keys[pending[i]], keys[pending[j]]) < 0
+	})
+	for level := 0; level < lm.opt.MaxLevelNum && len(pending) > 0; level++ {
+		lh := lm.levels[level]
+		searched := pending
+		lh.RLock()
+		var err error
+		if level == 0 {
+			// L0按fid从旧到新查找，与searchL0SST相同
+			for _, t := range lh.tables {
+				if pending, err = t.multiSearch(keys, pending, results); err != nil || len(pending) == 0 {
+					break
+				}
+			}
+		} else {
+			pending, err = lh.multiSearchLN(keys, pending, results)
+		}
+		lh.RUnlock()
+		if err != nil {
+			return err
+		}
+		// 查找前results中这些key都为nil，现在不为nil的是在这一层命中的，与Get一样检查是否需要读修复
+		for _, i := range searched {
+			if results[i] != nil {
+				lm.readRepair(keys[i], level)
+			}
+		}
+	}
+	return nil
+}
+
+// multiSearchLN 按getTable把排好序的key分到各个sst中查找，返回没有找到的key
+func (lh *levelHandler) multiSearchLN(keys [][]byte, pending []int, results []*utils.Entry) ([]int, error) {
+	var (
+		missed []int
+		group  []int
+		cur    *table
+	)
+	search := func() error {
+		if cur == nil {
+			missed = append(missed, group...)
+			return nil
+		}
+		rest, err := cur.multiSearch(keys, group, results)
+		missed = append(missed, rest...)
+		return err
+	}
+	// key已经排好序，落在同一个sst中的key是连续的
+	for _, i := range pending {
+		t := lh.getTable(keys[i])
+		if t != cur && len(group) > 0 {
+			if err := search(); err != nil {
+				return nil, err
+			}
+			group = group[:0]
+		}
+		cur = t
+		group = append(group, i)
+	}
+	if len(group) > 0 {
+		if err := search(); err != nil {
+			return nil, err
+		}
+	}
+	return missed, nil
+}
+
+// multiSearch 在sst中依次查找排好序的keys[idxs]，每个key的结果与Serach相同，返回没有找到的key
+// 所有key共用一个迭代器，BestEffortRead时可以忽略的读取错误按没有找到处理
+func (t *table) multiSearch(keys [][]byte, idxs []int, results []*utils.Entry) ([]int, error) {
+	t.IncrRef()
+	defer t.DecrRef()
+	var (
+		missed []int
+		iter   *tableIterator
+	)
+	idx := t.ss.Indexs()
+	bloomFilter := utils.Filter(idx.BloomFilter)
+	for _, i := range idxs {
+		key := keys[i]
+		if t.ss.HasBloomFilter() && !bloomFilter.MayContainKeyWith(utils.BloomHash(idx.BloomHash), utils.ParseKey(key)) {
+			missed = append(missed, i)
+			continue
+		}
+		if iter == nil {
+			iter = t.NewIterator(&utils.Options{}).(*tableIterator)
+			defer iter.Close()
+		}
+		iter.Seek(key)
+		if err := iter.Error(); err != nil {
+			if err = errors.Wrapf(err, "search table %d", t.fid); !t.lm.ignoreReadError(err) {
+				return nil, err
+			}
+			missed = append(missed, i)
+			continue
+		}
+		// 与Serach相同，版本号为0的entry视为没有找到
+		if iter.Valid() && utils.SameKey(key, iter.Item().Entry().Key) && utils.ParseTs(iter.Item().Entry().Key) > 0 {
+			results[i] = iter.Item().Entry()
+			continue
+		}
+		missed = append(missed, i)
+	}
+	return missed, nil
+}
@@ -0,0 +1,203 @@
+package lsm
+
+import (
+	"lsm/utils"
+	"time"
+)
+
+// DefaultOptions 返回workDir下可以直接使用的默认配置，其余字段保持零值，即对应的功能默认关闭
+func DefaultOptions(workDir string) Options {
+	return Options{
+		WorkDir:             workDir,
+		MemTableSize:        64 << 20,
+		SSTableMaxSz:        64 << 20,
+		BlockSize:           4 << 10,
+		BloomFalsePositive:  0.01,
+		NumCompactors:       1,
+		BaseLevelSize:       10 << 20,
+		LevelSizeMultiplier: 10,
+		BaseTableSize:       2 << 20,
+		TableSizeMultiplier: 2,
+		NumLevelZeroTables:  5,
+		MaxLevelNum:         utils.MaxLevelNum,
+		L0StallThreshold:    10,
+		L0StopThreshold:     15,
+	}
+}
+
+// 下面的With系列方法返回修改后的副本，便于链式调用：
+// DefaultOptions(dir).WithMemTableSize(8 << 20).WithSyncWrites(true)
+
+func (opt Options) WithMemTableSize(size int64) Options {
+	opt.MemTableSize = size
+	return opt
+}
+
+func (opt Options) WithMemTableMaxEntries(n int) Options {
+	opt.MemTableMaxEntries = n
+	return opt
+}
+
+// WithSkipList 同时设置SkipListMaxHeight与SkipListBranchProb
+func (opt Options) WithSkipList(maxHeight int, branchProb float64) Options {
+	opt.SkipListMaxHeight, opt.SkipListBranchProb = maxHeight, branchProb
+	return opt
+}
+
+func (opt Options) WithSSTableMaxSz(size int64) Options {
+	opt.SSTableMaxSz = size
+	return opt
+}
+
+func (opt Options) WithBlockSize(size int) Options {
+	opt.BlockSize = size
+	return opt
+}
+
+func (opt Options) WithBloomFalsePositive(fp float64) Options {
+	opt.BloomFalsePositive = fp
+	opt.BloomBitsPerKey = 0
+	return opt
+}
+
+func (opt Options) WithBloomBitsPerKey(bits int) Options {
+	opt.BloomBitsPerKey = bits
+	opt.BloomFalsePositive = 0
+	return opt
+}
+
+func (opt Options) WithBloomHash(h utils.BloomHash) Options {
+	opt.BloomHash = h
+	return opt
+}
+
+func (opt Options) WithNumCompactors(n int) Options {
+	opt.NumCompactors = n
+	return opt
+}
+
+func (opt Options) WithBaseLevelSize(size int64) Options {
+	opt.BaseLevelSize = size
+	return opt
+}
+
+func (opt Options) WithLevelSizeMultiplier(m int) Options {
+	opt.LevelSizeMultiplier = m
+	return opt
+}
+
+func (opt Options) WithBaseTableSize(size int64) Options {
+	opt.BaseTableSize = size
+	return opt
+}
+
+func (opt Options) WithTableSizeMultiplier(m int) Options {
+	opt.TableSizeMultiplier = m
+	return opt
+}
+
+func (opt Options) WithNumLevelZeroTables(n int) Options {
+	opt.NumLevelZeroTables = n
+	return opt
+}
+
+func (opt Options) WithMaxLevelNum(n int) Options {
+	opt.MaxLevelNum = n
+	return opt
+}
+
+// WithL0Thresholds 同时设置L0StallThreshold与L0StopThreshold
+func (opt Options) WithL0Thresholds(stall, stop int) Options {
+	opt.L0StallThreshold, opt.L0StopThreshold = stall, stop
+	return opt
+}
+
+func (opt Options) WithSyncCompaction(b bool) Options {
+	opt.SyncCompaction = b
+	return opt
+}
+
+func (opt Options) WithMaxImmutableMemory(size int64) Options {
+	opt.MaxImmutableMemory = size
+	return opt
+}
+
+func (opt Options) WithMaxStoreSize(size int64) Options {
+	opt.MaxStoreSize = size
+	return opt
+}
+
+func (opt Options) WithLogger(logger utils.Logger) Options {
+	opt.Logger = logger
+	return opt
+}
+
+func (opt Options) WithSyncWrites(b bool) Options {
+	opt.SyncWrites = b
+	return opt
+}
+
+func (opt Options) WithSSTableLayout(layout utils.SSTableLayout) Options {
+	opt.SSTableLayout = layout
+	return opt
+}
+
+func (opt Options) WithEncryptor(enc utils.Encryptor) Options {
+	opt.Encryptor = enc
+	return opt
+}
+
+func (opt Options) WithManifestBackupInterval(n int) Options {
+	opt.ManifestBackupInterval = n
+	return opt
+}
+
+func (opt Options) WithMaxSmallTables(n int) Options {
+	opt.MaxSmallTables = n
+	return opt
+}
+
+func (opt Options) WithTTLCompactionInterval(d time.Duration) Options {
+	opt.TTLCompactionInterval = d
+	return opt
+}
+
+func (opt Options) WithTrashRetention(d time.Duration) Options {
+	opt.TrashRetention = d
+	return opt
+}
+
+func (opt Options) WithValueCompressionThreshold(n int) Options {
+	opt.ValueCompressionThreshold = n
+	return opt
+}
+
+func (opt Options) WithRowCacheSize(size int64) Options {
+	opt.RowCacheSize = size
+	return opt
+}
+
+func (opt Options) WithFileRetry(retries int, interval time.Duration) Options {
+	opt.FileRetry = utils.RetryPolicy{Retries: retries, Interval: interval}
+	return opt
+}
+
+func (opt Options) WithWalRetainAfterFlush(d time.Duration) Options {
+	opt.WalRetainAfterFlush = d
+	return opt
+}
+
+func (opt Options) WithValueAlignment(align int) Options {
+	opt.ValueAlignment = align
+	return opt
+}
+
+func (opt Options) WithSkipBloomBottomLevel(skip bool) Options {
+	opt.SkipBloomBottomLevel = skip
+	return opt
+}
+
+func (opt Options) WithMaxRecoveryMemory(size int64) Options {
+	opt.MaxRecoveryMemory = size
+	return opt
+}
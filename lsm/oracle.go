@@ -0,0 +1,146 @@
+package lsm
+
+import (
+	"fmt"
+	"lsm/utils"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// oracle 为写入的key分配版本号
+type oracle struct {
+	nextTs      uint64 // 已经分配出去的最大版本号
+	versionFunc func() uint64
+}
+
+// newOracle 使用恢复出的最大版本号初始化，保证重新打开后分配的版本号不会回退
+func (lsm *LSM) newOracle() *oracle {
+	o := &oracle{versionFunc: lsm.option.VersionFunc}
+	// manifest中的检查点不小于所有sst中的版本号，检查点之后的写入都还在wal中
+	// 旧的manifest没有记录检查点，只能扫描所有sst
+	if o.nextTs = lsm.levels.manifestFile.GetManifest().MaxVersion; o.nextTs == 0 {
+		o.nextTs = lsm.levels.maxVersion()
+	}
+	for _, mt := range append(lsm.immutables, lsm.memTable) {
+		if v := atomic.LoadUint64(&mt.maxVersion); v > o.nextTs {
+			o.nextTs = v
+		}
+	}
+	return o
+}
+
+// newTs 返回一个新的版本号，配置了VersionFunc时由它决定
+func (o *oracle) newTs() uint64 {
+	if o.versionFunc != nil {
+		return o.versionFunc()
+	}
+	return atomic.AddUint64(&o.nextTs, 1)
+}
+
+// checkpointVersion 刷盘生成的sst写入manifest时记录的版本号检查点
+// 取oracle已经分配出去的版本号与sst中最大版本号的较大者，后者覆盖了不经过oracle直接指定版本号的写入
+func (lsm *LSM) checkpointVersion(t *table) uint64 {
+	v := t.ss.Indexs().GetMaxVersion()
+	if lsm.orc != nil {
+		if ts := atomic.LoadUint64(&lsm.orc.nextTs); ts > v {
+			v = ts
+		}
+	}
+	return v
+}
+
+// maxVersion 所有sst中最大的版本号
+func (lm *levelManager) maxVersion() uint64 {
+	var version uint64
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			if v := t.ss.Indexs().GetMaxVersion(); v > version {
+				version = v
+			}
+		}
+		lh.RUnlock()
+	}
+	return version
+}
+
+// maxVersionViolations verifyMonotonicVersions的错误中最多列出的entry数量
+const maxVersionViolations = 10
+
+// verifyMonotonicVersions 检查所有sst中每个entry的版本号都不大于oracle恢复出的水位
+// 水位取manifest的检查点与回放出的内存表中的最大版本号，wal中的版本号总是已经计入，需要检查的只有sst
+// sst中超过检查点的版本号说明检查点或sst已经损坏
+func (lsm *LSM) verifyMonotonicVersions() error {
+	watermark := atomic.LoadUint64(&lsm.orc.nextTs)
+	var (
+		violations []string
+		count      int
+	)
+	report := func(source string, key []byte) {
+		if ts := utils.ParseTs(key); ts > watermark {
+			if count < maxVersionViolations {
+				violations = append(violations, fmt.Sprintf("%s key %q version %d", source, utils.ParseKey(key), ts))
+			}
+			count++
+		}
+	}
+	for level, lh := range lsm.levels.levels {
+		for _, t := range lh.tables {
+			source := fmt.Sprintf("level %d table %d", level, t.fid)
+			it := t.NewIterator(&utils.Options{IsAsc: true, KeysOnly: true}).(*tableIterator)
+			for it.Rewind(); it.Valid(); it.Next() {
+				if err := it.Error(); err != nil {
+					_ = it.Close()
+					return errors.Wrapf(err, "verify versions of table %d", t.fid)
+				}
+				report(source, it.Item().Entry().Key)
+			}
+			_ = it.Close()
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if count > len(violations) {
+		violations = append(violations, fmt.Sprintf("and %d more", count-len(violations)))
+	}
+	return errors.Wrapf(utils.ErrVersionRegression, "watermark %d, %d entries above it: %s",
+		watermark, count, strings.Join(violations, "; "))
+}
+
+// MakeKey 为user key分配下一个版本号，返回存储使用的带版本号的key，可以直接用于Set
+// 版本号以大端序编码在最后8个字节，越新的版本排序越靠前
+func (lsm *LSM) MakeKey(userKey []byte) []byte {
+	return utils.KeyWithTs(userKey, lsm.orc.newTs())
+}
+
+// Put 写入user key，版本号由oracle分配后追加到key上
+func (lsm *LSM) Put(key, value []byte) error {
+	return lsm.Set(utils.NewEntry(lsm.MakeKey(key), value))
+}
+
+// CompareAndSwap 只有key当前最新的版本等于expectedVersion时才写入value，版本不一致时返回false
+// expectedVersion为0表示key必须不存在，最新版本已经删除或过期的key视为不存在，检查与写入在同一次写锁内完成
+func (lsm *LSM) CompareAndSwap(key, value []byte, expectedVersion uint64) (bool, error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	lsm.throttleWrite()
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	version, ok, err := lsm.version(key)
+	if err != nil {
+		return false, err
+	}
+	if (expectedVersion == 0 && ok) || (expectedVersion != 0 && (!ok || version != expectedVersion)) {
+		return false, nil
+	}
+	if err := lsm.applyFlushPolicy(); err != nil {
+		return false, err
+	}
+	if err := lsm.set(utils.NewEntry(lsm.MakeKey(key), value)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package lsm
+
+// CompactionPlan 一次合并任务的预估，由PlanCompaction返回
+type CompactionPlan struct {
+	Level      int
+	NextLevel  int
+	Score      float64  // 调整后的得分
+	Tables     []uint64 // 源层参与合并的sst
+	NextTables []uint64 // 目标层与之重叠的sst
+	InputSize  int64
+	// EstimatedOutputSize 输入的大小减去其中的过期数据，合并时旧版本的丢弃情况无法提前知道
+	EstimatedOutputSize int64
+	// WriteAmplification 预估写入的字节数与源层移动下去的字节数之比
+	WriteAmplification float64
+}
+
+// PlanCompaction 返回合并协程此刻会调度的任务，但不执行
+// 任务的选择与runOnce一致，前面的任务会占用key范围，就像多个合并协程同时运行时一样
+// 规划期间这些key范围会短暂登记在合并状态中，后台的合并协程不会选中它们
+func (lsm *LSM) PlanCompaction() []CompactionPlan {
+	lm := lsm.levels
+	var (
+		plans []CompactionPlan
+		defs  []compactDef
+	)
+	for _, p := range moveL0toFront(lm.pickCompactLevels()) {
+		if p.level != 0 && p.adjusted < 1.0 {
+			break
+		}
+		cd, err := lm.fillCompactDef(0, p)
+		if err != nil {
+			continue
+		}
+		defs = append(defs, cd)
+		plans = append(plans, newCompactionPlan(&cd))
+	}
+	for _, cd := range defs {
+		lm.compactState.delete(cd)
+	}
+	return plans
+}
+
+func newCompactionPlan(cd *compactDef) CompactionPlan {
+	plan := CompactionPlan{
+		Level:     cd.thisLevel.levelNum,
+		NextLevel: cd.nextLevel.levelNum,
+		Score:     cd.p.adjusted,
+	}
+	var topSize int64
+	for _, t := range cd.top {
+		plan.Tables = append(plan.Tables, t.fid)
+		topSize += t.Size()
+		plan.EstimatedOutputSize -= int64(t.StaleDataSize())
+	}
+	plan.InputSize = topSize
+	for _, t := range cd.bot {
+		plan.NextTables = append(plan.NextTables, t.fid)
+		plan.InputSize += t.Size()
+		plan.EstimatedOutputSize -= int64(t.StaleDataSize())
+	}
+	plan.EstimatedOutputSize += plan.InputSize
+	if topSize > 0 {
+		plan.WriteAmplification = float64(plan.EstimatedOutputSize) / float64(topSize)
+	}
+	return plan
+}
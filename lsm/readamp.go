@@ -0,0 +1,36 @@
+package lsm
+
+import "lsm/utils"
+
+// ReadStats 一次Get查找过的数据源，用于观察读放大
+type ReadStats struct {
+	Memtables int    // 查找过的内存表数量，包括immutables
+	Tables    int    // 查找过的sst数量，包括被布隆过滤器排除的sst
+	Blocks    int    // 从sst中读取的block数量
+	Level     int    // 命中的level，在内存表中命中或没有找到时为-1
+	TableID   uint64 // 命中的sst，Level为-1时为0
+}
+
+// addTable 记录即将查找一个sst，已经查找了max个sst时返回ErrReadAmpExceeded，max为0表示不限制
+func (s *ReadStats) addTable(max int) error {
+	if max > 0 && s.Tables >= max {
+		return utils.ErrReadAmpExceeded
+	}
+	s.Tables++
+	return nil
+}
+
+// GetWithSource 与Get相同，同时返回这次查找检查过的内存表、sst与block
+// 为了如实反映读取路径，不读取也不填充row cache
+func (lsm *LSM) GetWithSource(key []byte) (*utils.Entry, ReadStats, error) {
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	stats := ReadStats{Level: -1}
+	entry, err := lsm.get(key, &stats)
+	if entry != nil {
+		if derr := entry.Decompress(); derr != nil {
+			return nil, stats, derr
+		}
+	}
+	return entry, stats, err
+}
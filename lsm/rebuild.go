@@ -0,0 +1,118 @@
+package lsm
+
+import (
+	"lsm/file"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// RebuildFromWAL manifest丢失或损坏时只用wal重建dir中的存储，完成后关闭，之后可以正常Open
+// 已有的manifest改名为ManifestCorruptFilename保留，备份直接删除；所有wal按fid顺序回放并刷盘到L0，写入新的manifest
+// opt.RebuildKeepTables为true时目录中已有的sst一并注册到L0，否则作为孤儿表保留，可以通过FindOrphans找到
+// 重建时忽略DeleteOrphans，新的manifest是空的，否则目录中所有的sst都会被当作孤儿表删除
+// 与Open一样，恢复过程中的磁盘错误会panic
+func RebuildFromWAL(dir string, opt Options) error {
+	opt.WorkDir = dir
+	if err := opt.validate(); err != nil {
+		return errors.Wrap(err, "invalid options")
+	}
+	opt.DeleteOrphans = false
+	if err := os.Rename(filepath.Join(dir, utils.ManifestFilename), filepath.Join(dir, utils.ManifestCorruptFilename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 旧的备份与新的manifest不一致，留着的话新manifest损坏时会用它恢复
+	if err := os.Remove(filepath.Join(dir, utils.ManifestBackupFilename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lsm, err := openLSM(&opt)
+	if err != nil {
+		return errors.Wrapf(err, "rebuild %s", dir)
+	}
+	if opt.RebuildKeepTables {
+		err = lsm.registerOrphans()
+	}
+	if _, cerr := lsm.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "rebuild %s", dir)
+}
+
+// registerOrphans 将manifest没有引用的sst注册到L0，无法读取的sst跳过并保留文件
+// fid与待刷盘的wal相同的sst是刷盘之后wal还没删除时留下的，之后刷盘会用wal重新生成它，这里不注册
+func (lsm *LSM) registerOrphans() error {
+	lm := lsm.levels
+	pending := make(map[uint64]struct{}, len(lsm.immutables))
+	for _, imm := range lsm.immutables {
+		pending[imm.wal.Fid()] = struct{}{}
+	}
+	paths := utils.LoadSSTPaths(lsm.option.WorkDir)
+	var (
+		tables []*table
+		metas  []*file.TableMeta
+	)
+	for _, fid := range lsm.FindOrphans() {
+		if _, ok := pending[fid]; ok {
+			continue
+		}
+		t, err := loadTable(lm, paths[fid], nil)
+		if err == nil {
+			err = t.scanExpiry()
+			if err == nil {
+				var sum uint64
+				sum, err = fileChecksum(paths[fid])
+				t.checksum = utils.U64ToBytes(sum)
+			}
+			if err != nil {
+				_ = t.ss.Close()
+			}
+		}
+		if err != nil {
+			lsm.option.Logger.Warnf("skip orphan table %d: %v", fid, err)
+			continue
+		}
+		tables = append(tables, t)
+		metas = append(metas, &file.TableMeta{
+			ID:           fid,
+			Checksum:     t.checksum,
+			MaxVersion:   lsm.checkpointVersion(t),
+			MinExpiresAt: t.minExpiresAt,
+			MaxExpiresAt: t.maxExpiresAt,
+		})
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	if err := lm.manifestFile.AddTableMetas(0, metas); err != nil {
+		// 注册失败时保留文件，不能用DecrRef删除
+		for _, t := range tables {
+			_ = t.ss.Close()
+		}
+		return errors.Wrap(err, "register orphan tables")
+	}
+	lm.levels[0].addBatch(tables)
+	lm.levels[0].Sort()
+	return nil
+}
+
+// scanExpiry 读取sst中的所有entry，得到manifest中记录的过期时间范围
+func (t *table) scanExpiry() error {
+	it := t.NewIterator(&utils.Options{IsAsc: true}).(*tableIterator)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		expiresAt := it.Item().Entry().ExpiresAt
+		if expiresAt == 0 {
+			continue
+		}
+		if t.minExpiresAt == 0 || expiresAt < t.minExpiresAt {
+			t.minExpiresAt = expiresAt
+		}
+		if expiresAt > t.maxExpiresAt {
+			t.maxExpiresAt = expiresAt
+		}
+	}
+	return it.Error()
+}
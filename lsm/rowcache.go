@@ -0,0 +1,155 @@
+package lsm
+
+import (
+	"container/list"
+	"lsm/utils"
+	"sync"
+)
+
+// rowCacheItemOverhead 每个缓存项除key与value之外大约占用的内存
+const rowCacheItemOverhead = 128
+
+// rowCache 按user key缓存Get读到的entry，写入某个key后立即淘汰它的缓存，因此不会读到旧数据
+// 缓存项记录查询时使用的版本号，只有版本号相同的查询才会命中
+// 查询与写入并发时，查询开始之后被淘汰过的key不会再加入缓存，避免写入之后加入查询读到的旧entry
+type rowCache struct {
+	sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List               // 最近使用的在前
+	items   map[string]*list.Element // user key -> *rowCacheItem
+	seq     uint64                   // 每次淘汰加1
+	dropped uint64                   // 移出缓存的项中最大的淘汰序号，这些key开始之后的查询都不能加入缓存
+	reading int                      // 已经begin还没有end的查询数量
+}
+
+// rowCacheItem entry为nil表示key在有查询进行时被淘汰，只用来记录淘汰序号
+type rowCacheItem struct {
+	key     string
+	queryTs uint64
+	entry   *utils.Entry
+	inv     uint64 // 最近一次淘汰这个key时的序号
+}
+
+func newRowCache(size int64) *rowCache {
+	if size <= 0 {
+		return nil
+	}
+	return &rowCache{maxSize: size, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (it *rowCacheItem) charge() int64 {
+	n := int64(len(it.key)) + rowCacheItemOverhead
+	if it.entry != nil {
+		n += int64(len(it.entry.Key) + len(it.entry.Value))
+	}
+	return n
+}
+
+// begin 查询开始前调用，返回的序号传给end
+func (c *rowCache) begin() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.reading++
+	return c.seq
+}
+
+// get 返回key对应的缓存entry的副本，value与缓存共用，调用方不能修改
+// 已经过期的entry被移出缓存
+func (c *rowCache) get(key []byte) *utils.Entry {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.items[string(utils.ParseKey(key))]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*rowCacheItem)
+	if item.entry == nil || item.queryTs != utils.ParseTs(key) {
+		return nil
+	}
+	if isDeletedOrExpired(0, item.entry.ExpiresAt) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	e := *item.entry
+	return &e
+}
+
+// end 查询结束后调用，缓存查询key读到的entry，没有读到时e为nil；start为查询开始前begin返回的序号
+func (c *rowCache) end(key []byte, e *utils.Entry, start uint64) {
+	if c == nil {
+		return
+	}
+	userKey := string(utils.ParseKey(key))
+	c.Lock()
+	defer c.Unlock()
+	c.reading--
+	if e == nil {
+		return
+	}
+	elem, ok := c.items[userKey]
+	if ok && elem.Value.(*rowCacheItem).inv > start || !ok && c.dropped > start {
+		return
+	}
+	item := &rowCacheItem{
+		key:     userKey,
+		queryTs: utils.ParseTs(key),
+		// sst中的value指向mmap的内存，sst删除后不能再访问
+		entry: &utils.Entry{
+			Key:       utils.Copy(e.Key),
+			Value:     utils.Copy(e.Value),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+			Version:   e.Version,
+		},
+	}
+	if ok {
+		item.inv = elem.Value.(*rowCacheItem).inv
+		c.remove(elem)
+	}
+	if item.charge() > c.maxSize {
+		return
+	}
+	c.insert(item)
+}
+
+// invalidate 写入user key之后调用，淘汰它的缓存
+// 有查询正在进行时留下记录淘汰序号的项，这些查询读到的可能是写入之前的entry
+func (c *rowCache) invalidate(userKey []byte) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.seq++
+	if elem, ok := c.items[string(userKey)]; ok {
+		c.remove(elem)
+	}
+	if c.reading > 0 {
+		c.insert(&rowCacheItem{key: string(userKey), inv: c.seq})
+	}
+}
+
+func (c *rowCache) insert(item *rowCacheItem) {
+	c.items[item.key] = c.lru.PushFront(item)
+	c.size += item.charge()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *rowCache) remove(elem *list.Element) {
+	item := c.lru.Remove(elem).(*rowCacheItem)
+	delete(c.items, item.key)
+	c.size -= item.charge()
+	if item.inv > c.dropped {
+		c.dropped = item.inv
+	}
+}
@@ -0,0 +1,85 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"lsm/utils"
+	"math"
+	"sort"
+)
+
+// SequenceIterator 按版本号从小到大返回版本号不小于fromVersion的所有entry，用于按提交顺序回放写入
+// sst中的数据已经按key排序，因此创建时会把符合条件的entry全部读出并排序，内存占用与返回的数据量成正比
+// 版本号相同的entry（例如VersionFunc返回了重复的值）按user key升序返回；key与版本号都相同的只返回一次，取最新的数据源
+// 创建之后的写入不可见，读取时遇到损坏的sst返回错误
+func (lsm *LSM) SequenceIterator(fromVersion uint64) (utils.Iterator, error) {
+	iter := lsm.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	var entries []*utils.Entry
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		version := utils.ParseTs(e.Key)
+		if version < fromVersion {
+			continue
+		}
+		entries = append(entries, &utils.Entry{
+			Key:       utils.Copy(e.Key),
+			Value:     utils.Copy(e.Value),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+			Version:   version,
+		})
+	}
+	if err := iter.(*Iterator).Error(); err != nil {
+		return nil, err
+	}
+	// 合并迭代器按key升序返回，稳定排序后版本号相同的entry保持user key的顺序
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Version < entries[j].Version
+	})
+	return &sequenceIterator{entries: entries}, nil
+}
+
+// sequenceIterator 遍历按版本号排好序的entry
+type sequenceIterator struct {
+	entries []*utils.Entry
+	idx     int
+}
+
+func (iter *sequenceIterator) Next() {
+	iter.idx++
+}
+
+func (iter *sequenceIterator) Valid() bool {
+	return iter.idx < len(iter.entries)
+}
+
+func (iter *sequenceIterator) Rewind() {
+	iter.idx = 0
+}
+
+func (iter *sequenceIterator) Item() utils.Item {
+	return &Item{e: iter.entries[iter.idx]}
+}
+
+func (iter *sequenceIterator) Close() error {
+	iter.entries = nil
+	return nil
+}
+
+// Seek 定位到第一个不早于key的entry，key为utils.KeyWithTs(userKey, version)，先比较版本号再比较user key
+// 只定位版本号时userKey可以为空
+func (iter *sequenceIterator) Seek(key []byte) {
+	var version uint64
+	if len(key) >= 8 {
+		version = math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-8:])
+	}
+	userKey := utils.ParseKey(key)
+	iter.idx = sort.Search(len(iter.entries), func(i int) bool {
+		e := iter.entries[i]
+		if e.Version != version {
+			return e.Version > version
+		}
+		return bytes.Compare(utils.ParseKey(e.Key), userKey) >= 0
+	})
+}
@@ -1,8 +1,10 @@
 package lsm
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/pkg/errors"
+	"hash/crc32"
 	"io"
 	"lsm/file"
 	file2 "lsm/file/osFile"
@@ -20,9 +22,27 @@ type table struct {
 	lm  *levelManager
 	fid uint64
 	ref int32 // For osFile garbage collection. Atomic.
+	// 表中entry最早与最晚的过期时间，没有设置过期时间的entry时均为0，保存在manifest中
+	minExpiresAt uint64
+	maxExpiresAt uint64
+	// createdAt 保存在manifest中的创建时间，unix秒，旧的manifest没有记录时为0
+	createdAt uint64
+	// checksum 整个文件的crc32，大端8字节，保存在manifest中，之前注册的sst记录的是占位的mock
+	checksum []byte
 }
 
+// openTable 打开或创建sst，失败时记录日志并返回nil
 func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table {
+	t, err := loadTable(lm, tableName, builder)
+	if err != nil {
+		lm.opt.Logger.Errorf("open table %s: %v", tableName, err)
+		return nil
+	}
+	return t
+}
+
+// loadTable 与openTable相同，但返回失败的原因
+func loadTable(lm *levelManager, tableName string, builder *tableBuilder) (*table, error) {
 	sstSize := int(lm.opt.SSTableMaxSz)
 	if builder != nil {
 		sstSize = int(builder.done().size)
@@ -31,28 +51,37 @@ func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table
 		t   *table
 		err error
 	)
-	fid := utils.FID(tableName)
+	fid, ok := utils.FID(tableName)
+	if !ok {
+		return nil, errors.Errorf("invalid table name %s", tableName)
+	}
 	// 对builder存在的情况 把buf flush到磁盘
 	if builder != nil {
 		if t, err = builder.flush(lm, tableName); err != nil {
-			utils.PrintErr(err)
-			return nil
+			return nil, errors.Wrap(err, "flush table")
 		}
 	} else {
 		t = &table{lm: lm, fid: fid}
 		// 如果没有builder 则创打开一个已经存在的sst文件
-		t.ss = file.OpenSStable(&file2.FileOption{
+		if t.ss, err = file.OpenSStable(&file2.FileOption{
 			FileName: tableName,
 			WorkDir:  lm.opt.WorkDir,
 			Flag:     os.O_CREATE | os.O_RDWR,
-			MaxSz:    int(sstSize)})
+			MaxSz:    int(sstSize),
+
+			Encryptor: lm.opt.Encryptor,
+			TrashDir:  lm.opt.trashDir(),
+			Retry:     lm.opt.FileRetry,
+		}); err != nil {
+			return nil, err
+		}
 	}
 	// 先要引用一下，否则后面使用迭代器会导致引用状态错误
 	t.IncrRef()
 	//  初始化sst文件，把index加载进来
 	if err := t.ss.Init(); err != nil {
-		utils.PrintErr(err)
-		return nil
+		_ = t.ss.Close()
+		return nil, errors.Wrap(err, "init table")
 	}
 
 	// 获取sst的最大key 需要使用迭代器
@@ -60,28 +89,41 @@ func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table
 	defer itr.Close()
 	// 定位到初始位置就是最大的key
 	itr.Rewind()
+	// 最后一个block损坏时迭代器只记录错误，调用方在BestEffortRead下跳过这个sst
+	if err := itr.(*tableIterator).Error(); err != nil {
+		_ = t.ss.Close()
+		return nil, errors.Wrap(err, "read max key")
+	}
 	utils.CondPanic(!itr.Valid(), errors.Errorf("failed to read index, form maxKey"))
 	maxKey := itr.Item().Entry().Key
 	t.ss.SetMaxKey(maxKey)
 
-	return t
+	return t, nil
 }
 
 // Serach 从table中查找key
-func (t *table) Serach(key []byte, maxVs *uint64) (entry *utils.Entry, err error) {
+func (t *table) Serach(key []byte, maxVs *uint64, stats *ReadStats) (entry *utils.Entry, err error) {
+	if err := stats.addTable(t.lm.opt.MaxReadAmplification); err != nil {
+		return nil, err
+	}
 	t.IncrRef()
 	defer t.DecrRef()
 	// 获取索引
 	idx := t.ss.Indexs()
 	// 检查key是否存在
 	bloomFilter := utils.Filter(idx.BloomFilter)
-	if t.ss.HasBloomFilter() && !bloomFilter.MayContainKey(key) {
+	if t.ss.HasBloomFilter() && !bloomFilter.MayContainKeyWith(utils.BloomHash(idx.BloomHash), utils.ParseKey(key)) {
 		return nil, utils.ErrKeyNotFound
 	}
 	iter := t.NewIterator(&utils.Options{})
 	defer iter.Close()
 
 	iter.Seek(key)
+	stats.Blocks += iter.(*tableIterator).blockReads
+	// 读取block失败，例如checksum校验不通过
+	if err := iter.(*tableIterator).Error(); err != nil {
+		return nil, errors.Wrapf(err, "search table %d", t.fid)
+	}
 	if !iter.Valid() {
 		return nil, utils.ErrKeyNotFound
 	}
@@ -95,6 +137,35 @@ func (t *table) Serach(key []byte, maxVs *uint64) (entry *utils.Entry, err error
 	return nil, utils.ErrKeyNotFound
 }
 
+// version 返回sst中与seekKey的user key相同的最新版本，deleted表示该版本已经删除或过期，不解码value
+func (t *table) version(seekKey []byte) (ts uint64, deleted, ok bool, err error) {
+	if !t.mayContain(seekKey) {
+		return 0, false, false, nil
+	}
+	iter := t.NewIterator(&utils.Options{KeysOnly: true}).(*tableIterator)
+	defer iter.Close()
+	iter.Seek(seekKey)
+	if err := iter.Error(); err != nil {
+		return 0, false, false, errors.Wrapf(err, "search table %d", t.fid)
+	}
+	if !iter.Valid() || !utils.SameKey(seekKey, iter.Item().Entry().Key) {
+		return 0, false, false, nil
+	}
+	e := iter.Item().Entry()
+	return utils.ParseTs(e.Key), isDeletedOrExpired(e.Meta, e.ExpiresAt), true, nil
+}
+
+// mayContain 根据key范围与布隆过滤器判断sst是否可能包含key的某个版本
+func (t *table) mayContain(key []byte) bool {
+	userKey := utils.ParseKey(key)
+	if bytes.Compare(userKey, utils.ParseKey(t.ss.MinKey())) < 0 ||
+		bytes.Compare(userKey, utils.ParseKey(t.ss.MaxKey())) > 0 {
+		return false
+	}
+	idx := t.ss.Indexs()
+	return !t.ss.HasBloomFilter() || utils.Filter(idx.BloomFilter).MayContainKeyWith(utils.BloomHash(idx.BloomHash), userKey)
+}
+
 func (t *table) indexKey() uint64 {
 	return t.fid
 }
@@ -145,22 +216,74 @@ func (t *table) block(idx int) (*block, error) {
 	readPos -= b.chkLen
 	b.checksum = b.data[readPos : readPos+b.chkLen]
 
-	readPos -= 4
-	numEntries := int(utils.BytesToU32(b.data[readPos : readPos+4]))
-	entriesIndexStart := readPos - (numEntries * 4)
-	entriesIndexEnd := entriesIndexStart + numEntries*4
+	// checksum覆盖的是落盘的数据，索引中记录了block是否加密，校验通过后再解密
+	b.data = b.data[:readPos]
+	if err = b.verifyCheckSum(); err != nil {
+		return nil, err
+	}
+	if t.ss.Indexs().GetEncrypted() {
+		if b.data, err = utils.DecryptData(t.lm.opt.Encryptor, b.data); err != nil {
+			return nil, errors.Wrapf(err, "decrypt block %d of table %d", idx, t.fid)
+		}
+	}
+
+	readPos = len(b.data) - 4
+	numRestarts := int(utils.BytesToU32(b.data[readPos : readPos+4]))
+	entriesIndexStart := readPos - (numRestarts * 4)
+	entriesIndexEnd := entriesIndexStart + numRestarts*4
 
-	b.entryOffsets = utils.BytesToU32Slice(b.data[entriesIndexStart:entriesIndexEnd])
+	b.restarts = utils.BytesToU32Slice(b.data[entriesIndexStart:entriesIndexEnd])
 
 	b.entriesIndexStart = entriesIndexStart
 
-	b.data = b.data[:readPos+4]
+	return b, nil
+}
+
+// fileChecksum 流式读取文件计算整个文件的crc32，与utils.CalculateChecksum相同
+func fileChecksum(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.New(utils.CastagnoliCrcTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return uint64(h.Sum32()), nil
+}
 
-	if err = b.verifyCheckSum(); err != nil {
-		return nil, err
+// verify 依次加载每个block，加载时会校验block的checksum
+func (t *table) verify() error {
+	t.IncrRef()
+	defer t.DecrRef()
+	for i := range t.ss.Indexs().GetOffsets() {
+		if _, err := t.block(i); err != nil {
+			return errors.Wrapf(err, "verify table %d block %d", t.fid, i)
+		}
 	}
+	return nil
+}
 
-	return b, nil
+// checkOrder 检查sst中的key是否按CompareKeys严格递增，出错时返回第一个乱序key所在block的偏移
+func (t *table) checkOrder() error {
+	it := t.NewIterator(&utils.Options{IsAsc: true, KeysOnly: true}).(*tableIterator)
+	defer it.Close()
+	var prev []byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := it.Error(); err != nil {
+			return errors.Wrapf(err, "check order of table %d", t.fid)
+		}
+		key := it.Item().Entry().Key
+		if prev != nil && utils.CompareKeys(prev, key) >= 0 {
+			var ko pb.BlockOffset
+			t.offsets(&ko, it.blockPos)
+			return errors.Wrapf(utils.ErrSSTableOrder, "table %d block %d at offset %d",
+				t.fid, it.blockPos, ko.GetOffset())
+		}
+		prev = key
+	}
+	return nil
 }
 
 func (t *table) read(off, sz int) ([]byte, error) {
@@ -174,6 +297,12 @@ type tableIterator struct {
 	blockPos int
 	bi       *blockIterator
 	err      error
+
+	// seeked Seek最近一次读取的block，连续Seek到同一个block时直接复用
+	seeked    *block
+	seekedPos int
+	// blockReads Seek读取block的次数，复用seeked时不计入
+	blockReads int
 }
 
 func (t *table) NewIterator(options *utils.Options) utils.Iterator {
@@ -181,9 +310,16 @@ func (t *table) NewIterator(options *utils.Options) utils.Iterator {
 	return &tableIterator{
 		opt: options,
 		t:   t,
-		bi:  &blockIterator{},
+		bi:  t.newBlockIterator(options.KeysOnly),
 	}
 }
+
+// newBlockIterator 按sst索引中记录的格式解析block
+func (t *table) newBlockIterator(keysOnly bool) *blockIterator {
+	idx := t.ss.Indexs()
+	return &blockIterator{keysOnly: keysOnly, valueMeta: idx.ValueMeta, padded: idx.ValueAlign > 1, varintTs: idx.VarintTs, tableID: t.fid}
+}
+
 func (it *tableIterator) Next() {
 	it.err = nil
 
@@ -203,6 +339,7 @@ func (it *tableIterator) Next() {
 		it.bi.setBlock(block)
 		it.bi.seekToFirst()
 		it.err = it.bi.Error()
+		it.it = it.bi.it
 		return
 	}
 
@@ -228,6 +365,14 @@ func (it *tableIterator) Rewind() {
 func (it *tableIterator) Item() utils.Item {
 	return it.it
 }
+
+// Error 返回迭代中读取block时遇到的错误，到达末尾不算错误
+func (it *tableIterator) Error() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
 func (it *tableIterator) Close() error {
 	it.bi.Close()
 	return it.t.DecrRef()
@@ -299,10 +444,15 @@ func (it *tableIterator) Seek(key []byte) {
 
 func (it *tableIterator) seekHelper(blockIdx int, key []byte) {
 	it.blockPos = blockIdx
-	block, err := it.t.block(blockIdx)
-	if err != nil {
-		it.err = err
-		return
+	block := it.seeked
+	if block == nil || it.seekedPos != blockIdx {
+		var err error
+		if block, err = it.t.block(blockIdx); err != nil {
+			it.err = err
+			return
+		}
+		it.blockReads++
+		it.seeked, it.seekedPos = block, blockIdx
 	}
 	it.bi.tableID = it.t.fid
 	it.bi.blockID = it.blockPos
@@ -339,6 +489,9 @@ func (t *table) StaleDataSize() uint32 { return t.ss.Indexs().StaleDataSize }
 func (t *table) DecrRef() error {
 	newRef := atomic.AddInt32(&t.ref, -1)
 	if newRef == 0 {
+		if t.lm.backups.deferDelete(t) {
+			return nil
+		}
 		if err := t.Delete(); err != nil {
 			return err
 		}
@@ -0,0 +1,100 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// l0StallDelay L0达到L0StallThreshold后每次写入前的延迟
+	l0StallDelay = time.Millisecond
+	// l0StopCheckInterval L0达到L0StopThreshold后检查合并进度的周期
+	l0StopCheckInterval = time.Millisecond
+)
+
+// WriteStallState 写入因L0积压被限速的状态
+type WriteStallState int
+
+const (
+	WriteStallNone    WriteStallState = iota
+	WriteStallDelayed                 // L0达到L0StallThreshold，每次写入前延迟
+	WriteStallStopped                 // L0达到L0StopThreshold，写入阻塞直到合并降低L0
+)
+
+func (s WriteStallState) String() string {
+	switch s {
+	case WriteStallDelayed:
+		return "delayed"
+	case WriteStallStopped:
+		return "stopped"
+	}
+	return "none"
+}
+
+// WriteStallStats 当前的限速状态与打开以来的累计
+type WriteStallStats struct {
+	State     WriteStallState
+	Delays    int64         // 被延迟的写入次数
+	Stops     int64         // 被阻塞的写入次数
+	StallTime time.Duration // 写入因限速等待的总时间
+}
+
+// writeStallStats 限速的累计统计，均使用原子操作更新
+type writeStallStats struct {
+	delays    int64
+	stops     int64
+	stallTime int64
+}
+
+// writeStallState 根据当前L0的sst数量判断限速状态
+func (lsm *LSM) writeStallState() WriteStallState {
+	opt := lsm.option
+	if opt.L0StallThreshold <= 0 && opt.L0StopThreshold <= 0 {
+		return WriteStallNone
+	}
+	n := lsm.levels.levels[0].numTables()
+	switch {
+	case opt.L0StopThreshold > 0 && n >= opt.L0StopThreshold:
+		return WriteStallStopped
+	case opt.L0StallThreshold > 0 && n >= opt.L0StallThreshold:
+		return WriteStallDelayed
+	}
+	return WriteStallNone
+}
+
+// throttleWrite 写入前根据L0的积压限速，需要在获取写锁之前调用，这样等待期间刷盘与读取不受影响
+// 并发写入的协程可能同时通过检查，一次刷盘也可能切分出多个sst，L0因此可能短暂超过L0StopThreshold
+// 开启SyncCompaction时需要由其他协程调用CompactAll，否则达到L0StopThreshold后写入会一直阻塞
+func (lsm *LSM) throttleWrite() {
+	state := lsm.writeStallState()
+	if state == WriteStallNone {
+		return
+	}
+	start := time.Now()
+	stats := &lsm.stallStats
+	if state == WriteStallDelayed {
+		atomic.AddInt64(&stats.delays, 1)
+		time.Sleep(l0StallDelay)
+	} else {
+		atomic.AddInt64(&stats.stops, 1)
+		ticker := time.NewTicker(l0StopCheckInterval)
+		defer ticker.Stop()
+		for lsm.writeStallState() == WriteStallStopped && lsm.IsFrozen() == nil {
+			select {
+			case <-ticker.C:
+			case <-lsm.closer.Wait():
+				return
+			}
+		}
+	}
+	atomic.AddInt64(&stats.stallTime, int64(time.Since(start)))
+}
+
+func (lsm *LSM) writeStallStats() WriteStallStats {
+	return WriteStallStats{
+		State:     lsm.writeStallState(),
+		Delays:    atomic.LoadInt64(&lsm.stallStats.delays),
+		Stops:     atomic.LoadInt64(&lsm.stallStats.stops),
+		StallTime: time.Duration(atomic.LoadInt64(&lsm.stallStats.stallTime)),
+	}
+}
@@ -0,0 +1,271 @@
+package lsm
+
+import (
+	"lsm/utils"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Stats 存储当前状态的汇总，适合直接序列化后输出到调试接口
+type Stats struct {
+	MemTableSize   int64 // 活跃memtable的内存占用
+	NumImmutables  int
+	ImmutablesSize int64
+	Levels         []LevelStats
+	Compaction     CompactionStats
+	MaxVersion     uint64 // 当前存储中最大的key版本号
+	WAL            WALStats
+	WriteStall     WriteStallStats
+	Amplification  AmplificationStats
+}
+
+// LevelStats 单个level的状态
+type LevelStats struct {
+	Level     int
+	NumTables int
+	Size      int64
+	StaleSize int64
+}
+
+// CompactionStats 打开以来的刷盘与合并计数
+type CompactionStats struct {
+	Flushes     int64
+	FlushBytes  int64 // 刷盘生成的sst大小
+	Compactions int64
+	Failed      int64
+	TablesIn    int64 // 参与合并的旧表数量
+	TablesOut   int64 // 合并生成的新表数量
+	BytesIn     int64
+	BytesOut    int64
+	Paused      bool // 后台合并是否被PauseCompaction暂停
+}
+
+// AmplificationStats 打开以来的写放大与当前的空间放大，用于调整合并策略
+type AmplificationStats struct {
+	IngestBytes     int64 // 写入的key与value字节数
+	TableWriteBytes int64 // 刷盘与合并写入sst的字节数
+	// LiveSize 有效数据大小的估计：去掉过期数据后最大的一层
+	// leveled合并下大部分数据最终位于最大的一层，其余各层多是对它的更新
+	LiveSize           int64
+	WriteAmplification float64 // TableWriteBytes / IngestBytes
+	SpaceAmplification float64 // 所有sst的总大小 / LiveSize
+}
+
+// WALStats 打开以来写wal的耗时，与写跳表的耗时分开统计，用于判断写入延迟是否受限于磁盘
+type WALStats struct {
+	AppendBytes   int64
+	AppendLatency LatencyStats
+	SyncLatency   LatencyStats // 只在开启SyncWrites时统计
+}
+
+// latencyBuckets 延迟直方图的桶数
+const latencyBuckets = 24
+
+// LatencyStats 延迟直方图
+// Buckets[0]统计小于1微秒的次数，Buckets[i]统计[2^(i-1), 2^i)微秒的次数，最后一个桶包含所有更长的耗时
+type LatencyStats struct {
+	Count   int64
+	Total   time.Duration
+	Max     time.Duration
+	Buckets []int64
+}
+
+// Mean 平均耗时
+func (ls LatencyStats) Mean() time.Duration {
+	if ls.Count == 0 {
+		return 0
+	}
+	return ls.Total / time.Duration(ls.Count)
+}
+
+// latencyHistogram 使用原子操作更新的延迟直方图
+type latencyHistogram struct {
+	count   int64
+	total   int64
+	max     int64
+	buckets [latencyBuckets]int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.total, int64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			break
+		}
+	}
+	i := bits.Len64(uint64(d.Microseconds()))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+}
+
+func (h *latencyHistogram) snapshot() LatencyStats {
+	ls := LatencyStats{
+		Count:   atomic.LoadInt64(&h.count),
+		Total:   time.Duration(atomic.LoadInt64(&h.total)),
+		Max:     time.Duration(atomic.LoadInt64(&h.max)),
+		Buckets: make([]int64, latencyBuckets),
+	}
+	for i := range h.buckets {
+		ls.Buckets[i] = atomic.LoadInt64(&h.buckets[i])
+	}
+	return ls
+}
+
+// walStats 写wal的累计统计
+type walStats struct {
+	appendBytes int64
+	append      latencyHistogram
+	sync        latencyHistogram
+}
+
+// compactStats 合并过程中累计的计数，均使用原子操作更新
+type compactStats struct {
+	flushes     int64
+	flushBytes  int64
+	compactions int64
+	failed      int64
+	tablesIn    int64
+	tablesOut   int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+func (cs *compactStats) record(tablesIn int, bytesIn int64, newTables []*table) {
+	atomic.AddInt64(&cs.compactions, 1)
+	atomic.AddInt64(&cs.tablesIn, int64(tablesIn))
+	atomic.AddInt64(&cs.tablesOut, int64(len(newTables)))
+	atomic.AddInt64(&cs.bytesIn, bytesIn)
+	atomic.AddInt64(&cs.bytesOut, tablesSize(newTables))
+}
+
+func tablesSize(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.Size()
+	}
+	return size
+}
+
+// Stats 返回当前存储状态的快照
+// 所有level的读锁会同时持有，保证各level的数据来自同一时刻，因此开销很小，可以频繁轮询
+func (lsm *LSM) Stats() Stats {
+	var s Stats
+	// 刷盘策略会在后台切换memtable，使用发布的快照而不是直接读取memTable与immutables
+	mts := lsm.memTables()
+	if len(mts) > 0 {
+		s.MemTableSize = mts[0].Size()
+		s.MaxVersion = atomic.LoadUint64(&mts[0].maxVersion)
+		mts = mts[1:]
+	}
+	s.NumImmutables = len(mts)
+	for _, imm := range mts {
+		s.ImmutablesSize += imm.Size()
+		if v := atomic.LoadUint64(&imm.maxVersion); v > s.MaxVersion {
+			s.MaxVersion = v
+		}
+	}
+
+	lm := lsm.levels
+	for _, lh := range lm.levels {
+		lh.RLock()
+	}
+	s.Levels = make([]LevelStats, 0, len(lm.levels))
+	var sstSize int64
+	for _, lh := range lm.levels {
+		sstSize += lh.totalSize
+		if live := lh.totalSize - lh.totalStaleSize; live > s.Amplification.LiveSize {
+			s.Amplification.LiveSize = live
+		}
+		s.Levels = append(s.Levels, LevelStats{
+			Level:     lh.levelNum,
+			NumTables: len(lh.tables),
+			Size:      lh.totalSize,
+			StaleSize: lh.totalStaleSize,
+		})
+		for _, t := range lh.tables {
+			if v := t.ss.Indexs().GetMaxVersion(); v > s.MaxVersion {
+				s.MaxVersion = v
+			}
+		}
+	}
+	for i := len(lm.levels) - 1; i >= 0; i-- {
+		lm.levels[i].RUnlock()
+	}
+
+	cs := &lm.compactStats
+	s.Compaction = CompactionStats{
+		Flushes:     atomic.LoadInt64(&cs.flushes),
+		FlushBytes:  atomic.LoadInt64(&cs.flushBytes),
+		Compactions: atomic.LoadInt64(&cs.compactions),
+		Failed:      atomic.LoadInt64(&cs.failed),
+		TablesIn:    atomic.LoadInt64(&cs.tablesIn),
+		TablesOut:   atomic.LoadInt64(&cs.tablesOut),
+		BytesIn:     atomic.LoadInt64(&cs.bytesIn),
+		BytesOut:    atomic.LoadInt64(&cs.bytesOut),
+		Paused:      lsm.pause.isPaused(),
+	}
+	s.WAL = WALStats{
+		AppendBytes:   atomic.LoadInt64(&lsm.walStats.appendBytes),
+		AppendLatency: lsm.walStats.append.snapshot(),
+		SyncLatency:   lsm.walStats.sync.snapshot(),
+	}
+	s.WriteStall = lsm.writeStallStats()
+
+	amp := &s.Amplification
+	amp.IngestBytes = atomic.LoadInt64(&lsm.ingestBytes)
+	amp.TableWriteBytes = s.Compaction.FlushBytes + s.Compaction.BytesOut
+	if amp.IngestBytes > 0 {
+		amp.WriteAmplification = float64(amp.TableWriteBytes) / float64(amp.IngestBytes)
+	}
+	if amp.LiveSize > 0 {
+		amp.SpaceAmplification = float64(sstSize) / float64(amp.LiveSize)
+	}
+	return s
+}
+
+// TableInfo 一个sst的基本信息
+type TableInfo struct {
+	ID     uint64
+	Level  int
+	Size   int64
+	MinKey []byte // 带版本号的最小与最大key
+	MaxKey []byte
+	// CreatedAt 创建时间，精确到秒，旧的manifest没有记录时为零值
+	CreatedAt time.Time
+}
+
+// Age 距离创建过去的时间，创建时间未知时为0
+func (ti TableInfo) Age() time.Duration {
+	if ti.CreatedAt.IsZero() {
+		return 0
+	}
+	return time.Since(ti.CreatedAt)
+}
+
+// Tables 按level从小到大返回所有sst，每一层内的顺序与该层的查找顺序相同
+func (lsm *LSM) Tables() []TableInfo {
+	var infos []TableInfo
+	for _, lh := range lsm.levels.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			info := TableInfo{
+				ID:     t.fid,
+				Level:  lh.levelNum,
+				Size:   t.Size(),
+				MinKey: utils.Copy(t.ss.MinKey()),
+				MaxKey: utils.Copy(t.ss.MaxKey()),
+			}
+			if t.createdAt != 0 {
+				info.CreatedAt = time.Unix(int64(t.createdAt), 0)
+			}
+			infos = append(infos, info)
+		}
+		lh.RUnlock()
+	}
+	return infos
+}
@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// swapGate 读写请求与迭代器在执行期间登记，SwapFrom等到登记的请求全部结束后才替换数据
+// SwapFrom开始等待后新的请求阻塞直到替换完成，与sync.RWMutex一样不能重入：
+// 持有迭代器的协程再调用Get等接口时，如果恰好有SwapFrom在等待就会死锁
+// 没有SwapFrom时登记与离开各是一次原子操作，只有等待替换时才使用mu
+type swapGate struct {
+	active  int32      // 登记的请求数量
+	pending int32      // 等待或正在替换的SwapFrom数量
+	swap    sync.Mutex // 同时只有一个SwapFrom执行
+	mu      sync.Mutex
+	cond    *sync.Cond
+}
+
+// wait 在持有mu时等待状态变化
+func (g *swapGate) wait() {
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+	g.cond.Wait()
+}
+
+func (g *swapGate) broadcast() {
+	g.mu.Lock()
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+	g.mu.Unlock()
+}
+
+// enter 先登记再检查pending，与lock先增加pending再检查active对应，两者至少有一方能看到对方
+func (g *swapGate) enter() {
+	for {
+		atomic.AddInt32(&g.active, 1)
+		if atomic.LoadInt32(&g.pending) == 0 {
+			return
+		}
+		// 有SwapFrom在等待，撤销登记，替换完成后重试
+		g.leave()
+		g.mu.Lock()
+		for atomic.LoadInt32(&g.pending) > 0 {
+			g.wait()
+		}
+		g.mu.Unlock()
+	}
+}
+
+// join 为已经登记的请求派生出的请求登记，不等待pending的SwapFrom：原来的请求结束之前替换不会开始
+func (g *swapGate) join() {
+	atomic.AddInt32(&g.active, 1)
+}
+
+func (g *swapGate) leave() {
+	if atomic.AddInt32(&g.active, -1) == 0 && atomic.LoadInt32(&g.pending) > 0 {
+		g.broadcast()
+	}
+}
+
+// lock 阻止新的请求进入，等待所有登记的请求结束
+func (g *swapGate) lock() {
+	atomic.AddInt32(&g.pending, 1)
+	g.swap.Lock()
+	g.mu.Lock()
+	for atomic.LoadInt32(&g.active) != 0 {
+		g.wait()
+	}
+	g.mu.Unlock()
+}
+
+func (g *swapGate) unlock() {
+	g.swap.Unlock()
+	atomic.AddInt32(&g.pending, -1)
+	g.broadcast()
+}
+
+// swapOldSuffix 替换时当前WorkDir被重命名为WorkDir加上这个后缀，新数据打开后删除
+const swapOldSuffix = ".swap-old"
+
+// SwapFrom 用stagingDir中已经关闭的存储替换当前的全部数据，成功后stagingDir不再存在
+// 等待正在执行的读写与未关闭的迭代器结束后替换，期间新的请求阻塞，因此每个请求看到的要么全是旧数据要么全是新数据
+// 当前的数据，包括内存表中尚未刷盘的写入全部丢弃；stagingDir必须与WorkDir位于同一个文件系统，并使用相同的SSTableLayout
+// 持有迭代器的协程不能调用SwapFrom，也不能在有SwapFrom等待时调用其他读写接口，否则会死锁
+// 重新打开时的磁盘错误与Open一样会panic
+func (lsm *LSM) SwapFrom(stagingDir string) error {
+	if err := lsm.IsFrozen(); err != nil {
+		return err
+	}
+	workDir := lsm.option.WorkDir
+	if _, err := os.Stat(filepath.Join(stagingDir, utils.ManifestFilename)); err != nil {
+		return errors.Wrapf(err, "staging dir %s", stagingDir)
+	}
+	oldDir := filepath.Clean(workDir) + swapOldSuffix
+	// 上一次替换在删除旧数据之前崩溃时会留下oldDir
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+
+	lsm.gate.lock()
+	defer lsm.gate.unlock()
+	lsm.closer.Close()
+	lsm.writeLock.Lock()
+	defer lsm.unlockWrite()
+	if err := lsm.release(); err != nil {
+		return lsm.freeze(errors.Wrap(err, "swap: close current data"))
+	}
+
+	err := os.Rename(workDir, oldDir)
+	if err == nil {
+		if err = os.Rename(stagingDir, workDir); err != nil {
+			// 放回原来的数据，继续使用旧数据
+			if rerr := os.Rename(oldDir, workDir); rerr != nil {
+				return lsm.freeze(errors.Wrapf(rerr, "swap: restore %s after %v", workDir, err))
+			}
+		}
+	}
+	if err == nil {
+		err = utils.SyncDir(filepath.Dir(filepath.Clean(workDir)))
+	}
+	lsm.flushEvents = nil
+	if lerr := lsm.load(); lerr != nil {
+		return lsm.freeze(errors.Wrapf(lerr, "swap: load %s", workDir))
+	}
+	if lsm.compacting {
+		lsm.StartCompacter()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "swap %s into %s", stagingDir, workDir)
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// release 关闭内存表与所有sst，保留wal与文件，之后只能重新load
+func (lsm *LSM) release() error {
+	for _, mt := range append(lsm.immutables, lsm.memTable) {
+		if err := mt.release(); err != nil {
+			return err
+		}
+	}
+	return lsm.levels.close()
+}
@@ -0,0 +1,41 @@
+package lsm
+
+import (
+	"lsm/utils"
+	"path/filepath"
+	"time"
+)
+
+// trashDir 开启TrashRetention时被删除的sst与wal移动到的目录，没有开启时返回空字符串
+func (opt *Options) trashDir() string {
+	if opt.TrashRetention <= 0 {
+		return ""
+	}
+	return filepath.Join(opt.WorkDir, utils.TrashDirname)
+}
+
+// runTrashPurge 周期性地删除回收站中超过TrashRetention的文件，打开时先清理一次
+func (lsm *LSM) runTrashPurge() {
+	defer lsm.closer.Done()
+	retention := lsm.option.TrashRetention
+	lsm.purgeTrash()
+	ticker := time.NewTicker(retention / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lsm.purgeTrash()
+		case <-lsm.closer.Wait():
+			return
+		}
+	}
+}
+
+func (lsm *LSM) purgeTrash() {
+	n, err := utils.PurgeTrash(lsm.option.trashDir(), time.Now().Add(-lsm.option.TrashRetention))
+	if err != nil {
+		lsm.option.Logger.Warnf("purge trash: %v", err)
+	} else if n > 0 {
+		lsm.option.Logger.Infof("purged %d files from trash", n)
+	}
+}
@@ -0,0 +1,67 @@
+package lsm
+
+import "time"
+
+// runTTLCompacter 每隔TTLCompactionInterval检查各层的sst，合并含有已过期entry的sst以回收空间
+// 只根据manifest中记录的过期时间范围判断，不需要读取sst的内容
+func (lm *levelManager) runTTLCompacter() {
+	defer lm.lsm.closer.Done()
+	ticker := time.NewTicker(lm.opt.TTLCompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lm.lsm.pause.runUnlessPaused(lm.compactExpired)
+		case <-lm.lsm.closer.Wait():
+			return
+		}
+	}
+}
+
+// compactExpired 依次合并每一个含有已过期entry、且合并后能丢弃这些entry的sst
+func (lm *levelManager) compactExpired() {
+	for level := 0; level < lm.opt.MaxLevelNum; level++ {
+		if lm.lsm.IsFrozen() != nil {
+			return
+		}
+		ids := lm.expiredTables(level)
+		if len(ids) == 0 {
+			continue
+		}
+		if err := lm.compactTables(ids); err != nil {
+			lm.opt.Logger.Warnf("ttl compaction of tables %v in level %d: %v", ids, level, err)
+		}
+	}
+}
+
+// expiredTables 返回level中需要为过期entry合并的sst
+// L0中还需要选中比它更旧的sst，其他层每次只合并一个sst
+// 合并的目标层之下还有重叠的数据时过期的entry不能丢弃，否则旧版本会重新可见，这样的sst不选
+func (lm *levelManager) expiredTables(level int) []uint64 {
+	lh := lm.levels[level]
+	target := level + 1
+	if level == 0 {
+		target = lm.levelTargets().baseLevel + 1
+	}
+	now := uint64(time.Now().Unix())
+	lh.RLock()
+	tables := append([]*table{}, lh.tables...)
+	lh.RUnlock()
+	for i, t := range tables {
+		if t.minExpiresAt == 0 || t.minExpiresAt > now {
+			continue
+		}
+		if lm.checkOverlap([]*table{t}, target) {
+			continue
+		}
+		if level > 0 {
+			return []uint64{t.fid}
+		}
+		ids := make([]uint64, 0, i+1)
+		for _, old := range tables[:i+1] {
+			ids = append(ids, old.fid)
+		}
+		return ids
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package lsm
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lsm/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retainedWalExt 保留的wal压缩后的后缀
+const retainedWalExt = walFileExt + ".z"
+
+// retainedWalDir 保留刷盘后的wal的目录
+func (opt *Options) retainedWalDir() string {
+	return filepath.Join(opt.WorkDir, utils.RetainedWalDirname)
+}
+
+// closeFlushed 刷盘完成后关闭内存表，开启WalRetainAfterFlush时先把wal压缩保存到retainedWalDir
+// 保存失败只记录日志，wal中的数据已经在sst中
+func (m *memTable) closeFlushed() error {
+	if m.lsm.option.WalRetainAfterFlush > 0 && m.entries > 0 {
+		if err := m.lsm.option.retainWal(m.wal.Fid(), m.wal.Bytes()); err != nil {
+			m.lsm.option.Logger.Warnf("retain wal %d: %v", m.wal.Fid(), err)
+		}
+	}
+	return m.close()
+}
+
+// retainWal 将wal的内容压缩写入临时文件，sync后改名，保留的文件不会只写了一半
+// 文件的修改时间作为开始保留的时间
+func (opt *Options) retainWal(fid uint64, data []byte) error {
+	dir := opt.retainedWalDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%05d%s", fid, retainedWalExt))
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, utils.DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	err = writeCompressed(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if opt.DisableSyncDir {
+		return nil
+	}
+	return utils.SyncDir(dir)
+}
+
+func writeCompressed(f *os.File, data []byte) error {
+	w, err := flate.NewWriter(f, flate.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// restoreRetainedWals 将保留的wal按原来的fid顺序解压回WorkDir，依次分配大于maxFid的新fid，返回这些fid
+// 原来的fid可能已经被刷盘生成的sst使用；解压后的wal sync之后才删除保留的文件
+func (lsm *LSM) restoreRetainedWals(maxFid *uint64) []uint64 {
+	dir := lsm.option.retainedWalDir()
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	utils.Panic(err)
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), retainedWalExt) {
+			names = append(names, info.Name())
+		}
+	}
+	// 文件名是补零的fid，按名字排序即按fid排序
+	sort.Strings(names)
+	var fids []uint64
+	for _, name := range names {
+		*maxFid++
+		fid := *maxFid
+		if err := restoreWal(filepath.Join(dir, name), filePath(lsm.option.WorkDir, fid)); err != nil {
+			utils.Panic(errors.Wrapf(err, "restore retained wal %s", name))
+		}
+		lsm.option.Logger.Infof("restored retained wal %s as wal %d", name, fid)
+		fids = append(fids, fid)
+		utils.Panic(os.Remove(filepath.Join(dir, name)))
+	}
+	if len(fids) > 0 && !lsm.option.DisableSyncDir {
+		utils.Panic(utils.SyncDir(lsm.option.WorkDir))
+	}
+	return fids
+}
+
+func restoreWal(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_EXCL, utils.DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, flate.NewReader(in))
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+	return err
+}
+
+// runRetainedWalPurge 周期性地删除保留超过WalRetainAfterFlush的wal，打开时先清理一次
+func (lsm *LSM) runRetainedWalPurge() {
+	defer lsm.closer.Done()
+	retention := lsm.option.WalRetainAfterFlush
+	lsm.purgeRetainedWals()
+	ticker := time.NewTicker(retention / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lsm.purgeRetainedWals()
+		case <-lsm.closer.Wait():
+			return
+		}
+	}
+}
+
+func (lsm *LSM) purgeRetainedWals() {
+	n, err := utils.PurgeTrash(lsm.option.retainedWalDir(), time.Now().Add(-lsm.option.WalRetainAfterFlush))
+	if err != nil {
+		lsm.option.Logger.Warnf("purge retained wals: %v", err)
+	} else if n > 0 {
+		lsm.option.Logger.Infof("purged %d retained wals", n)
+	}
+}
@@ -0,0 +1,124 @@
+package lsm
+
+import (
+	"bytes"
+	"io"
+	"lsm/utils"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// loadZoneBlock ScanZone读取sst中block的入口，测试时替换它来记录读取了哪些block
+var loadZoneBlock = (*table).block
+
+// ScanZone 返回ZoneMapExtractor提取值在[lo, hi]之间的key的最新版本，按user key升序排列
+// 内存表全部扫描；sst中zone范围与[lo, hi]不相交的block直接跳过，没有记录zone map的sst读取全部block
+// 候选的entry还要与key的最新版本比较，最新版本不在范围内或已过期的key不返回
+func (lsm *LSM) ScanZone(lo, hi []byte) ([]*utils.Entry, error) {
+	if lsm.option.ZoneMapExtractor == nil {
+		return nil, utils.ErrNoZoneMap
+	}
+	lsm.gate.enter()
+	defer lsm.gate.leave()
+	lsm.writeLock.Lock()
+	mts := append([]*memTable{lsm.memTable}, lsm.immutables...)
+	lsm.writeLock.Unlock()
+
+	// 每个user key只保留版本号最大的候选
+	candidates := make(map[string]*utils.Entry)
+	collect := func(e *utils.Entry) {
+		if !lsm.option.acceptKey(e.Key) {
+			return
+		}
+		v := lsm.option.zoneValue(e)
+		if v == nil || bytes.Compare(v, lo) < 0 || bytes.Compare(v, hi) > 0 {
+			return
+		}
+		userKey := string(utils.ParseKey(e.Key))
+		if old, ok := candidates[userKey]; ok && utils.ParseTs(old.Key) >= utils.ParseTs(e.Key) {
+			return
+		}
+		candidates[userKey] = &utils.Entry{
+			Key:       utils.Copy(e.Key),
+			Value:     utils.Copy(e.Value),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+			Version:   utils.ParseTs(e.Key),
+		}
+	}
+	for _, mt := range mts {
+		iter := mt.NewIterator(&utils.Options{IsAsc: true})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			collect(iter.Item().Entry())
+		}
+		_ = iter.Close()
+	}
+	for _, lh := range lsm.levels.levels {
+		lh.RLock()
+		tables := append([]*table{}, lh.tables...)
+		for _, t := range tables {
+			t.IncrRef()
+		}
+		lh.RUnlock()
+		var err error
+		for _, t := range tables {
+			if err == nil {
+				err = t.scanZone(lo, hi, collect)
+			}
+			_ = t.DecrRef()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]*utils.Entry, 0, len(candidates))
+	for userKey, e := range candidates {
+		if isDeletedOrExpired(e.Meta, e.ExpiresAt) {
+			continue
+		}
+		latest, ok, err := lsm.version([]byte(userKey))
+		if err != nil {
+			return nil, err
+		}
+		if !ok || latest != e.Version {
+			continue
+		}
+		if err := e.Decompress(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return utils.CompareKeys(entries[i].Key, entries[j].Key) < 0
+	})
+	return entries, nil
+}
+
+// scanZone 把t中zone范围与[lo, hi]相交的block里的entry交给fn
+func (t *table) scanZone(lo, hi []byte, fn func(e *utils.Entry)) error {
+	idx := t.ss.Indexs()
+	bi := t.newBlockIterator(false)
+	for i, ko := range idx.GetOffsets() {
+		if idx.ZoneMap && (!ko.HasZone || bytes.Compare(ko.ZoneMax, lo) < 0 || bytes.Compare(ko.ZoneMin, hi) > 0) {
+			continue
+		}
+		b, err := loadZoneBlock(t, i)
+		if err != nil {
+			if err = errors.Wrapf(err, "scan zone of table %d block %d", t.fid, i); !t.lm.ignoreReadError(err) {
+				return err
+			}
+			continue
+		}
+		bi.blockID = i
+		bi.setBlock(b)
+		for bi.seekToFirst(); bi.Valid(); bi.Next() {
+			fn(bi.Item().Entry())
+		}
+		if err := bi.Error(); err != nil && err != io.EOF {
+			return errors.Wrapf(err, "scan zone of table %d block %d", t.fid, i)
+		}
+	}
+	return nil
+}
@@ -25,18 +25,21 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 type ManifestChange_Operation int32
 
 const (
-	ManifestChange_CREATE ManifestChange_Operation = 0
-	ManifestChange_DELETE ManifestChange_Operation = 1
+	ManifestChange_CREATE   ManifestChange_Operation = 0
+	ManifestChange_DELETE   ManifestChange_Operation = 1
+	ManifestChange_SET_META ManifestChange_Operation = 2
 )
 
 var ManifestChange_Operation_name = map[int32]string{
 	0: "CREATE",
 	1: "DELETE",
+	2: "SET_META",
 }
 
 var ManifestChange_Operation_value = map[string]int32{
-	"CREATE": 0,
-	"DELETE": 1,
+	"CREATE":   0,
+	"DELETE":   1,
+	"SET_META": 2,
 }
 
 func (x ManifestChange_Operation) String() string {
@@ -192,10 +195,14 @@ func (m *KVList) GetKv() []*KV {
 
 type ManifestChangeSet struct {
 	// A set of changes that are applied atomically.
-	Changes              []*ManifestChange `protobuf:"bytes,1,rep,name=changes,proto3" json:"changes,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
-	XXX_unrecognized     []byte            `json:"-"`
-	XXX_sizecache        int32             `json:"-"`
+	Changes []*ManifestChange `protobuf:"bytes,1,rep,name=changes,proto3" json:"changes,omitempty"`
+	// 写入这个change set时已经分配出去的最大版本号，0表示没有记录
+	MaxVersion uint64 `protobuf:"varint,2,opt,name=maxVersion,proto3" json:"maxVersion,omitempty"`
+	// 这个change set刷盘的内存表的wal id，id不大于它的wal中的数据都已经在sst中，0表示没有记录
+	FlushedWal           uint64   `protobuf:"varint,3,opt,name=flushedWal,proto3" json:"flushedWal,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *ManifestChangeSet) Reset()         { *m = ManifestChangeSet{} }
@@ -238,11 +245,30 @@ func (m *ManifestChangeSet) GetChanges() []*ManifestChange {
 	return nil
 }
 
+func (m *ManifestChangeSet) GetMaxVersion() uint64 {
+	if m != nil {
+		return m.MaxVersion
+	}
+	return 0
+}
+
+func (m *ManifestChangeSet) GetFlushedWal() uint64 {
+	if m != nil {
+		return m.FlushedWal
+	}
+	return 0
+}
+
 type ManifestChange struct {
 	Id                   uint64                   `protobuf:"varint,1,opt,name=Id,proto3" json:"Id,omitempty"`
 	Op                   ManifestChange_Operation `protobuf:"varint,2,opt,name=Op,proto3,enum=pb.ManifestChange_Operation" json:"Op,omitempty"`
 	Level                uint32                   `protobuf:"varint,3,opt,name=Level,proto3" json:"Level,omitempty"`
 	Checksum             []byte                   `protobuf:"bytes,4,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
+	Key                  []byte                   `protobuf:"bytes,5,opt,name=Key,proto3" json:"Key,omitempty"`
+	Value                []byte                   `protobuf:"bytes,6,opt,name=Value,proto3" json:"Value,omitempty"`
+	MinExpiresAt         uint64                   `protobuf:"varint,7,opt,name=MinExpiresAt,proto3" json:"MinExpiresAt,omitempty"`
+	MaxExpiresAt         uint64                   `protobuf:"varint,8,opt,name=MaxExpiresAt,proto3" json:"MaxExpiresAt,omitempty"`
+	CreatedAt            uint64                   `protobuf:"varint,9,opt,name=CreatedAt,proto3" json:"CreatedAt,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}                 `json:"-"`
 	XXX_unrecognized     []byte                   `json:"-"`
 	XXX_sizecache        int32                    `json:"-"`
@@ -309,12 +335,53 @@ func (m *ManifestChange) GetChecksum() []byte {
 	return nil
 }
 
+func (m *ManifestChange) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *ManifestChange) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *ManifestChange) GetMinExpiresAt() uint64 {
+	if m != nil {
+		return m.MinExpiresAt
+	}
+	return 0
+}
+
+func (m *ManifestChange) GetMaxExpiresAt() uint64 {
+	if m != nil {
+		return m.MaxExpiresAt
+	}
+	return 0
+}
+
+func (m *ManifestChange) GetCreatedAt() uint64 {
+	if m != nil {
+		return m.CreatedAt
+	}
+	return 0
+}
+
 type TableIndex struct {
 	Offsets              []*BlockOffset `protobuf:"bytes,1,rep,name=offsets,proto3" json:"offsets,omitempty"`
 	BloomFilter          []byte         `protobuf:"bytes,2,opt,name=bloomFilter,proto3" json:"bloomFilter,omitempty"`
 	MaxVersion           uint64         `protobuf:"varint,3,opt,name=maxVersion,proto3" json:"maxVersion,omitempty"`
 	KeyCount             uint32         `protobuf:"varint,4,opt,name=keyCount,proto3" json:"keyCount,omitempty"`
 	StaleDataSize        uint32         `protobuf:"varint,5,opt,name=staleDataSize,proto3" json:"staleDataSize,omitempty"`
+	BloomHash            uint32         `protobuf:"varint,6,opt,name=bloomHash,proto3" json:"bloomHash,omitempty"`
+	ValueMeta            bool           `protobuf:"varint,7,opt,name=valueMeta,proto3" json:"valueMeta,omitempty"`
+	ZoneMap              bool           `protobuf:"varint,8,opt,name=zoneMap,proto3" json:"zoneMap,omitempty"`
+	ValueAlign           uint32         `protobuf:"varint,9,opt,name=valueAlign,proto3" json:"valueAlign,omitempty"`
+	VarintTs             bool           `protobuf:"varint,10,opt,name=varintTs,proto3" json:"varintTs,omitempty"`
+	Encrypted            bool           `protobuf:"varint,11,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
 	XXX_unrecognized     []byte         `json:"-"`
 	XXX_sizecache        int32          `json:"-"`
@@ -388,10 +455,55 @@ func (m *TableIndex) GetStaleDataSize() uint32 {
 	return 0
 }
 
+func (m *TableIndex) GetBloomHash() uint32 {
+	if m != nil {
+		return m.BloomHash
+	}
+	return 0
+}
+
+func (m *TableIndex) GetValueMeta() bool {
+	if m != nil {
+		return m.ValueMeta
+	}
+	return false
+}
+
+func (m *TableIndex) GetZoneMap() bool {
+	if m != nil {
+		return m.ZoneMap
+	}
+	return false
+}
+
+func (m *TableIndex) GetValueAlign() uint32 {
+	if m != nil {
+		return m.ValueAlign
+	}
+	return 0
+}
+
+func (m *TableIndex) GetVarintTs() bool {
+	if m != nil {
+		return m.VarintTs
+	}
+	return false
+}
+
+func (m *TableIndex) GetEncrypted() bool {
+	if m != nil {
+		return m.Encrypted
+	}
+	return false
+}
+
 type BlockOffset struct {
 	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
 	Offset               uint32   `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
 	Len                  uint32   `protobuf:"varint,3,opt,name=len,proto3" json:"len,omitempty"`
+	ZoneMin              []byte   `protobuf:"bytes,4,opt,name=zoneMin,proto3" json:"zoneMin,omitempty"`
+	ZoneMax              []byte   `protobuf:"bytes,5,opt,name=zoneMax,proto3" json:"zoneMax,omitempty"`
+	HasZone              bool     `protobuf:"varint,6,opt,name=hasZone,proto3" json:"hasZone,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -451,6 +563,27 @@ func (m *BlockOffset) GetLen() uint32 {
 	return 0
 }
 
+func (m *BlockOffset) GetZoneMin() []byte {
+	if m != nil {
+		return m.ZoneMin
+	}
+	return nil
+}
+
+func (m *BlockOffset) GetZoneMax() []byte {
+	if m != nil {
+		return m.ZoneMax
+	}
+	return nil
+}
+
+func (m *BlockOffset) GetHasZone() bool {
+	if m != nil {
+		return m.HasZone
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterEnum("pb.ManifestChange_Operation", ManifestChange_Operation_name, ManifestChange_Operation_value)
 	proto.RegisterType((*KV)(nil), "pb.KV")
@@ -464,38 +597,50 @@ func init() {
 func init() { proto.RegisterFile("pb.proto", fileDescriptor_f80abaa17e25ccc8) }
 
 var fileDescriptor_f80abaa17e25ccc8 = []byte{
-	// 485 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x52, 0x5d, 0x6e, 0xda, 0x4c,
-	0x14, 0xcd, 0x18, 0x62, 0xe0, 0x12, 0xf3, 0xf1, 0x8d, 0xaa, 0xc8, 0xea, 0x0f, 0xb2, 0xdc, 0x3e,
-	0x50, 0x29, 0xe2, 0x21, 0x5d, 0x01, 0x21, 0x54, 0xb2, 0x20, 0x42, 0x9a, 0x20, 0x5e, 0xd1, 0x18,
-	0x5f, 0x1a, 0xcb, 0xbf, 0xf2, 0x0c, 0x16, 0xe9, 0x4a, 0xba, 0x81, 0xae, 0xa0, 0x8f, 0xdd, 0x40,
-	0x1f, 0xbb, 0x84, 0x8a, 0x6e, 0xa4, 0x9a, 0xc1, 0x20, 0x50, 0xfb, 0x76, 0xcf, 0xb9, 0x77, 0xce,
-	0x9c, 0x39, 0x77, 0xa0, 0x99, 0xfb, 0x83, 0xbc, 0xc8, 0x64, 0x46, 0x8d, 0xdc, 0x77, 0xbf, 0x11,
-	0x30, 0x26, 0x0b, 0xda, 0x85, 0x5a, 0x84, 0xcf, 0x36, 0x71, 0x48, 0xff, 0x8a, 0xa9, 0x92, 0xbe,
-	0x80, 0xcb, 0x92, 0xc7, 0x1b, 0xb4, 0x0d, 0xcd, 0xed, 0x01, 0x7d, 0x05, 0xad, 0x8d, 0xc0, 0x62,
-	0x99, 0xa0, 0xe4, 0x76, 0x4d, 0x77, 0x9a, 0x8a, 0x78, 0x40, 0xc9, 0xa9, 0x0d, 0x8d, 0x12, 0x0b,
-	0x11, 0x66, 0xa9, 0x5d, 0x77, 0x48, 0xbf, 0xce, 0x0e, 0x90, 0xbe, 0x01, 0xc0, 0x6d, 0x1e, 0x16,
-	0x28, 0x96, 0x5c, 0xda, 0x97, 0xba, 0xd9, 0xaa, 0x98, 0xa1, 0xa4, 0x14, 0xea, 0x5a, 0xd0, 0xd4,
-	0x82, 0xba, 0x56, 0x37, 0x09, 0x59, 0x20, 0x4f, 0x96, 0x61, 0x60, 0x83, 0x43, 0xfa, 0x16, 0x6b,
-	0xee, 0x09, 0x2f, 0x70, 0x1d, 0x30, 0x27, 0x8b, 0x69, 0x28, 0x24, 0xbd, 0x06, 0x23, 0x2a, 0x6d,
-	0xe2, 0xd4, 0xfa, 0xed, 0x5b, 0x73, 0x90, 0xfb, 0x83, 0xc9, 0x82, 0x19, 0x51, 0xe9, 0x0e, 0xe1,
-	0xff, 0x07, 0x9e, 0x86, 0x6b, 0x14, 0x72, 0xf4, 0xc4, 0xd3, 0x4f, 0xf8, 0x88, 0x92, 0xde, 0x40,
-	0x63, 0xa5, 0x81, 0xa8, 0x4e, 0x50, 0x75, 0xe2, 0x7c, 0x8e, 0x1d, 0x46, 0xdc, 0xaf, 0x04, 0x3a,
-	0xe7, 0x3d, 0xda, 0x01, 0xc3, 0x0b, 0x74, 0x4a, 0x75, 0x66, 0x78, 0x01, 0xbd, 0x01, 0x63, 0x96,
-	0xeb, 0x84, 0x3a, 0xb7, 0xaf, 0xff, 0xd6, 0x1a, 0xcc, 0x72, 0x2c, 0xb8, 0x0c, 0xb3, 0x94, 0x19,
-	0xb3, 0x5c, 0x45, 0x3a, 0xc5, 0x12, 0x63, 0x1d, 0x9c, 0xc5, 0xf6, 0x80, 0xbe, 0x84, 0xe6, 0xe8,
-	0x09, 0x57, 0x91, 0xd8, 0x24, 0x3a, 0xb6, 0x2b, 0x76, 0xc4, 0xee, 0x5b, 0x68, 0x1d, 0x25, 0x28,
-	0x80, 0x39, 0x62, 0xe3, 0xe1, 0x7c, 0xdc, 0xbd, 0x50, 0xf5, 0xfd, 0x78, 0x3a, 0x9e, 0x8f, 0xbb,
-	0xc4, 0xfd, 0x4e, 0x00, 0xe6, 0xdc, 0x8f, 0xd1, 0x4b, 0x03, 0xdc, 0xd2, 0xf7, 0xd0, 0xc8, 0xd6,
-	0x6b, 0x81, 0xf2, 0xf0, 0xc8, 0xff, 0x94, 0xb1, 0xbb, 0x38, 0x5b, 0x45, 0x33, 0xcd, 0xb3, 0x43,
-	0x9f, 0x3a, 0xd0, 0xf6, 0xe3, 0x2c, 0x4b, 0x3e, 0x86, 0xb1, 0xc4, 0xa2, 0xda, 0xf4, 0x29, 0x45,
-	0x7b, 0x00, 0x09, 0xdf, 0x2e, 0xaa, 0xad, 0xd6, 0xf4, 0xc3, 0x4f, 0x18, 0x65, 0x3e, 0xc2, 0xe7,
-	0x51, 0xb6, 0x49, 0xa5, 0x36, 0x6f, 0xb1, 0x23, 0xa6, 0xef, 0xc0, 0x12, 0x92, 0xc7, 0x78, 0xcf,
-	0x25, 0x7f, 0x0c, 0x3f, 0xa3, 0xde, 0xbb, 0xc5, 0xce, 0x49, 0xd7, 0x83, 0xf6, 0x89, 0xb7, 0x7f,
-	0x7c, 0xc4, 0x6b, 0x30, 0xf7, 0x7e, 0xb5, 0x3f, 0x8b, 0x55, 0x48, 0x4d, 0xc6, 0x98, 0x56, 0x59,
-	0xaa, 0xf2, 0xae, 0xfb, 0x63, 0xd7, 0x23, 0x3f, 0x77, 0x3d, 0xf2, 0x6b, 0xd7, 0x23, 0x5f, 0x7e,
-	0xf7, 0x2e, 0x7c, 0x53, 0x7f, 0xf4, 0x0f, 0x7f, 0x02, 0x00, 0x00, 0xff, 0xff, 0x9e, 0xf4, 0xb3,
-	0x68, 0xf4, 0x02, 0x00, 0x00,
+	// 678 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x54, 0xdd, 0x6e, 0xda, 0x4a,
+	0x10, 0x8e, 0x0d, 0x01, 0x33, 0xe0, 0x1c, 0xce, 0xea, 0x28, 0xb2, 0x72, 0x52, 0x84, 0xac, 0x5e,
+	0x50, 0x29, 0x42, 0x6a, 0xfa, 0x04, 0x84, 0xb8, 0x2a, 0x22, 0x08, 0x69, 0x83, 0xa8, 0xd4, 0x1b,
+	0xb4, 0xe0, 0x21, 0x58, 0x18, 0xdb, 0xf2, 0x2e, 0x08, 0x72, 0xd7, 0xa7, 0x68, 0xdf, 0xa3, 0x4f,
+	0xd0, 0xbb, 0x5e, 0xf6, 0x11, 0xaa, 0xf4, 0xb2, 0x2f, 0x51, 0xed, 0xfa, 0x07, 0x68, 0x7a, 0x37,
+	0xdf, 0x37, 0xe3, 0x99, 0xd9, 0x6f, 0x66, 0x0c, 0x46, 0x34, 0x6d, 0x47, 0x71, 0x28, 0x42, 0xa2,
+	0x47, 0x53, 0xfb, 0x8b, 0x06, 0x7a, 0x7f, 0x4c, 0xea, 0x50, 0x58, 0xe2, 0xce, 0xd2, 0x9a, 0x5a,
+	0xab, 0x46, 0xa5, 0x49, 0xfe, 0x83, 0xd3, 0x0d, 0xf3, 0xd7, 0x68, 0xe9, 0x8a, 0x4b, 0x00, 0xf9,
+	0x1f, 0x2a, 0x6b, 0x8e, 0xf1, 0x64, 0x85, 0x82, 0x59, 0x05, 0xe5, 0x31, 0x24, 0x31, 0x40, 0xc1,
+	0x88, 0x05, 0xe5, 0x0d, 0xc6, 0xdc, 0x0b, 0x03, 0xab, 0xd8, 0xd4, 0x5a, 0x45, 0x9a, 0x41, 0xf2,
+	0x02, 0x00, 0xb7, 0x91, 0x17, 0x23, 0x9f, 0x30, 0x61, 0x9d, 0x2a, 0x67, 0x25, 0x65, 0x3a, 0x82,
+	0x10, 0x28, 0xaa, 0x84, 0x25, 0x95, 0x50, 0xd9, 0xb2, 0x12, 0x17, 0x31, 0xb2, 0xd5, 0xc4, 0x73,
+	0x2d, 0x68, 0x6a, 0x2d, 0x93, 0x1a, 0x09, 0xd1, 0x73, 0xed, 0x26, 0x94, 0xfa, 0xe3, 0x3b, 0x8f,
+	0x0b, 0x72, 0x0e, 0xfa, 0x72, 0x63, 0x69, 0xcd, 0x42, 0xab, 0x7a, 0x5d, 0x6a, 0x47, 0xd3, 0x76,
+	0x7f, 0x4c, 0xf5, 0xe5, 0xc6, 0xfe, 0xa8, 0xc1, 0xbf, 0x03, 0x16, 0x78, 0x73, 0xe4, 0xa2, 0xbb,
+	0x60, 0xc1, 0x03, 0xde, 0xa3, 0x20, 0x57, 0x50, 0x9e, 0x29, 0xc0, 0xd3, 0x4f, 0x88, 0xfc, 0xe4,
+	0x38, 0x8e, 0x66, 0x21, 0xa4, 0x01, 0xb0, 0x62, 0xdb, 0x71, 0xfa, 0x24, 0x5d, 0x75, 0x7d, 0xc0,
+	0x48, 0xff, 0xdc, 0x5f, 0xf3, 0x05, 0xba, 0xef, 0x99, 0xaf, 0xd4, 0x28, 0xd2, 0x03, 0xc6, 0xfe,
+	0xaa, 0xc3, 0xd9, 0x71, 0x6e, 0x72, 0x06, 0x7a, 0xcf, 0x55, 0x32, 0x17, 0xa9, 0xde, 0x73, 0xc9,
+	0x15, 0xe8, 0xc3, 0x48, 0xa5, 0x3e, 0xbb, 0xbe, 0x7c, 0xde, 0x4b, 0x7b, 0x18, 0x61, 0xcc, 0x84,
+	0x17, 0x06, 0x54, 0x1f, 0x46, 0x72, 0x26, 0x77, 0xb8, 0xc1, 0xa4, 0x96, 0x49, 0x13, 0x40, 0x2e,
+	0xc0, 0xe8, 0x2e, 0x70, 0xb6, 0xe4, 0xeb, 0x95, 0xd2, 0xbd, 0x46, 0x73, 0x2c, 0xe7, 0xda, 0xc7,
+	0x9d, 0x52, 0xbc, 0x46, 0xa5, 0x29, 0x73, 0x8c, 0xd5, 0x5c, 0x13, 0xb1, 0x13, 0x40, 0x6c, 0xa8,
+	0x0d, 0xbc, 0xc0, 0xc9, 0x26, 0x62, 0x95, 0x55, 0x87, 0x47, 0x9c, 0x8a, 0x61, 0xdb, 0x7d, 0x8c,
+	0x91, 0xc6, 0x1c, 0x70, 0xe4, 0x12, 0x2a, 0xdd, 0x18, 0x99, 0x40, 0xb7, 0x23, 0xac, 0x4a, 0x32,
+	0xe7, 0x9c, 0xb0, 0x5f, 0x43, 0x25, 0x7f, 0x10, 0x01, 0x28, 0x75, 0xa9, 0xd3, 0x19, 0x39, 0xf5,
+	0x13, 0x69, 0xdf, 0x3a, 0x77, 0xce, 0xc8, 0xa9, 0x6b, 0xa4, 0x06, 0xc6, 0xbd, 0x33, 0x9a, 0x0c,
+	0x9c, 0x51, 0xa7, 0xae, 0xdb, 0xbf, 0x74, 0x80, 0x11, 0x9b, 0xfa, 0xd8, 0x0b, 0x5c, 0xdc, 0x92,
+	0x57, 0x50, 0x0e, 0xe7, 0x73, 0x8e, 0x22, 0x1b, 0xe0, 0x3f, 0x52, 0xb4, 0x1b, 0x3f, 0x9c, 0x2d,
+	0x87, 0x8a, 0xa7, 0x99, 0x9f, 0x34, 0xa1, 0x3a, 0xf5, 0xc3, 0x70, 0xf5, 0xd6, 0xf3, 0x05, 0xc6,
+	0xe9, 0x1a, 0x1f, 0x52, 0x7f, 0xcc, 0xb7, 0xf0, 0x6c, 0xbe, 0x17, 0x60, 0x2c, 0x71, 0xd7, 0x0d,
+	0xd7, 0x81, 0x50, 0xc2, 0x9a, 0x34, 0xc7, 0xe4, 0x25, 0x98, 0x5c, 0x30, 0x1f, 0x6f, 0x99, 0x60,
+	0xf7, 0xde, 0x23, 0x2a, 0x89, 0x4d, 0x7a, 0x4c, 0x4a, 0x39, 0x54, 0xc1, 0x77, 0x8c, 0x2f, 0x94,
+	0xe0, 0x26, 0xdd, 0x13, 0xd2, 0xab, 0xae, 0x4a, 0x1e, 0x8f, 0x52, 0xdc, 0xa0, 0x7b, 0x42, 0x5e,
+	0xd3, 0x63, 0x18, 0xe0, 0x80, 0x45, 0x4a, 0x69, 0x83, 0x66, 0x50, 0xf6, 0xad, 0xc2, 0x3a, 0xbe,
+	0xf7, 0x10, 0x28, 0x95, 0x4d, 0x7a, 0xc0, 0xc8, 0xbe, 0x37, 0x2c, 0xf6, 0x02, 0x31, 0xe2, 0xea,
+	0x72, 0x0c, 0x9a, 0x63, 0x59, 0x13, 0x83, 0x59, 0xbc, 0x8b, 0x04, 0xba, 0x56, 0x35, 0xa9, 0x99,
+	0x13, 0xf6, 0x27, 0x0d, 0xaa, 0x07, 0x62, 0xfe, 0xe5, 0xb7, 0x70, 0x0e, 0xa5, 0x44, 0x60, 0x25,
+	0xa8, 0x49, 0x4b, 0x61, 0x1e, 0xe9, 0x63, 0x90, 0x2e, 0xa6, 0x34, 0xf3, 0xfe, 0xbd, 0x20, 0xdd,
+	0xca, 0x0c, 0xee, 0x5f, 0xb6, 0x4d, 0x17, 0x33, 0x83, 0xd2, 0xb3, 0x60, 0xfc, 0x43, 0x18, 0x24,
+	0xeb, 0x69, 0xd0, 0x0c, 0xde, 0xd4, 0xbf, 0x3d, 0x35, 0xb4, 0xef, 0x4f, 0x0d, 0xed, 0xc7, 0x53,
+	0x43, 0xfb, 0xfc, 0xb3, 0x71, 0x32, 0x2d, 0xa9, 0x9f, 0xd8, 0x9b, 0xdf, 0x03, 0x00, 0x93, 0x7f,
+	0x1a, 0x70, 0xd0, 0x04, 0x00, 0x00,
 }
 
 func (m *KV) Marshal() (dAtA []byte, err error) {
@@ -633,6 +778,16 @@ func (m *ManifestChangeSet) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.FlushedWal != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.FlushedWal))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.MaxVersion != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.MaxVersion))
+		i--
+		dAtA[i] = 0x10
+	}
 	if len(m.Changes) > 0 {
 		for iNdEx := len(m.Changes) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -674,6 +829,35 @@ func (m *ManifestChange) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.CreatedAt != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.CreatedAt))
+		i--
+		dAtA[i] = 0x48
+	}
+	if m.MaxExpiresAt != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.MaxExpiresAt))
+		i--
+		dAtA[i] = 0x40
+	}
+	if m.MinExpiresAt != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.MinExpiresAt))
+		i--
+		dAtA[i] = 0x38
+	}
+	if len(m.Value) > 0 {
+		i -= len(m.Value)
+		copy(dAtA[i:], m.Value)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.Value)))
+		i--
+		dAtA[i] = 0x32
+	}
+	if len(m.Key) > 0 {
+		i -= len(m.Key)
+		copy(dAtA[i:], m.Key)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.Key)))
+		i--
+		dAtA[i] = 0x2a
+	}
 	if len(m.Checksum) > 0 {
 		i -= len(m.Checksum)
 		copy(dAtA[i:], m.Checksum)
@@ -723,6 +907,56 @@ func (m *TableIndex) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Encrypted {
+		i--
+		if m.Encrypted {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x58
+	}
+	if m.VarintTs {
+		i--
+		if m.VarintTs {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x50
+	}
+	if m.ValueAlign != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.ValueAlign))
+		i--
+		dAtA[i] = 0x48
+	}
+	if m.ZoneMap {
+		i--
+		if m.ZoneMap {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x40
+	}
+	if m.ValueMeta {
+		i--
+		if m.ValueMeta {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x38
+	}
+	if m.BloomHash != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.BloomHash))
+		i--
+		dAtA[i] = 0x30
+	}
 	if m.StaleDataSize != 0 {
 		i = encodeVarintPb(dAtA, i, uint64(m.StaleDataSize))
 		i--
@@ -786,6 +1020,30 @@ func (m *BlockOffset) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.HasZone {
+		i--
+		if m.HasZone {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x30
+	}
+	if len(m.ZoneMax) > 0 {
+		i -= len(m.ZoneMax)
+		copy(dAtA[i:], m.ZoneMax)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.ZoneMax)))
+		i--
+		dAtA[i] = 0x2a
+	}
+	if len(m.ZoneMin) > 0 {
+		i -= len(m.ZoneMin)
+		copy(dAtA[i:], m.ZoneMin)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.ZoneMin)))
+		i--
+		dAtA[i] = 0x22
+	}
 	if m.Len != 0 {
 		i = encodeVarintPb(dAtA, i, uint64(m.Len))
 		i--
@@ -884,6 +1142,12 @@ func (m *ManifestChangeSet) Size() (n int) {
 			n += 1 + l + sovPb(uint64(l))
 		}
 	}
+	if m.MaxVersion != 0 {
+		n += 1 + sovPb(uint64(m.MaxVersion))
+	}
+	if m.FlushedWal != 0 {
+		n += 1 + sovPb(uint64(m.FlushedWal))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -909,6 +1173,23 @@ func (m *ManifestChange) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovPb(uint64(l))
 	}
+	l = len(m.Key)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	l = len(m.Value)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	if m.MinExpiresAt != 0 {
+		n += 1 + sovPb(uint64(m.MinExpiresAt))
+	}
+	if m.MaxExpiresAt != 0 {
+		n += 1 + sovPb(uint64(m.MaxExpiresAt))
+	}
+	if m.CreatedAt != 0 {
+		n += 1 + sovPb(uint64(m.CreatedAt))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -940,6 +1221,24 @@ func (m *TableIndex) Size() (n int) {
 	if m.StaleDataSize != 0 {
 		n += 1 + sovPb(uint64(m.StaleDataSize))
 	}
+	if m.BloomHash != 0 {
+		n += 1 + sovPb(uint64(m.BloomHash))
+	}
+	if m.ValueMeta {
+		n += 2
+	}
+	if m.ZoneMap {
+		n += 2
+	}
+	if m.ValueAlign != 0 {
+		n += 1 + sovPb(uint64(m.ValueAlign))
+	}
+	if m.VarintTs {
+		n += 2
+	}
+	if m.Encrypted {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -962,6 +1261,17 @@ func (m *BlockOffset) Size() (n int) {
 	if m.Len != 0 {
 		n += 1 + sovPb(uint64(m.Len))
 	}
+	l = len(m.ZoneMin)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	l = len(m.ZoneMax)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	if m.HasZone {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1366,6 +1676,44 @@ func (m *ManifestChangeSet) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxVersion", wireType)
+			}
+			m.MaxVersion = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxVersion |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FlushedWal", wireType)
+			}
+			m.FlushedWal = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.FlushedWal |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -1508,6 +1856,131 @@ func (m *ManifestChange) Unmarshal(dAtA []byte) error {
 				m.Checksum = []byte{}
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Key = append(m.Key[:0], dAtA[iNdEx:postIndex]...)
+			if m.Key == nil {
+				m.Key = []byte{}
+			}
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Value", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Value = append(m.Value[:0], dAtA[iNdEx:postIndex]...)
+			if m.Value == nil {
+				m.Value = []byte{}
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinExpiresAt", wireType)
+			}
+			m.MinExpiresAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MinExpiresAt |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxExpiresAt", wireType)
+			}
+			m.MaxExpiresAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxExpiresAt |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CreatedAt", wireType)
+			}
+			m.CreatedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CreatedAt |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -1684,6 +2157,124 @@ func (m *TableIndex) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BloomHash", wireType)
+			}
+			m.BloomHash = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BloomHash |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ValueMeta", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ValueMeta = bool(v != 0)
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ZoneMap", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ZoneMap = bool(v != 0)
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ValueAlign", wireType)
+			}
+			m.ValueAlign = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ValueAlign |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field VarintTs", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.VarintTs = bool(v != 0)
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Encrypted", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Encrypted = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -1807,6 +2398,94 @@ func (m *BlockOffset) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ZoneMin", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ZoneMin = append(m.ZoneMin[:0], dAtA[iNdEx:postIndex]...)
+			if m.ZoneMin == nil {
+				m.ZoneMin = []byte{}
+			}
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ZoneMax", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ZoneMax = append(m.ZoneMax[:0], dAtA[iNdEx:postIndex]...)
+			if m.ZoneMax == nil {
+				m.ZoneMax = []byte{}
+			}
+			iNdEx = postIndex
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HasZone", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.HasZone = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
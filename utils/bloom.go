@@ -1,6 +1,10 @@
 package utils
 
-import "math"
+import (
+	"math"
+
+	"github.com/cespare/xxhash/v2"
+)
 
 // Filter is an encoded set of []byte keys.
 type Filter []byte
@@ -10,6 +14,11 @@ func (f Filter) MayContainKey(k []byte) bool {
 	return f.MayContain(Hash(k))
 }
 
+// MayContainKeyWith 使用h计算k的哈希后查找，h必须与构建过滤器时使用的哈希函数相同
+func (f Filter) MayContainKeyWith(h BloomHash, k []byte) bool {
+	return f.MayContain(h.Sum(k))
+}
+
 // MayContain returns whether the filter may contain given key. False positives
 // are possible, where it returns true for keys not in the original set.
 func (f Filter) MayContain(h uint32) bool {
@@ -89,6 +98,34 @@ func appendFilter(keys []uint32, bitsPerKey int) []byte {
 	return filter
 }
 
+// BloomHash 布隆过滤器使用的哈希函数，记录在sst的索引中，读取时按每个sst记录的函数计算
+type BloomHash uint32
+
+const (
+	BloomHashMurmur BloomHash = iota // 默认，即Hash
+	BloomHashXXHash                  // xxhash64的低32位，key较长时更快
+)
+
+// Valid 是否为已知的哈希函数
+func (h BloomHash) Valid() bool {
+	return h == BloomHashMurmur || h == BloomHashXXHash
+}
+
+// Sum 计算key的哈希
+func (h BloomHash) Sum(key []byte) uint32 {
+	if h == BloomHashXXHash {
+		return uint32(xxhash.Sum64(key))
+	}
+	return Hash(key)
+}
+
+func (h BloomHash) String() string {
+	if h == BloomHashXXHash {
+		return "xxhash"
+	}
+	return "murmur"
+}
+
 // Hash implements a hashing algorithm similar to the Murmur hash.
 func Hash(b []byte) uint32 {
 	const (
@@ -1,6 +1,10 @@
 package utils
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"testing"
+)
 
 func (f Filter) String() string {
 	s := make([]byte, 8*len(f))
@@ -139,3 +143,34 @@ func TestHash(t *testing.T) {
 		}
 	}
 }
+
+func TestBloomHashFalsePositiveRate(t *testing.T) {
+	const n, probes = 10000, 100000
+	for _, h := range []BloomHash{BloomHashMurmur, BloomHashXXHash} {
+		for _, bits := range []int{6, 10, 16} {
+			hashes := make([]uint32, 0, n)
+			for i := 0; i < n; i++ {
+				hashes = append(hashes, h.Sum([]byte(fmt.Sprintf("key%08d", i))))
+			}
+			f := NewFilter(hashes, bits)
+			for i := 0; i < n; i++ {
+				if !f.MayContainKeyWith(h, []byte(fmt.Sprintf("key%08d", i))) {
+					t.Fatalf("%v bits=%d: did not contain key %d", h, bits, i)
+				}
+			}
+			fp := 0
+			for i := 0; i < probes; i++ {
+				if f.MayContainKeyWith(h, []byte(fmt.Sprintf("miss%08d", i))) {
+					fp++
+				}
+			}
+			// 哈希函数的数量与appendFilter相同，理论误判率为(1-e^(-k/bits))^k
+			k := float64(int(float64(bits) * 0.69))
+			want := math.Pow(1-math.Exp(-k/float64(bits)), k)
+			got := float64(fp) / probes
+			if got > want*1.5+0.001 || got < want/2-0.001 {
+				t.Errorf("%v bits=%d: false positive rate %.5f, want about %.5f", h, bits, got, want)
+			}
+		}
+	}
+}
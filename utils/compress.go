@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// CompressValue 用flate压缩value，压缩后没有变小时返回false，调用方保存原来的value
+func CompressValue(value []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	Panic(err)
+	Panic2(w.Write(value))
+	Panic(w.Close())
+	if buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// DecompressValue 解压CompressValue的结果
+func DecompressValue(data []byte) ([]byte, error) {
+	value, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress value")
+	}
+	return value, nil
+}
+
+// Decompress Meta带有BitValueCompressed时将Value替换为解压后的数据并清除这个标记，否则不做任何事
+// 读出时记录过校验和的entry按解压后的内容重新计算，之后仍然可以用Verify检查
+func (e *Entry) Decompress() error {
+	if e.Meta&BitValueCompressed == 0 {
+		return nil
+	}
+	value, err := DecompressValue(e.Value)
+	if err != nil {
+		return err
+	}
+	e.Value = value
+	e.Meta &^= BitValueCompressed
+	if e.src.deferred {
+		e.DeferChecksum()
+	} else if e.Checksum != 0 {
+		e.Checksum = e.CalculateChecksum()
+	}
+	return nil
+}
@@ -16,6 +16,11 @@ const (
 const (
 	ManifestFilename                  = "MANIFEST"
 	ManifestRewriteFilename           = "REWRITEMANIFEST"
+	ManifestBackupFilename            = "MANIFEST.bak"
+	ManifestBackupRewriteFilename     = "REWRITEMANIFEST.bak"
+	ManifestCorruptFilename           = "MANIFEST.corrupt"
+	TrashDirname                      = ".trash"
+	RetainedWalDirname                = ".wal-retained"
 	ManifestDeletionsRewriteThreshold = 10000
 	ManifestDeletionsRatio            = 10
 	DefaultFileFlag                   = os.O_RDWR | os.O_CREATE | os.O_APPEND
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Encryptor 加密落盘的sst block、sst索引与wal记录，密钥由调用方管理
+// 每次加密使用新生成的nonce，nonce与Encrypt返回的密钥编号一起保存在密文之后，解密时原样传回
+type Encryptor interface {
+	// NonceSize 每次加密需要的nonce长度
+	NonceSize() int
+	// Overhead 密文比明文最多多出的字节数，例如AES-GCM的认证tag
+	Overhead() int
+	// Encrypt 加密plaintext，返回所用密钥的编号与密文
+	Encrypt(nonce, plaintext []byte) (keyID uint32, ciphertext []byte, err error)
+	// Decrypt 使用编号为keyID的密钥解密，密文被篡改或密钥不匹配时返回错误
+	Decrypt(keyID uint32, nonce, ciphertext []byte) ([]byte, error)
+}
+
+// encryptedMagic 加密数据末尾的标记，解密前据此检查数据是否完整
+// 是否加密由sst索引的EncryptedIndexFlag、TableIndex.Encrypted与wal记录的WalEncryptedTag显式记录，不根据这个标记判断
+const encryptedMagic uint32 = 0x454e4352
+
+// encryptedTrailerSize nonce之后的 | key id | nonce len | magic |
+const encryptedTrailerSize = 12
+
+// EncryptData 加密data，返回 | ciphertext | nonce | key id | nonce len | magic |
+func EncryptData(enc Encryptor, data []byte) ([]byte, error) {
+	nonce := make([]byte, enc.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	keyID, ciphertext, err := enc.Encrypt(nonce, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypt")
+	}
+	out := make([]byte, 0, len(ciphertext)+len(nonce)+encryptedTrailerSize)
+	out = append(out, ciphertext...)
+	out = append(out, nonce...)
+	var trailer [encryptedTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[0:4], keyID)
+	binary.BigEndian.PutUint32(trailer[4:8], uint32(len(nonce)))
+	binary.BigEndian.PutUint32(trailer[8:12], encryptedMagic)
+	return append(out, trailer[:]...), nil
+}
+
+// EncryptionOverhead EncryptData的结果比data多出的最大字节数，enc为nil时为0
+func EncryptionOverhead(enc Encryptor) int {
+	if enc == nil {
+		return 0
+	}
+	return enc.Overhead() + enc.NonceSize() + encryptedTrailerSize
+}
+
+// EncryptedIndexFlag 加密的sst索引的第一个字节，protobuf编码的明文索引以字段的tag开头，不会是0
+const EncryptedIndexFlag byte = 0
+
+// EncryptIndex 加密sst的索引，返回 | EncryptedIndexFlag | EncryptData的结果 |
+func EncryptIndex(enc Encryptor, index []byte) ([]byte, error) {
+	sealed, err := EncryptData(enc, index)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{EncryptedIndexFlag}, sealed...), nil
+}
+
+// IsEncryptedIndex 判断sst的索引是否由EncryptIndex生成
+func IsEncryptedIndex(index []byte) bool {
+	return len(index) > 0 && index[0] == EncryptedIndexFlag
+}
+
+// DecryptIndex 解密EncryptIndex生成的索引
+func DecryptIndex(enc Encryptor, index []byte) ([]byte, error) {
+	return DecryptData(enc, index[1:])
+}
+
+// DecryptData 解密EncryptData生成的数据，enc为nil时返回ErrNoEncryptor
+func DecryptData(enc Encryptor, data []byte) ([]byte, error) {
+	if enc == nil {
+		return nil, ErrNoEncryptor
+	}
+	end := len(data) - encryptedTrailerSize
+	if end < 0 {
+		return nil, errors.Errorf("encrypted data is too short: %d bytes", len(data))
+	}
+	if binary.BigEndian.Uint32(data[len(data)-4:]) != encryptedMagic {
+		return nil, errors.New("encrypted data has no trailer")
+	}
+	keyID := binary.BigEndian.Uint32(data[end : end+4])
+	nonceLen := int(binary.BigEndian.Uint32(data[end+4 : end+8]))
+	if nonceLen > end {
+		return nil, errors.Errorf("invalid nonce length %d in %d bytes of encrypted data", nonceLen, len(data))
+	}
+	nonce := data[end-nonceLen : end]
+	plaintext, err := enc.Decrypt(keyID, nonce, data[:end-nonceLen])
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypt with key %d", keyID)
+	}
+	return plaintext, nil
+}
+
+// aesEncryptor 使用单个密钥的AES-GCM
+type aesEncryptor struct {
+	keyID uint32
+	aead  cipher.AEAD
+}
+
+// NewAESEncryptor 使用AES-GCM加密，key的长度为16、24或32字节，分别对应AES-128、AES-192与AES-256
+// 只能解密编号为keyID的密钥加密的数据，轮换密钥需要调用方实现自己的Encryptor
+func NewAESEncryptor(keyID uint32, key []byte) (Encryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesEncryptor{keyID: keyID, aead: aead}, nil
+}
+
+func (e *aesEncryptor) NonceSize() int {
+	return e.aead.NonceSize()
+}
+
+func (e *aesEncryptor) Overhead() int {
+	return e.aead.Overhead()
+}
+
+func (e *aesEncryptor) Encrypt(nonce, plaintext []byte) (uint32, []byte, error) {
+	return e.keyID, e.aead.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func (e *aesEncryptor) Decrypt(keyID uint32, nonce, ciphertext []byte) ([]byte, error) {
+	if keyID != e.keyID {
+		return nil, errors.Errorf("unknown key id %d", keyID)
+	}
+	return e.aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -2,34 +2,48 @@ package utils
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type ValueStruct struct {
+	Meta      byte
 	Value     []byte
 	ExpiresAt uint64
 }
 
-// value只持久化具体的value值和过期时间
+// BitValueCompressed Meta中的标记，表示Value是CompressValue压缩后的数据
+const BitValueCompressed byte = 1 << 0
+
+// value只持久化meta、具体的value值和过期时间
 func (e *ValueStruct) EncodedSize() uint32 {
 	sz := len(e.Value)
 	enc := sizeVarint(e.ExpiresAt)
-	return uint32(sz + enc)
+	return uint32(1 + sz + enc)
 }
 
-// DecodeValue
+// DecodeValue | meta | expiresAt | value |
 func (vs *ValueStruct) DecodeValue(buf []byte) {
+	vs.Meta = buf[0]
+	vs.DecodeValueWithoutMeta(buf[1:])
+}
+
+// DecodeValueWithoutMeta 解析没有meta的 | expiresAt | value |，即记录meta之前生成的sst中的value
+func (vs *ValueStruct) DecodeValueWithoutMeta(buf []byte) {
 	var sz int
 	vs.ExpiresAt, sz = binary.Uvarint(buf)
 	vs.Value = buf[sz:]
 }
 
 //对value进行编码，并将编码后的字节写入byte
-//这里将过期时间和value的值一起编码
+//这里将meta、过期时间和value的值一起编码
 func (e *ValueStruct) EncodeValue(b []byte) uint32 {
-	sz := binary.PutUvarint(b[:], e.ExpiresAt)
-	n := copy(b[sz:], e.Value)
-	return uint32(sz + n)
+	b[0] = e.Meta
+	sz := binary.PutUvarint(b[1:], e.ExpiresAt)
+	n := copy(b[1+sz:], e.Value)
+	return uint32(1 + sz + n)
 }
 
 func sizeVarint(x uint64) (n int) {
@@ -45,14 +59,30 @@ func sizeVarint(x uint64) (n int) {
 
 //Entry _ 最外层写入的结构体
 type Entry struct {
-	Key       []byte
+	Key []byte
+	// Value 长度为0的value与其他value一样是有效的数据，存储中没有用value长度表示删除的地方
 	Value     []byte
 	ExpiresAt uint64
+	// Meta 与value一起保存的标记，见BitValueCompressed
+	Meta byte
 
 	Version      uint64
 	Offset       uint32
 	Hlen         int // Length of the header.
 	ValThreshold int64
+	// Checksum 读取方校验过entry所在的wal记录或sst block之后记录的校验和，见CalculateChecksum，0表示没有记录
+	// 从sst读出的entry只记录读出时的内容，见DeferChecksum，第一次调用Verify时才计算，此前为0
+	Checksum uint32
+	// src DeferChecksum记录的读出时的内容
+	src checksumSource
+}
+
+// checksumSource 读出时entry中参与校验和计算的字段，key与value只记录引用
+type checksumSource struct {
+	key, value []byte
+	expiresAt  uint64
+	meta       byte
+	deferred   bool
 }
 
 // NewEntry_
@@ -78,5 +108,62 @@ func (e *Entry) WithTTL(dur time.Duration) *Entry {
 func (e *Entry) EncodedSize() uint32 {
 	sz := len(e.Value)
 	enc := sizeVarint(e.ExpiresAt)
-	return uint32(sz + enc)
+	return uint32(1 + sz + enc)
+}
+
+// CalculateChecksum 按wal记录中 | meta(不为0时) | header | key | value | 的编码计算Castagnoli crc32，与crc32的wal记录中保存的校验和相同
+// 结果为0时取1，0留给没有记录校验和的entry
+func (e *Entry) CalculateChecksum() uint32 {
+	h := WalHeader{
+		KeyLen:    uint32(len(e.Key)),
+		ValueLen:  uint32(len(e.Value)),
+		ExpiresAt: e.ExpiresAt,
+	}
+	var headerEnc [maxHeaderSize]byte
+	sz := h.Encode(headerEnc[:])
+	var sum uint32
+	if e.Meta != 0 {
+		sum = crc32.Update(sum, CastagnoliCrcTable, []byte{e.Meta})
+	}
+	sum = crc32.Update(sum, CastagnoliCrcTable, headerEnc[:sz])
+	sum = crc32.Update(sum, CastagnoliCrcTable, e.Key)
+	return MaskChecksum(crc32.Update(sum, CastagnoliCrcTable, e.Value))
+}
+
+// MaskChecksum 将crc32的结果转换为Checksum，0转换为1
+func MaskChecksum(sum uint32) uint32 {
+	if sum == 0 {
+		return 1
+	}
+	return sum
+}
+
+// DeferChecksum 记录entry当前的内容作为读出时的状态，Verify时再按它计算校验和，读取时不必为每个entry计算crc
+// 之后替换或修改entry的字段同样会被Verify发现，但原地修改与读出时共享的key或value字节不会
+func (e *Entry) DeferChecksum() {
+	e.Checksum = 0
+	e.src = checksumSource{key: e.Key, value: e.Value, expiresAt: e.ExpiresAt, meta: e.Meta, deferred: true}
+}
+
+// resolveChecksum 按DeferChecksum记录的内容计算出Checksum
+func (e *Entry) resolveChecksum() {
+	if !e.src.deferred {
+		return
+	}
+	src := Entry{Key: e.src.key, Value: e.src.value, ExpiresAt: e.src.expiresAt, Meta: e.src.meta}
+	e.Checksum = src.CalculateChecksum()
+	e.src = checksumSource{}
+}
+
+// Verify 重新计算校验和并与Checksum比较，用于检查读出之后被修改或损坏的entry
+// 没有记录校验和时返回ErrNoChecksum，例如从内存表中读出的entry
+func (e *Entry) Verify() error {
+	e.resolveChecksum()
+	if e.Checksum == 0 {
+		return ErrNoChecksum
+	}
+	if actual := e.CalculateChecksum(); actual != e.Checksum {
+		return errors.Wrapf(ErrChecksumMismatch, "actual: %d, expected: %d", actual, e.Checksum)
+	}
+	return nil
 }
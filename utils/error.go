@@ -29,16 +29,51 @@ var (
 	ErrBadChecksum = errors.New("bad check sum")
 	// ErrChecksumMismatch is returned at checksum mismatch.
 	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrNoChecksum entry没有记录校验和，无法校验
+	ErrNoChecksum = errors.New("entry has no checksum")
 	// ErrNotSupportManifestVersion 文件的版本号不匹配
 	ErrNotSupportManifestVersion = errors.New("not support this manifest version")
 	ErrTruncate                  = errors.New("Do truncate")
 	ErrStop                      = errors.New("Stop")
 
+	// ErrTruncateValidData 截断wal的位置在有效记录的末尾之前
+	ErrTruncateValidData = errors.New("truncate would drop valid wal records")
+
 	// ErrManifestHasWrongOp manifest文件中记录了错误的操作（manifest文件只支持create和delete操作）
 	ErrManifestHasWrongOp = errors.New("manifest contain wrong operation in change")
 
 	// compact
 	ErrFillTables = errors.New("Unable to fill tables")
+
+	// ErrSSTableOrder sst中的key没有严格递增
+	ErrSSTableOrder = errors.New("keys in sstable are out of order")
+
+	// ErrStoreFull 存储总大小超过了MaxStoreSize
+	ErrStoreFull = errors.New("store size exceeds MaxStoreSize")
+	// ErrEntryTooLarge 单个entry编码后超过了MemTableSize，任何内存表都无法容纳
+	ErrEntryTooLarge = errors.New("entry is larger than MemTableSize")
+	// ErrBatchTooLarge 一批entry编码后的总大小超过了MemTableSize或数量超过了MemTableMaxEntries，无法写入同一个内存表
+	ErrBatchTooLarge = errors.New("batch is larger than MemTableSize or MemTableMaxEntries")
+	// ErrStoreFrozen 持久化写入失败后存储进入只读状态，拒绝之后的所有写入
+	ErrStoreFrozen = errors.New("store is frozen after a failed durable write")
+	// ErrFlushOverlap 内存表的key范围与目标层及其上各层的sst重叠，不能直接刷到目标层
+	ErrFlushOverlap = errors.New("memtable overlaps tables at or above the target level")
+	// ErrNoEncryptor 读到了加密的数据，但没有配置Encryptor
+	ErrNoEncryptor = errors.New("data is encrypted but no Encryptor is configured")
+	// ErrImportOrder BuildStore读到的entry没有按key严格递增
+	ErrImportOrder = errors.New("imported entries are out of order")
+	// ErrVersionRegression 数据中存在比恢复出的版本号水位更大的版本号，之后分配的版本号会比它们小
+	ErrVersionRegression = errors.New("entry versions exceed the recovered version watermark")
+	// ErrNoZoneMap 没有配置ZoneMapExtractor时调用ScanZone
+	ErrNoZoneMap = errors.New("zone map extractor is not configured")
+	// ErrReadAmpExceeded 一次Get需要查找的sst超过了MaxReadAmplification
+	ErrReadAmpExceeded = errors.New("read amplification exceeds the limit")
+	// ErrFIDCollision 将要分配的fid已经被目录中的sst或wal使用
+	ErrFIDCollision = errors.New("fid is already used by an existing file")
+	// ErrNoTableChecksum sst注册时manifest中没有记录整个文件的checksum
+	ErrNoTableChecksum = errors.New("table has no checksum in manifest")
+	// ErrReservedMeta 写入的entry的Meta使用了存储内部的标记，例如BitValueCompressed
+	ErrReservedMeta = errors.New("entry meta uses bits reserved by the store")
 )
 
 // Panic 如果err 不为nil 则panicc
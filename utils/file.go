@@ -5,38 +5,98 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// FID 根据file name 获取其fid
-func FID(name string) uint64 {
+// FID 根据file name 获取其fid，文件名不是 <十进制id>.sst 时ok为false，用于区分不是sst的文件与id为0的sst
+func FID(name string) (fid uint64, ok bool) {
 	name = path.Base(name)
 	if !strings.HasSuffix(name, ".sst") {
-		return 0
+		return 0, false
 	}
-	//	suffix := name[len(fileSuffix):]
-	name = strings.TrimSuffix(name, ".sst")
-	id, err := strconv.Atoi(name)
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, ".sst"), 10, 64)
 	if err != nil {
-		PrintErr(err)
-		return 0
+		return 0, false
 	}
-	return uint64(id)
+	return id, true
 }
 
 // SSTableFullPath  获取sst文件但绝对路径
+// %05d只是最小宽度，超过99999的id同样可以被FID解析
 func SSTableFullPath(dir string, id uint64) string {
 	return filepath.Join(dir, fmt.Sprintf("%05d.sst", id))
 }
 
+// SSTableLayout sst文件在工作目录中的布局
+type SSTableLayout int
+
+const (
+	// SSTableLayoutFlat 所有sst直接位于工作目录中，文件名与之前的版本相同
+	SSTableLayoutFlat SSTableLayout = iota
+	// SSTableLayoutSharded sst按id的哈希分散到 sst/00 至 sst/ff 的256个子目录中，文件名为至少9位的id
+	// 避免sst数量很多时单个目录过大
+	SSTableLayoutSharded
+)
+
+// SSTableShardDir 分片布局下所有子目录所在的目录
+const SSTableShardDir = "sst"
+
+// Path 返回按当前布局新建的sst文件在dir中的路径
+func (l SSTableLayout) Path(dir string, id uint64) string {
+	if l == SSTableLayoutSharded {
+		return filepath.Join(SSTableShardPath(dir, sstShard(id)), fmt.Sprintf("%09d.sst", id))
+	}
+	return SSTableFullPath(dir, id)
+}
+
+// SSTableShardPath 分片布局下第shard个子目录的路径
+func SSTableShardPath(dir string, shard int) string {
+	return filepath.Join(dir, SSTableShardDir, fmt.Sprintf("%02x", shard))
+}
+
+// sstShard id所在的子目录，乘以黄金分割常数后取最高的8位，连续的id会被分散开
+func sstShard(id uint64) int {
+	return int((id * 0x9E3779B97F4A7C15) >> 56)
+}
+
+// FindSSTable 返回dir中已有的id对应的sst文件路径，依次检查平铺与分片布局，都不存在时返回平铺布局的路径
+func FindSSTable(dir string, id uint64) string {
+	if p := SSTableLayoutSharded.Path(dir, id); fileExists(p) {
+		return p
+	}
+	return SSTableFullPath(dir, id)
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
 // openDir opens a directory for syncing.
 func openDir(path string) (*os.File, error) { return os.Open(path) }
 
+// WriteFull 写入整个buf，Write短写但没有返回错误时继续写剩下的部分，一个字节也没有写入时返回io.ErrShortWrite
+func WriteFull(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
 // SyncDir When you create or delete a osFile, you have to ensure the directory entry for the osFile is synced
 // in order to guarantee the osFile is visible (if the system crashes). (See the man page for fsync,
 // or see https://github.com/coreos/etcd/issues/6368 for an example.)
@@ -53,20 +113,79 @@ func SyncDir(dir string) error {
 	return errors.Wrapf(closeErr, "While closing directory: %s.", dir)
 }
 
+// RemoveFile 删除文件，trashDir不为空时改为移动到trashDir中保留，由PurgeTrash在保留期之后删除
+// 移动后把文件的修改时间设为当前时间，作为进入回收站的时间
+func RemoveFile(path, trashDir string) error {
+	if trashDir == "" {
+		return os.Remove(path)
+	}
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(trashDir, filepath.Base(path))
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(dst, now, now)
+}
+
+// PurgeTrash 删除trashDir中进入回收站早于before的文件，返回删除的文件数，trashDir不存在时什么也不做
+func PurgeTrash(trashDir string, before time.Time) (int, error) {
+	infos, err := ioutil.ReadDir(trashDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, info := range infos {
+		if info.IsDir() || !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(trashDir, info.Name())); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 // LoadSSTIdMap 获取当前文件夹下所有sst文件的id
 func LoadSSTIdMap(dir string) map[uint64]struct{} {
+	idMap := make(map[uint64]struct{})
+	for fid := range LoadSSTPaths(dir) {
+		idMap[fid] = struct{}{}
+	}
+	return idMap
+}
+
+// LoadSSTPaths 获取dir中所有sst文件的id与路径，平铺与分片两种布局的sst都会被找到，因此可以在两种布局之间切换
+func LoadSSTPaths(dir string) map[uint64]string {
+	paths := make(map[uint64]string)
+	loadSSTPaths(dir, paths)
+	shards, err := ioutil.ReadDir(filepath.Join(dir, SSTableShardDir))
+	if err != nil && !os.IsNotExist(err) {
+		Panic(err)
+	}
+	for _, info := range shards {
+		if info.IsDir() {
+			loadSSTPaths(filepath.Join(dir, SSTableShardDir, info.Name()), paths)
+		}
+	}
+	return paths
+}
+
+func loadSSTPaths(dir string, paths map[uint64]string) {
 	fileInfo, err := ioutil.ReadDir(dir)
 	Panic(err)
-	idMap := make(map[uint64]struct{})
 	for _, info := range fileInfo {
 		if !info.IsDir() {
-			if fid := FID(info.Name()); fid != 0 {
-				idMap[fid] = struct{}{}
+			if fid, ok := FID(info.Name()); ok {
+				paths[fid] = filepath.Join(dir, info.Name())
 			}
 		}
-
 	}
-	return idMap
 }
 
 // CompareKeys checks the key without timestamp and checks the timestamp if keyNoTs
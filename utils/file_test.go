@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TestFID 可以解析完整的uint64范围，不是sst的文件名返回false而不是id 0
+func TestFID(t *testing.T) {
+	for _, id := range []uint64{0, 1, 99999, 100000, math.MaxUint64 - 1, math.MaxUint64} {
+		for _, p := range []string{SSTableFullPath("dir", id), SSTableLayoutSharded.Path("dir", id)} {
+			if fid, ok := FID(p); !ok || fid != id {
+				t.Fatalf("FID(%q) = %d, %v, want %d", p, fid, ok, id)
+			}
+		}
+	}
+	for _, name := range []string{"", "MANIFEST", "00001.wal", "00001.sst.tmp", ".sst", "abc.sst",
+		"-1.sst", "+1.sst", "1.5.sst", "18446744073709551616.sst", "dir.sst/00001"} {
+		if fid, ok := FID(name); ok {
+			t.Fatalf("FID(%q) = %d, want not ok", name, fid)
+		}
+	}
+}
+
+// TestLoadSSTPathsSkipsJunk 无法解析的文件名被忽略，id为0的sst正常返回
+func TestLoadSSTPathsSkipsJunk(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"00000.sst", "7.sst", "junk.sst", "MANIFEST", "00003.wal"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths := LoadSSTPaths(dir)
+	want := map[uint64]string{0: filepath.Join(dir, "00000.sst"), 7: filepath.Join(dir, "7.sst")}
+	if len(paths) != len(want) {
+		t.Fatalf("LoadSSTPaths = %v, want %v", paths, want)
+	}
+	for id, p := range want {
+		if paths[id] != p {
+			t.Fatalf("LoadSSTPaths = %v, want %v", paths, want)
+		}
+	}
+}
+
+// TestRetryPolicy 暂时性的错误重试后成功，ENOSPC等错误与sync的EIO立即返回
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{Retries: 2, Interval: time.Millisecond}
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := ioutil.WriteFile(src, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	err := p.Do(func() error {
+		if calls++; calls == 1 {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EINTR}
+		}
+		return os.Rename(src, dst)
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("rename with one injected EINTR: err %v after %d calls", err, calls)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := func(errno syscall.Errno) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			return errors.Wrap(&os.PathError{Op: "open", Path: dst, Err: errno}, "open")
+		}
+	}
+	for _, c := range []struct {
+		do    func(func() error) error
+		errno syscall.Errno
+		calls int
+	}{
+		{p.Do, syscall.EAGAIN, 3},
+		{p.Do, syscall.EIO, 3},
+		{p.Do, syscall.ENOSPC, 1},
+		{p.Do, syscall.EROFS, 1},
+		{p.DoSync, syscall.EINTR, 3},
+		{p.DoSync, syscall.EIO, 1},
+		{RetryPolicy{}.Do, syscall.EINTR, 1},
+	} {
+		if err := c.do(failing(c.errno)); !errors.Is(err, c.errno) || calls != c.calls {
+			t.Fatalf("%v: err %v after %d calls, want %d calls", c.errno, err, calls, c.calls)
+		}
+	}
+}
+
+// oneByteWriter 每次只写入一个字节
+type oneByteWriter struct{ buf []byte }
+
+func (w *oneByteWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	w.buf = append(w.buf, b[0])
+	return 1, nil
+}
+
+// TestWriteFull 短写时继续写完剩下的部分，没有进展时返回io.ErrShortWrite
+func TestWriteFull(t *testing.T) {
+	w := &oneByteWriter{}
+	if err := WriteFull(w, []byte("hello")); err != nil || string(w.buf) != "hello" {
+		t.Fatalf("WriteFull = %v, wrote %q", err, w.buf)
+	}
+	if err := WriteFull(writerFunc(func(b []byte) (int, error) { return 0, nil }), []byte("x")); err != io.ErrShortWrite {
+		t.Fatalf("WriteFull = %v, want io.ErrShortWrite", err)
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
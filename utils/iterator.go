@@ -19,4 +19,17 @@ type Item interface {
 type Options struct {
 	Prefix []byte
 	IsAsc  bool
+	// KeysOnly 只返回key，不解码value，返回的entry中Value为空，ExpiresAt与Meta仍然有效，可以据此跳过删除的key
+	KeysOnly bool
+
+	// FilterLevels 为true时LSM.NewIterator只合并level在[MinLevel, MaxLevel]中的数据源
+	// level -1表示活跃内存表与immutables，默认合并所有数据源
+	FilterLevels bool
+	MinLevel     int
+	MaxLevel     int
+}
+
+// LevelInRange 判断level的数据是否参与合并
+func (opt *Options) LevelInRange(level int) bool {
+	return !opt.FilterLevels || (level >= opt.MinLevel && level <= opt.MaxLevel)
 }
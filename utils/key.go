@@ -39,6 +39,27 @@ func KeyWithTs(key []byte, ts uint64) []byte {
 	return out
 }
 
+// KeyWithVarintTs 把KeyWithTs格式的key中固定8字节的时间戳换成 | uvarint(ts) | uvarint的长度 |
+// 版本号小于2^14时时间戳只占2到3个字节；编码后的key不能用CompareKeys比较，需要先用ParseVarintTsKey还原
+func KeyWithVarintTs(key []byte) []byte {
+	userKey := key[:len(key)-8]
+	ts := math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-8:])
+	out := make([]byte, len(userKey), len(userKey)+binary.MaxVarintLen64+1)
+	copy(out, userKey)
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], ts)
+	out = append(out, buf[:n]...)
+	return append(out, byte(n))
+}
+
+// ParseVarintTsKey 将KeyWithVarintTs编码的key还原为KeyWithTs的格式，返回新分配的key
+func ParseVarintTsKey(key []byte) []byte {
+	n := int(key[len(key)-1])
+	userKey := key[:len(key)-1-n]
+	ts, _ := binary.Uvarint(key[len(userKey) : len(key)-1])
+	return KeyWithTs(userKey, ts)
+}
+
 // SafeCopy does append(a[:0], src...).
 func SafeCopy(a, src []byte) []byte {
 	return append(a[:0], src...)
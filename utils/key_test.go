@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+)
+
+// TestKeyWithVarintTs 大小不同的时间戳编码后可以还原，还原后的排序与原来的key相同
+func TestKeyWithVarintTs(t *testing.T) {
+	var keys [][]byte
+	for _, userKey := range []string{"a", "ab", "b\x80\xff"} {
+		for _, ts := range []uint64{0, 1, 127, 128, 1 << 14, 1 << 35, math.MaxUint64 - 1, math.MaxUint64} {
+			keys = append(keys, KeyWithTs([]byte(userKey), ts))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return CompareKeys(keys[i], keys[j]) < 0 })
+
+	decoded := make([][]byte, len(keys))
+	for i, key := range keys {
+		enc := KeyWithVarintTs(key)
+		if ts := ParseTs(key); ts < 128 && len(enc) != len(key)-6 {
+			t.Fatalf("key %x with ts %d encoded to %d bytes", key, ts, len(enc))
+		}
+		decoded[i] = ParseVarintTsKey(enc)
+		if !bytes.Equal(decoded[i], key) {
+			t.Fatalf("decode %x: got %x", key, decoded[i])
+		}
+	}
+	// 打乱后重新排序，结果与原来的顺序一致
+	for i := range decoded {
+		j := (i * 7) % len(decoded)
+		decoded[i], decoded[j] = decoded[j], decoded[i]
+	}
+	sort.Slice(decoded, func(i, j int) bool { return CompareKeys(decoded[i], decoded[j]) < 0 })
+	for i := range keys {
+		if !bytes.Equal(decoded[i], keys[i]) {
+			t.Fatalf("order differs at %d: %x vs %x", i, decoded[i], keys[i])
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"log"
+	"os"
+)
+
+// Logger 分级日志接口，使用方可以替换为自己的日志组件
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// LogLevel 日志级别
+type LogLevel int
+
+const (
+	DEBUG LogLevel = iota
+	INFO
+	WARNING
+	ERROR
+)
+
+// DefaultLogger 未配置Logger时使用，输出INFO及以上级别到stderr
+var DefaultLogger Logger = NewDefaultLogger(INFO)
+
+// NopLogger 丢弃所有日志
+var NopLogger Logger = nopLogger{}
+
+type defaultLog struct {
+	*log.Logger
+	level LogLevel
+}
+
+// NewDefaultLogger 创建一个输出到stderr的Logger，低于level的日志会被忽略
+func NewDefaultLogger(level LogLevel) Logger {
+	return &defaultLog{
+		Logger: log.New(os.Stderr, "lsm ", log.LstdFlags),
+		level:  level,
+	}
+}
+
+func (l *defaultLog) Debugf(format string, v ...interface{}) {
+	if l.level <= DEBUG {
+		l.Printf("DEBUG: "+format, v...)
+	}
+}
+
+func (l *defaultLog) Infof(format string, v ...interface{}) {
+	if l.level <= INFO {
+		l.Printf("INFO: "+format, v...)
+	}
+}
+
+func (l *defaultLog) Warnf(format string, v ...interface{}) {
+	if l.level <= WARNING {
+		l.Printf("WARNING: "+format, v...)
+	}
+}
+
+func (l *defaultLog) Errorf(format string, v ...interface{}) {
+	if l.level <= ERROR {
+		l.Printf("ERROR: "+format, v...)
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
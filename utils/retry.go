@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy 文件操作遇到暂时性错误时的重试策略，零值表示不重试
+// 网络文件系统上打开、改名与sync偶尔会失败，稍后重试通常可以成功
+type RetryPolicy struct {
+	Retries  int           // 失败后最多重试的次数
+	Interval time.Duration // 第一次重试前等待的时间，之后每次翻倍
+}
+
+// IsRetryable EINTR、EAGAIN、ETIMEDOUT与EIO视为暂时性的错误，ENOSPC、EROFS等其他错误重试也不会成功
+func IsRetryable(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EAGAIN, syscall.ETIMEDOUT, syscall.EIO} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do 执行fn，返回暂时性的错误时按策略等待后重试，其他错误立即返回
+func (p RetryPolicy) Do(fn func() error) error {
+	return p.do(fn, IsRetryable)
+}
+
+// DoSync 与Do相同，但不重试EIO，用于sync：fsync返回EIO时内核可能已经丢弃了写入失败的脏页，再次sync成功不代表数据已经落盘
+func (p RetryPolicy) DoSync(fn func() error) error {
+	return p.do(fn, func(err error) bool {
+		return IsRetryable(err) && !errors.Is(err, syscall.EIO)
+	})
+}
+
+func (p RetryPolicy) do(fn func() error, retryable func(error) bool) error {
+	interval := p.Interval
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= p.Retries || !retryable(err) {
+			return err
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
@@ -7,10 +7,15 @@ import (
 
 const (
 	defaultMaxLevel = 20
+	// MaxSkipListHeight 跳表高度的上限，由Element中levels数组的长度决定
+	MaxSkipListHeight = defaultMaxLevel
+	// DefaultSkipListBranchProb 节点每升高一层的默认概率
+	DefaultSkipListBranchProb = 0.5
 )
 
 type SkipList struct {
 	maxLevel   int          //sl的最大高度
+	branchProb float64      //节点每升高一层的概率
 	lock       sync.RWMutex //读写锁，用来实现并发安全的sl
 	currHeight int32        //sl当前的最大高度
 	headOffset uint32       //头结点在arena当中的偏移量
@@ -18,12 +23,26 @@ type SkipList struct {
 }
 
 func NewSkipList(arenaSize int64) *SkipList {
+	return NewSkipListWithHeight(arenaSize, MaxSkipListHeight, DefaultSkipListBranchProb)
+}
+
+// NewSkipListWithHeight 指定最大高度与每升高一层的概率，传入0时使用默认值
+// 高度越低占用的内存越少，但数据量大时查找路径更长
+func NewSkipListWithHeight(arenaSize int64, maxHeight int, branchProb float64) *SkipList {
+	if maxHeight <= 0 || maxHeight > MaxSkipListHeight {
+		maxHeight = MaxSkipListHeight
+	}
+	if branchProb <= 0 || branchProb >= 1 {
+		branchProb = DefaultSkipListBranchProb
+	}
 	arena := newArena(arenaSize)
 	//引入一个空的头结点，因此Key和Value都是空的
 	head := newElement(arena, nil, ValueStruct{}, defaultMaxLevel)
 	ho := arena.getElementOffset(head)
 
 	return &SkipList{
+		maxLevel:   maxHeight,
+		branchProb: branchProb,
 		currHeight: 1,
 		headOffset: ho,
 		arena:      arena,
@@ -84,7 +103,9 @@ func (list *SkipList) Add(data *Entry) error {
 	score := calcScore(data.Key)
 	var elem *Element
 	value := ValueStruct{
-		Value: data.Value,
+		Meta:      data.Meta,
+		Value:     data.Value,
+		ExpiresAt: data.ExpiresAt,
 	}
 
 	//从当前最大高度开始
@@ -101,9 +122,11 @@ func (list *SkipList) Add(data *Entry) error {
 		for next := list.getNext(prevElem, int(i)); next != nil; next = list.getNext(prevElem, int(i)) {
 			if comp := list.compare(score, data.Key, next); comp <= 0 {
 				if comp == 0 {
+					// 写入value时arena可能扩容，需要按offset重新获取节点
+					nextOffset := list.arena.getElementOffset(next)
 					vo := list.arena.putVal(value)
 					encV := encodeValue(vo, value.EncodedSize())
-					next.value = encV
+					list.arena.getElement(nextOffset).value = encV
 					return nil
 				}
 
@@ -125,13 +148,27 @@ func (list *SkipList) Add(data *Entry) error {
 	}
 
 	level := list.randLevel()
+	// 新节点高于当前高度时，高出的部分由头结点指向它
+	if int32(level) > max {
+		head := list.arena.getElement(list.headOffset)
+		for i := max; i < int32(level); i++ {
+			prevElemHeaders[i] = head
+		}
+		list.currHeight = int32(level)
+	}
 
-	elem = newElement(list.arena, data.Key, ValueStruct{Value: data.Value}, level)
+	// 分配新节点时arena可能扩容，之前拿到的节点指针指向旧的buf，因此先记下offset
+	var prevOffsets [defaultMaxLevel]uint32
+	for i := 0; i < level; i++ {
+		prevOffsets[i] = list.arena.getElementOffset(prevElemHeaders[i])
+	}
+	elem = newElement(list.arena, data.Key, value, level)
 	//to add elem to the skiplist
 	off := list.arena.getElementOffset(elem)
 	for i := 0; i < level; i++ {
-		elem.levels[i] = prevElemHeaders[i].levels[i]
-		prevElemHeaders[i].levels[i] = off
+		prev := list.arena.getElement(prevOffsets[i])
+		elem.levels[i] = prev.levels[i]
+		prev.levels[i] = off
 	}
 
 	return nil
@@ -147,14 +184,15 @@ func (list *SkipList) Search(key []byte) (e *Entry) {
 	score := calcScore(key)
 
 	prevElem := list.arena.getElement(list.headOffset)
-	i := list.currHeight
+	i := list.currHeight - 1
 
 	for i >= 0 {
 		for next := list.getNext(prevElem, int(i)); next != nil; next = list.getNext(prevElem, int(i)) {
 			if comp := list.compare(score, key, next); comp <= 0 {
 				if comp == 0 {
 					vo, vSize := decodeValue(next.value)
-					return &Entry{Key: key, Value: list.arena.getVal(vo, vSize).Value}
+					vs := list.arena.getVal(vo, vSize)
+					return &Entry{Key: key, Value: vs.Value, ExpiresAt: vs.ExpiresAt, Meta: vs.Meta}
 				}
 				break
 			}
@@ -175,8 +213,10 @@ func (list *SkipList) Close() error {
 	return nil
 }
 
+// calcScore 只使用不含时间戳部分的前8个字节计算score，保证score的顺序与compare的顺序一致
 func calcScore(key []byte) (score float64) {
 	var hash uint64
+	key, _ = splitKey(key)
 	l := len(key)
 
 	if l > 8 {
@@ -194,7 +234,7 @@ func calcScore(key []byte) (score float64) {
 
 func (list *SkipList) compare(score float64, key []byte, next *Element) int {
 	if score == next.score {
-		return bytes.Compare(key, next.key(list.arena))
+		return compareKeys(key, next.key(list.arena))
 	}
 
 	if score < next.score {
@@ -204,13 +244,49 @@ func (list *SkipList) compare(score float64, key []byte, next *Element) int {
 	}
 }
 
+// splitKey 将key拆分为user key与时间戳两部分，不超过8字节的key没有时间戳
+func splitKey(key []byte) ([]byte, []byte) {
+	if len(key) <= 8 {
+		return key, nil
+	}
+	return key[:len(key)-8], key[len(key)-8:]
+}
+
+// compareKeys 先比较user key再比较时间戳，对于带时间戳的key与CompareKeys的顺序相同
+// 这样跳表的遍历顺序与sst中key的顺序一致
+func compareKeys(key1, key2 []byte) int {
+	k1, ts1 := splitKey(key1)
+	k2, ts2 := splitKey(key2)
+	if cmp := bytes.Compare(k1, k2); cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(ts1, ts2)
+}
+
+// findGreaterOrEqual 返回第一个不小于key的节点
+func (list *SkipList) findGreaterOrEqual(key []byte) *Element {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	score := calcScore(key)
+	prevElem := list.arena.getElement(list.headOffset)
+	for i := int(list.currHeight) - 1; i >= 0; i-- {
+		for next := list.getNext(prevElem, i); next != nil; next = list.getNext(prevElem, i) {
+			if list.compare(score, key, next) <= 0 {
+				break
+			}
+			prevElem = next
+		}
+	}
+	return list.getNext(prevElem, 0)
+}
+
 func (list *SkipList) randLevel() int {
 	if list.maxLevel <= 1 {
 		return 1
 	}
 	i := 1
 	for ; i < list.maxLevel; i++ {
-		if RandN(1000)%2 == 0 {
+		if Float64() >= list.branchProb {
 			return i
 		}
 	}
@@ -249,16 +325,25 @@ func (iter *SkipListIter) Rewind() {
 }
 
 func (iter *SkipListIter) Item() Item {
-	vo, vs := decodeValue(iter.elem.value)
+	vo, size := decodeValue(iter.elem.value)
+	vs := iter.list.arena.getVal(vo, size)
 	return &Entry{
 		Key:       iter.list.arena.getKey(iter.elem.keyOffset, iter.elem.keySize),
-		Value:     iter.list.arena.getVal(vo, vs).Value,
-		ExpiresAt: iter.list.arena.getVal(vo, vs).ExpiresAt,
+		Value:     vs.Value,
+		ExpiresAt: vs.ExpiresAt,
+		Meta:      vs.Meta,
 	}
 }
+
+// Key 只返回当前节点的key，不解码value
+func (iter *SkipListIter) Key() []byte {
+	return iter.list.arena.getKey(iter.elem.keyOffset, iter.elem.keySize)
+}
 func (iter *SkipListIter) Close() error {
 	return nil
 }
 
+// Seek 定位到第一个不小于key的节点
 func (iter *SkipListIter) Seek(key []byte) {
+	iter.elem = iter.list.findGreaterOrEqual(key)
 }
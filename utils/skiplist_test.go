@@ -116,3 +116,55 @@ func Benchmark_ConcurrentBasic(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestSkipListHeight(t *testing.T) {
+	const n = 5000
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	for _, height := range []int{1, 4, MaxSkipListHeight} {
+		// arena很小，插入过程中会多次扩容
+		l := NewSkipListWithHeight(1000, height, 0)
+		for i := n - 1; i >= 0; i-- {
+			assert.Nil(t, l.Add(NewEntry(key(i), key(i))))
+		}
+		assert.True(t, int(l.currHeight) <= height)
+		if height > 1 {
+			assert.True(t, l.currHeight > 1)
+		}
+		for i := 0; i < n; i++ {
+			e := l.Search(key(i))
+			require.NotNil(t, e, "height %d key %s", height, key(i))
+			assert.Equal(t, key(i), e.Value)
+		}
+		iter := l.NewSkipListIterator()
+		i := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, key(i), iter.Item().Entry().Key)
+			i++
+		}
+		assert.Equal(t, n, i)
+	}
+}
+
+// Benchmark_SkipListSearchHeight 大内存表中查找耗时随最大高度的变化
+func Benchmark_SkipListSearchHeight(b *testing.B) {
+	const n = 1 << 14
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%08d", i))
+	}
+	for _, height := range []int{1, 4, 8, 12, MaxSkipListHeight} {
+		b.Run(fmt.Sprintf("height=%d", height), func(b *testing.B) {
+			l := NewSkipListWithHeight(1<<20, height, DefaultSkipListBranchProb)
+			for i := 0; i < n; i++ {
+				require.Nil(b, l.Add(NewEntry(key(i), key(i))))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if l.Search(key(i%n)) == nil {
+					b.Fatalf("key %s not found", key(i%n))
+				}
+			}
+		})
+	}
+}
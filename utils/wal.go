@@ -6,6 +6,9 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
 )
 
 // LogEntry
@@ -46,9 +49,47 @@ func (h *WalHeader) Decode(reader *HashReader) (int, error) {
 	return reader.BytesRead, nil
 }
 
+// ChecksumType wal记录的校验算法
+type ChecksumType byte
+
+const (
+	// ChecksumCRC32 Castagnoli crc32，记录中不写算法标记，与之前的格式相同
+	ChecksumCRC32 ChecksumType = iota
+	// ChecksumXXHash 取xxhash64的低32位，计算开销更小，记录以一个字节的算法标记开头
+	ChecksumXXHash
+)
+
+// WalChecksumTag 使用xxhash的记录开头的标记
+// 没有标记的记录以key长度的varint开头，key总是带有8字节的时间戳，因此这个字节至少为8，不会与标记混淆
+const WalChecksumTag = byte(ChecksumXXHash)
+
+// WalMetaTag entry的Meta不为0的记录的标记，与其他标记按位或，标记之后是一个字节的meta
+const WalMetaTag = byte(4)
+
+// IsWalTag 判断wal记录的第一个字节是否为标记，标记都小于8
+func IsWalTag(b byte) bool {
+	return b != 0 && b < 8
+}
+
+// NewHash32 返回算法对应的hash
+func (ct ChecksumType) NewHash32() hash.Hash32 {
+	if ct == ChecksumXXHash {
+		return xxhash32{xxhash.New()}
+	}
+	return crc32.New(CastagnoliCrcTable)
+}
+
+type xxhash32 struct {
+	*xxhash.Digest
+}
+
+func (h xxhash32) Sum32() uint32 {
+	return uint32(h.Sum64())
+}
+
 // WalCodec 写入wal文件的编码
-// | header | key | value | crc32 |
-func WalCodec(buf *bytes.Buffer, e *Entry) int {
+// | tag(使用xxhash或meta不为0时) | meta(不为0时) | header | key | value | checksum |
+func WalCodec(buf *bytes.Buffer, e *Entry, ct ChecksumType) int {
 	buf.Reset()
 	h := WalHeader{
 		KeyLen:    uint32(len(e.Key)),
@@ -56,8 +97,21 @@ func WalCodec(buf *bytes.Buffer, e *Entry) int {
 		ExpiresAt: e.ExpiresAt,
 	}
 
-	hash := crc32.New(CastagnoliCrcTable)
+	tag := byte(ct)
+	if e.Meta != 0 {
+		tag |= WalMetaTag
+	}
+	var tagLen, metaLen int
+	if tag != 0 {
+		buf.WriteByte(tag)
+		tagLen = 1
+	}
+	hash := ct.NewHash32()
 	writer := io.MultiWriter(buf, hash)
+	if e.Meta != 0 {
+		Panic2(writer.Write([]byte{e.Meta}))
+		metaLen = 1
+	}
 
 	// encode header.
 	var headerEnc [maxHeaderSize]byte
@@ -65,18 +119,174 @@ func WalCodec(buf *bytes.Buffer, e *Entry) int {
 	Panic2(writer.Write(headerEnc[:sz]))
 	Panic2(writer.Write(e.Key))
 	Panic2(writer.Write(e.Value))
-	// write crc32 hash.
+	// write checksum.
 	var crcBuf [crc32.Size]byte
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
 	Panic2(buf.Write(crcBuf[:]))
 	// return encoded length.
-	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + len(crcBuf)
+	return tagLen + metaLen + len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + len(crcBuf)
+}
+
+// maxWalBatchCount 批次头中entry数量的上限，超过时说明批次头已经损坏
+const maxWalBatchCount = 1 << 24
+
+// MaxWalBatchHeaderSize 批次头的最大长度，tag、meta、数量的varint与checksum
+const MaxWalBatchHeaderSize = 2 + binary.MaxVarintLen32 + crc32.Size
+
+// WalBatchCodec 写在一批记录之前的批次头，之后紧跟n条记录，回放时只有n条记录全部完整才生效
+// 批次头带有WalMetaTag但meta为0，普通记录只有meta不为0才写入WalMetaTag，因此不会混淆；批次头不加密
+// | tag(WalMetaTag|ct) | 0 | count | checksum |
+func WalBatchCodec(buf *bytes.Buffer, n int, ct ChecksumType) int {
+	buf.Reset()
+	buf.WriteByte(WalMetaTag | byte(ct))
+	hash := ct.NewHash32()
+	writer := io.MultiWriter(buf, hash)
+	var countEnc [1 + binary.MaxVarintLen64]byte
+	sz := 1 + binary.PutUvarint(countEnc[1:], uint64(n))
+	Panic2(writer.Write(countEnc[:sz]))
+	var crcBuf [crc32.Size]byte
+	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
+	Panic2(buf.Write(crcBuf[:]))
+	return buf.Len()
+}
+
+// DecodeWalBatchCount 读取批次头中meta之后的entry数量，数量损坏时返回ErrTruncate
+func DecodeWalBatchCount(reader *HashReader) (int, error) {
+	n, err := binary.ReadUvarint(reader)
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = ErrTruncate
+		}
+		return 0, err
+	}
+	if n == 0 || n > maxWalBatchCount {
+		return 0, ErrTruncate
+	}
+	return int(n), nil
+}
+
+// WalEncryptedTag 加密记录的标记，与记录使用的校验算法按位或后写在记录开头，同样不会与header混淆
+const WalEncryptedTag = byte(2)
+
+// maxWalSealedLen 加密记录中密文长度的上限，超过时说明长度已经损坏
+const maxWalSealedLen = 1 << 31
+
+// WalCodecEncrypted 加密写入wal的编码，meta、header、key与value一起加密，checksum按ct计算密文
+// | tag | sealed len | sealed(meta(不为0时) | header | key | value) | checksum |
+func WalCodecEncrypted(buf *bytes.Buffer, e *Entry, ct ChecksumType, enc Encryptor) (int, error) {
+	h := WalHeader{
+		KeyLen:    uint32(len(e.Key)),
+		ValueLen:  uint32(len(e.Value)),
+		ExpiresAt: e.ExpiresAt,
+	}
+	var headerEnc [maxHeaderSize]byte
+	sz := h.Encode(headerEnc[:])
+	tag := WalEncryptedTag | byte(ct)
+	plain := make([]byte, 0, 1+sz+len(e.Key)+len(e.Value))
+	if e.Meta != 0 {
+		tag |= WalMetaTag
+		plain = append(plain, e.Meta)
+	}
+	plain = append(plain, headerEnc[:sz]...)
+	plain = append(plain, e.Key...)
+	plain = append(plain, e.Value...)
+	sealed, err := EncryptData(enc, plain)
+	if err != nil {
+		return 0, err
+	}
+
+	buf.Reset()
+	buf.WriteByte(tag)
+	hash := ct.NewHash32()
+	writer := io.MultiWriter(buf, hash)
+	var lenEnc [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenEnc[:], uint64(len(sealed)))
+	Panic2(writer.Write(lenEnc[:n]))
+	Panic2(writer.Write(sealed))
+	var crcBuf [crc32.Size]byte
+	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
+	Panic2(buf.Write(crcBuf[:]))
+	return buf.Len(), nil
+}
+
+// DecodeWalSealed 读取加密记录中tag之后的 | sealed len | sealed |，并返回读取的字节数
+// 长度损坏时返回ErrTruncate，读到末尾时返回io.EOF或io.ErrUnexpectedEOF
+func DecodeWalSealed(reader *HashReader) ([]byte, int, error) {
+	sealedLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = ErrTruncate
+		}
+		return nil, 0, err
+	}
+	if sealedLen > maxWalSealedLen {
+		return nil, 0, ErrTruncate
+	}
+	sealed := make([]byte, sealedLen)
+	if _, err := io.ReadFull(reader, sealed); err != nil {
+		if err == io.EOF {
+			err = ErrTruncate
+		}
+		return nil, 0, err
+	}
+	return sealed, reader.BytesRead, nil
+}
+
+// DecodeWalPlain 解析解密后的 | meta(hasMeta时) | header | key | value |
+func DecodeWalPlain(plain []byte, hasMeta bool) (*Entry, error) {
+	var meta byte
+	record := plain
+	if hasMeta {
+		if len(plain) == 0 {
+			return nil, errors.Errorf("invalid decrypted wal record of %d bytes", len(record))
+		}
+		meta, plain = plain[0], plain[1:]
+	}
+	var h WalHeader
+	hlen, err := h.Decode(NewHashReader(bytes.NewReader(plain)))
+	if err != nil || uint64(hlen)+uint64(h.KeyLen)+uint64(h.ValueLen) != uint64(len(plain)) {
+		return nil, errors.Errorf("invalid decrypted wal record of %d bytes", len(record))
+	}
+	kv := plain[hlen:]
+	return &Entry{
+		Key:       kv[:h.KeyLen],
+		Value:     kv[h.KeyLen:],
+		ExpiresAt: h.ExpiresAt,
+		Meta:      meta,
+	}, nil
 }
 
 // EstimateWalCodecSize 预估当前kv 写入wal文件占用的空间大小
+// maxHeaderSize比header实际的最大长度多出的一个字节留给了标记，meta不为0时再加上meta的一个字节
 func EstimateWalCodecSize(e *Entry) int {
-	return len(e.Key) + len(e.Value) + 8 /* ExpiresAt uint64 */ +
+	size := len(e.Key) + len(e.Value) + 8 /* ExpiresAt uint64 */ +
 		crc32.Size + maxHeaderSize
+	if e.Meta != 0 {
+		size++
+	}
+	return size
+}
+
+// WalEncryptionOverhead 配置enc时每条wal记录比EstimateWalCodecSize多出的最大字节数，enc为nil时为0
+// 加密记录在明文之外还有密文的开销、nonce、key id等尾部字段以及最多5字节的密文长度
+func WalEncryptionOverhead(enc Encryptor) int {
+	if enc == nil {
+		return 0
+	}
+	return EncryptionOverhead(enc) + 5
+}
+
+// EstimateWalCodecSizeBatch 预估一批kv写入wal占用的空间大小
+// 多个entry在逐条编码的记录之前还有一个批次头，按MaxWalBatchHeaderSize计算；只有一个entry时不写批次头
+func EstimateWalCodecSizeBatch(entries []*Entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += int64(EstimateWalCodecSize(e))
+	}
+	if len(entries) > 1 {
+		size += MaxWalBatchHeaderSize
+	}
+	return size
 }
 
 type HashReader struct {
@@ -86,10 +296,14 @@ type HashReader struct {
 }
 
 func NewHashReader(r io.Reader) *HashReader {
-	hash := crc32.New(CastagnoliCrcTable)
+	return NewHashReaderWithChecksum(r, ChecksumCRC32)
+}
+
+// NewHashReaderWithChecksum 使用指定的校验算法计算读出的数据
+func NewHashReaderWithChecksum(r io.Reader, ct ChecksumType) *HashReader {
 	return &HashReader{
 		R: r,
-		H: hash,
+		H: ct.NewHash32(),
 	}
 }
 
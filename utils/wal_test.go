@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestEstimateWalCodecSizeBatch 预估值不小于实际编码的大小，包括多个entry时的批次头
+// 每条entry最多多估header与ExpiresAt的空间，批次头最多多估数量varint未用到的字节
+func TestEstimateWalCodecSizeBatch(t *testing.T) {
+	var entries []*Entry
+	for i := 0; i < 100; i++ {
+		e := NewEntry([]byte(fmt.Sprintf("key-%d", i)), bytes.Repeat([]byte{'v'}, i*13))
+		e.ExpiresAt = uint64(i) << (i % 64)
+		entries = append(entries, e)
+	}
+	for _, ct := range []ChecksumType{ChecksumCRC32, ChecksumXXHash} {
+		for _, batch := range [][]*Entry{nil, entries[:1], entries[:2], entries} {
+			var actual int64
+			buf := &bytes.Buffer{}
+			slack := int64(len(batch) * (maxHeaderSize + 8))
+			var framing int64
+			if len(batch) > 1 {
+				header := int64(WalBatchCodec(buf, len(batch), ct))
+				if header > MaxWalBatchHeaderSize {
+					t.Fatalf("batch header of %d bytes exceeds MaxWalBatchHeaderSize", header)
+				}
+				actual += header
+				framing = MaxWalBatchHeaderSize
+				slack += binary.MaxVarintLen32 - 1
+			}
+			var records int64
+			for _, e := range batch {
+				actual += int64(WalCodec(buf, e, ct))
+				records += int64(EstimateWalCodecSize(e))
+			}
+			estimate := EstimateWalCodecSizeBatch(batch)
+			if estimate != records+framing {
+				t.Fatalf("estimate %d should be the records %d plus the batch header %d", estimate, records, framing)
+			}
+			if estimate < actual {
+				t.Fatalf("estimate %d is smaller than encoded size %d", estimate, actual)
+			}
+			if estimate-actual > slack {
+				t.Fatalf("estimate %d exceeds encoded size %d by more than %d", estimate, actual, slack)
+			}
+		}
+	}
+
+	// 加密的记录加上WalEncryptionOverhead之后同样不会低估
+	enc, err := NewAESEncryptor(1, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		n, err := WalCodecEncrypted(&bytes.Buffer{}, e, ChecksumCRC32, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate := EstimateWalCodecSize(e) + WalEncryptionOverhead(enc)
+		if estimate < n {
+			t.Fatalf("estimate %d is smaller than encrypted size %d", estimate, n)
+		}
+		if EstimateWalCodecSize(e) >= n {
+			t.Fatalf("estimate without encryption %d should be smaller than encrypted size %d", EstimateWalCodecSize(e), n)
+		}
+	}
+}
+
+// TestEntryVerify 校验和与crc32的wal记录中保存的相同，修改entry后校验失败
+func TestEntryVerify(t *testing.T) {
+	e := NewEntry(KeyWithTs([]byte("key"), 1), []byte("value"))
+	e.ExpiresAt = 123
+	if err := e.Verify(); err != ErrNoChecksum {
+		t.Fatalf("Verify without checksum = %v, want ErrNoChecksum", err)
+	}
+
+	var buf bytes.Buffer
+	n := WalCodec(&buf, e, ChecksumCRC32)
+	e.Checksum = MaskChecksum(BytesToU32(buf.Bytes()[n-4 : n]))
+	if e.Checksum != e.CalculateChecksum() {
+		t.Fatalf("checksum %d differs from the wal record %d", e.CalculateChecksum(), e.Checksum)
+	}
+	if err := e.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, corrupt := range []func(*Entry){
+		func(e *Entry) { e.Value[0] ^= 1 },
+		func(e *Entry) { e.Key = KeyWithTs([]byte("key"), 2) },
+		func(e *Entry) { e.ExpiresAt++ },
+	} {
+		c := *e
+		c.Value = append([]byte{}, e.Value...)
+		corrupt(&c)
+		if err := c.Verify(); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("Verify corrupted entry = %v, want ErrChecksumMismatch", err)
+		}
+	}
+}
+
+// TestEntryMeta meta不为0的entry在wal记录与value编码中都能还原，校验和覆盖meta
+func TestEntryMeta(t *testing.T) {
+	value, ok := CompressValue(bytes.Repeat([]byte("value"), 100))
+	if !ok {
+		t.Fatal("repeated value is not compressed")
+	}
+	e := NewEntry(KeyWithTs([]byte("key"), 1), value)
+	e.Meta = BitValueCompressed
+	e.ExpiresAt = 123
+
+	var buf bytes.Buffer
+	n := WalCodec(&buf, e, ChecksumCRC32)
+	if n > EstimateWalCodecSize(e) {
+		t.Fatalf("encoded size %d exceeds the estimate %d", n, EstimateWalCodecSize(e))
+	}
+	if buf.Bytes()[0] != WalMetaTag || buf.Bytes()[1] != e.Meta {
+		t.Fatalf("record starts with %v, want meta tag and meta", buf.Bytes()[:2])
+	}
+	if sum := MaskChecksum(BytesToU32(buf.Bytes()[n-4 : n])); sum != e.CalculateChecksum() {
+		t.Fatalf("checksum %d differs from the wal record %d", e.CalculateChecksum(), sum)
+	}
+	c := *e
+	c.Meta = 0
+	if c.CalculateChecksum() == e.CalculateChecksum() {
+		t.Fatal("checksum does not cover meta")
+	}
+
+	vs := ValueStruct{Meta: e.Meta, Value: e.Value, ExpiresAt: e.ExpiresAt}
+	enc := make([]byte, vs.EncodedSize())
+	vs.EncodeValue(enc)
+	var got ValueStruct
+	got.DecodeValue(enc)
+	if got.Meta != vs.Meta || got.ExpiresAt != vs.ExpiresAt || !bytes.Equal(got.Value, vs.Value) {
+		t.Fatalf("decoded %+v, want %+v", got, vs)
+	}
+	// 记录meta之前的value没有meta字节
+	got = ValueStruct{}
+	got.DecodeValueWithoutMeta(enc[1:])
+	if got.Meta != 0 || got.ExpiresAt != vs.ExpiresAt || !bytes.Equal(got.Value, vs.Value) {
+		t.Fatalf("decoded %+v without meta", got)
+	}
+
+	e.Checksum = e.CalculateChecksum()
+	if err := e.Decompress(); err != nil {
+		t.Fatal(err)
+	}
+	if e.Meta != 0 || !bytes.Equal(e.Value, bytes.Repeat([]byte("value"), 100)) {
+		t.Fatalf("decompressed meta %d value %q", e.Meta, e.Value)
+	}
+	if err := e.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}